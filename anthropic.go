@@ -4,10 +4,14 @@ package fun
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
@@ -19,9 +23,13 @@ import (
 	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 )
 
+const anthropicBaseURL = "https://api.anthropic.com"
+
 var anthropicRateLimiter = &keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "anthropic",
 	mu:       sync.RWMutex{},
 	limiters: map[string]map[string]any{},
 }
@@ -50,6 +58,7 @@ type anthropicRequest struct {
 	System      []anthropicSystem  `json:"system,omitempty"`
 	Temperature float64            `json:"temperature"`
 	Tools       []anthropicTool    `json:"tools,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
 }
 
 type anthropicCacheControl struct {
@@ -69,6 +78,16 @@ type anthropicContent struct {
 	Thinking     string                 `json:"thinking,omitempty"`
 	Signature    string                 `json:"signature,omitempty"`
 	Data         string                 `json:"data,omitempty"`
+	Source       *anthropicSource       `json:"source,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+
+	// raw is used for recording.
+	raw []byte
 }
 
 type anthropicResponse struct {
@@ -90,6 +109,26 @@ type anthropicResponse struct {
 	} `json:"error,omitempty"`
 }
 
+type anthropicBatchRequest struct {
+	CustomID string           `json:"custom_id"`
+	Params   anthropicRequest `json:"params"`
+}
+
+type anthropicBatch struct {
+	ID               string  `json:"id"`
+	ProcessingStatus string  `json:"processing_status"`
+	ResultsURL       *string `json:"results_url,omitempty"`
+}
+
+type anthropicBatchResult struct {
+	CustomID string `json:"custom_id"`
+	Result   struct {
+		Type    string             `json:"type"`
+		Message *anthropicResponse `json:"message,omitempty"`
+		Error   json.RawMessage    `json:"error,omitempty"`
+	} `json:"result"`
+}
+
 func parseAnthropicRateLimitHeaders(resp *http.Response) ( //nolint:nonamedreturns
 	limitRequests, limitInputTokens, limitOutputTokens,
 	remainingRequests, remainingInputTokens, remainingOutputTokens int,
@@ -190,7 +229,13 @@ type anthropicTool struct {
 	tool TextTooler
 }
 
-var _ TextProvider = (*AnthropicTextProvider)(nil)
+var (
+	_ TextProvider     = (*AnthropicTextProvider)(nil)
+	_ WithStreaming    = (*AnthropicTextProvider)(nil)
+	_ WithConversation = (*AnthropicTextProvider)(nil)
+	_ WithBatch        = (*AnthropicTextProvider)(nil)
+	_ typedProvider    = (*AnthropicTextProvider)(nil)
+)
 
 // AnthropicTextProvider is a [TextProvider] which provides integration with
 // text-based [Anthropic] AI models.
@@ -204,6 +249,15 @@ type AnthropicTextProvider struct {
 	// APIKey is the API key to be used for API calls.
 	APIKey string `json:"-"`
 
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://api.anthropic.com".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
 	// Model is the name of the model to be used.
 	Model string `json:"model"`
 
@@ -243,17 +297,24 @@ type AnthropicTextProvider struct {
 func (a AnthropicTextProvider) MarshalJSON() ([]byte, error) {
 	// We define a new type to not recurse into this same MarshalJSON.
 	type P AnthropicTextProvider
+	p := P(a)
+	p.Headers = nil
 	t := struct {
 		P
 
 		Type string `json:"type"`
 	}{
-		P:    P(a),
+		P:    p,
 		Type: "anthropic",
 	}
 	return x.MarshalWithoutEscapeHTML(t)
 }
 
+// typeModel implements typedProvider interface.
+func (a AnthropicTextProvider) typeModel() (string, string) {
+	return "anthropic", a.Model
+}
+
 // Init implements [TextProvider] interface.
 func (a *AnthropicTextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
 	if a.messages != nil {
@@ -274,15 +335,13 @@ func (a *AnthropicTextProvider) Init(_ context.Context, messages []ChatMessage)
 				},
 			}
 		} else {
+			content, errE := anthropicContents(message)
+			if errE != nil {
+				return errE
+			}
 			a.messages = append(a.messages, anthropicMessage{
-				Role: message.Role,
-				Content: []anthropicContent{
-					{ //nolint:exhaustruct
-						Type:         typeText,
-						Text:         &message.Content,
-						CacheControl: nil,
-					},
-				},
+				Role:    message.Role,
+				Content: content,
 			})
 		}
 	}
@@ -300,19 +359,23 @@ func (a *AnthropicTextProvider) Init(_ context.Context, messages []ChatMessage)
 		}
 	}
 
-	a.rateLimiterKey = fmt.Sprintf("%s-%s", a.APIKey, a.Model)
+	a.rateLimiterKey = fmt.Sprintf("%s-%s-%s", a.BaseURL, a.APIKey, a.Model)
 
 	if a.Client == nil {
 		a.Client = newClient(
 			func(req *http.Request) error {
-				ctx := req.Context()
-				estimatedInputTokens, estimatedOutputTokens := getEstimatedTokens(ctx)
-				// Rate limit retries.
-				return anthropicRateLimiter.Take(ctx, a.rateLimiterKey, map[string]int{
-					"rpm":  1,
-					"itpd": estimatedInputTokens,
-					"otpm": estimatedOutputTokens,
-				})
+				// Batch requests are not rate limited.
+				if strings.HasSuffix(req.URL.Path, "/v1/messages") {
+					ctx := req.Context()
+					estimatedInputTokens, estimatedOutputTokens := getEstimatedTokens(ctx)
+					// Rate limit retries.
+					return anthropicRateLimiter.Take(ctx, a.rateLimiterKey, map[string]int{
+						"rpm":  1,
+						"itpd": estimatedInputTokens,
+						"otpm": estimatedOutputTokens,
+					})
+				}
+				return nil
 			},
 			nil,
 			nil,
@@ -382,33 +445,62 @@ func (a *AnthropicTextProvider) Init(_ context.Context, messages []ChatMessage)
 }
 
 // Chat implements [TextProvider] interface.
-func (a *AnthropicTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) { //nolint:maintidx
+func (a *AnthropicTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return a.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (a *AnthropicTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return a.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (a *AnthropicTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return a.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (a *AnthropicTextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return a.chat(ctx, messages, fn)
+}
+
+func (a *AnthropicTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
 	callID := identifier.New().String()
 
 	var callRecorder *TextRecorderCall
 	if recorder := GetTextRecorder(ctx); recorder != nil {
-		callRecorder = recorder.newCall(callID, a)
+		callRecorder = recorder.newCall(ctx, callID, a)
 		defer recorder.recordCall(callRecorder)
 	}
 
 	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
 	ctx = logger.WithContext(ctx)
 
-	messages := slices.Clone(a.messages)
-	messages = append(messages, anthropicMessage{
-		Role: message.Role,
-		Content: []anthropicContent{
-			{ //nolint:exhaustruct
-				Type: typeText,
-				Text: &message.Content,
-			},
-		},
-	})
+	stream := newTextStream(callRecorder, fn)
+
+	system, messages, errE := a.conversationMessages(conversation)
+	if errE != nil {
+		return "", errE
+	}
 	lastCacheBreakpoint := len(messages) - 1
 
+	if a.PromptCaching && len(conversation) > 1 {
+		// We set a cache breakpoint at the end of the conversation so that
+		// the next turn of the conversation can read it from the cache.
+		messages[lastCacheBreakpoint].Content[len(messages[lastCacheBreakpoint].Content)-1].CacheControl = &anthropicCacheControl{
+			Type: "ephemeral",
+		}
+	}
+
 	if callRecorder != nil {
-		for _, system := range a.system {
-			callRecorder.addMessage(roleSystem, system.Text, "", "", false)
+		for _, s := range system {
+			callRecorder.addMessage(roleSystem, s.Text, "", "", false)
 		}
 
 		for _, message := range messages {
@@ -444,89 +536,28 @@ func (a *AnthropicTextProvider) Chat(ctx context.Context, message ChatMessage) (
 			lastCacheBreakpoint = len(messages) - 1
 		}
 
-		temperature := a.Temperature
-		var thinking *anthropicThinking
-		if a.ReasoningBudget > 0 {
-			thinking = &anthropicThinking{
-				Type:         "enabled",
-				BudgetTokens: a.ReasoningBudget,
-			}
-			// Temperature must be 1 when extended thinking is enabled.
-			temperature = 1
-		}
-		request, errE := x.MarshalWithoutEscapeHTML(anthropicRequest{
-			Model:       a.Model,
-			Messages:    messages,
-			MaxTokens:   a.MaxResponseLength,
-			Thinking:    thinking,
-			System:      a.system,
-			Temperature: temperature,
-			Tools:       a.tools,
-		})
+		response, apiRequest, apiCallDuration, errE := a.send(ctx, system, messages, stream)
 		if errE != nil {
 			return "", errE
 		}
 
-		estimatedInputTokens, estimatedOutputTokens := a.estimatedTokens(messages)
-
-		req, err := http.NewRequestWithContext(
-			withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens),
-			http.MethodPost,
-			"https://api.anthropic.com/v1/messages",
-			bytes.NewReader(request),
-		)
-		if err != nil {
-			return "", errors.WithStack(err)
-		}
-		req.Header.Add("X-Api-Key", a.APIKey)
-		req.Header.Add("Anthropic-Version", "2023-06-01")
-		req.Header.Add("Anthropic-Beta", "output-128k-2025-02-19")
-		req.Header.Add("Content-Type", "application/json")
-		// Rate limit the initial request.
-		errE = anthropicRateLimiter.Take(ctx, a.rateLimiterKey, map[string]int{
-			"rpm":  1,
-			"itpd": estimatedInputTokens,
-			"otpm": estimatedOutputTokens,
-		})
-		if errE != nil {
-			return "", errE
-		}
-		start := time.Now()
-		resp, err := a.Client.Do(req)
-		var apiRequest string
-		if resp != nil {
-			apiRequest = resp.Header.Get("Request-Id")
-		}
-		if err != nil {
-			errE = errors.Prefix(err, ErrAPIRequestFailed)
-			if apiRequest != "" {
-				errors.Details(errE)["apiRequest"] = apiRequest
+		if stream != nil {
+			errE = stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: newUsedTokens(
+					a.MaxContextLength,
+					a.MaxResponseLength,
+					response.Usage.InputTokens,
+					response.Usage.OutputTokens,
+					response.Usage.CacheCreationInputTokens,
+					response.Usage.CacheReadInputTokens,
+					nil,
+				),
+			})
+			if errE != nil {
+				return "", errE
 			}
-			return "", errE
-		}
-		defer resp.Body.Close()              //nolint:errcheck
-		defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
-
-		if apiRequest == "" {
-			body, _ := io.ReadAll(resp.Body)
-			return "", errors.WithDetails(ErrMissingRequestID, body, string(body))
-		}
-
-		var response anthropicResponse
-		errE = x.DecodeJSON(resp.Body, &response)
-		if errE != nil {
-			errors.Details(errE)["apiRequest"] = apiRequest
-			return "", errE
-		}
-
-		apiCallDuration := time.Since(start)
-
-		if response.Error != nil {
-			return "", errors.WithDetails(
-				ErrAPIResponseError,
-				"body", response.Error,
-				"apiRequest", apiRequest,
-			)
 		}
 
 		if callRecorder != nil {
@@ -548,6 +579,9 @@ func (a *AnthropicTextProvider) Chat(ctx context.Context, message ChatMessage) (
 				apiCallDuration,
 			)
 
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
 			errE := a.recordMessage(callRecorder, anthropicMessage{
 				Role:    response.Role,
 				Content: response.Content,
@@ -649,67 +683,432 @@ func (a *AnthropicTextProvider) Chat(ctx context.Context, message ChatMessage) (
 				)
 			}
 
+			if stream != nil {
+				for _, result := range messages[len(messages)-1].Content {
+					var content string
+					if result.Content != nil {
+						content = *result.Content
+					}
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    content,
+						ToolUseID:  result.ToolUseID,
+						IsError:    result.IsError,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
 			continue
 		}
 
-		if response.StopReason != "end_turn" {
+		return anthropicText(response, apiRequest)
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", a.MaxExchanges,
+	)
+}
+
+// conversationMessages returns the system prompt and messages provided to Init followed by the conversation.
+// The conversation can start with a system message if no system message was provided to Init.
+func (a *AnthropicTextProvider) conversationMessages(conversation []ChatMessage) ([]anthropicSystem, []anthropicMessage, errors.E) {
+	system := a.system
+	if len(conversation) > 0 && conversation[0].Role == roleSystem {
+		if a.system != nil {
+			return nil, nil, errors.WithStack(ErrMultipleSystemMessages)
+		}
+		system = []anthropicSystem{
+			{
+				Type:         "text",
+				Text:         conversation[0].Content,
+				CacheControl: nil,
+			},
+		}
+		conversation = conversation[1:]
+	}
+
+	messages := slices.Clone(a.messages)
+	for _, message := range conversation {
+		if message.Role == roleSystem {
+			return nil, nil, errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", message.Role,
+			)
+		}
+		content, errE := anthropicContents(message)
+		if errE != nil {
+			return nil, nil, errE
+		}
+		messages = append(messages, anthropicMessage{
+			Role:    message.Role,
+			Content: content,
+		})
+	}
+	return system, messages, nil
+}
+
+// anthropicText returns the text of the final response.
+func anthropicText(response *anthropicResponse, apiRequest string) (string, errors.E) {
+	if response.StopReason != "end_turn" {
+		return "", errors.WithDetails(
+			ErrUnexpectedStop,
+			"reason", response.StopReason,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	// Model sometimes returns no content when the last message to the agent
+	// was the tool result and that concluded the conversation.
+	if len(response.Content) == 0 {
+		return "", nil
+	}
+
+	var text *string
+	for _, content := range response.Content {
+		if content.Type == roleThinking {
+			continue
+		}
+		if content.Type == roleRedactedThinking {
+			continue
+		}
+		if content.Type != typeText {
 			return "", errors.WithDetails(
-				ErrUnexpectedStop,
-				"reason", response.StopReason,
+				ErrUnexpectedMessageType,
+				"type", content.Type,
 				"apiRequest", apiRequest,
 			)
 		}
+		if content.Text == nil {
+			errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+		if text != nil {
+			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+		text = content.Text
+	}
+
+	if text == nil {
+		errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return "", errE
+	}
+
+	return *text, nil
+}
+
+func (a *AnthropicTextProvider) newRequest(system []anthropicSystem, messages []anthropicMessage) anthropicRequest {
+	temperature := a.Temperature
+	var thinking *anthropicThinking
+	if a.ReasoningBudget > 0 {
+		thinking = &anthropicThinking{
+			Type:         "enabled",
+			BudgetTokens: a.ReasoningBudget,
+		}
+		// Temperature must be 1 when extended thinking is enabled.
+		temperature = 1
+	}
+	return anthropicRequest{
+		Model:       a.Model,
+		Messages:    messages,
+		MaxTokens:   a.MaxResponseLength,
+		Thinking:    thinking,
+		System:      system,
+		Temperature: temperature,
+		Tools:       a.tools,
+		Stream:      false,
+	}
+}
+
+func (a *AnthropicTextProvider) send(
+	ctx context.Context, system []anthropicSystem, messages []anthropicMessage, stream func(event TextStreamEvent) errors.E,
+) (_ *anthropicResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, a,
+		semconv.GenAIRequestMaxTokens(a.MaxResponseLength),
+		semconv.GenAIRequestTemperature(a.Temperature),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(a)
+
+	aReq := a.newRequest(system, messages)
+	aReq.Stream = stream != nil
+	request, errE := x.MarshalWithoutEscapeHTML(aReq)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := a.estimatedTokens(system, messages)
+
+	reservation, errE := reserveBudget(ctx, a, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		apiURL(a.BaseURL, anthropicBaseURL, "/v1/messages"),
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("X-Api-Key", a.APIKey)
+	req.Header.Add("Anthropic-Version", "2023-06-01")
+	req.Header.Add("Anthropic-Beta", "output-128k-2025-02-19")
+	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, a.Headers)
+	// Rate limit the initial request.
+	errE = anthropicRateLimiter.Take(ctx, a.rateLimiterKey, map[string]int{
+		"rpm":  1,
+		"itpd": estimatedInputTokens,
+		"otpm": estimatedOutputTokens,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	start := time.Now()
+	resp, err := a.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("Request-Id")
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if apiRequest == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, "", 0, errors.WithDetails(ErrMissingRequestID, body, string(body))
+	}
+
+	var response anthropicResponse
+	if stream != nil && isEventStream(resp) {
+		errE = a.decodeStream(resp.Body, apiRequest, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, apiRequest, 0, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, apiRequest, 0, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	usedTokens := newUsedTokens(
+		a.MaxContextLength,
+		a.MaxResponseLength,
+		response.Usage.InputTokens,
+		response.Usage.OutputTokens,
+		response.Usage.CacheCreationInputTokens,
+		response.Usage.CacheReadInputTokens,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	// Anthropic does not include cache tokens in input tokens, but GenAI semantic conventions do.
+	inputTokens := response.Usage.InputTokens
+	if response.Usage.CacheCreationInputTokens != nil {
+		inputTokens += *response.Usage.CacheCreationInputTokens
+	}
+	if response.Usage.CacheReadInputTokens != nil {
+		inputTokens += *response.Usage.CacheReadInputTokens
+	}
+	span.SetAttributes(
+		semconv.GenAIResponseID(response.ID),
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIResponseFinishReasons(response.StopReason),
+		semconv.GenAIUsageInputTokens(inputTokens),
+		semconv.GenAIUsageOutputTokens(response.Usage.OutputTokens),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+type anthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Message      *anthropicResponse `json:"message,omitempty"`
+	Index        int                `json:"index"`
+	ContentBlock *anthropicContent  `json:"content_block,omitempty"`
+	Delta        *struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta,omitempty"`
+	Usage *struct {
+		InputTokens              int  `json:"input_tokens"`
+		OutputTokens             int  `json:"output_tokens"`
+		CacheCreationInputTokens *int `json:"cache_creation_input_tokens,omitempty"`
+		CacheReadInputTokens     *int `json:"cache_read_input_tokens,omitempty"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error,omitempty"`
+}
 
-		// Model sometimes returns no content when the last message to the agent
-		// was the tool result and that concluded the conversation.
-		if len(response.Content) == 0 {
-			return "", nil
+// decodeStream decodes server-sent events into the response, calling stream for every delta.
+//
+// See: https://docs.anthropic.com/en/api/messages-streaming
+func (a *AnthropicTextProvider) decodeStream( //nolint:maintidx
+	body io.Reader, apiRequest string, response *anthropicResponse, stream func(event TextStreamEvent) errors.E,
+) errors.E {
+	texts := map[int]*strings.Builder{}
+	inputs := map[int]*strings.Builder{}
+
+	return decodeServerSentEvents(body, func(_ string, data []byte) errors.E {
+		var event anthropicStreamEvent
+		errE := x.Unmarshal(data, &event)
+		if errE != nil {
+			return errE
 		}
 
-		var text *string
-		for _, content := range response.Content {
-			if content.Type == roleThinking {
-				continue
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				*response = *event.Message
 			}
-			if content.Type == roleRedactedThinking {
-				continue
+		case "content_block_start":
+			if event.ContentBlock == nil || event.Index != len(response.Content) {
+				return errors.WithDetails(
+					ErrUnexpectedMessage,
+					"index", event.Index,
+				)
 			}
-			if content.Type != typeText {
-				return "", errors.WithDetails(
-					ErrUnexpectedMessageType,
-					"type", content.Type,
-					"apiRequest", apiRequest,
+			block := *event.ContentBlock
+			switch block.Type {
+			case typeText:
+				texts[event.Index] = new(strings.Builder)
+				if block.Text != nil {
+					texts[event.Index].WriteString(*block.Text)
+				}
+			case roleToolUse:
+				// Input is provided through deltas.
+				block.Input = nil
+				inputs[event.Index] = new(strings.Builder)
+			}
+			response.Content = append(response.Content, block)
+		case "content_block_delta":
+			if event.Delta == nil || event.Index < 0 || event.Index >= len(response.Content) {
+				return errors.WithDetails(
+					ErrUnexpectedMessage,
+					"index", event.Index,
 				)
 			}
-			if content.Text == nil {
-				errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
-				errors.Details(errE)["apiRequest"] = apiRequest
-				return "", errE
+			block := &response.Content[event.Index]
+			switch event.Delta.Type {
+			case "text_delta":
+				if texts[event.Index] == nil {
+					texts[event.Index] = new(strings.Builder)
+				}
+				texts[event.Index].WriteString(event.Delta.Text)
+				text := texts[event.Index].String()
+				block.Text = &text
+				return stream(TextStreamEvent{ //nolint:exhaustruct
+					Type:       typeText,
+					Content:    event.Delta.Text,
+					APIRequest: apiRequest,
+				})
+			case "input_json_delta":
+				if inputs[event.Index] == nil {
+					inputs[event.Index] = new(strings.Builder)
+				}
+				inputs[event.Index].WriteString(event.Delta.PartialJSON)
+			case "thinking_delta":
+				block.Thinking += event.Delta.Thinking
+				return stream(TextStreamEvent{ //nolint:exhaustruct
+					Type:       roleThinking,
+					Content:    event.Delta.Thinking,
+					APIRequest: apiRequest,
+				})
+			case "signature_delta":
+				block.Signature += event.Delta.Signature
+			default:
+				// We ignore unknown delta types as recommended by Anthropic.
 			}
-			if text != nil {
-				errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
-				errors.Details(errE)["apiRequest"] = apiRequest
-				return "", errE
+		case "content_block_stop":
+			if event.Index < 0 || event.Index >= len(response.Content) {
+				return errors.WithDetails(
+					ErrUnexpectedMessage,
+					"index", event.Index,
+				)
 			}
-			text = content.Text
-		}
-
-		if text == nil {
-			errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
-			errors.Details(errE)["apiRequest"] = apiRequest
-			return "", errE
+			block := &response.Content[event.Index]
+			if block.Type == roleToolUse {
+				input := "{}"
+				if inputs[event.Index] != nil && inputs[event.Index].Len() > 0 {
+					input = inputs[event.Index].String()
+				}
+				block.Input = json.RawMessage(input)
+				return stream(TextStreamEvent{ //nolint:exhaustruct
+					Type:        roleToolUse,
+					Content:     input,
+					ToolUseID:   block.ID,
+					ToolUseName: block.Name,
+					APIRequest:  apiRequest,
+				})
+			}
+		case "message_delta":
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				response.StopReason = event.Delta.StopReason
+			}
+			if event.Usage != nil {
+				if event.Usage.InputTokens != 0 {
+					response.Usage.InputTokens = event.Usage.InputTokens
+				}
+				response.Usage.OutputTokens = event.Usage.OutputTokens
+				if event.Usage.CacheCreationInputTokens != nil {
+					response.Usage.CacheCreationInputTokens = event.Usage.CacheCreationInputTokens
+				}
+				if event.Usage.CacheReadInputTokens != nil {
+					response.Usage.CacheReadInputTokens = event.Usage.CacheReadInputTokens
+				}
+			}
+		case "error":
+			response.Error = event.Error
+		case "message_stop", "ping":
+			// Nothing to do.
+		default:
+			// We ignore unknown events as recommended by Anthropic.
 		}
 
-		return *text, nil
-	}
-
-	return "", errors.WithDetails(
-		ErrMaxExchangesReached,
-		"maxExchanges", a.MaxExchanges,
-	)
+		return nil
+	})
 }
 
-func (a *AnthropicTextProvider) estimatedTokens(messages []anthropicMessage) (int, int) {
+func (a *AnthropicTextProvider) estimatedTokens(system []anthropicSystem, messages []anthropicMessage) (int, int) {
 	// We estimate inputTokens from training messages (including system message) by
 	// dividing number of characters by 4.
 	inputTokens := 0
@@ -722,10 +1121,13 @@ func (a *AnthropicTextProvider) estimatedTokens(messages []anthropicMessage) (in
 			if content.Content != nil {
 				inputTokens += len(*content.Content) / 4 //nolint:mnd
 			}
+			if content.Source != nil {
+				inputTokens += estimatedPartTokens
+			}
 		}
 	}
-	for _, system := range a.system {
-		inputTokens += len(system.Text) / 4 //nolint:mnd
+	for _, s := range system {
+		inputTokens += len(s.Text) / 4 //nolint:mnd
 	}
 	for _, tool := range a.tools {
 		inputTokens += len(tool.Name) / 4            //nolint:mnd
@@ -756,6 +1158,198 @@ func (a *AnthropicTextProvider) maxResponseTokens() int {
 	return 4096 //nolint:mnd
 }
 
+// SubmitBatch implements [WithBatch] interface.
+//
+// See: https://docs.anthropic.com/en/docs/build-with-claude/batch-processing
+func (a *AnthropicTextProvider) SubmitBatch(ctx context.Context, requests []TextBatchRequest) (string, errors.E) {
+	if len(a.tools) > 0 {
+		return "", errors.New("batches do not support tools")
+	}
+
+	errE := checkBatchRequests(requests)
+	if errE != nil {
+		return "", errE
+	}
+
+	batchRequests := make([]anthropicBatchRequest, 0, len(requests))
+	for _, request := range requests {
+		system, messages, errE := a.conversationMessages(request.Messages)
+		if errE != nil {
+			errors.Details(errE)["id"] = request.ID
+			return "", errE
+		}
+		batchRequests = append(batchRequests, anthropicBatchRequest{
+			CustomID: request.ID,
+			Params:   a.newRequest(system, messages),
+		})
+	}
+
+	request, errE := x.MarshalWithoutEscapeHTML(struct {
+		Requests []anthropicBatchRequest `json:"requests"`
+	}{
+		Requests: batchRequests,
+	})
+	if errE != nil {
+		return "", errE
+	}
+
+	var batch anthropicBatch
+	errE = a.batchRequest(ctx, http.MethodPost, apiURL(a.BaseURL, anthropicBaseURL, "/v1/messages/batches"), request, &batch)
+	if errE != nil {
+		return "", errE
+	}
+
+	return batch.ID, nil
+}
+
+// BatchResponses implements [WithBatch] interface.
+func (a *AnthropicTextProvider) BatchResponses(ctx context.Context, batchID string) ([]TextBatchResponse, bool, errors.E) {
+	var batch anthropicBatch
+	errE := a.batchRequest(ctx, http.MethodGet, apiURL(a.BaseURL, anthropicBaseURL, "/v1/messages/batches/"+url.PathEscape(batchID)), nil, &batch)
+	if errE != nil {
+		errors.Details(errE)["batch"] = batchID
+		return nil, false, errE
+	}
+
+	if batch.ProcessingStatus != "ended" {
+		return nil, false, nil
+	}
+
+	if batch.ResultsURL == nil || *batch.ResultsURL == "" {
+		return nil, true, errors.WithDetails(
+			ErrBatchFailed,
+			"batch", batchID,
+		)
+	}
+
+	var content []byte
+	errE = a.batchRequest(ctx, http.MethodGet, *batch.ResultsURL, nil, &content)
+	if errE != nil {
+		errors.Details(errE)["batch"] = batchID
+		return nil, true, errE
+	}
+
+	responses := []TextBatchResponse{}
+	for line := range bytes.Lines(content) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var result anthropicBatchResult
+		errE := x.Unmarshal(line, &result)
+		if errE != nil {
+			errors.Details(errE)["batch"] = batchID
+			return nil, true, errE
+		}
+
+		responses = append(responses, a.batchResponse(ctx, result))
+	}
+
+	return responses, true, nil
+}
+
+func (a *AnthropicTextProvider) batchResponse(ctx context.Context, result anthropicBatchResult) TextBatchResponse {
+	r := TextBatchResponse{
+		ID:      result.CustomID,
+		Content: "",
+		Err:     nil,
+	}
+
+	if result.Result.Type != "succeeded" {
+		r.Err = errors.WithDetails(
+			ErrAPIResponseError,
+			"type", result.Result.Type,
+		)
+		if result.Result.Error != nil {
+			errors.Details(r.Err)["body"] = result.Result.Error
+		}
+		return r
+	}
+	if result.Result.Message == nil {
+		r.Err = errors.Errorf("%w: missing response", ErrUnexpectedMessage)
+		return r
+	}
+
+	response := result.Result.Message
+	// There is no request ID for batched requests, so we use the message ID.
+	apiRequest := response.ID
+
+	usedTokens := newUsedTokens(
+		a.MaxContextLength,
+		a.MaxResponseLength,
+		response.Usage.InputTokens,
+		response.Usage.OutputTokens,
+		response.Usage.CacheCreationInputTokens,
+		response.Usage.CacheReadInputTokens,
+		nil,
+	)
+	chargeBudget(ctx, a, true, usedTokens)
+
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder := recorder.newBatchCall(ctx, identifier.New().String(), a)
+		callRecorder.setUsedTokens(apiRequest, usedTokens)
+		errE := a.recordMessage(callRecorder, anthropicMessage{
+			Role:    response.Role,
+			Content: response.Content,
+		})
+		recorder.recordCall(callRecorder)
+		if errE != nil {
+			r.Err = errE
+			return r
+		}
+	}
+
+	if response.Role != roleAssistant {
+		r.Err = errors.WithDetails(
+			ErrUnexpectedRole,
+			"role", response.Role,
+			"apiRequest", apiRequest,
+		)
+		return r
+	}
+
+	r.Content, r.Err = anthropicText(response, apiRequest)
+	return r
+}
+
+// batchRequest makes a request to the batch API. If output is *[]byte,
+// the response body is stored into it as-is, otherwise it is decoded as JSON.
+func (a *AnthropicTextProvider) batchRequest(ctx context.Context, method, u string, body []byte, output any) errors.E {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Add("X-Api-Key", a.APIKey)
+	req.Header.Add("Anthropic-Version", "2023-06-01")
+	if body != nil {
+		req.Header.Add("Content-Type", applicationJSONHeader)
+	}
+	setHeaders(req, a.Headers)
+
+	data, apiRequest, errE := doBatchRequest(a.Client, req, "Request-Id")
+	if errE != nil {
+		return errE
+	}
+
+	if b, ok := output.(*[]byte); ok {
+		*b = data
+		return nil
+	}
+
+	errE = x.Unmarshal(data, output)
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return errE
+	}
+
+	return nil
+}
+
 // InitTools implements [WithTools] interface.
 func (a *AnthropicTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
 	if a.tools != nil {
@@ -763,7 +1357,9 @@ func (a *AnthropicTextProvider) InitTools(ctx context.Context, tools map[string]
 	}
 	a.tools = []anthropicTool{}
 
-	for name, tool := range tools {
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
 		errE := tool.Init(ctx)
 		if errE != nil {
 			errors.Details(errE)["name"] = name
@@ -800,6 +1396,8 @@ func (a *AnthropicTextProvider) callToolWrapper(
 
 	defer func() {
 		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Name).Inc()
+
 			content := fmt.Sprintf("Error: %s", err)
 			result.Content = &content
 			result.IsError = true
@@ -815,7 +1413,12 @@ func (a *AnthropicTextProvider) callToolWrapper(
 	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.ID).Logger()
 	ctx = logger.WithContext(ctx)
 
+	ctx, span := startToolSpan(ctx, toolCall.Name, toolCall.ID)
+	defer span.End()
+
 	output, duration, errE := a.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Name, duration, errE)
 	if errE != nil {
 		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Name).Str("apiRequest", apiRequest).
 			Str("tool", toolCall.ID).RawJSON("input", toolCall.Input).Msg("tool error")
@@ -851,6 +1454,58 @@ func (a *AnthropicTextProvider) callTool(ctx context.Context, toolCall anthropic
 	return output, Duration(duration), errE
 }
 
+// anthropicContents converts message content to Anthropic content blocks.
+//
+// See: https://docs.anthropic.com/en/docs/build-with-claude/vision
+// See: https://docs.anthropic.com/en/docs/build-with-claude/pdf-support
+func anthropicContents(message ChatMessage) ([]anthropicContent, errors.E) {
+	contents := []anthropicContent{}
+	for _, part := range message.parts() {
+		mediaType, _, _ := mime.ParseMediaType(part.MIMEType)
+		switch {
+		case part.Type == typeText:
+			text := part.Text
+			contents = append(contents, anthropicContent{ //nolint:exhaustruct
+				Type: typeText,
+				Text: &text,
+			})
+		case part.Type == typeImage && slices.Contains(commonImageMIMETypes, mediaType):
+			contents = append(contents, anthropicContent{ //nolint:exhaustruct
+				Type: typeImage,
+				Source: &anthropicSource{
+					Type:      "base64",
+					MediaType: part.MIMEType,
+					Data:      base64.StdEncoding.EncodeToString(part.Data),
+					raw:       part.Data,
+				},
+			})
+		case part.Type == typeDocument && (mediaType == "application/pdf" || mediaType == "text/plain"):
+			source := &anthropicSource{
+				Type:      "base64",
+				MediaType: part.MIMEType,
+				Data:      base64.StdEncoding.EncodeToString(part.Data),
+				raw:       part.Data,
+			}
+			if mediaType == "text/plain" {
+				source.Type = "text"
+				source.MediaType = "text/plain"
+				source.Data = string(part.Data)
+			}
+			contents = append(contents, anthropicContent{ //nolint:exhaustruct
+				Type:   typeDocument,
+				Source: source,
+			})
+		default:
+			return nil, errors.WithDetails(
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+	return contents, nil
+}
+
 func (a *AnthropicTextProvider) recordMessage(recorder *TextRecorderCall, message anthropicMessage) errors.E {
 	for _, content := range message.Content {
 		switch content.Type {
@@ -860,6 +1515,13 @@ func (a *AnthropicTextProvider) recordMessage(recorder *TextRecorderCall, messag
 			if content.Text != nil {
 				recorder.addMessage(message.Role, *content.Text, "", "", false)
 			}
+		case typeImage, typeDocument:
+			recorder.addPart(message.Role, ChatContentPart{
+				Type:     content.Type,
+				Text:     "",
+				MIMEType: content.Source.MediaType,
+				Data:     content.Source.raw,
+			})
 		case roleToolUse:
 			recorder.addMessage(roleToolUse, string(content.Input), content.ID, content.Name, false)
 		case roleThinking:
@@ -1,13 +1,20 @@
 package fun_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 
 	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
 )
 
 func TestAnthropicJSON(t *testing.T) {
@@ -29,3 +36,144 @@ func TestAnthropicJSON(t *testing.T) {
 	require.NoError(t, errE, "% -+#.1v", errE)
 	assert.Equal(t, `{"model":"claude-3-haiku-20240307","maxContextLength":43,"maxResponseLength":56,"maxExchanges":57,"promptCaching":true,"reasoningBudget":12345,"temperature":0.7,"type":"anthropic"}`, string(out)) //nolint:testifylint
 }
+
+// anthropicStreamFixture is a recorded response of Anthropic streaming API
+// with an added delta and event of unknown types.
+const anthropicStreamFixture = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-haiku-20240307","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":25,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"foo"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"unknown_delta","unknown":"bar"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"foo"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: unknown_event
+data: {"type":"unknown_event"}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":5}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicTextProviderStream(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Request-Id", "req_1")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(anthropicStreamFixture))
+	}))
+	defer server.Close()
+
+	provider := &fun.AnthropicTextProvider{ //nolint:exhaustruct
+		Client:  server.Client(),
+		APIKey:  "test",
+		BaseURL: server.URL,
+		Model:   "claude-3-haiku-20240307",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, []fun.ChatMessage{{Role: "system", Content: "Repeat the input twice."}}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	ct := fun.WithTextRecorder(ctx)
+	events := []fun.TextStreamEvent{}
+	output, errE := provider.ChatStream(ct, fun.ChatMessage{Role: "user", Content: "foo"}, func(event fun.TextStreamEvent) errors.E { //nolint:exhaustruct
+		events = append(events, event)
+		return nil
+	})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foofoo", output)
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+		assert.Equal(t, "req_1", event.APIRequest)
+	}
+	assert.Equal(t, []string{"text", "text", "usage"}, types)
+	assert.Equal(t, 30, events[2].UsedTokens.Total)
+
+	// Streamed messages should be replaced with complete messages.
+	messages := fun.GetTextRecorder(ct).Calls()[0].Messages
+	assert.Equal(t, "foofoo", *messages[len(messages)-1].Content)
+}
+
+func TestAnthropicTextProviderContentParts(t *testing.T) {
+	t.Parallel()
+
+	message := contentPartsMessage(t, "image/png", "application/pdf")
+
+	server := emulator.NewAnthropic(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				var request struct {
+					Messages []struct {
+						Role    string          `json:"role"`
+						Content json.RawMessage `json:"content"`
+					} `json:"messages"`
+				}
+				errE := x.Unmarshal(req.Body, &request)
+				if errE != nil {
+					return errE
+				}
+				require.Len(t, request.Messages, 1)
+				assert.Equal(t, "user", request.Messages[0].Role)
+				assert.JSONEq(t, `[
+					{"type": "text", "text": "Describe."},
+					{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "`+base64.StdEncoding.EncodeToString(message.Parts[1].Data)+`"}},
+					{"type": "document", "source": {"type": "base64", "media_type": "application/pdf", "data": "`+base64.StdEncoding.EncodeToString(testPDF)+`"}}
+				]`, string(request.Messages[0].Content))
+				return nil
+			},
+			Content:        "red",
+			PromptTokens:   100,
+			ResponseTokens: 1,
+		},
+	)
+	defer server.Close()
+
+	provider := &fun.AnthropicTextProvider{ //nolint:exhaustruct
+		Client: server.Client(),
+		APIKey: "test",
+		Model:  "claude-3-haiku-20240307",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := provider.Chat(ctx, message)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "red", output)
+
+	// Unsupported MIME types are rejected before making a request.
+	for _, m := range []fun.ChatMessage{
+		contentPartsMessage(t, "image/bmp", "application/pdf"),
+		contentPartsMessage(t, "image/png", "application/msword"),
+	} {
+		_, errE = provider.Chat(ctx, m)
+		require.ErrorIs(t, errE, fun.ErrUnsupportedContentPart)
+		assert.Contains(t, []string{"image/bmp", "application/msword"}, errors.Details(errE)["mimeType"])
+	}
+
+	assert.Equal(t, 0, server.Remaining())
+}
@@ -0,0 +1,383 @@
+package fun
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// maxAWSEventStreamMessageSize is the maximum size of one message in an AWS event stream.
+const maxAWSEventStreamMessageSize = 16 * 1024 * 1024
+
+// awsCredentials are AWS credentials used to sign requests.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// loadAWSConfig returns AWS credentials and region in a similar way AWS CLI does:
+// from environment variables, or from the profile in shared config and credentials files.
+// If profile is empty, AWS_PROFILE environment variable is used, and "default" profile
+// if that one is empty as well. Only static credentials are supported.
+func loadAWSConfig(profile string) (awsCredentials, string, errors.E) {
+	credentials := awsCredentials{
+		AccessKeyID:     "",
+		SecretAccessKey: "",
+		SessionToken:    "",
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	// Credentials from environment variables are used only when no profile is explicitly requested.
+	if profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		credentials.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		credentials.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		credentials.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	if credentials.AccessKeyID != "" && region != "" {
+		return credentials, region, nil
+	}
+
+	home, _ := os.UserHomeDir()
+
+	configPath := os.Getenv("AWS_CONFIG_FILE")
+	if configPath == "" && home != "" {
+		configPath = filepath.Join(home, ".aws", "config")
+	}
+	credentialsPath := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsPath == "" && home != "" {
+		credentialsPath = filepath.Join(home, ".aws", "credentials")
+	}
+
+	// In the config file, sections of non-default profiles are prefixed with "profile".
+	configSection := profile
+	if profile != "default" {
+		configSection = "profile " + profile
+	}
+	config, errE := readAWSProfile(configPath, configSection)
+	if errE != nil {
+		return credentials, region, errE
+	}
+	shared, errE := readAWSProfile(credentialsPath, profile)
+	if errE != nil {
+		return credentials, region, errE
+	}
+
+	if credentials.AccessKeyID == "" {
+		// Credentials file has precedence over the config file.
+		for _, values := range []map[string]string{shared, config} {
+			if values["aws_access_key_id"] != "" && values["aws_secret_access_key"] != "" {
+				credentials.AccessKeyID = values["aws_access_key_id"]
+				credentials.SecretAccessKey = values["aws_secret_access_key"]
+				credentials.SessionToken = values["aws_session_token"]
+				break
+			}
+		}
+	}
+
+	if region == "" {
+		region = config["region"]
+	}
+
+	return credentials, region, nil
+}
+
+// readAWSProfile returns values in the section of the INI file at path.
+// It returns nil if the file or the section do not exist.
+func readAWSProfile(path, section string) (map[string]string, errors.E) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithDetails(err, "path", path)
+	}
+	defer file.Close() //nolint:errcheck
+
+	var values map[string]string
+	current := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			continue
+		}
+		if current != section {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if values == nil {
+			values = map[string]string{}
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.WithDetails(err, "path", path)
+	}
+
+	return values, nil
+}
+
+// signAWSRequest signs the request using AWS Signature Version 4, given
+// the hex encoded SHA256 hash of its body. Any existing signature is replaced.
+//
+// See: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+func signAWSRequest(req *http.Request, payloadHash string, credentials awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(awsTimeFormat)
+	date := now.Format(awsDateFormat)
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// We sign the host header, the content type, and all X-Amz-* headers.
+	headers := map[string]string{
+		"host": host,
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, 0, len(values))
+			for _, value := range values {
+				trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+	signedHeaders := slices.Sorted(func(yield func(string) bool) {
+		for name := range headers {
+			if !yield(name) {
+				return
+			}
+		}
+	})
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name)
+		canonicalHeaders.WriteString(":")
+		canonicalHeaders.WriteString(headers[name])
+		canonicalHeaders.WriteString("\n")
+	}
+
+	// Path segments are encoded twice, the second time here.
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(segment)
+	}
+	canonicalURI := strings.Join(segments, "/")
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	query := req.URL.Query()
+	queryParams := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			queryParams = append(queryParams, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+	slices.Sort(queryParams)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		strings.Join(queryParams, "&"),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		hashSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", awsSigningAlgorithm+" Credential="+credentials.AccessKeyID+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+// awsURIEncode encodes s as required by AWS Signature Version 4.
+func awsURIEncode(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := range len(s) {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xF])
+		}
+	}
+	return b.String()
+}
+
+func hashSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// decodeAWSEventStream reads messages in AWS event stream encoding from r and calls fn
+// for every message with its string headers and payload.
+//
+// See: https://docs.aws.amazon.com/transcribe/latest/dg/streaming-setting-up.html
+func decodeAWSEventStream(r io.Reader, fn func(headers map[string]string, payload []byte) errors.E) errors.E {
+	reader := bufio.NewReader(r)
+	prelude := make([]byte, 12) //nolint:mnd
+	for {
+		_, err := io.ReadFull(reader, prelude)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		totalLength := binary.BigEndian.Uint32(prelude[0:4])
+		headersLength := binary.BigEndian.Uint32(prelude[4:8])
+		if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+			return errors.New("invalid event stream prelude checksum")
+		}
+		// Message consists of the prelude, headers, payload, and the message checksum.
+		if totalLength > maxAWSEventStreamMessageSize || uint64(totalLength) < uint64(headersLength)+16 {
+			return errors.WithDetails(
+				errors.New("invalid event stream message length"),
+				"length", totalLength,
+				"headersLength", headersLength,
+			)
+		}
+
+		message := make([]byte, totalLength)
+		copy(message, prelude)
+		_, err = io.ReadFull(reader, message[12:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if crc32.ChecksumIEEE(message[:totalLength-4]) != binary.BigEndian.Uint32(message[totalLength-4:]) {
+			return errors.New("invalid event stream message checksum")
+		}
+
+		headers, errE := parseAWSEventStreamHeaders(message[12 : 12+headersLength])
+		if errE != nil {
+			return errE
+		}
+
+		errE = fn(headers, message[12+headersLength:totalLength-4])
+		if errE != nil {
+			return errE
+		}
+	}
+}
+
+// parseAWSEventStreamHeaders parses event stream headers, returning only those with string values.
+func parseAWSEventStreamHeaders(data []byte) (map[string]string, errors.E) {
+	// Sizes of values of fixed size types, by the type.
+	fixedSizes := map[byte]int{
+		0: 0, 1: 0, 2: 1, 3: 2, 4: 4, 5: 8, 8: 8, 9: 16, //nolint:mnd
+	}
+
+	headers := map[string]string{}
+	for len(data) > 0 {
+		nameLength := int(data[0])
+		if len(data) < 1+nameLength+1 {
+			return nil, errors.New("invalid event stream header")
+		}
+		name := string(data[1 : 1+nameLength])
+		valueType := data[1+nameLength]
+		data = data[1+nameLength+1:]
+
+		switch valueType {
+		case 6, 7: //nolint:mnd
+			// Byte array and string values are prefixed with their length.
+			if len(data) < 2 { //nolint:mnd
+				return nil, errors.New("invalid event stream header")
+			}
+			valueLength := int(binary.BigEndian.Uint16(data[0:2]))
+			if len(data) < 2+valueLength {
+				return nil, errors.New("invalid event stream header")
+			}
+			if valueType == 7 { //nolint:mnd
+				headers[name] = string(data[2 : 2+valueLength])
+			}
+			data = data[2+valueLength:]
+		default:
+			size, ok := fixedSizes[valueType]
+			if !ok || len(data) < size {
+				return nil, errors.WithDetails(
+					errors.New("invalid event stream header"),
+					"type", valueType,
+				)
+			}
+			data = data[size:]
+		}
+	}
+
+	return headers, nil
+}
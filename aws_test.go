@@ -0,0 +1,100 @@
+package fun
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Vectors are from the AWS Signature Version 4 test suite.
+//
+// The test suite sends paths unencoded and encodes them once. Go always sends
+// paths encoded, which are then encoded again, as required for all services
+// other than Amazon S3 (this is the same as AWS SDK for Go does). So for paths
+// which require encoding, signatures differ from those in the test suite.
+func TestSignAWSRequest(t *testing.T) {
+	t.Parallel()
+
+	credentials := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	scope := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+
+	tests := []struct {
+		Name          string
+		Method        string
+		Path          string
+		ContentType   string
+		Body          string
+		SessionToken  string
+		Authorization string
+	}{
+		{
+			"get-vanilla", http.MethodGet, "/", "", "", "",
+			"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"post-vanilla", http.MethodPost, "/", "", "", "",
+			"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			"get-vanilla-query-order-key-case", http.MethodGet, "/?Param2=value2&Param1=value1", "", "", "",
+			"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			"post-x-www-form-urlencoded", http.MethodPost, "/", "application/x-www-form-urlencoded", "Param1=value1", "",
+			"SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			"post-sts-header-after", http.MethodPost, "/", "", "",
+			"AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/" +
+				"qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+" +
+				"xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA==",
+			"SignedHeaders=host;x-amz-date;x-amz-security-token, Signature=85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead",
+		},
+		{
+			// The canonical path is "/%25E1%2588%25B4".
+			"get-utf8", http.MethodGet, "/ሴ", "", "", "",
+			"SignedHeaders=host;x-amz-date, Signature=697b34846207a3f72246f99d74ae1ee4fe54f44bb06730c58a0d339eb079596d",
+		},
+		{
+			// The canonical path is "/model/anthropic.claude-3-haiku-20240307-v1%253A0/converse".
+			"double-encoded", http.MethodPost, "/model/anthropic.claude-3-haiku-20240307-v1%3A0/converse", "", "{}", "",
+			"SignedHeaders=host;x-amz-date, Signature=000a9a1dd4b20795b14d11e4d12329e0b2fd0059e9aa316da2c212adea16be49",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(tt.Method, "https://example.amazonaws.com"+tt.Path, strings.NewReader(tt.Body)) //nolint:noctx
+			require.NoError(t, err)
+			if tt.ContentType != "" {
+				req.Header.Set("Content-Type", tt.ContentType)
+			}
+
+			c := credentials
+			c.SessionToken = tt.SessionToken
+			signAWSRequest(req, hashSHA256([]byte(tt.Body)), c, "us-east-1", "service", now)
+
+			assert.Equal(t, scope+tt.Authorization, req.Header.Get("Authorization"))
+			assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+			assert.Equal(t, tt.SessionToken, req.Header.Get("X-Amz-Security-Token"))
+
+			// Signing again replaces the existing signature.
+			signAWSRequest(req, hashSHA256([]byte(tt.Body)), c, "us-east-1", "service", now.Add(time.Second))
+
+			assert.Len(t, req.Header.Values("Authorization"), 1)
+			assert.NotEqual(t, scope+tt.Authorization, req.Header.Get("Authorization"))
+			assert.Equal(t, "20150830T123601Z", req.Header.Get("X-Amz-Date"))
+		})
+	}
+}
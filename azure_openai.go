@@ -0,0 +1,447 @@
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+const azureOpenAIAPIVersion = "2024-12-01-preview"
+
+// Azure OpenAI evaluates requests over 10 second intervals
+// and tokens over one minute intervals.
+const (
+	azureOpenAIRequestsWindow = 10 * time.Second
+	azureOpenAITokensWindow   = time.Minute
+)
+
+var azureOpenAIRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "azure-openai",
+	mu:       sync.RWMutex{},
+	limiters: map[string]map[string]any{},
+}
+
+var (
+	_ TextProvider         = (*AzureOpenAITextProvider)(nil)
+	_ WithStreaming        = (*AzureOpenAITextProvider)(nil)
+	_ WithConversation     = (*AzureOpenAITextProvider)(nil)
+	_ WithOutputJSONSchema = (*AzureOpenAITextProvider)(nil)
+	_ WithTools            = (*AzureOpenAITextProvider)(nil)
+	_ typedProvider        = (*AzureOpenAITextProvider)(nil)
+)
+
+// AzureOpenAITextProvider is a [TextProvider] which provides integration with
+// text-based OpenAI AI models deployed on [Azure OpenAI].
+//
+// [Azure OpenAI]: https://azure.microsoft.com/en-us/products/ai-services/openai-service
+type AzureOpenAITextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key of the Azure OpenAI resource to be used for API calls.
+	// Either APIKey or AccessToken has to be provided.
+	APIKey string `json:"-"`
+
+	// AccessToken is the Microsoft Entra ID access token to be used for API calls.
+	// Either APIKey or AccessToken has to be provided.
+	AccessToken string `json:"-"`
+
+	// BaseURL is the endpoint of the Azure OpenAI resource,
+	// e.g., "https://NAME.openai.azure.com".
+	BaseURL string `json:"baseUrl"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Deployment is the name of the model deployment to be used.
+	Deployment string `json:"deployment"`
+
+	// APIVersion is the version of the API to be used.
+	// Default is "2024-12-01-preview".
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Model is the name of the model deployed, including its version
+	// (e.g., "gpt-4o-2024-08-06"). It is used to determine MaxContextLength
+	// and MaxResponseLength when they are not provided, and for pricing.
+	Model string `json:"model"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, heuristics are used to determine it automatically.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, heuristics
+	// are used to determine it automatically.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// ReasoningEffort is the reasoning effort to use for reasoning models.
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+
+	// ForceOutputJSONSchema when set to true requests the AI model to force
+	// the output JSON Schema for its output. The same limitations on the JSON
+	// Schema apply as with [OpenAITextProvider].
+	ForceOutputJSONSchema bool `json:"forceOutputJsonSchema"`
+
+	// Seed is used to control the randomness of the AI model. Default is 0.
+	Seed int `json:"seed"`
+
+	// Temperature is how creative should the AI model be.
+	// It has to be set to 1 with reasoning models.
+	// Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	rateLimiterKey              string
+	messages                    []openAIMessage
+	tools                       []openAITool
+	outputJSONSchema            json.RawMessage
+	outputJSONSchemaName        string
+	outputJSONSchemaDescription string
+}
+
+// MarshalJSON implements json.Marshaler interface for AzureOpenAITextProvider.
+func (o AzureOpenAITextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P AzureOpenAITextProvider
+	p := P(o)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "azure-openai",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o AzureOpenAITextProvider) typeModel() (string, string) {
+	return "azure-openai", o.Model
+}
+
+// parseAzureOpenAIRateLimitHeaders parses rate limit headers Azure OpenAI API uses.
+// It reports only the remaining number of requests and tokens, without limits and resets.
+func parseAzureOpenAIRateLimitHeaders(resp *http.Response) (int, int, bool, errors.E) {
+	remainingRequestsStr := resp.Header.Get("X-Ratelimit-Remaining-Requests")
+	remainingTokensStr := resp.Header.Get("X-Ratelimit-Remaining-Tokens")
+
+	if remainingRequestsStr == "" || remainingTokensStr == "" {
+		return 0, 0, false, nil
+	}
+
+	remainingRequests, err := strconv.Atoi(remainingRequestsStr)
+	if err != nil {
+		return 0, 0, false, errors.WithDetails(err, "value", remainingRequestsStr)
+	}
+	remainingTokens, err := strconv.Atoi(remainingTokensStr)
+	if err != nil {
+		return 0, 0, false, errors.WithDetails(err, "value", remainingTokensStr)
+	}
+
+	return remainingRequests, remainingTokens, true, nil
+}
+
+// Init implements [TextProvider] interface.
+func (o *AzureOpenAITextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
+	if o.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.messages = []openAIMessage{}
+
+	for _, message := range messages {
+		m, errE := newOpenAIMessage(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, m)
+	}
+
+	if o.BaseURL == "" {
+		return errors.New("BaseURL not set")
+	}
+
+	if o.Deployment == "" {
+		return errors.New("Deployment not set")
+	}
+
+	if o.APIKey == "" && o.AccessToken == "" {
+		return errors.New("APIKey or AccessToken not set")
+	}
+
+	if o.APIVersion == "" {
+		o.APIVersion = azureOpenAIAPIVersion
+	}
+
+	// Rate limits are per deployment.
+	o.rateLimiterKey = fmt.Sprintf("%s-%s", o.BaseURL, o.Deployment)
+
+	if o.Client == nil {
+		o.Client = newRetryableClient(
+			func(req *http.Request) error {
+				ctx := req.Context()
+				estimatedInputTokens, _ := getEstimatedTokens(ctx)
+				// Rate limit retries.
+				return azureOpenAIRateLimiter.Take(ctx, o.rateLimiterKey, map[string]int{
+					"rpm": 1,
+					"tpm": estimatedInputTokens,
+				})
+			},
+			func(resp *http.Response) errors.E {
+				remainingRequests, remainingTokens, ok, errE := parseAzureOpenAIRateLimitHeaders(resp)
+				if errE != nil {
+					return errE
+				}
+				if ok {
+					azureOpenAIRateLimiter.Set(o.rateLimiterKey, map[string]any{
+						"rpm": remainingRateLimit{
+							Remaining: remainingRequests,
+							Window:    azureOpenAIRequestsWindow,
+						},
+						"tpm": remainingRateLimit{
+							Remaining: remainingTokens,
+							Window:    azureOpenAITokensWindow,
+						},
+					})
+				}
+				return nil
+			},
+		)
+	}
+
+	if o.MaxContextLength == 0 {
+		o.MaxContextLength = openAIModels[o.Model].MaxContextLength
+	}
+	if o.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	if o.MaxResponseLength == 0 {
+		o.MaxResponseLength = openAIModels[o.Model].MaxResponseLength
+	}
+	if o.MaxResponseLength == 0 {
+		return errors.New("MaxResponseLength not set")
+	}
+
+	if o.MaxExchanges == 0 {
+		o.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// Chat implements [TextProvider] interface.
+func (o *AzureOpenAITextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (o *AzureOpenAITextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (o *AzureOpenAITextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *AzureOpenAITextProvider) ChatConversationStream(
+	ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E,
+) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
+
+func (o *AzureOpenAITextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.openAIChat().chat(ctx, conversation, fn)
+}
+
+// openAIChat returns chat completions API configuration for the provider.
+func (o *AzureOpenAITextProvider) openAIChat() *openAIChat {
+	return &openAIChat{
+		provider:          o,
+		client:            o.Client,
+		maxContextLength:  o.MaxContextLength,
+		maxResponseLength: o.MaxResponseLength,
+		maxExchanges:      o.MaxExchanges,
+		messages:          o.messages,
+		tools:             o.tools,
+		attributes: []attribute.KeyValue{
+			semconv.GenAIRequestMaxTokens(o.MaxResponseLength),
+			semconv.GenAIRequestSeed(o.Seed),
+			semconv.GenAIRequestTemperature(o.Temperature),
+		},
+		url: o.chatCompletionsURL(),
+		setHeaders: func(req *http.Request) {
+			if o.APIKey != "" {
+				req.Header.Add("Api-Key", o.APIKey)
+			} else {
+				req.Header.Add("Authorization", "Bearer "+o.AccessToken)
+			}
+			setHeaders(req, o.Headers)
+		},
+		rateLimiter:    &azureOpenAIRateLimiter,
+		rateLimiterKey: o.rateLimiterKey,
+		newRequest: func(messages []openAIMessage, stream bool) any {
+			return o.newRequest(messages, stream)
+		},
+		requestID: func(resp *http.Response) string {
+			apiRequest := resp.Header.Get("X-Request-Id")
+			if apiRequest == "" {
+				apiRequest = resp.Header.Get("Apim-Request-Id")
+			}
+			return apiRequest
+		},
+		requireRequestID: true,
+		responseError: func(resp *http.Response) errors.E {
+			body, _ := io.ReadAll(resp.Body)
+			errE := errors.WithDetails(
+				ErrAPIResponseError,
+				"code", resp.StatusCode,
+			)
+			var response openAIResponse
+			if x.Unmarshal(body, &response) == nil && response.Error != nil {
+				errors.Details(errE)["body"] = response.Error
+			} else {
+				errors.Details(errE)["body"] = string(body)
+			}
+			return errE
+		},
+	}
+}
+
+func (o *AzureOpenAITextProvider) newRequest(messages []openAIMessage, stream bool) openAIRequest {
+	var reasoningEffort *string
+	if o.ReasoningEffort != "" {
+		reasoningEffort = &o.ReasoningEffort
+	}
+	oReq := openAIRequest{
+		Messages:            messages,
+		Model:               o.Model,
+		Seed:                o.Seed,
+		Temperature:         o.Temperature,
+		MaxCompletionTokens: o.MaxResponseLength,
+		ReasoningEffort:     reasoningEffort,
+		ResponseFormat:      nil,
+		Tools:               o.tools,
+		Stream:              false,
+		StreamOptions:       nil,
+	}
+
+	if stream {
+		oReq.Stream = true
+		oReq.StreamOptions = &openAIStreamOptions{
+			IncludeUsage: true,
+		}
+	}
+
+	if o.outputJSONSchema != nil {
+		oReq.ResponseFormat = &openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: openAIJSONSchema{
+				Description: o.outputJSONSchemaDescription,
+				Name:        o.outputJSONSchemaName,
+				Schema:      o.outputJSONSchema,
+				Strict:      true,
+			},
+		}
+	}
+
+	return oReq
+}
+
+// chatCompletionsURL returns the URL of the chat completions endpoint of the deployment.
+func (o *AzureOpenAITextProvider) chatCompletionsURL() string {
+	return apiURL(o.BaseURL, "", "/openai/deployments/"+url.PathEscape(o.Deployment)+"/chat/completions") +
+		"?api-version=" + url.QueryEscape(o.APIVersion)
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (o *AzureOpenAITextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if !o.ForceOutputJSONSchema {
+		return nil
+	}
+
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if o.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.outputJSONSchema = schema
+
+	s, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	o.outputJSONSchemaName = getString(s, "title")
+	o.outputJSONSchemaDescription = getString(s, "description")
+
+	if o.outputJSONSchemaName == "" {
+		return errors.Errorf(`%w: JSON Schema is missing "title" field which is used for required JSON Schema "name" for Azure OpenAI API`, ErrInvalidJSONSchema)
+	}
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (o *AzureOpenAITextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if o.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.tools = []openAITool{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		o.tools = append(o.tools, openAITool{
+			Type: "function",
+			Function: openAIFunction{
+				Name:            name,
+				Description:     tool.GetDescription(),
+				InputJSONSchema: tool.GetInputJSONSchema(),
+				Strict:          true,
+			},
+			tool: tool,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package fun_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+var outputJSONSchemaWithTitle = []byte(`
+{
+	"title": "output",
+	"properties": {
+		"string": {
+			"type": "string"
+		}
+	},
+	"additionalProperties": false,
+	"type": "object",
+	"required": [
+		"string"
+	]
+}
+`)
+
+func TestAzureOpenAITextProvider(t *testing.T) {
+	t.Parallel()
+
+	for _, bearer := range []bool{false, true} {
+		name := "apikey"
+		if bearer {
+			name = "bearer"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := emulator.NewAzureOpenAI(
+				emulator.Response{ //nolint:exhaustruct
+					Check: func(req emulator.Request) error {
+						var request map[string]any
+						errE := x.Unmarshal(req.Body, &request)
+						if errE != nil {
+							return errE
+						}
+						assert.Equal(t, "/openai/deployments/my-deployment/chat/completions", req.Path)
+						assert.Equal(t, "2024-10-21", req.Query.Get("api-version"))
+						if bearer {
+							assert.Empty(t, req.Header.Get("Api-Key"))
+							assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+						} else {
+							assert.Equal(t, "secret", req.Header.Get("Api-Key"))
+							assert.Empty(t, req.Header.Get("Authorization"))
+						}
+						assert.InEpsilon(t, 16_384, request["max_completion_tokens"], 0)
+						assert.Equal(t, "json_schema", request["response_format"].(map[string]any)["type"])                            //nolint:forcetypeassert,errcheck
+						assert.Equal(t, "output", request["response_format"].(map[string]any)["json_schema"].(map[string]any)["name"]) //nolint:forcetypeassert,errcheck
+						return nil
+					},
+					Content:        `{"string":"foo"}`,
+					PromptTokens:   100,
+					ResponseTokens: 10,
+				},
+				emulator.Response{StatusCode: http.StatusBadRequest}, //nolint:exhaustruct
+			)
+			defer server.Close()
+
+			provider := &fun.AzureOpenAITextProvider{ //nolint:exhaustruct
+				BaseURL:               server.URL,
+				Deployment:            "my-deployment",
+				APIVersion:            "2024-10-21",
+				Model:                 "gpt-4o-mini-2024-07-18",
+				ForceOutputJSONSchema: true,
+			}
+			if bearer {
+				provider.AccessToken = "token"
+			} else {
+				provider.APIKey = "secret"
+			}
+
+			f := fun.Text[string, toolStringInput]{
+				Provider:          provider,
+				InputJSONSchema:   nil,
+				OutputJSONSchema:  outputJSONSchemaWithTitle,
+				Prompt:            "Repeat the input.",
+				PromptTemplate:    "",
+				InputTemplate:     "",
+				Data:              nil,
+				Tools:             nil,
+				MaxRepairAttempts: 0,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			output, errE := f.Call(ct, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, toolStringInput{String: "foo"}, output)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			require.Len(t, calls, 1)
+			require.Len(t, calls[0].UsedTokens, 1)
+			for _, usedTokens := range calls[0].UsedTokens {
+				assert.Equal(t, 110, usedTokens.Total)
+			}
+
+			_, errE = f.Call(ctx, "foo")
+			assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+			assert.Equal(t, http.StatusBadRequest, errors.Details(errE)["code"])
+
+			assert.Equal(t, 0, server.Remaining())
+		})
+	}
+}
+
+func TestAzureOpenAITextProviderRemainingRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewAzureOpenAI(
+		emulator.Response{Content: "foo", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+		emulator.Response{Content: "bar", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	server.SetRateLimits(emulator.RateLimits{ //nolint:exhaustruct
+		Requests: emulator.RateLimit{Limit: 1, Window: time.Hour},
+		Tokens:   emulator.RateLimit{Limit: 1000, Window: time.Hour},
+	})
+
+	provider := &fun.AzureOpenAITextProvider{ //nolint:exhaustruct
+		APIKey:     "secret",
+		BaseURL:    server.URL,
+		Deployment: "my-deployment",
+		Model:      "gpt-4o-mini-2024-07-18",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, []fun.ChatMessage{{Role: "system", Content: "Repeat the input."}}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+
+	// No requests remain, so the rate limiter waits instead of sending the request.
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, errE = provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "bar"}) //nolint:exhaustruct
+	assert.ErrorIs(t, errE, context.DeadlineExceeded)
+
+	assert.Len(t, server.Requests(), 1)
+	assert.Equal(t, 1, server.Remaining())
+}
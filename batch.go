@@ -0,0 +1,251 @@
+package fun
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// TextBatchResult is the result for one input submitted with [Text.SubmitBatch].
+type TextBatchResult[Output any] struct {
+	// Output is the parsed and validated output.
+	Output Output
+
+	// Err is set if processing the input failed.
+	Err errors.E
+}
+
+// SubmitBatch submits inputs for asynchronous processing by the provider
+// and returns the ID of the batch. Each element of inputs corresponds to
+// input arguments of one [Text.Call].
+//
+// The provider must implement [WithBatch] interface. The returned batch ID
+// is the provider's batch ID with the number of submitted inputs appended
+// (after ":"), so that missing responses can be detected. It can be persisted
+// to retrieve results later, e.g., after a restart, using [Text.BatchResults]
+// on a [Text] with the same configuration.
+// Tools and repair attempts (see MaxRepairAttempts) are not supported.
+func (t *Text[Input, Output]) SubmitBatch(ctx context.Context, inputs ...[]Input) (string, errors.E) {
+	provider, ok := t.Provider.(WithBatch)
+	if !ok {
+		return "", errors.New("provider does not support batches")
+	}
+
+	if len(t.Tools) > 0 {
+		return "", errors.New("batches do not support tools")
+	}
+
+	if len(inputs) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+
+	requests := make([]TextBatchRequest, 0, len(inputs))
+	for i, input := range inputs {
+		for _, in := range input {
+			errE := validate(t.inputValidator, in)
+			if errE != nil {
+				errors.Details(errE)["input"] = i
+				return "", errE
+			}
+		}
+
+		messages, errE := t.messages(ctx, input)
+		if errE != nil {
+			errors.Details(errE)["input"] = i
+			return "", errE
+		}
+
+		requests = append(requests, TextBatchRequest{
+			ID:       strconv.Itoa(i),
+			Messages: messages,
+		})
+	}
+
+	batchID, errE := provider.SubmitBatch(ctx, requests)
+	if errE != nil {
+		return "", errE
+	}
+
+	return batchID + ":" + strconv.Itoa(len(requests)), nil
+}
+
+// parseBatchID parses the batch ID returned by [Text.SubmitBatch]
+// into the provider's batch ID and the number of submitted inputs.
+func parseBatchID(batchID string) (string, int, errors.E) {
+	i := strings.LastIndex(batchID, ":")
+	if i == -1 {
+		return "", 0, errors.WithDetails(
+			errors.New("invalid batch ID"),
+			"batch", batchID,
+		)
+	}
+	count, err := strconv.Atoi(batchID[i+1:])
+	if err != nil || count < 1 {
+		return "", 0, errors.WithDetails(
+			errors.New("invalid batch ID"),
+			"batch", batchID,
+		)
+	}
+	return batchID[:i], count, nil
+}
+
+// BatchResults returns results for the batch submitted with [Text.SubmitBatch],
+// in the same order as inputs were submitted. If the batch has not yet finished
+// processing, it returns false and no results. If the provider did not return
+// responses for all submitted inputs, it returns an error with indices of
+// missing inputs in "missing" error detail.
+func (t *Text[Input, Output]) BatchResults(ctx context.Context, batchID string) ([]TextBatchResult[Output], bool, errors.E) {
+	provider, ok := t.Provider.(WithBatch)
+	if !ok {
+		return nil, false, errors.New("provider does not support batches")
+	}
+
+	providerBatchID, count, errE := parseBatchID(batchID)
+	if errE != nil {
+		return nil, false, errE
+	}
+
+	responses, done, errE := provider.BatchResponses(ctx, providerBatchID)
+	if errE != nil || !done {
+		return nil, done, errE
+	}
+
+	results := make([]TextBatchResult[Output], count)
+	seen := make([]bool, count)
+	for _, response := range responses {
+		i, err := strconv.Atoi(response.ID)
+		if err != nil || i < 0 || i >= len(results) || seen[i] {
+			return nil, true, errors.WithDetails(
+				ErrUnexpectedMessage,
+				"id", response.ID,
+				"batch", batchID,
+			)
+		}
+		seen[i] = true
+
+		if response.Err != nil {
+			results[i].Err = response.Err
+			continue
+		}
+
+		results[i].Output, results[i].Err = t.parseOutput(response.Content)
+	}
+
+	missing := []string{}
+	for i, ok := range seen {
+		if !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, true, errors.WithDetails(
+			ErrMissingBatchResponses,
+			"missing", missing,
+			"batch", batchID,
+		)
+	}
+
+	return results, true, nil
+}
+
+// WaitBatch is like [Text.BatchResults], but it polls the provider
+// every interval until the batch finishes processing.
+func (t *Text[Input, Output]) WaitBatch(ctx context.Context, batchID string, interval time.Duration) ([]TextBatchResult[Output], errors.E) {
+	for {
+		results, done, errE := t.BatchResults(ctx, batchID)
+		if errE != nil {
+			return nil, errE
+		}
+		if done {
+			return results, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// doBatchRequest makes a request to a batch API endpoint and returns the response body.
+// It returns an error if the response status code is not successful.
+func doBatchRequest(client *http.Client, req *http.Request, requestIDHeader string) ([]byte, string, errors.E) {
+	resp, err := client.Do(req)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get(requestIDHeader)
+	}
+	if err != nil {
+		errE := errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, errE
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		errE := errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, errE
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		errE := errors.WithDetails(
+			ErrAPIResponseError,
+			"code", resp.StatusCode,
+			"body", string(body),
+		)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, errE
+	}
+
+	return body, apiRequest, nil
+}
+
+var batchRequestIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`) //nolint:gochecknoglobals
+
+// checkBatchRequests checks that there is at least one request and
+// that request IDs are valid and unique.
+func checkBatchRequests(requests []TextBatchRequest) errors.E {
+	if len(requests) == 0 {
+		return errors.WithStack(ErrNoMessages)
+	}
+
+	ids := map[string]bool{}
+	for _, request := range requests {
+		if !batchRequestIDRegexp.MatchString(request.ID) {
+			return errors.WithDetails(
+				errors.New("invalid request ID"),
+				"id", request.ID,
+			)
+		}
+		if ids[request.ID] {
+			return errors.WithDetails(
+				errors.New("duplicate request ID"),
+				"id", request.ID,
+			)
+		}
+		ids[request.ID] = true
+		if len(request.Messages) == 0 {
+			return errors.WithDetails(
+				ErrNoMessages,
+				"id", request.ID,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,406 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+// rewriteTransport sends all requests to the test server.
+type rewriteTransport struct {
+	URL *url.URL
+}
+
+func (r rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = r.URL.Scheme
+	req.URL.Host = r.URL.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *http.Client {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	return &http.Client{ //nolint:exhaustruct
+		Transport: rewriteTransport{URL: u},
+	}
+}
+
+// lastUserContent returns the content of the last message in the request.
+func lastUserContent(t *testing.T, messages []json.RawMessage) string {
+	t.Helper()
+
+	var message struct {
+		Content json.RawMessage `json:"content"`
+	}
+	err := json.Unmarshal(messages[len(messages)-1], &message)
+	require.NoError(t, err)
+
+	var content string
+	if json.Unmarshal(message.Content, &content) == nil {
+		return content
+	}
+
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	err = json.Unmarshal(message.Content, &parts)
+	require.NoError(t, err)
+	return parts[len(parts)-1].Text
+}
+
+func testBatch(t *testing.T, provider fun.TextProvider, expectedCost float64) {
+	t.Helper()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Text[string, string]{
+		Provider:          provider,
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  jsonSchemaString,
+		Prompt:            "Repeat the input.",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              nil,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	batchID, errE := f.SubmitBatch(ctx, []string{"foo"}, []string{"fail"}, []string{"bar"})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "batch_1:3", batchID)
+
+	results, done, errE := f.BatchResults(ctx, batchID)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.False(t, done)
+	assert.Nil(t, results)
+
+	ctx = fun.WithTextRecorder(fun.WithBudget(ctx, 0, 0))
+	results, errE = f.WaitBatch(ctx, batchID, time.Millisecond)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	require.Len(t, results, 3)
+
+	assert.Equal(t, "FOO", results[0].Output)
+	require.NoError(t, results[0].Err, "% -+#.1v", results[0].Err)
+	assert.ErrorIs(t, results[1].Err, fun.ErrAPIResponseError)
+	assert.Equal(t, "BAR", results[2].Output)
+	require.NoError(t, results[2].Err, "% -+#.1v", results[2].Err)
+
+	calls := fun.GetTextRecorder(ctx).Calls()
+	assert.Len(t, calls, 2)
+	for i := range calls {
+		assert.Len(t, calls[i].UsedTokens, 1)
+		assert.True(t, calls[i].Batch)
+		assert.InDelta(t, expectedCost, calls[i].TotalCost(), 1e-12)
+	}
+	assert.InDelta(t, 2*expectedCost, fun.GetTextRecorder(ctx).TotalCost(), 1e-12)
+	assert.InDelta(t, 2*expectedCost, fun.GetBudget(ctx).UsedCost(), 1e-12)
+	assert.Equal(t, 2*11, fun.GetBudget(ctx).UsedTokens())
+}
+
+func TestOpenAIBatch(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	lines := []string{}
+	polls := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/files", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "batch", r.FormValue("purpose"))
+		file, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		mu.Lock()
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"id":"file-in"}`))
+	})
+	mux.HandleFunc("POST /v1/batches", func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		assert.Equal(t, "file-in", request["input_file_id"])
+		assert.Equal(t, "/v1/chat/completions", request["endpoint"])
+		_, _ = w.Write([]byte(`{"id":"batch_1","status":"validating"}`))
+	})
+	mux.HandleFunc("GET /v1/batches/batch_1", func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		if polls < 3 { //nolint:mnd
+			_, _ = w.Write([]byte(`{"id":"batch_1","status":"in_progress"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"batch_1","status":"completed","output_file_id":"file-out","error_file_id":"file-err"}`))
+	})
+	fileContent := func(failed bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, line := range lines {
+				var request struct {
+					CustomID string `json:"custom_id"`
+					Body     struct {
+						Messages []json.RawMessage `json:"messages"`
+					} `json:"body"`
+				}
+				err := json.Unmarshal([]byte(line), &request)
+				require.NoError(t, err)
+				content := lastUserContent(t, request.Body.Messages)
+				if (content == "fail") != failed {
+					continue
+				}
+				if failed {
+					fmt.Fprintf(w, `{"custom_id":%q,"response":null,"error":{"code":"batch_expired","message":"expired"}}`+"\n", request.CustomID)
+				} else {
+					fmt.Fprintf(w, `{"custom_id":%q,"response":{"status_code":200,"request_id":"req_%s","body":`+
+						`{"choices":[{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":"stop"}],`+
+						`"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}},"error":null}`+"\n",
+						request.CustomID, request.CustomID, strings.ToUpper(content))
+				}
+			}
+		}
+	}
+	mux.HandleFunc("GET /v1/files/file-out/content", fileContent(false))
+	mux.HandleFunc("GET /v1/files/file-err/content", fileContent(true))
+
+	testBatch(t, &fun.OpenAITextProvider{ //nolint:exhaustruct
+		Client: newTestClient(t, mux),
+		APIKey: "test",
+		Model:  "gpt-4o-mini-2024-07-18",
+	}, (10*0.15+1*0.6)/2/1_000_000) // 50% batch discount.
+}
+
+func TestAnthropicBatch(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var requests []struct {
+		CustomID string `json:"custom_id"`
+		Params   struct {
+			Messages []json.RawMessage `json:"messages"`
+		} `json:"params"`
+	}
+	polls := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages/batches", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test", r.Header.Get("X-Api-Key"))
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct {
+			Requests any `json:"requests"`
+		}
+		body.Requests = &requests
+		err := json.NewDecoder(r.Body).Decode(&body)
+		require.NoError(t, err)
+		_, _ = w.Write([]byte(`{"id":"batch_1","processing_status":"in_progress"}`))
+	})
+	mux.HandleFunc("GET /v1/messages/batches/batch_1", func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		if polls < 3 { //nolint:mnd
+			_, _ = w.Write([]byte(`{"id":"batch_1","processing_status":"in_progress"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"batch_1","processing_status":"ended","results_url":"https://api.anthropic.com/v1/messages/batches/batch_1/results"}`))
+	})
+	mux.HandleFunc("GET /v1/messages/batches/batch_1/results", func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, request := range requests {
+			content := lastUserContent(t, request.Params.Messages)
+			if content == "fail" {
+				fmt.Fprintf(w, `{"custom_id":%q,"result":{"type":"errored","error":{"type":"error","error":{"type":"invalid_request_error","message":"invalid"}}}}`+"\n", request.CustomID)
+			} else {
+				fmt.Fprintf(w, `{"custom_id":%q,"result":{"type":"succeeded","message":{"id":"msg_%s","type":"message","role":"assistant",`+
+					`"content":[{"type":"text","text":%q}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":1}}}}`+"\n",
+					request.CustomID, request.CustomID, strings.ToUpper(content))
+			}
+		}
+	})
+
+	testBatch(t, &fun.AnthropicTextProvider{ //nolint:exhaustruct
+		Client: newTestClient(t, mux),
+		APIKey: "test",
+		Model:  "claude-3-haiku-20240307",
+	}, (10*0.25+1*1.25)/2/1_000_000) // 50% batch discount.
+}
+
+// partialBatchProvider returns responses only to some requests of a batch.
+type partialBatchProvider struct {
+	Skip string
+
+	requests []fun.TextBatchRequest
+}
+
+func (p *partialBatchProvider) Init(_ context.Context, _ []fun.ChatMessage) errors.E {
+	return nil
+}
+
+func (p *partialBatchProvider) Chat(_ context.Context, _ fun.ChatMessage) (string, errors.E) {
+	return "", errors.New("not supported")
+}
+
+func (p *partialBatchProvider) SubmitBatch(_ context.Context, requests []fun.TextBatchRequest) (string, errors.E) {
+	p.requests = requests
+	return "batch_1", nil
+}
+
+func (p *partialBatchProvider) BatchResponses(_ context.Context, batchID string) ([]fun.TextBatchResponse, bool, errors.E) {
+	if batchID != "batch_1" {
+		return nil, false, errors.New("unknown batch")
+	}
+	responses := []fun.TextBatchResponse{}
+	for _, request := range p.requests {
+		if request.ID == p.Skip {
+			continue
+		}
+		responses = append(responses, fun.TextBatchResponse{ID: request.ID, Content: "foo", Err: nil})
+	}
+	return responses, true, nil
+}
+
+func TestBatchMissingResponses(t *testing.T) {
+	t.Parallel()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	for _, skip := range []string{"1", "2"} {
+		f := fun.Text[string, string]{ //nolint:exhaustruct
+			Provider: &partialBatchProvider{Skip: skip}, //nolint:exhaustruct
+			Prompt:   "Repeat the input.",
+		}
+
+		errE := f.Init(ctx)
+		require.NoError(t, errE, "% -+#.1v", errE)
+
+		batchID, errE := f.SubmitBatch(ctx, []string{"foo"}, []string{"foo"}, []string{"foo"})
+		require.NoError(t, errE, "% -+#.1v", errE)
+		assert.Equal(t, "batch_1:3", batchID)
+
+		results, done, errE := f.BatchResults(ctx, batchID)
+		require.ErrorIs(t, errE, fun.ErrMissingBatchResponses)
+		assert.True(t, done)
+		assert.Nil(t, results)
+		assert.Equal(t, []string{skip}, errors.Details(errE)["missing"])
+	}
+
+	f := fun.Text[string, string]{ //nolint:exhaustruct
+		Provider: &partialBatchProvider{Skip: ""}, //nolint:exhaustruct
+		Prompt:   "Repeat the input.",
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, _, errE = f.BatchResults(ctx, "batch_1")
+	assert.EqualError(t, errE, "invalid batch ID")
+}
+
+func TestBatchRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		Path     string
+		Response string
+		Provider func(baseURL string) fun.WithBatch
+	}{
+		{
+			"openai",
+			"/v1/batches/batch_1",
+			`{"id":"batch_1","status":"in_progress"}`,
+			func(baseURL string) fun.WithBatch {
+				return &fun.OpenAITextProvider{ //nolint:exhaustruct
+					APIKey:  "test",
+					BaseURL: baseURL + "/v1",
+					Model:   "gpt-4o-mini-2024-07-18",
+				}
+			},
+		},
+		{
+			"anthropic",
+			"/v1/messages/batches/batch_1",
+			`{"id":"batch_1","processing_status":"in_progress"}`,
+			func(baseURL string) fun.WithBatch {
+				return &fun.AnthropicTextProvider{ //nolint:exhaustruct
+					APIKey:  "test",
+					BaseURL: baseURL,
+					Model:   "claude-3-haiku-20240307",
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			polls := 0
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tt.Path, r.URL.Path)
+				mu.Lock()
+				defer mu.Unlock()
+				polls++
+				w.Header().Set("X-Request-Id", fmt.Sprintf("req_%d", polls))
+				w.Header().Set("Request-Id", fmt.Sprintf("req_%d", polls))
+				if polls == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					_, _ = w.Write([]byte(`{"error":{"type":"api_error","message":"Internal server error"}}`))
+					return
+				}
+				_, _ = w.Write([]byte(tt.Response))
+			}))
+			defer ts.Close()
+
+			provider := tt.Provider(ts.URL)
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			// The default client is used, which retries the failed request.
+			errE := provider.(fun.TextProvider).Init(ctx, nil) //nolint:forcetypeassert,errcheck
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			responses, done, errE := provider.BatchResponses(ctx, "batch_1")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.False(t, done)
+			assert.Nil(t, responses)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, 2, polls)
+		})
+	}
+}
@@ -0,0 +1,1335 @@
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"golang.org/x/time/rate"
+)
+
+const bedrockService = "bedrock"
+
+// bedrockInitialRequestsPerMinute is the limit of requests per minute used after the first
+// throttling when RequestsPerMinuteLimit is not set.
+const bedrockInitialRequestsPerMinute = 60
+
+var bedrockRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "bedrock",
+	mu:       sync.RWMutex{},
+	limiters: map[string]map[string]any{},
+}
+
+//nolint:gochecknoglobals
+var (
+	// bedrockRequestsPerMinuteMu guards bedrockRequestsPerMinute.
+	bedrockRequestsPerMinuteMu sync.Mutex
+	// bedrockRequestsPerMinute are current adaptive limits of requests per minute by rate limiter keys.
+	bedrockRequestsPerMinute = map[string]float64{}
+)
+
+type bedrockSource struct {
+	// Bytes are base64 encoded when marshaled to JSON.
+	Bytes []byte `json:"bytes"`
+}
+
+type bedrockImage struct {
+	Format string        `json:"format"`
+	Source bedrockSource `json:"source"`
+
+	// mimeType is used for recording.
+	mimeType string
+}
+
+type bedrockDocument struct {
+	Format string        `json:"format"`
+	Name   string        `json:"name"`
+	Source bedrockSource `json:"source"`
+
+	// mimeType is used for recording.
+	mimeType string
+}
+
+type bedrockToolUse struct {
+	ToolUseID string          `json:"toolUseId"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+type bedrockToolResultContent struct {
+	Text string `json:"text"`
+}
+
+type bedrockToolResult struct {
+	ToolUseID string                     `json:"toolUseId"`
+	Content   []bedrockToolResultContent `json:"content"`
+	Status    string                     `json:"status"`
+}
+
+type bedrockReasoningText struct {
+	Text      string `json:"text"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type bedrockReasoningContent struct {
+	ReasoningText   *bedrockReasoningText `json:"reasoningText,omitempty"`
+	RedactedContent []byte                `json:"redactedContent,omitempty"`
+}
+
+type bedrockContent struct {
+	Text             *string                  `json:"text,omitempty"`
+	Image            *bedrockImage            `json:"image,omitempty"`
+	Document         *bedrockDocument         `json:"document,omitempty"`
+	ToolUse          *bedrockToolUse          `json:"toolUse,omitempty"`
+	ToolResult       *bedrockToolResult       `json:"toolResult,omitempty"`
+	ReasoningContent *bedrockReasoningContent `json:"reasoningContent,omitempty"`
+}
+
+type bedrockMessage struct {
+	Role    string           `json:"role"`
+	Content []bedrockContent `json:"content"`
+}
+
+type bedrockSystem struct {
+	Text string `json:"text"`
+}
+
+type bedrockInputSchema struct {
+	JSON json.RawMessage `json:"json"`
+}
+
+type bedrockToolSpec struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	InputSchema bedrockInputSchema `json:"inputSchema"`
+}
+
+type bedrockTool struct {
+	ToolSpec bedrockToolSpec `json:"toolSpec"`
+
+	tool TextTooler
+}
+
+type bedrockToolConfig struct {
+	Tools []bedrockTool `json:"tools"`
+}
+
+type bedrockInferenceConfig struct {
+	MaxTokens   int      `json:"maxTokens"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+type bedrockRequest struct {
+	Messages                     []bedrockMessage       `json:"messages"`
+	System                       []bedrockSystem        `json:"system,omitempty"`
+	InferenceConfig              bedrockInferenceConfig `json:"inferenceConfig"`
+	ToolConfig                   *bedrockToolConfig     `json:"toolConfig,omitempty"`
+	AdditionalModelRequestFields map[string]any         `json:"additionalModelRequestFields,omitempty"`
+}
+
+type bedrockUsage struct {
+	InputTokens           int  `json:"inputTokens"`
+	OutputTokens          int  `json:"outputTokens"`
+	TotalTokens           int  `json:"totalTokens"`
+	CacheReadInputTokens  *int `json:"cacheReadInputTokens,omitempty"`
+	CacheWriteInputTokens *int `json:"cacheWriteInputTokens,omitempty"`
+}
+
+type bedrockResponse struct {
+	Output struct {
+		Message bedrockMessage `json:"message"`
+	} `json:"output"`
+	StopReason string       `json:"stopReason"`
+	Usage      bedrockUsage `json:"usage"`
+}
+
+type bedrockError struct {
+	Message string `json:"message"`
+}
+
+type bedrockStreamEvent struct {
+	Role              string `json:"role"`
+	ContentBlockIndex int    `json:"contentBlockIndex"`
+	Start             *struct {
+		ToolUse *bedrockToolUse `json:"toolUse,omitempty"`
+	} `json:"start,omitempty"`
+	Delta *struct {
+		Text    *string `json:"text,omitempty"`
+		ToolUse *struct {
+			Input string `json:"input"`
+		} `json:"toolUse,omitempty"`
+		ReasoningContent *struct {
+			Text            string `json:"text"`
+			Signature       string `json:"signature"`
+			RedactedContent []byte `json:"redactedContent"`
+		} `json:"reasoningContent,omitempty"`
+	} `json:"delta,omitempty"`
+	StopReason string        `json:"stopReason"`
+	Usage      *bedrockUsage `json:"usage,omitempty"`
+	Message    string        `json:"message"`
+}
+
+var (
+	_ TextProvider     = (*BedrockTextProvider)(nil)
+	_ WithStreaming    = (*BedrockTextProvider)(nil)
+	_ WithConversation = (*BedrockTextProvider)(nil)
+	_ WithTools        = (*BedrockTextProvider)(nil)
+	_ typedProvider    = (*BedrockTextProvider)(nil)
+)
+
+// BedrockTextProvider is a [TextProvider] which provides integration with
+// text-based AI models available on [Amazon Bedrock] through its Converse API.
+//
+// Anthropic and Llama models are supported.
+//
+// [Amazon Bedrock]: https://aws.amazon.com/bedrock/
+type BedrockTextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// AccessKeyID is the AWS access key ID to be used to sign API calls.
+	// If not provided, it is obtained from AWS_ACCESS_KEY_ID environment
+	// variable or from the profile.
+	AccessKeyID string `json:"-"`
+
+	// SecretAccessKey is the AWS secret access key to be used to sign API calls.
+	// If not provided, it is obtained from AWS_SECRET_ACCESS_KEY environment
+	// variable or from the profile.
+	SecretAccessKey string `json:"-"`
+
+	// SessionToken is the AWS session token for temporary credentials.
+	// If not provided, it is obtained from AWS_SESSION_TOKEN environment
+	// variable or from the profile.
+	SessionToken string `json:"-"`
+
+	// Profile is the name of the profile in AWS shared config and credentials
+	// files to obtain credentials and region from. If set, environment variables
+	// with credentials are ignored. Default is AWS_PROFILE environment variable
+	// or "default".
+	Profile string `json:"profile,omitempty"`
+
+	// Region is the AWS region to be used. If not provided, it is obtained
+	// from AWS_REGION or AWS_DEFAULT_REGION environment variables or from the profile.
+	Region string `json:"region"`
+
+	// BaseURL is the base URL of the API, e.g., to use a VPC endpoint or a proxy.
+	// Default is "https://bedrock-runtime.<region>.amazonaws.com".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the ID of the model or of the inference profile to be used
+	// (e.g., "us.anthropic.claude-3-7-sonnet-20250219-v1:0").
+	Model string `json:"model"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, heuristics are used to determine it automatically.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, heuristics
+	// are used to determine it automatically.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// RequestsPerMinuteLimit is the maximum number of requests per minute.
+	// Bedrock does not report rate limits, so the limit is halved whenever
+	// requests are throttled and then gradually increased back with successful requests.
+	// Default is 0 which means that requests are not limited until they are throttled.
+	RequestsPerMinuteLimit int `json:"requestsPerMinuteLimit,omitempty"`
+
+	// ReasoningBudget is the budget of tokens to use for reasoning with Anthropic models.
+	// Default is 0 which means that reasoning is not enabled.
+	ReasoningBudget int `json:"reasoningBudget"`
+
+	// Temperature is how creative should the AI model be.
+	// Ignored when reasoning is enabled.
+	// Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	credentials    awsCredentials
+	rateLimiterKey string
+	system         []bedrockSystem
+	messages       []bedrockMessage
+	tools          []bedrockTool
+}
+
+// MarshalJSON implements json.Marshaler interface for BedrockTextProvider.
+func (b BedrockTextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P BedrockTextProvider
+	p := P(b)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		P:    p,
+		Type: "bedrock",
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (b BedrockTextProvider) typeModel() (string, string) {
+	return "bedrock", b.Model
+}
+
+// Init implements [TextProvider] interface.
+func (b *BedrockTextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
+	if b.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	b.messages = []bedrockMessage{}
+
+	for _, message := range messages {
+		if message.Role == roleSystem {
+			if b.system != nil {
+				return errors.WithStack(ErrMultipleSystemMessages)
+			}
+			b.system = []bedrockSystem{{Text: message.Content}}
+		} else {
+			content, errE := bedrockContents(message)
+			if errE != nil {
+				return errE
+			}
+			b.messages = append(b.messages, bedrockMessage{
+				Role:    message.Role,
+				Content: content,
+			})
+		}
+	}
+
+	b.credentials = awsCredentials{
+		AccessKeyID:     b.AccessKeyID,
+		SecretAccessKey: b.SecretAccessKey,
+		SessionToken:    b.SessionToken,
+	}
+	if b.credentials.AccessKeyID == "" || b.Region == "" {
+		credentials, region, errE := loadAWSConfig(b.Profile)
+		if errE != nil {
+			return errE
+		}
+		if b.credentials.AccessKeyID == "" {
+			b.credentials = credentials
+		}
+		if b.Region == "" {
+			b.Region = region
+		}
+	}
+
+	if b.credentials.AccessKeyID == "" || b.credentials.SecretAccessKey == "" {
+		return errors.New("AWS credentials are missing")
+	}
+
+	if b.Region == "" {
+		return errors.New("AWS region is missing")
+	}
+
+	b.rateLimiterKey = fmt.Sprintf("%s-%s-%s-%s", b.BaseURL, b.Region, b.credentials.AccessKeyID, b.Model)
+
+	if b.RequestsPerMinuteLimit > 0 {
+		b.setRequestsPerMinute(float64(b.RequestsPerMinuteLimit))
+	}
+
+	if b.Client == nil {
+		b.Client = newClient(
+			func(req *http.Request) error {
+				reqCtx := req.Context()
+				// Rate limit retries.
+				errE := bedrockRateLimiter.Take(reqCtx, b.rateLimiterKey, map[string]int{
+					"rpm": 1,
+				})
+				if errE != nil {
+					return errE
+				}
+				// We sign again because the signature might have expired while waiting.
+				signAWSRequest(req, req.Header.Get("X-Amz-Content-Sha256"), b.credentials, b.Region, bedrockService, time.Now())
+				return nil
+			},
+			nil,
+			nil,
+		)
+		transport := b.Client.Transport.(*retryablehttp.RoundTripper) //nolint:forcetypeassert,errcheck
+		checkRetry := transport.Client.CheckRetry
+		transport.Client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if err == nil {
+				if isThrottled(resp) {
+					b.adaptRequestsPerMinute(true)
+				} else if resp.StatusCode == http.StatusOK {
+					b.adaptRequestsPerMinute(false)
+				}
+			}
+			return checkRetry(ctx, resp, err)
+		}
+	}
+
+	if b.MaxContextLength == 0 || b.MaxResponseLength == 0 {
+		maxContextLength, maxResponseLength := b.modelLimits()
+		if b.MaxContextLength == 0 {
+			b.MaxContextLength = maxContextLength
+		}
+		if b.MaxResponseLength == 0 {
+			b.MaxResponseLength = maxResponseLength
+		}
+	}
+
+	if b.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	if b.MaxResponseLength == 0 {
+		return errors.New("MaxResponseLength not set")
+	}
+
+	if b.MaxExchanges == 0 {
+		b.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// setRequestsPerMinute sets the limit of requests per minute. Requests are spread
+// evenly over the minute.
+func (b *BedrockTextProvider) setRequestsPerMinute(requestsPerMinute float64) {
+	bedrockRequestsPerMinuteMu.Lock()
+	defer bedrockRequestsPerMinuteMu.Unlock()
+
+	bedrockRequestsPerMinute[b.rateLimiterKey] = requestsPerMinute
+	bedrockRateLimiter.Set(b.rateLimiterKey, map[string]any{
+		"rpm": tokenBucketRateLimit{
+			Limit: rate.Limit(requestsPerMinute / time.Minute.Seconds()),
+			Burst: 1,
+		},
+	})
+}
+
+// adaptRequestsPerMinute halves the limit of requests per minute when a request
+// was throttled and increases it by one otherwise, up to RequestsPerMinuteLimit.
+func (b *BedrockTextProvider) adaptRequestsPerMinute(throttled bool) {
+	bedrockRequestsPerMinuteMu.Lock()
+	requestsPerMinute := bedrockRequestsPerMinute[b.rateLimiterKey]
+	bedrockRequestsPerMinuteMu.Unlock()
+
+	if throttled {
+		if requestsPerMinute == 0 {
+			requestsPerMinute = bedrockInitialRequestsPerMinute
+		} else {
+			requestsPerMinute = max(1, requestsPerMinute/2) //nolint:mnd
+		}
+	} else {
+		if requestsPerMinute == 0 {
+			// Requests are not limited.
+			return
+		}
+		requestsPerMinute++
+		if b.RequestsPerMinuteLimit > 0 {
+			requestsPerMinute = min(requestsPerMinute, float64(b.RequestsPerMinuteLimit))
+		}
+	}
+
+	b.setRequestsPerMinute(requestsPerMinute)
+}
+
+// modelName returns the model ID without the region prefix of cross-region inference profiles.
+func (b *BedrockTextProvider) modelName() string {
+	if prefix, name, ok := strings.Cut(b.Model, "."); ok && prefix != "anthropic" && prefix != "meta" {
+		return name
+	}
+	return b.Model
+}
+
+func (b *BedrockTextProvider) isAnthropic() bool {
+	return strings.HasPrefix(b.modelName(), "anthropic.")
+}
+
+// modelLimits returns the context window and maximum response length of known models.
+func (b *BedrockTextProvider) modelLimits() (int, int) {
+	model := b.modelName()
+	switch {
+	case strings.HasPrefix(model, "anthropic."):
+		switch {
+		case strings.Contains(model, "opus-4"):
+			return 200_000, 32_000 //nolint:mnd
+		case strings.Contains(model, "sonnet-4"):
+			return 200_000, 64_000 //nolint:mnd
+		case strings.Contains(model, "3-7"):
+			if b.ReasoningBudget > 0 {
+				return 200_000, 64_000 //nolint:mnd
+			}
+			return 200_000, 8192 //nolint:mnd
+		case strings.Contains(model, "3-5"):
+			return 200_000, 8192 //nolint:mnd
+		default:
+			return 200_000, 4096 //nolint:mnd
+		}
+	case strings.HasPrefix(model, "meta.llama3-1-"), strings.HasPrefix(model, "meta.llama3-2-"), strings.HasPrefix(model, "meta.llama3-3-"):
+		return 128_000, 2048 //nolint:mnd
+	case strings.HasPrefix(model, "meta.llama3-"):
+		return 8192, 2048 //nolint:mnd
+	default:
+		return 0, 0
+	}
+}
+
+// Chat implements [TextProvider] interface.
+func (b *BedrockTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return b.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (b *BedrockTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return b.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (b *BedrockTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return b.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (b *BedrockTextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return b.chat(ctx, messages, fn)
+}
+
+func (b *BedrockTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newCall(ctx, callID, b)
+		defer recorder.recordCall(callRecorder)
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	stream := newTextStream(callRecorder, fn)
+
+	system, messages, errE := b.conversationMessages(conversation)
+	if errE != nil {
+		return "", errE
+	}
+
+	if callRecorder != nil {
+		for _, s := range system {
+			callRecorder.addMessage(roleSystem, s.Text, "", "", false)
+		}
+
+		for _, message := range messages {
+			errE := b.recordMessage(callRecorder, message)
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		callRecorder.notify("", nil)
+	}
+
+	for range b.MaxExchanges {
+		response, apiRequest, apiCallDuration, errE := b.send(ctx, system, messages, stream)
+		if errE != nil {
+			return "", errE
+		}
+
+		usedTokens := newUsedTokens(
+			b.MaxContextLength,
+			b.MaxResponseLength,
+			response.Usage.InputTokens,
+			response.Usage.OutputTokens,
+			response.Usage.CacheWriteInputTokens,
+			response.Usage.CacheReadInputTokens,
+			nil,
+		)
+
+		if stream != nil {
+			errE = stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: usedTokens,
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		if callRecorder != nil {
+			callRecorder.setUsedTokens(apiRequest, usedTokens)
+			callRecorder.addUsedTime(
+				apiRequest,
+				0,
+				0,
+				apiCallDuration,
+			)
+
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
+			errE := b.recordMessage(callRecorder, response.Output.Message)
+			if errE != nil {
+				return "", errE
+			}
+
+			callRecorder.notify("", nil)
+		}
+
+		if response.Usage.InputTokens+response.Usage.OutputTokens >= b.MaxContextLength {
+			return "", errors.WithDetails(
+				ErrUnexpectedNumberOfTokens,
+				"prompt", response.Usage.InputTokens,
+				"response", response.Usage.OutputTokens,
+				"total", response.Usage.InputTokens+response.Usage.OutputTokens,
+				"maxTotal", b.MaxContextLength,
+				"maxResponse", b.MaxResponseLength,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		if response.Output.Message.Role != roleAssistant {
+			return "", errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", response.Output.Message.Role,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		if response.StopReason == roleToolUse {
+			toolUses := []*bedrockToolUse{}
+			for _, content := range response.Output.Message.Content {
+				if content.ToolUse != nil {
+					toolUses = append(toolUses, content.ToolUse)
+				}
+			}
+
+			if len(toolUses) == 0 {
+				return "", errors.WithDetails(
+					ErrToolCallsWithoutCalls,
+					"apiRequest", apiRequest,
+				)
+			}
+
+			// We have already recorded this message above.
+			messages = append(messages, response.Output.Message)
+
+			// We make space for tool results (one per tool call) so that the Content slice
+			// does not grow when appending below and invalidate pointers goroutines keep.
+			messages = append(messages, bedrockMessage{
+				Role:    roleUser,
+				Content: make([]bedrockContent, 0, len(toolUses)),
+			})
+
+			if callRecorder != nil {
+				// We grow the slice inside call recorder as well.
+				callRecorder.prepareForToolMessages(len(toolUses))
+			}
+
+			var wg sync.WaitGroup
+			for _, toolUse := range toolUses {
+				messages[len(messages)-1].Content = append(messages[len(messages)-1].Content, bedrockContent{ //nolint:exhaustruct
+					ToolResult: &bedrockToolResult{
+						ToolUseID: toolUse.ToolUseID,
+						Content:   nil,
+						Status:    "success",
+					},
+				})
+				result := messages[len(messages)-1].Content[len(messages[len(messages)-1].Content)-1].ToolResult
+
+				toolCtx := ctx
+				var toolMessage *TextRecorderMessage
+				if callRecorder != nil {
+					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolUse.ToolUseID)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					b.callToolWrapper(toolCtx, apiRequest, toolUse, result, callRecorder, toolMessage)
+				}()
+			}
+
+			wg.Wait()
+
+			if stream != nil {
+				for _, content := range messages[len(messages)-1].Content {
+					result := content.ToolResult
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    result.Content[0].Text,
+						ToolUseID:  result.ToolUseID,
+						IsError:    result.Status == "error",
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
+			continue
+		}
+
+		return bedrockText(response, apiRequest)
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", b.MaxExchanges,
+	)
+}
+
+// conversationMessages returns the system prompt and messages provided to Init followed by the conversation.
+// The conversation can start with a system message if no system message was provided to Init.
+func (b *BedrockTextProvider) conversationMessages(conversation []ChatMessage) ([]bedrockSystem, []bedrockMessage, errors.E) {
+	system := b.system
+	if len(conversation) > 0 && conversation[0].Role == roleSystem {
+		if b.system != nil {
+			return nil, nil, errors.WithStack(ErrMultipleSystemMessages)
+		}
+		system = []bedrockSystem{{Text: conversation[0].Content}}
+		conversation = conversation[1:]
+	}
+
+	messages := slices.Clone(b.messages)
+	for _, message := range conversation {
+		if message.Role == roleSystem {
+			return nil, nil, errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", message.Role,
+			)
+		}
+		content, errE := bedrockContents(message)
+		if errE != nil {
+			return nil, nil, errE
+		}
+		messages = append(messages, bedrockMessage{
+			Role:    message.Role,
+			Content: content,
+		})
+	}
+	return system, messages, nil
+}
+
+// bedrockText returns the text of the final response.
+func bedrockText(response *bedrockResponse, apiRequest string) (string, errors.E) {
+	switch response.StopReason {
+	case "end_turn", "stop_sequence":
+	case "guardrail_intervened", "content_filtered":
+		return "", errors.WithDetails(
+			ErrRefused,
+			"refusal", response.StopReason,
+			"apiRequest", apiRequest,
+		)
+	default:
+		return "", errors.WithDetails(
+			ErrUnexpectedStop,
+			"reason", response.StopReason,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	// Model sometimes returns no content when the last message to the agent
+	// was the tool result and that concluded the conversation.
+	if len(response.Output.Message.Content) == 0 {
+		return "", nil
+	}
+
+	var text *string
+	for _, content := range response.Output.Message.Content {
+		if content.ReasoningContent != nil {
+			continue
+		}
+		if content.Text == nil {
+			errE := errors.Errorf("%w: content is not text", ErrUnexpectedMessageType)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+		if text != nil {
+			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+		text = content.Text
+	}
+
+	if text == nil {
+		errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return "", errE
+	}
+
+	return *text, nil
+}
+
+func (b *BedrockTextProvider) newRequest(system []bedrockSystem, messages []bedrockMessage) bedrockRequest {
+	bReq := bedrockRequest{
+		Messages: messages,
+		System:   system,
+		InferenceConfig: bedrockInferenceConfig{
+			MaxTokens:   b.MaxResponseLength,
+			Temperature: &b.Temperature,
+		},
+		ToolConfig:                   nil,
+		AdditionalModelRequestFields: nil,
+	}
+
+	if len(b.tools) > 0 {
+		bReq.ToolConfig = &bedrockToolConfig{
+			Tools: b.tools,
+		}
+	}
+
+	if b.ReasoningBudget > 0 && b.isAnthropic() {
+		// Temperature cannot be set when reasoning is enabled.
+		bReq.InferenceConfig.Temperature = nil
+		bReq.AdditionalModelRequestFields = map[string]any{
+			"thinking": map[string]any{
+				"type":          "enabled",
+				"budget_tokens": b.ReasoningBudget,
+			},
+		}
+	}
+
+	return bReq
+}
+
+func (b *BedrockTextProvider) send(
+	ctx context.Context, system []bedrockSystem, messages []bedrockMessage, stream func(event TextStreamEvent) errors.E,
+) (_ *bedrockResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, b,
+		semconv.GenAIRequestMaxTokens(b.MaxResponseLength),
+		semconv.GenAIRequestTemperature(b.Temperature),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(b)
+
+	request, errE := x.MarshalWithoutEscapeHTML(b.newRequest(system, messages))
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := b.estimatedTokens(system, messages)
+
+	reservation, errE := reserveBudget(ctx, b, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	// Model IDs can contain colons and slashes (e.g., ARNs of inference profiles).
+	path := "/model/" + awsURIEncode(b.Model) + "/converse"
+	if stream != nil {
+		path += "-stream"
+	}
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		apiURL(b.BaseURL, "https://bedrock-runtime."+b.Region+".amazonaws.com", path),
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if stream != nil {
+		req.Header.Add("Accept", "application/vnd.amazon.eventstream")
+	} else {
+		req.Header.Add("Accept", "application/json")
+	}
+	payloadHash := hashSHA256(request)
+	req.Header.Add("X-Amz-Content-Sha256", payloadHash)
+	setHeaders(req, b.Headers)
+	// Rate limit the initial request.
+	errE = bedrockRateLimiter.Take(ctx, b.rateLimiterKey, map[string]int{
+		"rpm": 1,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	signAWSRequest(req, payloadHash, b.credentials, b.Region, bedrockService, time.Now())
+	start := time.Now()
+	resp, err := b.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("X-Amzn-Requestid")
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if apiRequest == "" {
+		errE = errors.WithStack(ErrMissingRequestID)
+		errors.Details(errE)["code"] = resp.StatusCode
+		return nil, "", 0, errE
+	}
+
+	span.SetAttributes(apiRequestKey.String(apiRequest))
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apiRequest, 0, bedrockResponseError(resp.StatusCode, resp.Header.Get("X-Amzn-Errortype"), body, apiRequest)
+	}
+
+	var response bedrockResponse
+	if stream != nil && resp.Header.Get("Content-Type") == "application/vnd.amazon.eventstream" {
+		errE = decodeBedrockStream(resp.Body, apiRequest, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, apiRequest, 0, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	usedTokens := newUsedTokens(
+		b.MaxContextLength,
+		b.MaxResponseLength,
+		response.Usage.InputTokens,
+		response.Usage.OutputTokens,
+		response.Usage.CacheWriteInputTokens,
+		response.Usage.CacheReadInputTokens,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	span.SetAttributes(
+		semconv.GenAIResponseID(apiRequest),
+		semconv.GenAIResponseModel(b.Model),
+		semconv.GenAIResponseFinishReasons(response.StopReason),
+		semconv.GenAIUsageInputTokens(response.Usage.InputTokens),
+		semconv.GenAIUsageOutputTokens(response.Usage.OutputTokens),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+// bedrockResponseError returns an error for an error response or an exception in the stream.
+// AWS APIs report the type of the error separately from the body.
+func bedrockResponseError(statusCode int, errorType string, body []byte, apiRequest string) errors.E {
+	errorType, _, _ = strings.Cut(errorType, ":")
+	errE := errors.WithDetails(
+		ErrAPIResponseError,
+		"type", errorType,
+		"apiRequest", apiRequest,
+	)
+	if statusCode != 0 {
+		errors.Details(errE)["code"] = statusCode
+	}
+	var e bedrockError
+	if x.Unmarshal(body, &e) == nil && e.Message != "" {
+		errors.Details(errE)["body"] = e.Message
+	} else {
+		errors.Details(errE)["body"] = string(body)
+	}
+	return errE
+}
+
+// decodeBedrockStream decodes event stream messages into the response, calling stream for every delta.
+//
+// See: https://docs.aws.amazon.com/bedrock/latest/APIReference/API_runtime_ConverseStream.html
+func decodeBedrockStream( //nolint:maintidx
+	body io.Reader, apiRequest string, response *bedrockResponse, stream func(event TextStreamEvent) errors.E,
+) errors.E {
+	response.Output.Message.Role = roleAssistant
+	response.Output.Message.Content = []bedrockContent{}
+	texts := map[int]*strings.Builder{}
+	inputs := map[int]*strings.Builder{}
+
+	block := func(index int) (*bedrockContent, errors.E) {
+		if index == len(response.Output.Message.Content) {
+			response.Output.Message.Content = append(response.Output.Message.Content, bedrockContent{}) //nolint:exhaustruct
+		}
+		if index < 0 || index >= len(response.Output.Message.Content) {
+			return nil, errors.WithDetails(
+				ErrUnexpectedMessage,
+				"index", index,
+			)
+		}
+		return &response.Output.Message.Content[index], nil
+	}
+
+	return decodeAWSEventStream(body, func(headers map[string]string, payload []byte) errors.E {
+		if headers[":message-type"] == "exception" || headers[":message-type"] == "error" {
+			errorType := headers[":exception-type"]
+			if errorType == "" {
+				errorType = headers[":error-code"]
+			}
+			return bedrockResponseError(0, errorType, payload, apiRequest)
+		}
+
+		var event bedrockStreamEvent
+		errE := x.Unmarshal(payload, &event)
+		if errE != nil {
+			return errE
+		}
+
+		switch headers[":event-type"] {
+		case "messageStart":
+			response.Output.Message.Role = event.Role
+		case "contentBlockStart":
+			content, errE := block(event.ContentBlockIndex)
+			if errE != nil {
+				return errE
+			}
+			if event.Start != nil && event.Start.ToolUse != nil {
+				content.ToolUse = event.Start.ToolUse
+				inputs[event.ContentBlockIndex] = new(strings.Builder)
+			}
+		case "contentBlockDelta":
+			content, errE := block(event.ContentBlockIndex)
+			if errE != nil {
+				return errE
+			}
+			if event.Delta == nil {
+				return errors.WithDetails(
+					ErrUnexpectedMessage,
+					"index", event.ContentBlockIndex,
+				)
+			}
+			switch {
+			case event.Delta.Text != nil:
+				if texts[event.ContentBlockIndex] == nil {
+					texts[event.ContentBlockIndex] = new(strings.Builder)
+				}
+				texts[event.ContentBlockIndex].WriteString(*event.Delta.Text)
+				text := texts[event.ContentBlockIndex].String()
+				content.Text = &text
+				return stream(TextStreamEvent{ //nolint:exhaustruct
+					Type:       typeText,
+					Content:    *event.Delta.Text,
+					APIRequest: apiRequest,
+				})
+			case event.Delta.ToolUse != nil:
+				if inputs[event.ContentBlockIndex] == nil {
+					inputs[event.ContentBlockIndex] = new(strings.Builder)
+				}
+				inputs[event.ContentBlockIndex].WriteString(event.Delta.ToolUse.Input)
+			case event.Delta.ReasoningContent != nil:
+				if content.ReasoningContent == nil {
+					content.ReasoningContent = &bedrockReasoningContent{
+						ReasoningText:   nil,
+						RedactedContent: nil,
+					}
+				}
+				if event.Delta.ReasoningContent.RedactedContent != nil {
+					content.ReasoningContent.RedactedContent = append(content.ReasoningContent.RedactedContent, event.Delta.ReasoningContent.RedactedContent...)
+					return nil
+				}
+				if content.ReasoningContent.ReasoningText == nil {
+					content.ReasoningContent.ReasoningText = &bedrockReasoningText{
+						Text:      "",
+						Signature: "",
+					}
+				}
+				content.ReasoningContent.ReasoningText.Signature += event.Delta.ReasoningContent.Signature
+				if event.Delta.ReasoningContent.Text != "" {
+					content.ReasoningContent.ReasoningText.Text += event.Delta.ReasoningContent.Text
+					return stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleThinking,
+						Content:    event.Delta.ReasoningContent.Text,
+						APIRequest: apiRequest,
+					})
+				}
+			}
+		case "contentBlockStop":
+			content, errE := block(event.ContentBlockIndex)
+			if errE != nil {
+				return errE
+			}
+			if content.ToolUse != nil {
+				input := "{}"
+				if inputs[event.ContentBlockIndex] != nil && inputs[event.ContentBlockIndex].Len() > 0 {
+					input = inputs[event.ContentBlockIndex].String()
+				}
+				content.ToolUse.Input = json.RawMessage(input)
+				return stream(TextStreamEvent{ //nolint:exhaustruct
+					Type:        roleToolUse,
+					Content:     input,
+					ToolUseID:   content.ToolUse.ToolUseID,
+					ToolUseName: content.ToolUse.Name,
+					APIRequest:  apiRequest,
+				})
+			}
+		case "messageStop":
+			response.StopReason = event.StopReason
+		case "metadata":
+			if event.Usage != nil {
+				response.Usage = *event.Usage
+			}
+		default:
+			// We ignore unknown events.
+		}
+
+		return nil
+	})
+}
+
+func (b *BedrockTextProvider) estimatedTokens(system []bedrockSystem, messages []bedrockMessage) (int, int) {
+	// We estimate inputTokens from training messages (including system message) by
+	// dividing number of characters by 4.
+	inputTokens := 0
+	for _, message := range messages {
+		for _, content := range message.Content {
+			if content.Text != nil {
+				inputTokens += len(*content.Text) / 4 //nolint:mnd
+			}
+			if content.ToolUse != nil {
+				inputTokens += len(content.ToolUse.Input) / 4 //nolint:mnd
+			}
+			if content.ToolResult != nil {
+				for _, c := range content.ToolResult.Content {
+					inputTokens += len(c.Text) / 4 //nolint:mnd
+				}
+			}
+			if content.ReasoningContent != nil && content.ReasoningContent.ReasoningText != nil {
+				inputTokens += len(content.ReasoningContent.ReasoningText.Text) / 4 //nolint:mnd
+			}
+			if content.Image != nil || content.Document != nil {
+				inputTokens += estimatedPartTokens
+			}
+		}
+	}
+	for _, s := range system {
+		inputTokens += len(s.Text) / 4 //nolint:mnd
+	}
+	for _, tool := range b.tools {
+		inputTokens += len(tool.ToolSpec.Name) / 4             //nolint:mnd
+		inputTokens += len(tool.ToolSpec.Description) / 4      //nolint:mnd
+		inputTokens += len(tool.ToolSpec.InputSchema.JSON) / 4 //nolint:mnd
+	}
+	// TODO: Can we provide a better estimate for output tokens?
+	return inputTokens, b.MaxResponseLength
+}
+
+// InitTools implements [WithTools] interface.
+func (b *BedrockTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if b.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	b.tools = []bedrockTool{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		b.tools = append(b.tools, bedrockTool{
+			ToolSpec: bedrockToolSpec{
+				Name:        name,
+				Description: tool.GetDescription(),
+				InputSchema: bedrockInputSchema{
+					JSON: tool.GetInputJSONSchema(),
+				},
+			},
+			tool: tool,
+		})
+	}
+
+	return nil
+}
+
+func (b *BedrockTextProvider) callToolWrapper(
+	ctx context.Context, apiRequest string, toolUse *bedrockToolUse, result *bedrockToolResult, callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+) {
+	if callRecorder != nil {
+		defer func() {
+			callRecorder.notify("", nil)
+		}()
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolUse.Name).Inc()
+
+			content := fmt.Sprintf("Error: %s", err)
+			result.Content = []bedrockToolResultContent{{Text: content}}
+			result.Status = "error"
+
+			toolMessage.setContent(content, true)
+		}
+	}()
+
+	defer func() {
+		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
+	}()
+
+	logger := zerolog.Ctx(ctx).With().Str("tool", toolUse.ToolUseID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startToolSpan(ctx, toolUse.Name, toolUse.ToolUseID)
+	defer span.End()
+
+	output, duration, errE := b.callTool(ctx, toolUse)
+	setSpanError(span, errE)
+	metrics.toolCall(toolUse.Name, duration, errE)
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolUse.Name).Str("apiRequest", apiRequest).
+			Str("tool", toolUse.ToolUseID).RawJSON("input", toolUse.Input).Msg("tool error")
+		content := "Error: " + errE.Error()
+		result.Content = []bedrockToolResultContent{{Text: content}}
+		result.Status = "error"
+
+		toolMessage.setContent(content, true)
+	} else {
+		result.Content = []bedrockToolResultContent{{Text: output}}
+
+		toolMessage.setContent(output, false)
+	}
+
+	toolMessage.setToolDuration(duration)
+}
+
+func (b *BedrockTextProvider) callTool(ctx context.Context, toolUse *bedrockToolUse) (string, Duration, errors.E) {
+	var tool TextTooler
+	for _, t := range b.tools {
+		if t.ToolSpec.Name == toolUse.Name {
+			tool = t.tool
+			break
+		}
+	}
+	if tool == nil {
+		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolUse.Name)
+	}
+
+	start := time.Now()
+	output, errE := tool.Call(ctx, toolUse.Input)
+	duration := time.Since(start)
+	return output, Duration(duration), errE
+}
+
+// bedrockDocumentFormats maps MIME types to document formats supported by Converse API.
+//
+//nolint:gochecknoglobals
+var bedrockDocumentFormats = map[string]string{
+	"application/pdf":    "pdf",
+	"text/csv":           "csv",
+	"application/msword": "doc",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "docx",
+	"application/vnd.ms-excel": "xls",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "xlsx",
+	"text/html":     "html",
+	"text/plain":    "txt",
+	"text/markdown": "md",
+}
+
+// bedrockContents converts message content to Converse API content blocks.
+//
+// See: https://docs.aws.amazon.com/bedrock/latest/APIReference/API_runtime_ContentBlock.html
+func bedrockContents(message ChatMessage) ([]bedrockContent, errors.E) {
+	contents := []bedrockContent{}
+	for _, part := range message.parts() {
+		mediaType, _, _ := mime.ParseMediaType(part.MIMEType)
+		switch {
+		case part.Type == typeText:
+			text := part.Text
+			contents = append(contents, bedrockContent{ //nolint:exhaustruct
+				Text: &text,
+			})
+		case part.Type == typeImage && strings.HasPrefix(mediaType, "image/"):
+			contents = append(contents, bedrockContent{ //nolint:exhaustruct
+				Image: &bedrockImage{
+					Format:   strings.TrimPrefix(mediaType, "image/"),
+					Source:   bedrockSource{Bytes: part.Data},
+					mimeType: part.MIMEType,
+				},
+			})
+		case part.Type == typeDocument && bedrockDocumentFormats[mediaType] != "":
+			contents = append(contents, bedrockContent{ //nolint:exhaustruct
+				Document: &bedrockDocument{
+					Format: bedrockDocumentFormats[mediaType],
+					// Documents have to be named and names have to be unique.
+					Name:     "Document " + identifier.New().String(),
+					Source:   bedrockSource{Bytes: part.Data},
+					mimeType: part.MIMEType,
+				},
+			})
+		default:
+			return nil, errors.WithDetails(
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+	return contents, nil
+}
+
+func (b *BedrockTextProvider) recordMessage(recorder *TextRecorderCall, message bedrockMessage) errors.E {
+	for _, content := range message.Content {
+		switch {
+		case content.ToolResult != nil:
+			return errors.New("recording tool result message should not happen")
+		case content.Text != nil:
+			recorder.addMessage(message.Role, *content.Text, "", "", false)
+		case content.Image != nil:
+			recorder.addPart(message.Role, ChatContentPart{
+				Type:     typeImage,
+				Text:     "",
+				MIMEType: content.Image.mimeType,
+				Data:     content.Image.Source.Bytes,
+			})
+		case content.Document != nil:
+			recorder.addPart(message.Role, ChatContentPart{
+				Type:     typeDocument,
+				Text:     "",
+				MIMEType: content.Document.mimeType,
+				Data:     content.Document.Source.Bytes,
+			})
+		case content.ToolUse != nil:
+			recorder.addMessage(roleToolUse, string(content.ToolUse.Input), content.ToolUse.ToolUseID, content.ToolUse.Name, false)
+		case content.ReasoningContent != nil && content.ReasoningContent.ReasoningText != nil:
+			recorder.addMessage(roleThinking, content.ReasoningContent.ReasoningText.Text, "", "", false)
+		case content.ReasoningContent != nil:
+			recorder.addMessage(roleRedactedThinking, "", "", "", false)
+		default:
+			return errors.WithStack(ErrUnexpectedMessageType)
+		}
+	}
+	return nil
+}
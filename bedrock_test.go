@@ -0,0 +1,287 @@
+package fun_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+func TestBedrockTextProvider(t *testing.T) {
+	t.Parallel()
+
+	for _, stream := range []bool{false, true} {
+		name := "call"
+		if stream {
+			name = "stream"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := emulator.NewBedrock(
+				emulator.Response{ //nolint:exhaustruct
+					Check: func(req emulator.Request) error {
+						var request struct {
+							System []struct {
+								Text string `json:"text"`
+							} `json:"system"`
+							Messages []struct {
+								Role string `json:"role"`
+							} `json:"messages"`
+							InferenceConfig              map[string]any `json:"inferenceConfig"`
+							AdditionalModelRequestFields map[string]any `json:"additionalModelRequestFields"`
+						}
+						errE := x.Unmarshal(req.Body, &request)
+						if errE != nil {
+							return errE
+						}
+						authorization := req.Header.Get("Authorization")
+						assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/"), authorization)
+						assert.Contains(t, authorization, "/us-west-2/bedrock/aws4_request, SignedHeaders=")
+						assert.Contains(t, authorization, "host;x-amz-content-sha256;x-amz-date;x-amz-security-token")
+						assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+						assert.NotEmpty(t, req.Header.Get("X-Amz-Date"))
+						if stream {
+							assert.Equal(t, "/model/us.anthropic.claude-3-7-sonnet-20250219-v1:0/converse-stream", req.Path)
+						} else {
+							assert.Equal(t, "/model/us.anthropic.claude-3-7-sonnet-20250219-v1:0/converse", req.Path)
+						}
+						require.Len(t, request.System, 1)
+						assert.Equal(t, "Repeat the input.", request.System[0].Text)
+						// One example and the input.
+						roles := []string{}
+						for _, message := range request.Messages {
+							roles = append(roles, message.Role)
+						}
+						assert.Equal(t, []string{"user", "assistant", "user"}, roles)
+						assert.Equal(t, map[string]any{"maxTokens": float64(64_000)}, request.InferenceConfig)
+						assert.Equal(t, map[string]any{"thinking": map[string]any{"type": "enabled", "budget_tokens": float64(1024)}}, request.AdditionalModelRequestFields)
+						return nil
+					},
+					Content:        "foo",
+					Thinking:       "The input is foo.",
+					PromptTokens:   100,
+					ResponseTokens: 10,
+					ThinkingTokens: 50,
+					CachedTokens:   80,
+				},
+				emulator.Response{StatusCode: http.StatusBadRequest}, //nolint:exhaustruct
+			)
+			defer server.Close()
+
+			f := fun.Text[string, string]{
+				Provider: &fun.BedrockTextProvider{ //nolint:exhaustruct
+					AccessKeyID:     "AKID",
+					SecretAccessKey: "secret",
+					SessionToken:    "token",
+					Region:          "us-west-2",
+					BaseURL:         server.URL,
+					Model:           "us.anthropic.claude-3-7-sonnet-20250219-v1:0",
+					ReasoningBudget: 1024,
+				},
+				InputJSONSchema:  nil,
+				OutputJSONSchema: nil,
+				Prompt:           "Repeat the input.",
+				PromptTemplate:   "",
+				InputTemplate:    "",
+				Data: []fun.InputOutput[string, string]{
+					{Input: []string{"bar"}, Output: "bar"},
+				},
+				Tools:             nil,
+				MaxRepairAttempts: 0,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			var output string
+			if stream {
+				events := []string{}
+				output, errE = f.Stream(ct, func(event fun.TextStreamEvent) errors.E {
+					events = append(events, event.Type)
+					return nil
+				}, "foo")
+				assert.Equal(t, []string{"thinking", "text", "usage"}, events)
+			} else {
+				output, errE = f.Call(ct, "foo")
+			}
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "foo", output)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			require.Len(t, calls, 1)
+
+			assert.Equal(t, 200_000, calls[0].Provider.(*fun.BedrockTextProvider).MaxContextLength) //nolint:forcetypeassert,errcheck
+
+			roles := []string{}
+			for i := range calls[0].Messages {
+				roles = append(roles, calls[0].Messages[i].Role)
+			}
+			assert.Equal(t, []string{"system", "user", "assistant", "user", "thinking", "assistant"}, roles)
+
+			require.Len(t, calls[0].UsedTokens, 1)
+			for _, usedTokens := range calls[0].UsedTokens {
+				// Cached tokens are not included in prompt tokens.
+				assert.Equal(t, 100, usedTokens.Prompt)
+				assert.Equal(t, 60, usedTokens.Response)
+				assert.Equal(t, 160, usedTokens.Total)
+				assert.Equal(t, 80, *usedTokens.CacheReadInputTokens)
+			}
+
+			_, errE = f.Call(ctx, "foo")
+			assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+			assert.Equal(t, http.StatusBadRequest, errors.Details(errE)["code"])
+			assert.Equal(t, "ValidationException", errors.Details(errE)["type"])
+
+			assert.Equal(t, 0, server.Remaining())
+		})
+	}
+}
+
+func TestBedrockTextProviderRetrySigning(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	dates := []string{}
+	authorizations := []string{}
+	record := func(req emulator.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		dates = append(dates, req.Header.Get("X-Amz-Date"))
+		authorizations = append(authorizations, req.Header.Get("Authorization"))
+	}
+
+	server := emulator.NewBedrock(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				record(req)
+				// X-Amz-Date has a precision of one second, so we make sure
+				// that the retry is signed in a later second.
+				time.Sleep(time.Second)
+				return nil
+			},
+			StatusCode: http.StatusInternalServerError,
+		},
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				record(req)
+				return nil
+			},
+			Content:        "foo",
+			PromptTokens:   10,
+			ResponseTokens: 1,
+		},
+	)
+	defer server.Close()
+
+	provider := &fun.BedrockTextProvider{ //nolint:exhaustruct
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Region:          "us-west-2",
+		BaseURL:         server.URL,
+		Model:           "meta.llama3-1-8b-instruct-v1:0",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, []fun.ChatMessage{{Role: "system", Content: "Repeat the input."}}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+
+	assert.Equal(t, 0, server.Remaining())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, dates, 2)
+	require.Len(t, authorizations, 2)
+	// The retry is signed again, with a new date and signature.
+	assert.NotEqual(t, dates[0], dates[1])
+	assert.NotEqual(t, authorizations[0], authorizations[1])
+	for _, authorization := range authorizations {
+		assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/"), authorization)
+		assert.Contains(t, authorization, "/us-west-2/bedrock/aws4_request, SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, Signature=")
+	}
+}
+
+func TestBedrockTextProviderProfile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	credentialsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(configFile, []byte("[default]\nregion = us-east-1\n\n[profile test]\nregion = eu-central-1\n"), 0o600))
+	require.NoError(t, os.WriteFile(credentialsFile, []byte("[test]\naws_access_key_id = AKIDPROFILE\naws_secret_access_key = secret\n"), 0o600))
+
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	// These are ignored because the profile is set explicitly.
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	server := emulator.NewBedrock(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				authorization := req.Header.Get("Authorization")
+				assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDPROFILE/"), authorization)
+				assert.Contains(t, authorization, "/eu-central-1/bedrock/aws4_request")
+				assert.Empty(t, req.Header.Get("X-Amz-Security-Token"))
+				return nil
+			},
+			Content:        "foo",
+			PromptTokens:   10,
+			ResponseTokens: 1,
+		},
+	)
+	defer server.Close()
+
+	provider := &fun.BedrockTextProvider{ //nolint:exhaustruct
+		Profile: "test",
+		BaseURL: server.URL,
+		Model:   "meta.llama3-1-8b-instruct-v1:0",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, []fun.ChatMessage{{Role: "system", Content: "Repeat the input."}}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	assert.Equal(t, "eu-central-1", provider.Region)
+	assert.Equal(t, 128_000, provider.MaxContextLength)
+	assert.Equal(t, 2048, provider.MaxResponseLength)
+
+	output, errE := provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+
+	assert.Equal(t, 0, server.Remaining())
+
+	// Without credentials Init fails.
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "missing"))
+	provider = &fun.BedrockTextProvider{ //nolint:exhaustruct
+		Profile: "test",
+		BaseURL: server.URL,
+		Model:   "meta.llama3-1-8b-instruct-v1:0",
+	}
+	errE = provider.Init(ctx, nil)
+	assert.EqualError(t, errE, "AWS credentials are missing")
+}
@@ -0,0 +1,231 @@
+package fun
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+type budgetContextKey struct{}
+
+// Budget limits the number of tokens used and their cost
+// for all API requests made with the context.
+//
+// Before each API request the estimated number of tokens (and their cost)
+// is reserved from the budget and after the response is received
+// the reservation is replaced with the actual usage. If the reservation
+// would exceed the budget, the request fails with [ErrBudgetExceeded].
+// Requests made through batch APIs (see [WithBatch]) are counted when
+// their results are retrieved, at the batch price, and are not limited.
+//
+// Budget is safe for concurrent use.
+type Budget struct {
+	mu sync.Mutex
+
+	maxTokens int
+	maxCost   float64
+
+	usedTokens     int
+	usedCost       float64
+	reservedTokens int
+	reservedCost   float64
+
+	parent *Budget
+}
+
+// WithBudget returns a copy of the context with a budget of maxTokens tokens
+// and maxCost USD. If maxTokens or maxCost is zero, that limit is not enforced.
+//
+// If the context already has a budget, the new budget is nested inside it:
+// API requests are counted against both budgets.
+//
+// Cost is computed using model prices (see [SetModelPrice]). Tokens of models
+// without a known price do not count against maxCost.
+func WithBudget(ctx context.Context, maxTokens int, maxCost float64) context.Context {
+	return context.WithValue(ctx, budgetContextKey{}, &Budget{
+		mu:             sync.Mutex{},
+		maxTokens:      maxTokens,
+		maxCost:        maxCost,
+		usedTokens:     0,
+		usedCost:       0,
+		reservedTokens: 0,
+		reservedCost:   0,
+		parent:         GetBudget(ctx),
+	})
+}
+
+// GetBudget returns the budget from the context, if any.
+func GetBudget(ctx context.Context) *Budget {
+	b, _ := ctx.Value(budgetContextKey{}).(*Budget)
+	return b
+}
+
+// UsedTokens returns the number of tokens used so far.
+func (b *Budget) UsedTokens() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.usedTokens
+}
+
+// UsedCost returns the cost (in USD) of tokens used so far.
+func (b *Budget) UsedCost() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.usedCost
+}
+
+// ancestors returns the budget and all budgets it is nested inside.
+func (b *Budget) ancestors() []*Budget {
+	budgets := []*Budget{}
+	for ; b != nil; b = b.parent {
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// budgetReservation is a reservation of estimated tokens and their
+// cost from all budgets in the context, made before an API request.
+type budgetReservation struct {
+	budgets             []*Budget
+	price               *ModelPrice
+	promptIncludesCache bool
+	tokens              int
+	cost                float64
+	done                bool
+}
+
+// reserveBudget reserves estimated tokens and their cost from budgets in the context.
+// It returns nil reservation if there is no budget in the context.
+func reserveBudget(ctx context.Context, provider any, estimatedInputTokens, estimatedOutputTokens int) (*budgetReservation, errors.E) {
+	budget := GetBudget(ctx)
+	if budget == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	price, promptIncludesCache := providerPrice(provider, false)
+	tokens := estimatedInputTokens + estimatedOutputTokens
+	cost := 0.0
+	if price != nil {
+		cost = price.cost(TextRecorderUsedTokens{ //nolint:exhaustruct
+			Prompt:   estimatedInputTokens,
+			Response: estimatedOutputTokens,
+		}, promptIncludesCache)
+	}
+
+	budgets := budget.ancestors()
+	// We always lock budgets in the same order (from the innermost out)
+	// and all of them at once, so that the check and the reservation are atomic.
+	for _, b := range budgets {
+		b.mu.Lock()
+	}
+	defer func() {
+		for _, b := range budgets {
+			b.mu.Unlock()
+		}
+	}()
+
+	for _, b := range budgets {
+		if b.maxTokens > 0 && b.usedTokens+b.reservedTokens+tokens > b.maxTokens {
+			return nil, errors.WithDetails(
+				ErrBudgetExceeded,
+				"maxTokens", b.maxTokens,
+				"usedTokens", b.usedTokens,
+				"reservedTokens", b.reservedTokens,
+				"estimatedTokens", tokens,
+			)
+		}
+		if b.maxCost > 0 && b.usedCost+b.reservedCost+cost > b.maxCost {
+			return nil, errors.WithDetails(
+				ErrBudgetExceeded,
+				"maxCost", b.maxCost,
+				"usedCost", b.usedCost,
+				"reservedCost", b.reservedCost,
+				"estimatedCost", cost,
+			)
+		}
+	}
+
+	for _, b := range budgets {
+		b.reservedTokens += tokens
+		b.reservedCost += cost
+	}
+
+	return &budgetReservation{
+		budgets:             budgets,
+		price:               price,
+		promptIncludesCache: promptIncludesCache,
+		tokens:              tokens,
+		cost:                cost,
+		done:                false,
+	}, nil
+}
+
+// settle replaces the reservation with actual used tokens and their cost.
+func (r *budgetReservation) settle(usedTokens *TextRecorderUsedTokens) {
+	if r == nil || r.done {
+		return
+	}
+	r.done = true
+
+	tokens := usedTokens.Total
+	if !r.promptIncludesCache {
+		if usedTokens.CacheCreationInputTokens != nil {
+			tokens += *usedTokens.CacheCreationInputTokens
+		}
+		if usedTokens.CacheReadInputTokens != nil {
+			tokens += *usedTokens.CacheReadInputTokens
+		}
+	}
+	cost := 0.0
+	if r.price != nil {
+		cost = r.price.cost(*usedTokens, r.promptIncludesCache)
+	}
+
+	for _, b := range r.budgets {
+		b.mu.Lock()
+		b.reservedTokens -= r.tokens
+		b.reservedCost -= r.cost
+		b.usedTokens += tokens
+		b.usedCost += cost
+		b.mu.Unlock()
+	}
+}
+
+// chargeBudget counts used tokens and their cost against budgets in the context
+// without a prior reservation. It is used for requests made through batch APIs,
+// which are counted when their results are retrieved.
+func chargeBudget(ctx context.Context, provider any, batch bool, usedTokens *TextRecorderUsedTokens) {
+	budget := GetBudget(ctx)
+	if budget == nil {
+		return
+	}
+
+	price, promptIncludesCache := providerPrice(provider, batch)
+	r := &budgetReservation{
+		budgets:             budget.ancestors(),
+		price:               price,
+		promptIncludesCache: promptIncludesCache,
+		tokens:              0,
+		cost:                0,
+		done:                false,
+	}
+	r.settle(usedTokens)
+}
+
+// release releases the reservation if it has not been settled.
+func (r *budgetReservation) release() {
+	if r == nil || r.done {
+		return
+	}
+	r.done = true
+
+	for _, b := range r.budgets {
+		b.mu.Lock()
+		b.reservedTokens -= r.tokens
+		b.reservedCost -= r.cost
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,121 @@
+package fun_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func newBudgetText(t *testing.T) (context.Context, *fun.Text[string, string]) {
+	t.Helper()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"foo"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":1000,"completion_tokens":100,"total_tokens":1100}}`))
+	})
+
+	f := &fun.Text[string, string]{
+		Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+			Client: newTestClient(t, mux),
+			APIKey: "test",
+			Model:  "gpt-4o-mini-2024-07-18",
+		},
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  nil,
+		Prompt:            "Repeat the input.",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              nil,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	return ctx, f
+}
+
+func TestBudgetTokens(t *testing.T) {
+	t.Parallel()
+
+	ctx, f := newBudgetText(t)
+
+	ctx = fun.WithBudget(ctx, 3000, 0)
+	nested := fun.WithBudget(ctx, 1000, 0)
+
+	_, errE := f.Call(nested, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, errE = f.Call(nested, "foo")
+	assert.ErrorIs(t, errE, fun.ErrBudgetExceeded)
+
+	assert.Equal(t, 1100, fun.GetBudget(nested).UsedTokens())
+	assert.Equal(t, 1100, fun.GetBudget(ctx).UsedTokens())
+
+	// The budget is checked before each request using the estimated number
+	// of tokens, so the last request can go over the budget.
+	for range 2 {
+		_, errE = f.Call(ctx, "foo")
+		require.NoError(t, errE, "% -+#.1v", errE)
+	}
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrBudgetExceeded)
+
+	assert.Equal(t, 3300, fun.GetBudget(ctx).UsedTokens())
+	// (1000 * 0.15 + 100 * 0.6) / 1,000,000 per call.
+	assert.InDelta(t, 3*0.00021, fun.GetBudget(ctx).UsedCost(), 1e-12)
+}
+
+func TestBudgetCost(t *testing.T) {
+	t.Parallel()
+
+	ctx, f := newBudgetText(t)
+
+	ctx = fun.WithBudget(ctx, 0, 0.0004)
+
+	for range 2 {
+		_, errE := f.Call(ctx, "foo")
+		require.NoError(t, errE, "% -+#.1v", errE)
+	}
+
+	_, errE := f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrBudgetExceeded)
+
+	assert.InDelta(t, 2*0.00021, fun.GetBudget(ctx).UsedCost(), 1e-12)
+}
+
+func TestBudgetParallel(t *testing.T) {
+	t.Parallel()
+
+	ctx, f := newBudgetText(t)
+
+	ctx = fun.WithBudget(ctx, 0, 0)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errE := f.Call(ctx, "foo")
+			assert.NoError(t, errE, "% -+#.1v", errE)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 11000, fun.GetBudget(ctx).UsedTokens())
+}
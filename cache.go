@@ -0,0 +1,434 @@
+package fun
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+)
+
+var (
+	_ Callee[any, any] = (*Cached[any, any])(nil)
+	_ CacheStore       = (*MemoryCacheStore)(nil)
+	_ CacheStore       = (*DirectoryCacheStore)(nil)
+)
+
+// CacheStore is a store used by [Cached] to store outputs.
+//
+// Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the value stored under the key. It returns false
+	// if there is no value under the key or if the value has expired.
+	Get(ctx context.Context, key string) ([]byte, bool, errors.E)
+
+	// Set stores the value under the key. The value expires after ttl.
+	// If ttl is zero, the value does not expire.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) errors.E
+
+	// Delete removes the value stored under the key, if any.
+	Delete(ctx context.Context, key string) errors.E
+
+	// Clear removes all stored values.
+	Clear(ctx context.Context) errors.E
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCacheStore implements [CacheStore] interface by storing
+// values in memory. When there are more than MaxEntries values,
+// least recently used values are removed.
+type MemoryCacheStore struct {
+	// MaxEntries is the maximum number of values stored.
+	// If zero, the number of values is not limited.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func (m *MemoryCacheStore) init() {
+	if m.entries == nil {
+		m.entries = map[string]*list.Element{}
+		m.order = list.New()
+	}
+}
+
+func (m *MemoryCacheStore) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.entries, element.Value.(*memoryCacheEntry).key) //nolint:forcetypeassert,errcheck
+}
+
+// Get implements [CacheStore] interface.
+func (m *MemoryCacheStore) Get(_ context.Context, key string) ([]byte, bool, errors.E) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryCacheEntry) //nolint:forcetypeassert,errcheck
+	if !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		m.remove(element)
+		return nil, false, nil
+	}
+	m.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+// Set implements [CacheStore] interface.
+func (m *MemoryCacheStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) errors.E {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+	m.entries[key] = m.order.PushFront(&memoryCacheEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	for m.MaxEntries > 0 && m.order.Len() > m.MaxEntries {
+		m.remove(m.order.Back())
+	}
+
+	return nil
+}
+
+// Delete implements [CacheStore] interface.
+func (m *MemoryCacheStore) Delete(_ context.Context, key string) errors.E {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+	return nil
+}
+
+// Clear implements [CacheStore] interface.
+func (m *MemoryCacheStore) Clear(_ context.Context) errors.E {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = nil
+	m.order = nil
+	return nil
+}
+
+type directoryCacheEntry struct {
+	Expires *time.Time `json:"expires,omitempty"`
+	Value   []byte     `json:"value"`
+}
+
+// DirectoryCacheStore implements [CacheStore] interface by storing
+// each value in a file in a directory on disk.
+type DirectoryCacheStore struct {
+	// Path to the directory. It is created if it does not exist.
+	Path string
+}
+
+func (d *DirectoryCacheStore) path(key string) (string, errors.E) {
+	if key == "" || filepath.Base(key) != key {
+		return "", errors.WithDetails(
+			errors.New("invalid key"),
+			"key", key,
+		)
+	}
+	return filepath.Join(d.Path, key+".json"), nil
+}
+
+// Get implements [CacheStore] interface.
+func (d *DirectoryCacheStore) Get(_ context.Context, key string) ([]byte, bool, errors.E) {
+	path, errE := d.path(key)
+	if errE != nil {
+		return nil, false, errE
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.WithDetails(err, "path", path)
+	}
+
+	var entry directoryCacheEntry
+	errE = x.Unmarshal(data, &entry)
+	if errE != nil {
+		errors.Details(errE)["path"] = path
+		return nil, false, errE
+	}
+
+	if entry.Expires != nil && !time.Now().Before(*entry.Expires) {
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, false, errors.WithDetails(err, "path", path)
+		}
+		return nil, false, nil
+	}
+
+	return entry.Value, true, nil
+}
+
+// Set implements [CacheStore] interface.
+func (d *DirectoryCacheStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) errors.E {
+	path, errE := d.path(key)
+	if errE != nil {
+		return errE
+	}
+
+	entry := directoryCacheEntry{
+		Expires: nil,
+		Value:   value,
+	}
+	if ttl > 0 {
+		entry.Expires = ptr(time.Now().Add(ttl))
+	}
+
+	data, errE := x.MarshalWithoutEscapeHTML(entry)
+	if errE != nil {
+		return errE
+	}
+
+	err := os.MkdirAll(d.Path, 0o755) //nolint:mnd,gosec
+	if err != nil {
+		return errors.WithDetails(err, "path", d.Path)
+	}
+
+	// We write to a temporary file first and then rename it,
+	// so that concurrent readers never observe a partially written file.
+	f, err := os.CreateTemp(d.Path, key+".*.tmp")
+	if err != nil {
+		return errors.WithDetails(err, "path", d.Path)
+	}
+	_, err = f.Write(data)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithDetails(err, "path", path)
+	}
+
+	return nil
+}
+
+// Delete implements [CacheStore] interface.
+func (d *DirectoryCacheStore) Delete(_ context.Context, key string) errors.E {
+	path, errE := d.path(key)
+	if errE != nil {
+		return errE
+	}
+
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.WithDetails(err, "path", path)
+	}
+	return nil
+}
+
+// Clear implements [CacheStore] interface.
+func (d *DirectoryCacheStore) Clear(_ context.Context) errors.E {
+	paths, err := filepath.Glob(filepath.Join(d.Path, "*.json"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.WithDetails(err, "path", path)
+		}
+	}
+	return nil
+}
+
+// cacheable is implemented by callees which can provide their
+// configuration to be included in cache keys.
+type cacheable interface {
+	cacheConfig() (TextProvider, any)
+}
+
+// Cached implements [Callee] interface by wrapping another callee
+// and caching its outputs in a [CacheStore].
+//
+// Outputs are cached under a key which is a hash of inputs, Key, template
+// variables (see [WithTemplateVars]), and, for [Text] callees, of the
+// configuration of the callee: the provider (as marshaled to JSON), Prompt,
+// PromptTemplate, InputTemplate, InputJSONSchema, OutputJSONSchema, Data,
+// MaxData, MaxRepairAttempts, and names, descriptions, and input JSON Schemas
+// of Tools. DataScorer is not part of the key. For other callees, use Key to
+// distinguish between callees which share the same store.
+//
+// If the configuration of the callee cannot be marshaled to JSON (e.g., because
+// the provider contains a function), Key is used instead of the configuration.
+// In that case Key has to be provided and it is your responsibility to change it
+// when the configuration changes.
+//
+// Calls which are answered from the cache are recorded in [TextRecorder]
+// with [TextRecorderCall.Cached] set to true and without used tokens.
+type Cached[Input, Output any] struct {
+	// Callee to call when the output is not cached.
+	Callee Callee[Input, Output]
+
+	// Store to store outputs in.
+	Store CacheStore
+
+	// TTL is the duration after which cached outputs expire.
+	// If zero, cached outputs do not expire.
+	TTL time.Duration
+
+	// Key is additional data included in cache keys. It is required
+	// if the configuration of the callee cannot be marshaled to JSON.
+	Key string
+
+	config   json.RawMessage
+	provider TextProvider
+}
+
+// Init implements [Callee] interface.
+func (c *Cached[Input, Output]) Init(ctx context.Context) errors.E {
+	if c.config != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	if c.Store == nil {
+		return errors.New("store is missing")
+	}
+
+	errE := c.Callee.Init(ctx)
+	if errE != nil {
+		return errE
+	}
+
+	var config any
+	if callee, ok := c.Callee.(cacheable); ok {
+		c.provider, config = callee.cacheConfig()
+	}
+	c.config, errE = x.MarshalWithoutEscapeHTML(config)
+	if errE != nil {
+		if c.Key == "" {
+			return errors.Errorf("unable to marshal callee configuration for cache key and Key is missing: %w", errE)
+		}
+		zerolog.Ctx(ctx).Warn().Err(errE).Msg("unable to marshal callee configuration for cache key, using only Key")
+		c.config = json.RawMessage("null")
+	}
+
+	return nil
+}
+
+func (c *Cached[Input, Output]) key(ctx context.Context, input []Input) (string, errors.E) {
+	data, errE := x.MarshalWithoutEscapeHTML(struct {
+		Config json.RawMessage `json:"config"`
+		Key    string          `json:"key"`
+		Input  []Input         `json:"input"`
+		Vars   map[string]any  `json:"vars,omitempty"`
+	}{
+		Config: c.config,
+		Key:    c.Key,
+		Input:  input,
+		Vars:   getTemplateVars(ctx),
+	})
+	if errE != nil {
+		return "", errE
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Call implements [Callee] interface.
+func (c *Cached[Input, Output]) Call(ctx context.Context, input ...Input) (Output, errors.E) { //nolint:ireturn
+	key, errE := c.key(ctx, input)
+	if errE != nil {
+		return *new(Output), errE
+	}
+
+	value, ok, errE := c.Store.Get(ctx, key)
+	if errE != nil {
+		return *new(Output), errE
+	}
+	if ok {
+		var output Output
+		errE = x.Unmarshal(value, &output)
+		if errE == nil {
+			if recorder := GetTextRecorder(ctx); recorder != nil {
+				callRecorder := recorder.newCall(ctx, identifier.New().String(), c.provider)
+				callRecorder.Cached = true
+				callRecorder.addMessage(roleAssistant, string(value), "", "", false)
+				recorder.recordCall(callRecorder)
+			}
+			return output, nil
+		}
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("key", key).Msg("invalid cached output")
+	}
+
+	output, errE := c.Callee.Call(ctx, input...)
+	if errE != nil {
+		return output, errE
+	}
+
+	value, errE = x.MarshalWithoutEscapeHTML(output)
+	if errE == nil {
+		errE = c.Store.Set(ctx, key, value, c.TTL)
+	}
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("key", key).Msg("unable to cache output")
+	}
+
+	return output, nil
+}
+
+// Invalidate removes the cached output for inputs, if any.
+func (c *Cached[Input, Output]) Invalidate(ctx context.Context, input ...Input) errors.E {
+	key, errE := c.key(ctx, input)
+	if errE != nil {
+		return errE
+	}
+	return c.Store.Delete(ctx, key)
+}
+
+// Variadic implements [Callee] interface.
+func (c *Cached[Input, Output]) Variadic() func(ctx context.Context, input ...Input) (Output, errors.E) {
+	return func(ctx context.Context, input ...Input) (Output, errors.E) {
+		return c.Call(ctx, input...)
+	}
+}
+
+// Unary implements [Callee] interface.
+func (c *Cached[Input, Output]) Unary() func(ctx context.Context, input Input) (Output, errors.E) {
+	return func(ctx context.Context, input Input) (Output, errors.E) {
+		return c.Call(ctx, input)
+	}
+}
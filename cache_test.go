@@ -0,0 +1,251 @@
+package fun_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func TestCached(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		Name  string
+		Store func(t *testing.T) fun.CacheStore
+	}{
+		{"memory", func(_ *testing.T) fun.CacheStore { return &fun.MemoryCacheStore{} }}, //nolint:exhaustruct
+		{"directory", func(t *testing.T) fun.CacheStore { return &fun.DirectoryCacheStore{Path: t.TempDir()} }},
+	} {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			calls := 0
+			f := fun.Cached[string, []string]{
+				Callee: &fun.Go[string, []string]{
+					Fun: func(_ context.Context, input ...string) ([]string, errors.E) {
+						calls++
+						return []string{input[0], input[0]}, nil
+					},
+				},
+				Store: tt.Store(t),
+				TTL:   0,
+				Key:   "",
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			output, errE := f.Call(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, []string{"foo", "foo"}, output)
+			assert.Equal(t, 1, calls)
+
+			recorderCtx := fun.WithTextRecorder(ctx)
+			output, errE = f.Unary()(recorderCtx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, []string{"foo", "foo"}, output)
+			assert.Equal(t, 1, calls)
+
+			recorded := fun.GetTextRecorder(recorderCtx).Calls()
+			require.Len(t, recorded, 1)
+			assert.True(t, recorded[0].Cached)
+			assert.Empty(t, recorded[0].UsedTokens)
+
+			output, errE = f.Variadic()(ctx, "bar")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, []string{"bar", "bar"}, output)
+			assert.Equal(t, 2, calls)
+
+			errE = f.Invalidate(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			_, errE = f.Call(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, 3, calls)
+
+			_, errE = f.Call(ctx, "bar")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, 3, calls)
+
+			errE = f.Store.Clear(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			_, errE = f.Call(ctx, "bar")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, 4, calls)
+		})
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		Name  string
+		Store func(t *testing.T) fun.CacheStore
+	}{
+		{"memory", func(_ *testing.T) fun.CacheStore { return &fun.MemoryCacheStore{} }}, //nolint:exhaustruct
+		{"directory", func(t *testing.T) fun.CacheStore { return &fun.DirectoryCacheStore{Path: t.TempDir()} }},
+	} {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := t.Context()
+			store := tt.Store(t)
+
+			_, ok, errE := store.Get(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.False(t, ok)
+
+			errE = store.Set(ctx, "foo", []byte("bar"), 0)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			value, ok, errE := store.Get(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.True(t, ok)
+			assert.Equal(t, []byte("bar"), value)
+
+			errE = store.Set(ctx, "expiring", []byte("bar"), time.Millisecond)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			time.Sleep(10 * time.Millisecond)
+
+			_, ok, errE = store.Get(ctx, "expiring")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.False(t, ok)
+
+			errE = store.Delete(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			_, ok, errE = store.Get(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestMemoryCacheStoreMaxEntries(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	store := &fun.MemoryCacheStore{MaxEntries: 2} //nolint:exhaustruct
+
+	for _, key := range []string{"a", "b"} {
+		errE := store.Set(ctx, key, []byte(key), 0)
+		require.NoError(t, errE, "% -+#.1v", errE)
+	}
+
+	// Makes "a" most recently used.
+	_, ok, errE := store.Get(ctx, "a")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.True(t, ok)
+
+	errE = store.Set(ctx, "c", []byte("c"), 0)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		_, ok, errE := store.Get(ctx, key)
+		require.NoError(t, errE, "% -+#.1v", errE)
+		assert.Equal(t, expected, ok, key)
+	}
+}
+
+type funcDataScorer struct {
+	Fn func(input []string) []float64
+}
+
+func (s *funcDataScorer) Init(_ context.Context, _ []fun.InputOutput[string, string]) errors.E {
+	return nil
+}
+
+func (s *funcDataScorer) Score(_ context.Context, input []string) ([]float64, errors.E) {
+	return s.Fn(input), nil
+}
+
+type funcTextProvider struct {
+	Fn func(message fun.ChatMessage) string
+}
+
+func (p *funcTextProvider) Init(_ context.Context, _ []fun.ChatMessage) errors.E {
+	return nil
+}
+
+func (p *funcTextProvider) Chat(_ context.Context, message fun.ChatMessage) (string, errors.E) {
+	return p.Fn(message), nil
+}
+
+func TestCachedTextConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	// DataScorer is not part of the cache key, so it does not have to be marshalable.
+	f := fun.Cached[string, string]{
+		Callee: &fun.Text[string, string]{ //nolint:exhaustruct
+			Provider: &fun.FakeTextProvider{ //nolint:exhaustruct
+				Responses: []fun.FakeTextResponse{
+					{Content: "bar"}, //nolint:exhaustruct
+				},
+			},
+			Prompt: "Repeat the input.",
+			Data: []fun.InputOutput[string, string]{
+				{Input: []string{"foo"}, Output: "foo"},
+			},
+			MaxData: 1,
+			DataScorer: &funcDataScorer{
+				Fn: func(_ []string) []float64 { return []float64{1} },
+			},
+		},
+		Store: &fun.MemoryCacheStore{}, //nolint:exhaustruct
+		TTL:   0,
+		Key:   "",
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Call(ctx, "bar")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "bar", output)
+
+	output, errE = f.Call(ctx, "bar")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "bar", output)
+
+	// Provider which cannot be marshaled requires Key.
+	newCached := func(key string) *fun.Cached[string, string] {
+		return &fun.Cached[string, string]{
+			Callee: &fun.Text[string, string]{ //nolint:exhaustruct
+				Provider: &funcTextProvider{
+					Fn: func(message fun.ChatMessage) string { return message.Content },
+				},
+				Prompt: "Repeat the input.",
+			},
+			Store: &fun.MemoryCacheStore{}, //nolint:exhaustruct
+			TTL:   0,
+			Key:   key,
+		}
+	}
+
+	g := newCached("")
+	errE = g.Init(ctx)
+	require.Error(t, errE)
+	assert.Contains(t, errE.Error(), "Key is missing")
+
+	g = newCached("func")
+	errE = g.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE = g.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+}
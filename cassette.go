@@ -0,0 +1,349 @@
+package fun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+)
+
+var _ http.RoundTripper = (*Cassette)(nil)
+
+// CassetteMode is the mode in which [Cassette] operates.
+type CassetteMode int
+
+const (
+	// CassetteReplay mode replays previously recorded exchanges without
+	// making any real requests. A request without a matching recorded
+	// exchange fails with [ErrCassetteNoMatch].
+	CassetteReplay CassetteMode = iota
+
+	// CassetteRecord mode makes real requests and records exchanges
+	// into the cassette file, replacing any previously recorded exchanges.
+	CassetteRecord
+)
+
+const cassetteRedacted = "REDACTED"
+
+// Request headers which carry credentials and are never recorded.
+//
+//nolint:gochecknoglobals
+var cassetteRequestHeaders = []string{
+	"Authorization",
+	"Api-Key",
+	"X-Api-Key",
+	"X-Goog-Api-Key",
+	"X-Amz-Security-Token",
+	"Cookie",
+}
+
+// Response headers which carry credentials and are never recorded.
+//
+//nolint:gochecknoglobals
+var cassetteResponseHeaders = []string{
+	"Set-Cookie",
+}
+
+// Query parameters which carry credentials and are never recorded.
+//
+//nolint:gochecknoglobals
+var cassetteQueryParameters = []string{
+	"key",
+	"api-key",
+	"api_key",
+}
+
+type cassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type cassetteResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+type cassetteExchange struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteFile struct {
+	Exchanges []cassetteExchange `json:"exchanges"`
+}
+
+// Cassette implements [http.RoundTripper] interface which records HTTP exchanges
+// into a file and replays them later, without network access.
+//
+// Use it as a transport of the HTTP client passed as Client to any provider.
+// Credentials (authorization headers, API key headers and query parameters,
+// and cookies) are never recorded.
+//
+// When replaying, each request is matched with the first not yet replayed
+// recorded exchange with the same method, URL path and query, and body
+// (JSON bodies are compared semantically). Scheme and host of the URL are
+// ignored so that exchanges recorded against one server can be replayed
+// for another one (e.g., a local Ollama instance).
+//
+// Responses are fully read before they are recorded, so streamed responses
+// are replayed at once.
+type Cassette struct {
+	// Path is the path to the cassette file.
+	Path string
+
+	// Mode is the mode in which the cassette operates.
+	Mode CassetteMode
+
+	// Transport is used to make real requests when recording.
+	// If not provided, [http.DefaultTransport] is used.
+	Transport http.RoundTripper
+
+	mu        sync.Mutex
+	exchanges []cassetteExchange
+	replayed  []bool
+	loaded    bool
+}
+
+// RoundTrip implements [http.RoundTripper] interface.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	switch c.Mode {
+	case CassetteReplay:
+		return c.replay(req, body)
+	case CassetteRecord:
+		return c.record(req, body)
+	default:
+		return nil, errors.Errorf("invalid cassette mode: %d", c.Mode)
+	}
+}
+
+func (c *Cassette) load() errors.E {
+	if c.loaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return errors.WithDetails(err, "path", c.Path)
+	}
+
+	var file cassetteFile
+	errE := x.UnmarshalWithoutUnknownFields(data, &file)
+	if errE != nil {
+		errors.Details(errE)["path"] = c.Path
+		return errE
+	}
+
+	c.exchanges = file.Exchanges
+	c.replayed = make([]bool, len(file.Exchanges))
+	c.loaded = true
+	return nil
+}
+
+func (c *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errE := c.load()
+	if errE != nil {
+		return nil, errE
+	}
+
+	u := cassetteURL(req.URL)
+	b := cassetteBody(body)
+	for i, exchange := range c.exchanges {
+		if c.replayed[i] {
+			continue
+		}
+		if exchange.Request.Method != req.Method || exchange.Request.URL != u || cassetteBody([]byte(exchange.Request.Body)) != b {
+			continue
+		}
+
+		c.replayed[i] = true
+
+		header := exchange.Response.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{ //nolint:exhaustruct
+			Status:        fmt.Sprintf("%d %s", exchange.Response.StatusCode, http.StatusText(exchange.Response.StatusCode)),
+			StatusCode:    exchange.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader([]byte(exchange.Response.Body))),
+			ContentLength: int64(len(exchange.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, errors.WithDetails(
+		ErrCassetteNoMatch,
+		"path", c.Path,
+		"method", req.Method,
+		"url", u,
+	)
+}
+
+func (c *Cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// A RoundTripper must not modify the request, so we make a copy.
+	r := req.Clone(req.Context())
+	if req.Body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := transport.RoundTrip(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	requestHeader := req.Header.Clone()
+	for _, h := range cassetteRequestHeaders {
+		requestHeader.Del(h)
+	}
+	responseHeader := resp.Header.Clone()
+	for _, h := range cassetteResponseHeaders {
+		responseHeader.Del(h)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// We start with an empty cassette, replacing any previously recorded exchanges.
+	c.loaded = true
+	c.exchanges = append(c.exchanges, cassetteExchange{
+		Request: cassetteRequest{
+			Method: req.Method,
+			URL:    cassetteURL(req.URL),
+			Header: requestHeader,
+			Body:   string(body),
+		},
+		Response: cassetteResponse{
+			StatusCode: resp.StatusCode,
+			Header:     responseHeader,
+			Body:       string(respBody),
+		},
+	})
+
+	errE := c.save()
+	if errE != nil {
+		return nil, errE
+	}
+
+	return resp, nil
+}
+
+func (c *Cassette) save() errors.E {
+	data, errE := x.MarshalWithoutEscapeHTML(cassetteFile{
+		Exchanges: c.exchanges,
+	})
+	if errE != nil {
+		return errE
+	}
+	var out bytes.Buffer
+	err := json.Indent(&out, data, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	out.WriteString("\n")
+
+	dir := filepath.Dir(c.Path)
+	err = os.MkdirAll(dir, 0o755) //nolint:mnd,gosec
+	if err != nil {
+		return errors.WithDetails(err, "path", dir)
+	}
+
+	// We write to a temporary file first and then rename it,
+	// so that the cassette file is never partially written.
+	f, err := os.CreateTemp(dir, filepath.Base(c.Path)+".*.tmp")
+	if err != nil {
+		return errors.WithDetails(err, "path", dir)
+	}
+	_, err = f.Write(out.Bytes())
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644) //nolint:mnd,gosec
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.Path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithDetails(err, "path", c.Path)
+	}
+
+	return nil
+}
+
+// cassetteURL returns the URL without scheme and host and with
+// credentials in query parameters redacted.
+func cassetteURL(u *url.URL) string {
+	query := u.Query()
+	for _, p := range cassetteQueryParameters {
+		if query.Has(p) {
+			query.Set(p, cassetteRedacted)
+		}
+	}
+	r := url.URL{ //nolint:exhaustruct
+		Path:     u.Path,
+		RawPath:  u.RawPath,
+		RawQuery: query.Encode(),
+	}
+	return r.String()
+}
+
+// cassetteBody returns the body in a canonical form so that
+// JSON bodies can be compared semantically.
+func cassetteBody(body []byte) string {
+	if len(body) == 0 || !json.Valid(body) {
+		return string(body)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v any
+	err := decoder.Decode(&v)
+	if err != nil {
+		return string(body)
+	}
+	data, errE := x.MarshalWithoutEscapeHTML(v)
+	if errE != nil {
+		return string(body)
+	}
+	return string(data)
+}
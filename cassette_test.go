@@ -0,0 +1,147 @@
+package fun_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+//nolint:gochecknoglobals
+var cassetteNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_.=-]+`)
+
+// cassetteClient returns a HTTP client and a value of the environment variable
+// (e.g., an API key) to be used by a provider in the test.
+//
+// If the environment variable is set, a nil client is returned (so that the provider
+// uses its default client and makes real requests), unless FUN_CASSETTE environment
+// variable is set to "record", in which case the client also records exchanges into
+// the cassette of the test. If the environment variable is not set, the client replays
+// exchanges from the cassette of the test and replayValue is returned instead.
+// If there is no cassette, the test fails.
+//
+// Cassettes are recorded into testdata/cassettes by running tests with real API keys
+// and FUN_CASSETTE=record, e.g.:
+//
+//	FUN_CASSETTE=record OPENAI_API_KEY=... go test -run TestText/openai
+//
+// Recorded cassettes do not contain credentials and should be committed.
+func cassetteClient(t *testing.T, env, replayValue string) (*http.Client, string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "cassettes", cassetteNameRegex.ReplaceAllString(t.Name(), "_")+".json")
+
+	value := os.Getenv(env)
+	if value != "" {
+		if os.Getenv("FUN_CASSETTE") == "record" {
+			return &http.Client{ //nolint:exhaustruct
+				Transport: &fun.Cassette{ //nolint:exhaustruct
+					Path: path,
+					Mode: fun.CassetteRecord,
+				},
+			}, value
+		}
+		return nil, value
+	}
+
+	_, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%s is not available and there is no cassette at %s, record it with FUN_CASSETTE=record and %s set", env, path, env)
+	}
+
+	return &http.Client{ //nolint:exhaustruct
+		Transport: &fun.Cassette{ //nolint:exhaustruct
+			Path: path,
+			Mode: fun.CassetteReplay,
+		},
+	}, replayValue
+}
+
+func TestCassette(t *testing.T) {
+	t.Parallel()
+
+	calls := atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		w.Header().Set("X-Request-Id", "req_1")
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"done"},` +
+			`"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`))
+	})
+
+	path := filepath.Join(t.TempDir(), "cassettes", "test.json")
+
+	newText := func(mode fun.CassetteMode, transport http.RoundTripper, apiKey string) *fun.Text[string, string] {
+		return &fun.Text[string, string]{
+			Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+				Client: &http.Client{ //nolint:exhaustruct
+					Transport: &fun.Cassette{ //nolint:exhaustruct
+						Path:      path,
+						Mode:      mode,
+						Transport: transport,
+					},
+				},
+				APIKey:            apiKey,
+				Model:             "gpt-4o-mini-2024-07-18",
+				MaxContextLength:  128_000,
+				MaxResponseLength: 16_384,
+				Seed:              42,
+			},
+			InputJSONSchema:   nil,
+			OutputJSONSchema:  nil,
+			Prompt:            "Repeat the input.",
+			PromptTemplate:    "",
+			InputTemplate:     "",
+			Data:              nil,
+			Tools:             nil,
+			MaxRepairAttempts: 0,
+			MaxData:           0,
+			DataScorer:        nil,
+		}
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	recording := newText(fun.CassetteRecord, newTestClient(t, mux).Transport, "secret")
+	errE := recording.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	output, errE := recording.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "done", output)
+	assert.Equal(t, int32(1), calls.Load())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+	assert.Contains(t, string(data), "req_1")
+
+	// Replaying does not make any real requests.
+	replaying := newText(fun.CassetteReplay, nil, "other")
+	errE = replaying.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	output, errE = replaying.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "done", output)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Each recorded exchange is replayed only once.
+	_, errE = replaying.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrCassetteNoMatch)
+
+	// Requests with a different body do not match.
+	replaying = newText(fun.CassetteReplay, nil, "other")
+	errE = replaying.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	_, errE = replaying.Call(ctx, "bar")
+	assert.ErrorIs(t, errE, fun.ErrCassetteNoMatch)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"math"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,7 +26,9 @@ import (
 )
 
 const (
-	progressPrintRate = 30 * time.Second
+	progressPrintRate     = 30 * time.Second
+	batchAPIPollRate      = time.Minute
+	batchAPIStateFileName = ".batch-api-%d.json"
 )
 
 var errFileSkipped = errors.Base("file skipped")
@@ -34,21 +38,55 @@ type errorAndCalls struct {
 	Calls []fun.TextRecorderCall `json:"calls,omitempty"`
 }
 
+// costCounter accumulates cost of calls to AI models.
+type costCounter struct {
+	mu   sync.Mutex
+	cost float64
+}
+
+func (c *costCounter) Add(cost float64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cost += cost
+}
+
+func (c *costCounter) Cost() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cost
+}
+
+// batchAPIState is persisted while waiting for a batch submitted
+// to the provider's batch API so that waiting can be resumed.
+type batchAPIState struct {
+	ID    string   `json:"id"`
+	Files []string `json:"files"`
+}
+
 //nolint:lll
 type CallCommand struct {
-	InputDir         string               `                                                   help:"Path to input directory."                                                                    name:"input"         placeholder:"PATH" required:"" short:"i" type:"existingdir"`
-	OutputDir        string               `                                                   help:"Path to output directory."                                                                   name:"output"        placeholder:"PATH" required:"" short:"o" type:"path"`
-	DataDir          string               `                                                   help:"Path to data directory. It should contains pairs of files with inputs and expected outputs." name:"data"          placeholder:"PATH"             short:"d" type:"existingdir"`
-	PromptPath       string               `                                                   help:"Path to a file with the prompt, a natural language description of the function."             name:"prompt"        placeholder:"PATH"             short:"P" type:"path"`
-	InputExtension   string               `default:".in"                                      help:"File extension of an input file."                                                            name:"in"            placeholder:"EXT"`
-	OutputExtension  string               `default:".out"                                     help:"File extension of an output file."                                                           name:"out"           placeholder:"EXT"`
-	InputJSONSchema  kong.FileContentFlag `                                                   help:"Path to a file with JSON Schema to validate inputs."                                         name:"input-schema"  placeholder:"PATH"`
-	OutputJSONSchema kong.FileContentFlag `                                                   help:"Path to a file with JSON Schema to validate outputs."                                        name:"output-schema" placeholder:"PATH"`
-	Provider         string               `               enum:"ollama,groq,anthropic,openai" help:"AI model provider."                                                                                                                  required:"" short:"p"`
-	Config           kong.FileContentFlag `                                                   help:"Path to a file with AI model configuration in JSON."                                                              placeholder:"PATH" required:"" short:"c"`
-	Parallel         int                  `default:"1"                                        help:"How many input files to process in parallel."                                                                     placeholder:"INT"`
-	Batches          int                  `default:"1"                                        help:"Split input files into batches."                                                                                  placeholder:"INT"              short:"B"`
-	Batch            int                  `default:"0"                                        help:"Process only files in the batch with this 0-based index."                                                         placeholder:"INT"              short:"b"`
+	InputDir          string               `                                                                                                                           help:"Path to input directory."                                                                                                  name:"input"               placeholder:"PATH" required:"" short:"i" type:"existingdir"`
+	OutputDir         string               `                                                                                                                           help:"Path to output directory."                                                                                                 name:"output"              placeholder:"PATH" required:"" short:"o" type:"path"`
+	DataDir           string               `                                                                                                                           help:"Path to data directory. It should contains pairs of files with inputs and expected outputs."                               name:"data"                placeholder:"PATH"             short:"d" type:"existingdir"`
+	PromptPath        string               `                                                                                                                           help:"Path to a file with the prompt, a natural language description of the function."                                           name:"prompt"              placeholder:"PATH"             short:"P" type:"path"`
+	InputExtension    string               `default:".in"                                                                                                              help:"File extension of an input file."                                                                                          name:"in"                  placeholder:"EXT"`
+	OutputExtension   string               `default:".out"                                                                                                             help:"File extension of an output file."                                                                                         name:"out"                 placeholder:"EXT"`
+	InputJSONSchema   kong.FileContentFlag `                                                                                                                           help:"Path to a file with JSON Schema to validate inputs."                                                                       name:"input-schema"        placeholder:"PATH"`
+	OutputJSONSchema  kong.FileContentFlag `                                                                                                                           help:"Path to a file with JSON Schema to validate outputs."                                                                      name:"output-schema"       placeholder:"PATH"`
+	Provider          string               `               enum:"ollama,groq,anthropic,openai,openai-responses,openai-compatible,azure-openai,gemini,bedrock,llamacpp" help:"AI model provider."                                                                                                                                                      required:"" short:"p"`
+	Config            kong.FileContentFlag `                                                                                                                           help:"Path to a file with AI model configuration in JSON."                                                                                                  placeholder:"PATH" required:"" short:"c"`
+	Parallel          int                  `default:"1"                                                                                                                help:"How many input files to process in parallel."                                                                                                         placeholder:"INT"`
+	Batches           int                  `default:"1"                                                                                                                help:"Split input files into batches."                                                                                                                      placeholder:"INT"              short:"B"`
+	Batch             int                  `default:"0"                                                                                                                help:"Process only files in the batch with this 0-based index."                                                                                             placeholder:"INT"              short:"b"`
+	MaxRepairAttempts int                  `default:"0"                                                                                                                help:"How many times to ask the AI model to correct an output which fails JSON Schema validation."                               name:"max-repair-attempts" placeholder:"INT"`
+	MaxData           int                  `                                                                                                                           help:"Maximum number of the most relevant examples from data directory to provide with each input. By default all are provided." name:"max-data"            placeholder:"INT"`
+	BatchAPI          bool                 `                                                                                                                           help:"Use provider's batch API. Waiting for results is resumed if restarted."                                                    name:"batch-api"`
 }
 
 func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
@@ -115,6 +153,87 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 		if p.APIKey == "" {
 			return errors.New("OPENAI_API_KEY is missing")
 		}
+	case "openai-responses":
+		var p fun.OpenAIResponsesTextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		if apiKey := os.Getenv("OPENAI_API_KEY"); apiKey != "" {
+			p.APIKey = apiKey
+		}
+		provider = &p
+		model = p.Model
+		if p.APIKey == "" {
+			return errors.New("OPENAI_API_KEY is missing")
+		}
+	case "openai-compatible":
+		var p fun.OpenAICompatibleTextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		// API key is optional because local servers often do not require one.
+		if apiKey := os.Getenv("OPENAI_COMPATIBLE_API_KEY"); apiKey != "" {
+			p.APIKey = apiKey
+		}
+		provider = &p
+		model = p.Model
+		if p.BaseURL == "" {
+			return errors.New("baseUrl is missing")
+		}
+	case "azure-openai":
+		var p fun.AzureOpenAITextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		if apiKey := os.Getenv("AZURE_OPENAI_API_KEY"); apiKey != "" {
+			p.APIKey = apiKey
+		}
+		if accessToken := os.Getenv("AZURE_OPENAI_AD_TOKEN"); accessToken != "" {
+			p.AccessToken = accessToken
+		}
+		provider = &p
+		model = p.Model
+		if p.APIKey == "" && p.AccessToken == "" {
+			return errors.New("AZURE_OPENAI_API_KEY or AZURE_OPENAI_AD_TOKEN is missing")
+		}
+	case "gemini":
+		var p fun.GeminiTextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		if apiKey := os.Getenv("GEMINI_API_KEY"); apiKey != "" {
+			p.APIKey = apiKey
+		}
+		provider = &p
+		model = p.Model
+		if p.APIKey == "" {
+			return errors.New("GEMINI_API_KEY is missing")
+		}
+	case "bedrock":
+		var p fun.BedrockTextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		// Credentials are obtained from the environment or the profile during Init.
+		provider = &p
+		model = p.Model
+	case "llamacpp":
+		var p fun.LlamaCppTextProvider
+		errE := x.UnmarshalWithoutUnknownFields(c.Config, &p)
+		if errE != nil {
+			return errE
+		}
+		// API key is optional because llama.cpp server does not require one by default.
+		if apiKey := os.Getenv("LLAMA_API_KEY"); apiKey != "" {
+			p.APIKey = apiKey
+		}
+		provider = &p
+		model = p.Model
 	}
 
 	// TODO: We could use type:"filecontent" Kong's option on string field type instead?
@@ -153,13 +272,27 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 		}
 	}
 
+	var dataScorer fun.DataScorer[string, string]
+	if c.MaxData > 0 {
+		// TODO: How to make embedding-based scoring configurable?
+		dataScorer = &fun.BM25DataScorer[string, string]{
+			K1: 0,
+			B:  0,
+		}
+	}
+
 	fn := &fun.Text[string, string]{
-		Provider:         provider,
-		InputJSONSchema:  c.InputJSONSchema,
-		OutputJSONSchema: c.OutputJSONSchema,
-		Prompt:           prompt,
-		Data:             data,
-		Tools:            nil, // TODO: How to make it configurable?
+		Provider:          provider,
+		InputJSONSchema:   c.InputJSONSchema,
+		OutputJSONSchema:  c.OutputJSONSchema,
+		Prompt:            prompt,
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              data,
+		Tools:             nil, // TODO: How to make it configurable?
+		MaxRepairAttempts: c.MaxRepairAttempts,
+		MaxData:           c.MaxData,
+		DataScorer:        dataScorer,
 	}
 
 	errE := fn.Init(logger.WithContext(ctx))
@@ -196,12 +329,17 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 		Int("inputs", len(batch)).
 		Msg("running")
 
+	if c.BatchAPI {
+		return c.runBatchAPI(logger.WithContext(ctx), fn, batch)
+	}
+
 	count := x.Counter(0)
 	failed := x.Counter(0)
 	errored := x.Counter(0)
 	invalid := x.Counter(0)
 	skipped := x.Counter(0)
 	done := x.Counter(0)
+	cost := new(costCounter)
 	ticker := x.NewTicker(ctx, &count, x.NewCounter(int64(len(files))), progressPrintRate)
 	defer ticker.Stop()
 	go func() {
@@ -209,7 +347,7 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 			logger.Info().
 				Int64("failed", failed.Count()).Int64("errored", errored.Count()).Int64("invalid", invalid.Count()).
 				Int64("skipped", skipped.Count()).Int64("done", done.Count()).Int64("count", p.Count).
-				Str("eta", p.Remaining().Truncate(time.Second).String()).Send()
+				Float64("cost", cost.Cost()).Str("eta", p.Remaining().Truncate(time.Second).String()).Send()
 		}
 	}()
 
@@ -247,7 +385,7 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 
 				count.Increment()
 
-				hasErrored, errE := c.processFile(l.WithContext(ctx), fn, inputPath, outputPath)
+				hasErrored, errE := c.processFile(l.WithContext(ctx), fn.Call, inputPath, outputPath, cost)
 				if errE != nil {
 					if errors.Is(errE, context.Canceled) || errors.Is(errE, context.DeadlineExceeded) {
 						return errE
@@ -274,12 +412,13 @@ func (c *CallCommand) Run(logger zerolog.Logger) errors.E { //nolint:maintidx
 
 	errE = errors.WithStack(g.Wait())
 	logger.Info().Int64("failed", failed.Count()).Int64("errored", errored.Count()).Int64("invalid", invalid.Count()).
-		Int64("skipped", skipped.Count()).Int64("done", done.Count()).Int64("count", count.Count()).Msg("done")
+		Int64("skipped", skipped.Count()).Int64("done", done.Count()).Int64("count", count.Count()).
+		Float64("cost", cost.Cost()).Msg("done")
 	return errE
 }
 
 func (c *CallCommand) processFile( //nolint:nonamedreturns
-	ctx context.Context, fn fun.Callee[string, string], inputPath, outputPath string,
+	ctx context.Context, call func(ctx context.Context, input ...string) (string, errors.E), inputPath, outputPath string, cost *costCounter,
 ) (errored bool, errE errors.E) {
 	// Was there an output error?
 	var errorErrE errors.E
@@ -370,6 +509,7 @@ func (c *CallCommand) processFile( //nolint:nonamedreturns
 
 	ctx = fun.WithTextRecorder(ctx)
 	defer func() {
+		cost.Add(fun.GetTextRecorder(ctx).TotalCost())
 		e := zerolog.Ctx(ctx).Debug()
 		if e.Enabled() {
 			calls := fun.GetTextRecorder(ctx).Calls()
@@ -379,7 +519,7 @@ func (c *CallCommand) processFile( //nolint:nonamedreturns
 		}
 	}()
 
-	output, errE := fn.Call(ctx, string(inputData))
+	output, errE := call(ctx, string(inputData))
 	if errors.Is(errE, context.Canceled) || errors.Is(errE, context.DeadlineExceeded) {
 		return false, errE
 	} else if errors.Is(errE, fun.ErrJSONSchemaValidation) {
@@ -410,3 +550,143 @@ func (c *CallCommand) processFile( //nolint:nonamedreturns
 	_, err = f.WriteString(output)
 	return false, errors.WithStack(err)
 }
+
+func (c *CallCommand) outputPath(inputPath string) (string, errors.E) {
+	relPath, err := filepath.Rel(c.InputDir, inputPath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(c.OutputDir, strings.TrimSuffix(relPath, c.InputExtension)+c.OutputExtension), nil
+}
+
+// runBatchAPI submits input files (for which there are no outputs yet) to the provider's
+// batch API, waits for results, and writes them out. The batch ID is persisted in the output
+// directory so that waiting can be resumed if the process is restarted.
+func (c *CallCommand) runBatchAPI(ctx context.Context, fn *fun.Text[string, string], files []string) errors.E { //nolint:maintidx
+	logger := zerolog.Ctx(ctx)
+
+	statePath := filepath.Join(c.OutputDir, fmt.Sprintf(batchAPIStateFileName, c.Batch))
+
+	var state batchAPIState
+	stateData, err := os.ReadFile(statePath)
+	if err == nil {
+		errE := x.UnmarshalWithoutUnknownFields(stateData, &state)
+		if errE != nil {
+			errors.Details(errE)["path"] = statePath
+			return errE
+		}
+		logger.Info().Str("id", state.ID).Int("inputs", len(state.Files)).Msg("resuming batch")
+	} else if errors.Is(err, fs.ErrNotExist) {
+		inputs := [][]string{}
+		for _, inputPath := range files {
+			outputPath, errE := c.outputPath(inputPath)
+			if errE != nil {
+				return errE
+			}
+			exists := false
+			for _, path := range []string{outputPath, outputPath + ".error", outputPath + ".invalid"} {
+				_, err := os.Stat(path)
+				if err == nil {
+					exists = true
+					break
+				} else if !errors.Is(err, fs.ErrNotExist) {
+					return errors.WithStack(err)
+				}
+			}
+			if exists {
+				continue
+			}
+
+			inputData, err := os.ReadFile(filepath.Clean(inputPath))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			inputs = append(inputs, []string{string(inputData)})
+			state.Files = append(state.Files, inputPath)
+		}
+
+		if len(inputs) == 0 {
+			logger.Info().Int("skipped", len(files)).Msg("done")
+			return nil
+		}
+
+		batchID, errE := fn.SubmitBatch(ctx, inputs...)
+		if errE != nil {
+			return errE
+		}
+		state.ID = batchID
+
+		stateData, errE := x.MarshalWithoutEscapeHTML(state)
+		if errE != nil {
+			return errE
+		}
+		err = os.WriteFile(statePath, stateData, 0o644) //nolint:mnd,gosec
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		logger.Info().Str("id", state.ID).Int("inputs", len(state.Files)).Msg("submitted batch")
+	} else {
+		return errors.WithStack(err)
+	}
+
+	ctx = fun.WithTextRecorder(ctx)
+	results, errE := fn.WaitBatch(ctx, state.ID, batchAPIPollRate)
+	if errE != nil {
+		errors.Details(errE)["id"] = state.ID
+		return errE
+	}
+
+	if len(results) != len(state.Files) {
+		errE = errors.New("unexpected number of batch results")
+		errors.Details(errE)["id"] = state.ID
+		errors.Details(errE)["results"] = len(results)
+		errors.Details(errE)["inputs"] = len(state.Files)
+		return errE
+	}
+
+	failed := 0
+	errored := 0
+	invalid := 0
+	skipped := 0
+	done := 0
+	for i, inputPath := range state.Files {
+		outputPath, errE := c.outputPath(inputPath)
+		if errE != nil {
+			return errE
+		}
+
+		l := logger.With().Str("file", inputPath).Logger()
+
+		result := results[i]
+		hasErrored, errE := c.processFile(l.WithContext(ctx), func(_ context.Context, _ ...string) (string, errors.E) {
+			return result.Output, result.Err
+		}, inputPath, outputPath, nil)
+		if errE != nil {
+			if errors.Is(errE, errFileSkipped) {
+				skipped++
+				continue
+			}
+			l.Warn().Err(errE).Msg("error processing file")
+			if hasErrored {
+				errored++
+			} else if errors.Is(errE, fun.ErrJSONSchemaValidation) {
+				invalid++
+			} else {
+				failed++
+			}
+			continue
+		}
+		done++
+	}
+
+	err = os.Remove(statePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	logger.Info().Int("failed", failed).Int("errored", errored).Int("invalid", invalid).
+		Int("skipped", skipped).Int("done", done).Int("count", len(state.Files)).
+		Float64("cost", fun.GetTextRecorder(ctx).TotalCost()).Msg("done")
+	return nil
+}
@@ -0,0 +1,189 @@
+package fun
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+var _ Callee[any, any] = (*Conversation[any, any])(nil)
+
+// Conversation implements [Callee] interface similarly to [Text], but it keeps
+// the history of the conversation with the AI model between calls.
+//
+// Each call sends inputs as a new user message together with all prior
+// messages in the history, and on success appends both the user message
+// and the response of the AI model to the history. If the call fails,
+// the history is not changed. Calls are serialized.
+//
+// It uses a text-based AI model provided by a [TextProvider] which
+// implements [WithConversation] interface.
+type Conversation[Input, Output any] struct {
+	// Provider is a text-based AI model.
+	Provider TextProvider
+
+	// InputJSONSchema is a JSON Schema to validate inputs against.
+	// If not provided, it is automatically determined from the Input type.
+	InputJSONSchema []byte
+
+	// OutputJSONSchema is a JSON Schema to validate outputs against.
+	// If not provided, it is automatically determined from the Output type.
+	OutputJSONSchema []byte
+
+	// Prompt is a natural language description of the logic.
+	Prompt string
+
+	// Data are example inputs with corresponding outputs for the function.
+	Data []InputOutput[Input, Output]
+
+	// Tools that can be called by the AI model.
+	Tools map[string]TextTooler
+
+	// MaxRepairAttempts is the maximum number of times the AI model is asked
+	// to correct its response when the response cannot be parsed or fails to
+	// validate against OutputJSONSchema. See [Text] for details.
+	MaxRepairAttempts int
+
+	mu      sync.Mutex
+	text    *Text[Input, Output]
+	history []ChatMessage
+}
+
+// Init implements [Callee] interface.
+func (c *Conversation[Input, Output]) Init(ctx context.Context) errors.E {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.text != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	if _, ok := c.Provider.(WithConversation); !ok {
+		return errors.New("provider does not support conversations")
+	}
+
+	text := &Text[Input, Output]{
+		Provider:          c.Provider,
+		InputJSONSchema:   c.InputJSONSchema,
+		OutputJSONSchema:  c.OutputJSONSchema,
+		Prompt:            c.Prompt,
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              c.Data,
+		Tools:             c.Tools,
+		MaxRepairAttempts: c.MaxRepairAttempts,
+		MaxData:           0,
+		DataScorer:        nil,
+		inputValidator:    nil,
+		outputValidator:   nil,
+		data:              nil,
+		promptTemplate:    nil,
+		inputTemplate:     nil,
+	}
+	errE := text.Init(ctx)
+	if errE != nil {
+		return errE
+	}
+
+	c.InputJSONSchema = text.InputJSONSchema
+	c.OutputJSONSchema = text.OutputJSONSchema
+	c.text = text
+
+	return nil
+}
+
+// Call implements [Callee] interface.
+func (c *Conversation[Input, Output]) Call(ctx context.Context, input ...Input) (Output, errors.E) { //nolint:ireturn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	provider := c.Provider.(WithConversation) //nolint:errcheck,forcetypeassert
+
+	var message *ChatMessage
+	var content string
+	output, errE := c.text.call(ctx, input, func(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+		if message == nil {
+			// The input message is the last message of the first exchange. Any messages
+			// before it are not part of the history, and repair attempts add messages after it.
+			message = &messages[len(messages)-1]
+		}
+		var errE errors.E
+		content, errE = provider.ChatConversation(ctx, append(slices.Clone(c.history), messages...))
+		return content, errE
+	})
+	if errE != nil {
+		return output, errE
+	}
+
+	// Only the final response is added to the history, without any repair attempts.
+	c.history = append(c.history, *message, ChatMessage{
+		Role:    roleAssistant,
+		Content: content,
+		Parts:   nil,
+	})
+
+	return output, nil
+}
+
+// Variadic implements [Callee] interface.
+func (c *Conversation[Input, Output]) Variadic() func(ctx context.Context, input ...Input) (Output, errors.E) {
+	return func(ctx context.Context, input ...Input) (Output, errors.E) {
+		return c.Call(ctx, input...)
+	}
+}
+
+// Unary implements [Callee] interface.
+func (c *Conversation[Input, Output]) Unary() func(ctx context.Context, input Input) (Output, errors.E) {
+	return func(ctx context.Context, input Input) (Output, errors.E) {
+		return c.Call(ctx, input)
+	}
+}
+
+// History returns a copy of the conversation history, e.g., to persist it.
+//
+// It does not include messages from the prompt and example data, nor
+// messages exchanged while calling tools.
+func (c *Conversation[Input, Output]) History() []ChatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.history)
+}
+
+// SetHistory replaces the conversation history, e.g., to resume
+// a persisted conversation. Messages have to alternate between
+// "user" and "assistant" roles, starting with a "user" message
+// and ending with an "assistant" message.
+func (c *Conversation[Input, Output]) SetHistory(messages []ChatMessage) errors.E {
+	for i, message := range messages {
+		expected := roleUser
+		if i%2 == 1 {
+			expected = roleAssistant
+		}
+		if message.Role != expected {
+			return errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", message.Role,
+				"expected", expected,
+				"index", i,
+			)
+		}
+	}
+	if len(messages)%2 == 1 {
+		return errors.WithDetails(
+			ErrUnexpectedRole,
+			"role", roleUser,
+			"expected", roleAssistant,
+			"index", len(messages)-1,
+		)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.history = slices.Clone(messages)
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package fun_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+func TestConversation(t *testing.T) { //nolint:paralleltest,tparallel
+	// We do not run test cases in parallel, so that we can run Ollama tests in sequence.
+
+	for _, provider := range providers {
+		t.Run(provider.Name, func(t *testing.T) {
+			if provider.Name != "ollama" {
+				t.Parallel()
+			}
+
+			f := fun.Conversation[string, string]{
+				Provider:         provider.Provider(t),
+				InputJSONSchema:  jsonSchemaString,
+				OutputJSONSchema: jsonSchemaString,
+				Prompt:           "Respond only with a number, without any explanation.",
+				Data:             nil,
+				Tools:            nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			output, errE := f.Call(ctx, "Remember number 17 and respond with it.")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "17", output)
+
+			output, errE = f.Call(ctx, "Add 25 to the number I asked you to remember.")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "42", output)
+
+			history := f.History()
+			assert.Len(t, history, 4)
+
+			// History can be persisted and resumed.
+			historyJSON, err := json.Marshal(history)
+			require.NoError(t, err)
+
+			var messages []fun.ChatMessage
+			err = json.Unmarshal(historyJSON, &messages)
+			require.NoError(t, err)
+
+			g := fun.Conversation[string, string]{
+				Provider:         provider.Provider(t),
+				InputJSONSchema:  jsonSchemaString,
+				OutputJSONSchema: jsonSchemaString,
+				Prompt:           "Respond only with a number, without any explanation.",
+				Data:             nil,
+				Tools:            nil,
+			}
+
+			errE = g.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			errE = g.SetHistory(messages)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			output, errE = g.Call(ctx, "Subtract 2 from the last number you responded with.")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "40", output)
+			assert.Len(t, g.History(), 6)
+		})
+	}
+}
+
+func TestConversationSetHistory(t *testing.T) {
+	t.Parallel()
+
+	f := fun.Conversation[string, string]{} //nolint:exhaustruct
+
+	errE := f.SetHistory([]fun.ChatMessage{
+		{Role: "user", Content: "foo", Parts: nil},
+		{Role: "assistant", Content: "bar", Parts: nil},
+	})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Len(t, f.History(), 2)
+
+	errE = f.SetHistory([]fun.ChatMessage{
+		{Role: "assistant", Content: "bar", Parts: nil},
+	})
+	assert.ErrorIs(t, errE, fun.ErrUnexpectedRole)
+
+	errE = f.SetHistory([]fun.ChatMessage{
+		{Role: "user", Content: "foo", Parts: nil},
+	})
+	assert.ErrorIs(t, errE, fun.ErrUnexpectedRole)
+
+	errE = f.SetHistory([]fun.ChatMessage{
+		{Role: "user", Content: "foo", Parts: nil},
+		{Role: "user", Content: "bar", Parts: nil},
+	})
+	assert.ErrorIs(t, errE, fun.ErrUnexpectedRole)
+
+	// History was not changed by failed calls.
+	assert.Len(t, f.History(), 2)
+}
+
+func TestConversationRepair(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewOpenAI(
+		emulator.Response{Content: "seventeen", PromptTokens: 100, ResponseTokens: 5}, //nolint:exhaustruct
+		emulator.Response{Content: "17", PromptTokens: 150, ResponseTokens: 5},        //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	f := fun.Conversation[string, int]{ //nolint:exhaustruct
+		Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+			Client:            server.Client(),
+			APIKey:            "test",
+			Model:             "gpt-4o-mini-2024-07-18",
+			MaxContextLength:  128_000,
+			MaxResponseLength: 16_384,
+		},
+		InputJSONSchema:   jsonSchemaString,
+		OutputJSONSchema:  jsonSchemaNumber,
+		Prompt:            "Respond only with a number, without any explanation.",
+		MaxRepairAttempts: 1,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Call(ctx, "Remember number 17 and respond with it.")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, 17, output)
+
+	// Only the input message and the final response are in the history.
+	assert.Equal(t, []fun.ChatMessage{
+		{Role: "user", Content: "Remember number 17 and respond with it.", Parts: nil},
+		{Role: "assistant", Content: "17", Parts: nil},
+	}, f.History())
+}
@@ -0,0 +1,227 @@
+package fun
+
+import (
+	"context"
+	"math"
+	"strings"
+	"unicode"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// embeddingDataScorerBatchSize is the maximum number of example inputs
+// embedded with one call to the embedding provider.
+const embeddingDataScorerBatchSize = 100
+
+// DataScorer scores how relevant are example data to an input.
+//
+// It is used by [Text] to select for each call only the most
+// relevant example data (see MaxData).
+type DataScorer[Input, Output any] interface {
+	// Init initializes the scorer with all example data.
+	Init(ctx context.Context, data []InputOutput[Input, Output]) errors.E
+
+	// Score returns relevance scores of example data to the input,
+	// in the same order as data was provided to Init. Higher score
+	// means more relevant example.
+	Score(ctx context.Context, input []Input) ([]float64, errors.E)
+}
+
+var (
+	_ DataScorer[any, any] = (*BM25DataScorer[any, any])(nil)
+	_ DataScorer[any, any] = (*EmbeddingDataScorer[any, any])(nil)
+)
+
+// BM25DataScorer is a [DataScorer] which scores example data using
+// the [Okapi BM25] ranking function over words of inputs.
+//
+// String inputs are used as they are. Other inputs are converted
+// to their JSON representation first.
+//
+// [Okapi BM25]: https://en.wikipedia.org/wiki/Okapi_BM25
+type BM25DataScorer[Input, Output any] struct {
+	// K1 controls term frequency saturation. Default is 1.2.
+	K1 float64 `json:"k1"`
+
+	// B controls how much scores are normalized by input length. Default is 0.75.
+	B float64 `json:"b"`
+
+	documents     []map[string]int
+	lengths       []int
+	averageLength float64
+	frequencies   map[string]int
+}
+
+// Init implements [DataScorer] interface.
+func (s *BM25DataScorer[Input, Output]) Init(_ context.Context, data []InputOutput[Input, Output]) errors.E {
+	if s.documents != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	if s.K1 == 0 {
+		s.K1 = 1.2 //nolint:mnd
+	}
+	if s.B == 0 {
+		s.B = 0.75 //nolint:mnd
+	}
+
+	s.documents = make([]map[string]int, 0, len(data))
+	s.lengths = make([]int, 0, len(data))
+	s.frequencies = map[string]int{}
+	totalLength := 0
+	for _, d := range data {
+		text, errE := toInputString(d.Input)
+		if errE != nil {
+			return errE
+		}
+		words := bm25Words(text)
+		document := map[string]int{}
+		for _, word := range words {
+			document[word]++
+		}
+		for word := range document {
+			s.frequencies[word]++
+		}
+		s.documents = append(s.documents, document)
+		s.lengths = append(s.lengths, len(words))
+		totalLength += len(words)
+	}
+	if len(data) > 0 {
+		s.averageLength = float64(totalLength) / float64(len(data))
+	}
+
+	return nil
+}
+
+// Score implements [DataScorer] interface.
+func (s *BM25DataScorer[Input, Output]) Score(_ context.Context, input []Input) ([]float64, errors.E) {
+	text, errE := toInputString(input)
+	if errE != nil {
+		return nil, errE
+	}
+
+	query := map[string]bool{}
+	for _, word := range bm25Words(text) {
+		query[word] = true
+	}
+
+	n := float64(len(s.documents))
+	scores := make([]float64, len(s.documents))
+	for i, document := range s.documents {
+		length := 1.0
+		if s.averageLength > 0 {
+			length = float64(s.lengths[i]) / s.averageLength
+		}
+		for word := range query {
+			f := float64(document[word])
+			if f == 0 {
+				continue
+			}
+			df := float64(s.frequencies[word])
+			idf := math.Log((n-df+0.5)/(df+0.5) + 1) //nolint:mnd
+			scores[i] += idf * f * (s.K1 + 1) / (f + s.K1*(1-s.B+s.B*length))
+		}
+	}
+
+	return scores, nil
+}
+
+// bm25Words splits text into lower-cased words.
+func bm25Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// EmbeddingDataScorer is a [DataScorer] which scores example data using
+// cosine similarity between embeddings of inputs.
+//
+// String inputs are embedded as they are. Other inputs are converted
+// to their JSON representation first. Embeddings of all example inputs
+// are computed during initialization.
+type EmbeddingDataScorer[Input, Output any] struct {
+	// Provider is an embedding-based AI model. It is initialized by Init.
+	Provider EmbeddingProvider `json:"provider"`
+
+	embeddings [][]float32
+}
+
+// Init implements [DataScorer] interface.
+func (s *EmbeddingDataScorer[Input, Output]) Init(ctx context.Context, data []InputOutput[Input, Output]) errors.E {
+	if s.embeddings != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	errE := s.Provider.Init(ctx)
+	if errE != nil {
+		return errE
+	}
+
+	texts := make([]string, 0, len(data))
+	for _, d := range data {
+		text, errE := toInputString(d.Input)
+		if errE != nil {
+			return errE
+		}
+		texts = append(texts, text)
+	}
+
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingDataScorerBatchSize {
+		end := min(start+embeddingDataScorerBatchSize, len(texts))
+		e, errE := s.Provider.Embed(ctx, texts[start:end])
+		if errE != nil {
+			return errE
+		}
+		embeddings = append(embeddings, e...)
+	}
+	s.embeddings = embeddings
+
+	return nil
+}
+
+// Score implements [DataScorer] interface.
+func (s *EmbeddingDataScorer[Input, Output]) Score(ctx context.Context, input []Input) ([]float64, errors.E) {
+	text, errE := toInputString(input)
+	if errE != nil {
+		return nil, errE
+	}
+
+	embeddings, errE := s.Provider.Embed(ctx, []string{text})
+	if errE != nil {
+		return nil, errE
+	}
+	if len(embeddings) != 1 {
+		return nil, errors.WithDetails(
+			ErrUnexpectedMessage,
+			"number", len(embeddings),
+		)
+	}
+
+	scores := make([]float64, len(s.embeddings))
+	for i, embedding := range s.embeddings {
+		scores[i] = cosineSimilarity(embeddings[0], embedding)
+	}
+
+	return scores, nil
+}
+
+// cosineSimilarity returns cosine similarity between vectors a and b.
+// It returns 0 if vectors have different lengths or if any of them is zero.
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
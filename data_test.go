@@ -0,0 +1,187 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+var testData = []fun.InputOutput[string, string]{ //nolint:gochecknoglobals
+	{Input: []string{"red apple"}, Output: "fruit"},
+	{Input: []string{"green car"}, Output: "vehicle"},
+	{Input: []string{"yellow banana"}, Output: "fruit"},
+	{Input: []string{"red bus"}, Output: "vehicle"},
+}
+
+// letterEmbeddingProvider embeds texts as counts of letters "a", "e", and "r".
+type letterEmbeddingProvider struct{}
+
+func (letterEmbeddingProvider) Init(_ context.Context) errors.E {
+	return nil
+}
+
+func (letterEmbeddingProvider) Embed(_ context.Context, texts []string) ([][]float32, errors.E) {
+	embeddings := [][]float32{}
+	for _, text := range texts {
+		embeddings = append(embeddings, []float32{
+			float32(strings.Count(text, "a")),
+			float32(strings.Count(text, "e")),
+			float32(strings.Count(text, "r")),
+		})
+	}
+	return embeddings, nil
+}
+
+func TestBM25DataScorer(t *testing.T) {
+	t.Parallel()
+
+	s := fun.BM25DataScorer[string, string]{
+		K1: 0,
+		B:  0,
+	}
+
+	errE := s.Init(t.Context(), testData)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.InDelta(t, 1.2, s.K1, 0.0001)
+	assert.InDelta(t, 0.75, s.B, 0.0001)
+
+	scores, errE := s.Score(t.Context(), []string{"Red Bus"})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	require.Len(t, scores, 4)
+	assert.Greater(t, scores[3], scores[0])
+	assert.Greater(t, scores[0], scores[1])
+	assert.Zero(t, scores[1])
+	assert.Zero(t, scores[2])
+
+	errE = s.Init(t.Context(), testData)
+	assert.ErrorIs(t, errE, fun.ErrAlreadyInitialized)
+}
+
+func TestEmbeddingDataScorer(t *testing.T) {
+	t.Parallel()
+
+	s := fun.EmbeddingDataScorer[string, string]{
+		Provider: letterEmbeddingProvider{},
+	}
+
+	errE := s.Init(t.Context(), testData)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	scores, errE := s.Score(t.Context(), []string{"banana"})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	require.Len(t, scores, 4)
+	for i, score := range scores {
+		if i != 2 { //nolint:mnd
+			assert.Less(t, score, scores[2])
+		}
+	}
+}
+
+func TestTextMaxData(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var received [][]json.RawMessage
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []json.RawMessage `json:"messages"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		mu.Lock()
+		received = append(received, request.Messages)
+		mu.Unlock()
+		w.Header().Set("X-Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"vehicle"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`))
+	})
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Text[string, string]{
+		Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+			Client: newTestClient(t, mux),
+			APIKey: "test",
+			Model:  "gpt-4o-mini-2024-07-18",
+		},
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  nil,
+		Prompt:            "Classify the input.",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              testData,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           2,
+		DataScorer: &fun.BM25DataScorer[string, string]{
+			K1: 0,
+			B:  0,
+		},
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Call(ctx, "blue bus")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "vehicle", output)
+
+	output, errE = f.Call(ctx, "red car")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "vehicle", output)
+
+	require.Len(t, received, 2)
+
+	contents := func(messages []json.RawMessage) []string {
+		result := []string{}
+		for _, message := range messages {
+			var m struct {
+				Content string `json:"content"`
+			}
+			err := json.Unmarshal(message, &m)
+			require.NoError(t, err)
+			result = append(result, m.Content)
+		}
+		return result
+	}
+
+	// Examples are selected by relevance, but provided in the original order.
+	assert.Equal(t, []string{"Classify the input.", "red apple", "fruit", "red bus", "vehicle", "blue bus"}, contents(received[0]))
+	assert.Equal(t, []string{"Classify the input.", "red apple", "fruit", "green car", "vehicle", "red car"}, contents(received[1]))
+}
+
+func TestTextMaxDataErrors(t *testing.T) {
+	t.Parallel()
+
+	f := fun.Text[string, string]{
+		Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+			APIKey: "test",
+			Model:  "gpt-4o-mini-2024-07-18",
+		},
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  nil,
+		Prompt:            "",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              testData,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           2,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(t.Context())
+	assert.EqualError(t, errE, "DataScorer is missing, but MaxData is set")
+}
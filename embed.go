@@ -0,0 +1,88 @@
+package fun
+
+import (
+	"context"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gitlab.com/tozd/go/errors"
+)
+
+var _ Callee[any, []float32] = (*Embed[any])(nil)
+
+// Embed implements [Callee] interface with its logic defined by an embedding-based AI model.
+// It returns an embedding vector of the input.
+//
+// String inputs are embedded as they are. Other inputs are converted
+// to their JSON representation first. If multiple inputs are provided, they
+// are embedded together as one JSON array.
+type Embed[Input any] struct {
+	// Provider is an embedding-based AI model.
+	Provider EmbeddingProvider
+
+	// InputJSONSchema is a JSON Schema to validate inputs against.
+	// If not provided, it is automatically determined from the Input type.
+	InputJSONSchema []byte
+
+	inputValidator *jsonschema.Schema
+}
+
+// Init implements [Callee] interface.
+func (e *Embed[Input]) Init(ctx context.Context) errors.E {
+	if e.inputValidator != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	validator, inputSchema, errE := compileValidator[Input](e.InputJSONSchema)
+	if errE != nil {
+		return errE
+	}
+	e.inputValidator = validator
+	if e.InputJSONSchema == nil {
+		e.InputJSONSchema = inputSchema
+	}
+
+	return e.Provider.Init(ctx)
+}
+
+// Call implements [Callee] interface.
+func (e *Embed[Input]) Call(ctx context.Context, input ...Input) ([]float32, errors.E) {
+	for _, i := range input {
+		errE := validate(e.inputValidator, i)
+		if errE != nil {
+			return nil, errE
+		}
+	}
+
+	text, errE := toInputString(input)
+	if errE != nil {
+		return nil, errE
+	}
+
+	embeddings, errE := e.Provider.Embed(ctx, []string{text})
+	if errE != nil {
+		return nil, errE
+	}
+
+	if len(embeddings) != 1 {
+		return nil, errors.WithDetails(
+			ErrUnexpectedMessage,
+			"number", len(embeddings),
+		)
+	}
+
+	return embeddings[0], nil
+}
+
+// Variadic implements [Callee] interface.
+func (e *Embed[Input]) Variadic() func(ctx context.Context, input ...Input) ([]float32, errors.E) {
+	return func(ctx context.Context, input ...Input) ([]float32, errors.E) {
+		return e.Call(ctx, input...)
+	}
+}
+
+// Unary implements [Callee] interface.
+func (e *Embed[Input]) Unary() func(ctx context.Context, input Input) ([]float32, errors.E) {
+	return func(ctx context.Context, input Input) ([]float32, errors.E) {
+		return e.Call(ctx, input)
+	}
+}
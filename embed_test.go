@@ -0,0 +1,79 @@
+package fun_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func TestOpenAIEmbed(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test", r.Header.Get("Authorization"))
+		var request struct {
+			Model      string   `json:"model"`
+			Input      []string `json:"input"`
+			Dimensions int      `json:"dimensions"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		assert.Equal(t, "text-embedding-3-small", request.Model)
+		assert.Equal(t, 3, request.Dimensions) //nolint:testifylint
+		w.Header().Set("X-Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"object":"list","model":"text-embedding-3-small","data":[`))
+		// We return embeddings in reverse order to test reordering.
+		for i := len(request.Input) - 1; i >= 0; i-- {
+			if i != len(request.Input)-1 {
+				_, _ = w.Write([]byte(`,`))
+			}
+			fmt.Fprintf(w, `{"object":"embedding","index":%d,"embedding":[%d,%d,%d]}`, i, len(request.Input[i]), i, 1)
+		}
+		_, _ = w.Write([]byte(`],"usage":{"prompt_tokens":5,"total_tokens":5}}`))
+	})
+
+	provider := &fun.OpenAIEmbeddingProvider{ //nolint:exhaustruct
+		Client:     newTestClient(t, mux),
+		APIKey:     "test",
+		Model:      "text-embedding-3-small",
+		Dimensions: 3, //nolint:mnd
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Embed[string]{
+		Provider:        provider,
+		InputJSONSchema: nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, 8_191, provider.MaxContextLength)
+
+	ctx = fun.WithTextRecorder(ctx)
+	embedding, errE := f.Call(ctx, "hello")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, []float32{5, 0, 1}, embedding)
+
+	calls := fun.GetTextRecorder(ctx).Calls()
+	require.Len(t, calls, 1)
+	assert.Nil(t, calls[0].Provider)
+	assert.Equal(t, provider, calls[0].EmbeddingProvider)
+	require.Contains(t, calls[0].UsedTokens, "req_1")
+	assert.Equal(t, 5, calls[0].UsedTokens["req_1"].Prompt)
+	assert.Equal(t, 5, calls[0].UsedTokens["req_1"].Total)
+	require.Len(t, calls[0].Messages, 1)
+	assert.Equal(t, "hello", *calls[0].Messages[0].Content)
+
+	embeddings, errE := provider.Embed(ctx, []string{"a", "bb"})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, [][]float32{{1, 0, 1}, {2, 1, 1}}, embeddings)
+}
@@ -0,0 +1,240 @@
+package emulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type anthropicContent struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID         string             `json:"id"`
+	Type       string             `json:"type"`
+	Role       string             `json:"role"`
+	Content    []anthropicContent `json:"content"`
+	Model      string             `json:"model"`
+	StopReason *string            `json:"stop_reason"`
+	Usage      anthropicUsage     `json:"usage"`
+}
+
+type anthropicDelta struct {
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"`
+}
+
+type anthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Message      *anthropicResponse `json:"message,omitempty"`
+	Index        *int               `json:"index,omitempty"`
+	ContentBlock *anthropicContent  `json:"content_block,omitempty"`
+	Delta        *anthropicDelta    `json:"delta,omitempty"`
+	Usage        *anthropicUsage    `json:"usage,omitempty"`
+}
+
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicAPI struct{}
+
+var _ api = anthropicAPI{}
+
+// NewAnthropic returns a new emulator of Anthropic messages API
+// which responds with provided scripted responses.
+//
+// Close it when you are done with it.
+func NewAnthropic(responses ...Response) *Server {
+	return newServer(anthropicAPI{}, RateLimits{ //nolint:exhaustruct
+		Requests:     RateLimit{Limit: 4_000, Window: time.Minute},     //nolint:mnd
+		InputTokens:  RateLimit{Limit: 2_000_000, Window: time.Minute}, //nolint:mnd
+		OutputTokens: RateLimit{Limit: 400_000, Window: time.Minute},   //nolint:mnd
+	}, responses)
+}
+
+func (a anthropicAPI) requestIDHeader() string {
+	return "Request-Id"
+}
+
+func (a anthropicAPI) handle(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	if req.Method != http.MethodPost || req.Path != "/v1/messages" {
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+
+	response, ok := s.next(w, req)
+	if !ok {
+		return
+	}
+
+	var model struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(req.Body, &model)
+
+	stopReason := "end_turn"
+	content := []anthropicContent{}
+	if response.Content != "" || len(response.ToolCalls) == 0 {
+		content = append(content, anthropicContent{ //nolint:exhaustruct
+			Type: "text",
+			Text: &response.Content,
+		})
+	}
+	for i, toolCall := range response.ToolCalls {
+		stopReason = "tool_use"
+		content = append(content, anthropicContent{ //nolint:exhaustruct
+			Type:  "tool_use",
+			ID:    toolCallID(req, toolCall, i),
+			Name:  toolCall.Name,
+			Input: toolCall.Input,
+		})
+	}
+
+	message := anthropicResponse{
+		ID:         "msg_" + strconv.Itoa(req.number),
+		Type:       "message",
+		Role:       "assistant",
+		Content:    content,
+		Model:      model.Model,
+		StopReason: &stopReason,
+		Usage: anthropicUsage{
+			InputTokens:  response.PromptTokens,
+			OutputTokens: response.ResponseTokens,
+		},
+	}
+
+	if !stream {
+		writeJSON(w, http.StatusOK, message)
+		return
+	}
+
+	startEvents(w)
+
+	start := message
+	start.Content = []anthropicContent{}
+	start.StopReason = nil
+	start.Usage.OutputTokens = 0
+	writeEvent(w, "message_start", anthropicStreamEvent{ //nolint:exhaustruct
+		Type:    "message_start",
+		Message: &start,
+	})
+	for i, block := range content {
+		delta := anthropicDelta{ //nolint:exhaustruct
+			Type: "text_delta",
+		}
+		if block.Type == "text" {
+			delta.Text = *block.Text
+			block.Text = ptr("")
+		} else {
+			delta.Type = "input_json_delta"
+			delta.PartialJSON = string(block.Input)
+			block.Input = json.RawMessage(`{}`)
+		}
+		writeEvent(w, "content_block_start", anthropicStreamEvent{ //nolint:exhaustruct
+			Type:         "content_block_start",
+			Index:        &i,
+			ContentBlock: &block,
+		})
+		writeEvent(w, "content_block_delta", anthropicStreamEvent{ //nolint:exhaustruct
+			Type:  "content_block_delta",
+			Index: &i,
+			Delta: &delta,
+		})
+		writeEvent(w, "content_block_stop", anthropicStreamEvent{ //nolint:exhaustruct
+			Type:  "content_block_stop",
+			Index: &i,
+		})
+	}
+	writeEvent(w, "message_delta", anthropicStreamEvent{ //nolint:exhaustruct
+		Type: "message_delta",
+		Delta: &anthropicDelta{ //nolint:exhaustruct
+			StopReason: stopReason,
+		},
+		Usage: &anthropicUsage{
+			InputTokens:  0,
+			OutputTokens: response.ResponseTokens,
+		},
+	})
+	writeEvent(w, "message_stop", anthropicStreamEvent{ //nolint:exhaustruct
+		Type: "message_stop",
+	})
+}
+
+func (a anthropicAPI) rateLimitHeaders(s *Server, header http.Header, now time.Time) {
+	limits := []struct {
+		name   string
+		limit  RateLimit
+		window *window
+	}{
+		{"Requests", s.rateLimits.Requests, &s.requestsUsed},
+		{"Input-Tokens", s.rateLimits.InputTokens, &s.inputUsed},
+		{"Output-Tokens", s.rateLimits.OutputTokens, &s.outputUsed},
+	}
+	for _, l := range limits {
+		if l.limit.Limit == 0 {
+			return
+		}
+	}
+	for _, l := range limits {
+		header.Set("Anthropic-Ratelimit-"+l.name+"-Limit", strconv.Itoa(l.limit.Limit))
+		header.Set("Anthropic-Ratelimit-"+l.name+"-Remaining", strconv.Itoa(max(0, l.window.remaining(l.limit, now))))
+		// RFC3339 has only second precision, so we round up to not report a reset before it happens.
+		resets := l.window.resets.Truncate(time.Second)
+		if resets.Before(l.window.resets) {
+			resets = resets.Add(time.Second)
+		}
+		header.Set("Anthropic-Ratelimit-"+l.name+"-Reset", resets.UTC().Format(time.RFC3339))
+	}
+}
+
+func (a anthropicAPI) exceeds(s *Server, response Response, now time.Time) bool {
+	if s.rateLimits.Requests.Limit > 0 && s.requestsUsed.remaining(s.rateLimits.Requests, now) < 1 {
+		return true
+	}
+	if s.rateLimits.InputTokens.Limit > 0 && s.inputUsed.remaining(s.rateLimits.InputTokens, now) < response.PromptTokens {
+		return true
+	}
+	if s.rateLimits.OutputTokens.Limit > 0 && s.outputUsed.remaining(s.rateLimits.OutputTokens, now) < response.ResponseTokens {
+		return true
+	}
+	return false
+}
+
+func (a anthropicAPI) consume(s *Server, response Response) {
+	s.requestsUsed.used++
+	s.inputUsed.used += response.PromptTokens
+	s.outputUsed.used += response.ResponseTokens
+}
+
+func (a anthropicAPI) error(w http.ResponseWriter, statusCode int, message string) {
+	var e anthropicError
+	e.Type = "error"
+	e.Error.Type = "api_error"
+	if statusCode == http.StatusTooManyRequests {
+		e.Error.Type = "rate_limit_error"
+	}
+	e.Error.Message = message
+	writeJSON(w, statusCode, e)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
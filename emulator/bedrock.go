@@ -0,0 +1,274 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+type bedrockToolUse struct {
+	ToolUseID string          `json:"toolUseId"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input,omitempty"`
+}
+
+type bedrockReasoningText struct {
+	Text      string `json:"text"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type bedrockReasoningContent struct {
+	ReasoningText *bedrockReasoningText `json:"reasoningText,omitempty"`
+}
+
+type bedrockContent struct {
+	Text             *string                  `json:"text,omitempty"`
+	ToolUse          *bedrockToolUse          `json:"toolUse,omitempty"`
+	ReasoningContent *bedrockReasoningContent `json:"reasoningContent,omitempty"`
+}
+
+type bedrockMessage struct {
+	Role    string           `json:"role"`
+	Content []bedrockContent `json:"content"`
+}
+
+type bedrockOutput struct {
+	Message bedrockMessage `json:"message"`
+}
+
+type bedrockUsage struct {
+	InputTokens          int `json:"inputTokens"`
+	OutputTokens         int `json:"outputTokens"`
+	TotalTokens          int `json:"totalTokens"`
+	CacheReadInputTokens int `json:"cacheReadInputTokens,omitempty"`
+}
+
+type bedrockMetrics struct {
+	LatencyMs int `json:"latencyMs"`
+}
+
+type bedrockResponse struct {
+	Output     bedrockOutput  `json:"output"`
+	StopReason string         `json:"stopReason"`
+	Usage      bedrockUsage   `json:"usage"`
+	Metrics    bedrockMetrics `json:"metrics"`
+}
+
+type bedrockError struct {
+	Message string `json:"message"`
+}
+
+type bedrockAPI struct{}
+
+var _ api = bedrockAPI{}
+
+// NewBedrock returns a new emulator of Amazon Bedrock Converse API
+// which responds with provided scripted responses.
+//
+// Requests are not required to be signed. Bedrock does not emit rate limit
+// headers, but rate limits are still enforced and exceeding them is reported
+// as ThrottlingException.
+//
+// Close it when you are done with it.
+func NewBedrock(responses ...Response) *Server {
+	return newServer(bedrockAPI{}, RateLimits{ //nolint:exhaustruct
+		Requests: RateLimit{Limit: 1_000, Window: time.Minute},     //nolint:mnd
+		Tokens:   RateLimit{Limit: 1_000_000, Window: time.Minute}, //nolint:mnd
+	}, responses)
+}
+
+func (a bedrockAPI) requestIDHeader() string {
+	return "X-Amzn-Requestid"
+}
+
+func (a bedrockAPI) handle(s *Server, w http.ResponseWriter, req Request, _ bool) {
+	model, method, _ := strings.Cut(strings.TrimPrefix(req.Path, "/model/"), "/")
+
+	switch {
+	case req.Method != http.MethodPost || !strings.HasPrefix(req.Path, "/model/") || model == "":
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+	case method == "converse":
+		a.converse(s, w, req, false)
+	case method == "converse-stream":
+		a.converse(s, w, req, true)
+	default:
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (a bedrockAPI) converse(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	response, ok := s.next(w, req)
+	if !ok {
+		return
+	}
+
+	usage := bedrockUsage{
+		InputTokens:          response.PromptTokens,
+		OutputTokens:         response.ResponseTokens + response.ThinkingTokens,
+		TotalTokens:          response.PromptTokens + response.ResponseTokens + response.ThinkingTokens + response.CachedTokens,
+		CacheReadInputTokens: response.CachedTokens,
+	}
+
+	content := []bedrockContent{}
+	if response.Thinking != "" {
+		content = append(content, bedrockContent{ //nolint:exhaustruct
+			ReasoningContent: &bedrockReasoningContent{
+				ReasoningText: &bedrockReasoningText{
+					Text:      response.Thinking,
+					Signature: "signature",
+				},
+			},
+		})
+	}
+	if response.Content != "" || len(response.ToolCalls) == 0 {
+		content = append(content, bedrockContent{ //nolint:exhaustruct
+			Text: &response.Content,
+		})
+	}
+	for i, toolCall := range response.ToolCalls {
+		content = append(content, bedrockContent{ //nolint:exhaustruct
+			ToolUse: &bedrockToolUse{
+				ToolUseID: toolCallID(req, toolCall, i),
+				Name:      toolCall.Name,
+				Input:     toolCall.Input,
+			},
+		})
+	}
+
+	stopReason := "end_turn"
+	if len(response.ToolCalls) > 0 {
+		stopReason = "tool_use"
+	}
+
+	if !stream {
+		writeJSON(w, http.StatusOK, bedrockResponse{
+			Output: bedrockOutput{
+				Message: bedrockMessage{Role: "assistant", Content: content},
+			},
+			StopReason: stopReason,
+			Usage:      usage,
+			Metrics:    bedrockMetrics{LatencyMs: 1},
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	w.WriteHeader(http.StatusOK)
+
+	writeAWSEvent(w, "messageStart", map[string]any{"role": "assistant"})
+	for i, c := range content {
+		switch {
+		case c.ReasoningContent != nil:
+			writeAWSEvent(w, "contentBlockDelta", map[string]any{
+				"contentBlockIndex": i,
+				"delta":             map[string]any{"reasoningContent": map[string]any{"text": c.ReasoningContent.ReasoningText.Text}},
+			})
+			writeAWSEvent(w, "contentBlockDelta", map[string]any{
+				"contentBlockIndex": i,
+				"delta":             map[string]any{"reasoningContent": map[string]any{"signature": c.ReasoningContent.ReasoningText.Signature}},
+			})
+		case c.Text != nil:
+			writeAWSEvent(w, "contentBlockDelta", map[string]any{
+				"contentBlockIndex": i,
+				"delta":             map[string]any{"text": *c.Text},
+			})
+		case c.ToolUse != nil:
+			writeAWSEvent(w, "contentBlockStart", map[string]any{
+				"contentBlockIndex": i,
+				"start": map[string]any{"toolUse": bedrockToolUse{
+					ToolUseID: c.ToolUse.ToolUseID,
+					Name:      c.ToolUse.Name,
+					Input:     nil,
+				}},
+			})
+			writeAWSEvent(w, "contentBlockDelta", map[string]any{
+				"contentBlockIndex": i,
+				"delta":             map[string]any{"toolUse": map[string]any{"input": string(c.ToolUse.Input)}},
+			})
+		}
+		writeAWSEvent(w, "contentBlockStop", map[string]any{"contentBlockIndex": i})
+	}
+	writeAWSEvent(w, "messageStop", map[string]any{"stopReason": stopReason})
+	writeAWSEvent(w, "metadata", map[string]any{"usage": usage, "metrics": bedrockMetrics{LatencyMs: 1}})
+}
+
+// writeAWSEvent writes one message in the AWS event stream encoding.
+//
+// See: https://docs.aws.amazon.com/transcribe/latest/dg/streaming-setting-up.html
+func writeAWSEvent(w http.ResponseWriter, event string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+
+	var headers bytes.Buffer
+	for _, header := range [][2]string{
+		{":event-type", event},
+		{":content-type", "application/json"},
+		{":message-type", "event"},
+	} {
+		headers.WriteByte(byte(len(header[0])))
+		headers.WriteString(header[0])
+		// String header value type.
+		headers.WriteByte(7)                                                 //nolint:mnd
+		_ = binary.Write(&headers, binary.BigEndian, uint16(len(header[1]))) //nolint:gosec
+		headers.WriteString(header[1])
+	}
+
+	// Prelude (total length, headers length, and prelude CRC), headers, payload, and message CRC.
+	totalLength := 12 + headers.Len() + len(payload) + 4 //nolint:mnd
+	message := make([]byte, 0, totalLength)
+	message = binary.BigEndian.AppendUint32(message, uint32(totalLength))   //nolint:gosec
+	message = binary.BigEndian.AppendUint32(message, uint32(headers.Len())) //nolint:gosec
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+	message = append(message, headers.Bytes()...)
+	message = append(message, payload...)
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+
+	_, _ = w.Write(message)
+}
+
+func (a bedrockAPI) rateLimitHeaders(_ *Server, _ http.Header, _ time.Time) {
+	// Bedrock does not provide rate limit headers.
+}
+
+func (a bedrockAPI) exceeds(s *Server, response Response, now time.Time) bool {
+	if s.rateLimits.Requests.Limit > 0 && s.requestsUsed.remaining(s.rateLimits.Requests, now) < 1 {
+		return true
+	}
+	if s.rateLimits.Tokens.Limit > 0 && s.tokensUsed.remaining(s.rateLimits.Tokens, now) < response.PromptTokens+response.ResponseTokens+response.ThinkingTokens {
+		return true
+	}
+	return false
+}
+
+func (a bedrockAPI) consume(s *Server, response Response) {
+	s.requestsUsed.used++
+	s.tokensUsed.used += response.PromptTokens + response.ResponseTokens + response.ThinkingTokens
+}
+
+func (a bedrockAPI) error(w http.ResponseWriter, statusCode int, message string) {
+	var errorType string
+	switch statusCode {
+	case http.StatusBadRequest:
+		errorType = "ValidationException"
+	case http.StatusForbidden:
+		errorType = "AccessDeniedException"
+	case http.StatusNotFound:
+		errorType = "ResourceNotFoundException"
+	case http.StatusTooManyRequests:
+		errorType = "ThrottlingException"
+	case http.StatusServiceUnavailable:
+		errorType = "ServiceUnavailableException"
+	default:
+		errorType = "InternalServerException"
+	}
+	w.Header().Set("X-Amzn-Errortype", errorType+":http://internal.amazon.com/coral/com.amazon.bedrock/")
+	writeJSON(w, statusCode, bedrockError{Message: message})
+}
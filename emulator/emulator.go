@@ -0,0 +1,350 @@
+// Package emulator provides local HTTP servers which emulate HTTP APIs of AI
+// providers (Anthropic, OpenAI, Azure OpenAI, Groq, Gemini, Bedrock, and llama.cpp server)
+// with scripted responses.
+//
+// They speak the same wire formats as real APIs, emit rate limit headers,
+// and can inject errors, so that providers from [gitlab.com/tozd/go/fun]
+// can be tested end to end without network access.
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// ToolCall is a tool call requested by the emulated AI model.
+type ToolCall struct {
+	// ID of the tool call. If not provided, it is generated.
+	ID string
+
+	// Name of the tool to call.
+	Name string
+
+	// Input to the tool.
+	Input json.RawMessage
+}
+
+// Request is a request received by the emulator.
+type Request struct {
+	// Method of the request.
+	Method string
+
+	// Path of the request URL.
+	Path string
+
+	// Query of the request URL.
+	Query url.Values
+
+	// Header of the request.
+	Header http.Header
+
+	// Body of the request.
+	Body json.RawMessage
+
+	number int
+}
+
+// Response is a scripted response of the emulator.
+type Response struct {
+	// Check, if set, is called with the request before responding.
+	// If it returns an error, the emulator responds with 400 status
+	// code and the error message in the body.
+	Check func(req Request) error
+
+	// Content of the response.
+	Content string
+
+	// ToolCalls the emulated AI model requests.
+	ToolCalls []ToolCall
+
+	// PromptTokens is the number of tokens reported as used by the prompt.
+	PromptTokens int
+
+	// ResponseTokens is the number of tokens reported as used by the response.
+	ResponseTokens int
+
+	// Thinking is the thought summary of the response.
+	// It is used by Gemini, Bedrock, and OpenAI responses emulators.
+	Thinking string
+
+	// ThinkingTokens is the number of tokens reported as used by thinking.
+	// It is used by Gemini, Bedrock, and OpenAI responses emulators.
+	ThinkingTokens int
+
+	// CachedTokens is the number of prompt tokens reported as read from the cache.
+	// It is used by Gemini, Bedrock, and OpenAI responses emulators.
+	CachedTokens int
+
+	// StatusCode, if set to an error HTTP status code (e.g., 429, 500, or 524),
+	// makes the emulator respond with an error with that status code instead.
+	StatusCode int
+}
+
+// RateLimit is a rate limit enforced by the emulator.
+type RateLimit struct {
+	// Limit is the number of requests or tokens allowed in a window.
+	Limit int
+
+	// Window is the duration of the window after which the limit resets.
+	Window time.Duration
+}
+
+// RateLimits are rate limits enforced by the emulator. Rate limit headers are
+// emitted for all of them and when a request would exceed any of them, the emulator
+// responds with 429 status code instead of consuming a scripted response.
+type RateLimits struct {
+	// Requests is the limit on the number of requests.
+	Requests RateLimit
+
+	// Tokens is the limit on the number of tokens (prompt and response tokens combined).
+	// It is used by OpenAI, Azure OpenAI, Groq, Gemini, Bedrock, and llama.cpp emulators.
+	Tokens RateLimit
+
+	// InputTokens is the limit on the number of prompt tokens.
+	// It is used by Anthropic emulator.
+	InputTokens RateLimit
+
+	// OutputTokens is the limit on the number of response tokens.
+	// It is used by Anthropic emulator.
+	OutputTokens RateLimit
+}
+
+type window struct {
+	used   int
+	resets time.Time
+}
+
+func (w *window) remaining(limit RateLimit, now time.Time) int {
+	if !w.resets.After(now) {
+		w.used = 0
+		w.resets = now.Add(limit.Window)
+	}
+	return limit.Limit - w.used
+}
+
+type api interface {
+	handle(s *Server, w http.ResponseWriter, req Request, stream bool)
+	rateLimitHeaders(s *Server, header http.Header, now time.Time)
+	exceeds(s *Server, response Response, now time.Time) bool
+	consume(s *Server, response Response)
+	error(w http.ResponseWriter, statusCode int, message string)
+	requestIDHeader() string
+}
+
+// Server is an emulator of an AI provider's HTTP API.
+//
+// Scripted responses are consumed in order, one per request to the
+// chat endpoint. When there are no more scripted responses, the emulator
+// responds with 500 status code.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	api           api
+	responses     []Response
+	requests      []Request
+	rateLimits    RateLimits
+	requestsUsed  window
+	tokensUsed    window
+	inputUsed     window
+	outputUsed    window
+	requestNumber int
+}
+
+func newServer(a api, rateLimits RateLimits, responses []Response) *Server {
+	s := &Server{ //nolint:exhaustruct
+		api:        a,
+		responses:  responses,
+		rateLimits: rateLimits,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Enqueue adds scripted responses.
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses = append(s.responses, responses...)
+}
+
+// SetRateLimits sets rate limits enforced by the emulator, resetting their windows.
+func (s *Server) SetRateLimits(rateLimits RateLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimits = rateLimits
+	s.requestsUsed = window{}
+	s.tokensUsed = window{}
+	s.inputUsed = window{}
+	s.outputUsed = window{}
+}
+
+// Remaining returns the number of scripted responses not yet consumed.
+func (s *Server) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.responses)
+}
+
+// Requests returns all requests received by the emulator.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// Client returns a HTTP client which sends all requests to the emulator,
+// regardless of their URL.
+func (s *Server) Client() *http.Client {
+	u, _ := url.Parse(s.URL)
+	return &http.Client{ //nolint:exhaustruct
+		Transport: rewriteTransport{
+			URL:       u,
+			Transport: s.Server.Client().Transport,
+		},
+	}
+}
+
+type rewriteTransport struct {
+	URL       *url.URL
+	Transport http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.URL.Scheme
+	r.URL.Host = t.URL.Host
+	r.Host = t.URL.Host
+	return t.Transport.RoundTrip(r) //nolint:wrapcheck
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.api.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requestNumber++
+	req := Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+		number: s.requestNumber,
+	}
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	if header := s.api.requestIDHeader(); header != "" {
+		w.Header().Set(header, fmt.Sprintf("req_%d", req.number))
+	}
+
+	var options struct {
+		Stream bool `json:"stream"`
+	}
+	if len(body) > 0 {
+		// Errors are ignored here and handled (if necessary) by the API.
+		_ = json.Unmarshal(body, &options)
+	}
+
+	s.api.handle(s, w, req, options.Stream)
+}
+
+// next returns the next scripted response, or false if the emulator already responded.
+func (s *Server) next(w http.ResponseWriter, req Request) (Response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if len(s.responses) == 0 {
+		s.api.error(w, http.StatusInternalServerError, "no more scripted responses")
+		return Response{}, false //nolint:exhaustruct
+	}
+	response := s.responses[0]
+
+	if s.api.exceeds(s, response, now) {
+		s.api.rateLimitHeaders(s, w.Header(), now)
+		s.api.error(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return Response{}, false //nolint:exhaustruct
+	}
+
+	s.responses = s.responses[1:]
+
+	if response.Check != nil {
+		err := response.Check(req)
+		if err != nil {
+			s.api.error(w, http.StatusBadRequest, err.Error())
+			return Response{}, false //nolint:exhaustruct
+		}
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		s.api.rateLimitHeaders(s, w.Header(), now)
+		if response.StatusCode == 524 { //nolint:mnd
+			// Cloudflare responds with an HTML page.
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(response.StatusCode)
+			_, _ = w.Write([]byte("<html><body>A timeout occurred</body></html>"))
+			return Response{}, false //nolint:exhaustruct
+		}
+		s.api.error(w, response.StatusCode, http.StatusText(response.StatusCode))
+		return Response{}, false //nolint:exhaustruct
+	}
+
+	s.api.consume(s, response)
+	s.api.rateLimitHeaders(s, w.Header(), now)
+
+	return response, true
+}
+
+func toolCallID(req Request, toolCall ToolCall, i int) string {
+	if toolCall.ID != "" {
+		return toolCall.ID
+	}
+	return fmt.Sprintf("call_%d_%d", req.number, i)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(data)
+}
+
+func writeEvent(w http.ResponseWriter, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	if event != "" {
+		_, _ = fmt.Fprintf(w, "event: %s\n", event)
+	}
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+func startEvents(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+}
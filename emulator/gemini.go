@@ -0,0 +1,218 @@
+package emulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+}
+
+type geminiPart struct {
+	Text         *string             `json:"text,omitempty"`
+	Thought      bool                `json:"thought,omitempty"`
+	FunctionCall *geminiFunctionCall `json:"functionCall,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates    []geminiCandidate `json:"candidates"`
+	UsageMetadata geminiUsage       `json:"usageMetadata"`
+	ModelVersion  string            `json:"modelVersion"`
+	ResponseID    string            `json:"responseId"`
+}
+
+type geminiModel struct {
+	Name             string `json:"name"`
+	Version          string `json:"version"`
+	DisplayName      string `json:"displayName"`
+	InputTokenLimit  int    `json:"inputTokenLimit"`
+	OutputTokenLimit int    `json:"outputTokenLimit"`
+}
+
+type geminiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+type geminiAPI struct{}
+
+var _ api = geminiAPI{}
+
+// NewGemini returns a new emulator of Gemini generate content and models API
+// which responds with provided scripted responses.
+//
+// Gemini API does not emit rate limit headers, but rate limits are still enforced.
+// Models are reported with input token limit of 1,048,576 tokens
+// and output token limit of 65,536 tokens.
+//
+// Close it when you are done with it.
+func NewGemini(responses ...Response) *Server {
+	return newServer(geminiAPI{}, RateLimits{ //nolint:exhaustruct
+		Requests: RateLimit{Limit: 1_000, Window: time.Minute},     //nolint:mnd
+		Tokens:   RateLimit{Limit: 1_000_000, Window: time.Minute}, //nolint:mnd
+	}, responses)
+}
+
+func (a geminiAPI) requestIDHeader() string {
+	// Gemini API does not provide a request ID header.
+	return ""
+}
+
+func (a geminiAPI) handle(s *Server, w http.ResponseWriter, req Request, _ bool) {
+	model, method, _ := strings.Cut(strings.TrimPrefix(req.Path, "/v1beta/models/"), ":")
+
+	switch {
+	case !strings.HasPrefix(req.Path, "/v1beta/models/") || model == "":
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+	case req.Method == http.MethodPost && method == "generateContent":
+		a.generate(s, w, req, model, false)
+	case req.Method == http.MethodPost && method == "streamGenerateContent":
+		a.generate(s, w, req, model, true)
+	case req.Method == http.MethodGet && method == "":
+		writeJSON(w, http.StatusOK, geminiModel{
+			Name:             "models/" + model,
+			Version:          "001",
+			DisplayName:      model,
+			InputTokenLimit:  1_048_576, //nolint:mnd
+			OutputTokenLimit: 65_536,    //nolint:mnd
+		})
+	default:
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (a geminiAPI) generate(s *Server, w http.ResponseWriter, req Request, model string, stream bool) {
+	response, ok := s.next(w, req)
+	if !ok {
+		return
+	}
+
+	id := "resp_" + strconv.Itoa(req.number)
+	usage := geminiUsage{
+		PromptTokenCount:        response.PromptTokens,
+		CandidatesTokenCount:    response.ResponseTokens,
+		TotalTokenCount:         response.PromptTokens + response.ResponseTokens + response.ThinkingTokens,
+		CachedContentTokenCount: response.CachedTokens,
+		ThoughtsTokenCount:      response.ThinkingTokens,
+	}
+
+	parts := []geminiPart{}
+	if response.Thinking != "" {
+		parts = append(parts, geminiPart{Text: &response.Thinking, Thought: true, FunctionCall: nil})
+	}
+	if response.Content != "" || len(response.ToolCalls) == 0 {
+		parts = append(parts, geminiPart{Text: &response.Content, Thought: false, FunctionCall: nil})
+	}
+	for i, toolCall := range response.ToolCalls {
+		parts = append(parts, geminiPart{
+			Text:    nil,
+			Thought: false,
+			FunctionCall: &geminiFunctionCall{
+				ID:   toolCallID(req, toolCall, i),
+				Name: toolCall.Name,
+				Args: toolCall.Input,
+			},
+		})
+	}
+
+	if !stream {
+		writeJSON(w, http.StatusOK, geminiResponse{
+			Candidates: []geminiCandidate{{
+				Content:      geminiContent{Role: "model", Parts: parts},
+				FinishReason: "STOP",
+				Index:        0,
+			}},
+			UsageMetadata: usage,
+			ModelVersion:  model,
+			ResponseID:    id,
+		})
+		return
+	}
+
+	startEvents(w)
+
+	// Every part is sent in its own chunk and the finish reason with the last one.
+	// Usage metadata is cumulative, so we send the complete usage with every chunk.
+	for i, part := range parts {
+		finishReason := ""
+		if i == len(parts)-1 {
+			finishReason = "STOP"
+		}
+		writeEvent(w, "", geminiResponse{
+			Candidates: []geminiCandidate{{
+				Content:      geminiContent{Role: "model", Parts: []geminiPart{part}},
+				FinishReason: finishReason,
+				Index:        0,
+			}},
+			UsageMetadata: usage,
+			ModelVersion:  model,
+			ResponseID:    id,
+		})
+	}
+}
+
+func (a geminiAPI) rateLimitHeaders(_ *Server, _ http.Header, _ time.Time) {
+	// Gemini API does not provide rate limit headers.
+}
+
+func (a geminiAPI) exceeds(s *Server, response Response, now time.Time) bool {
+	if s.rateLimits.Requests.Limit > 0 && s.requestsUsed.remaining(s.rateLimits.Requests, now) < 1 {
+		return true
+	}
+	if s.rateLimits.Tokens.Limit > 0 && s.tokensUsed.remaining(s.rateLimits.Tokens, now) < response.PromptTokens+response.ResponseTokens+response.ThinkingTokens {
+		return true
+	}
+	return false
+}
+
+func (a geminiAPI) consume(s *Server, response Response) {
+	s.requestsUsed.used++
+	s.tokensUsed.used += response.PromptTokens + response.ResponseTokens + response.ThinkingTokens
+}
+
+func (a geminiAPI) error(w http.ResponseWriter, statusCode int, message string) {
+	var e geminiError
+	e.Error.Code = statusCode
+	e.Error.Message = message
+	switch statusCode {
+	case http.StatusBadRequest:
+		e.Error.Status = "INVALID_ARGUMENT"
+	case http.StatusNotFound:
+		e.Error.Status = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		e.Error.Status = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		e.Error.Status = "UNAVAILABLE"
+	default:
+		e.Error.Status = "INTERNAL"
+	}
+	writeJSON(w, statusCode, e)
+}
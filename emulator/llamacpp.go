@@ -0,0 +1,90 @@
+package emulator
+
+import (
+	"net/http"
+	"time"
+)
+
+type llamaCppDefaultGenerationSettings struct {
+	NCtx int `json:"n_ctx"`
+}
+
+type llamaCppProps struct {
+	DefaultGenerationSettings llamaCppDefaultGenerationSettings `json:"default_generation_settings"`
+	TotalSlots                int                               `json:"total_slots"`
+	ModelPath                 string                            `json:"model_path"`
+}
+
+type llamaCppError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// llamaCppAPI emulates llama.cpp server, which serves OpenAI compatible
+// chat completions API next to its own endpoints.
+type llamaCppAPI struct {
+	openAIAPI
+}
+
+var _ api = llamaCppAPI{}
+
+// NewLlamaCpp returns a new emulator of llama.cpp server's chat completions
+// and props API which responds with provided scripted responses.
+//
+// Props report one slot with context size of 8,192 tokens. llama.cpp server
+// does not have rate limits, so none are enforced by default.
+//
+// Close it when you are done with it.
+func NewLlamaCpp(responses ...Response) *Server {
+	return newServer(llamaCppAPI{openAIAPI{groq: false, azure: false}}, RateLimits{}, responses) //nolint:exhaustruct
+}
+
+func (a llamaCppAPI) requestIDHeader() string {
+	// llama.cpp server does not provide request ID header.
+	return ""
+}
+
+func (a llamaCppAPI) handle(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	switch {
+	case req.Method == http.MethodPost && (req.Path == "/v1/chat/completions" || req.Path == "/chat/completions"):
+		a.chat(s, w, req, stream)
+	case req.Method == http.MethodGet && req.Path == "/props":
+		writeJSON(w, http.StatusOK, llamaCppProps{
+			DefaultGenerationSettings: llamaCppDefaultGenerationSettings{
+				NCtx: 8_192, //nolint:mnd
+			},
+			TotalSlots: 1,
+			ModelPath:  "models/emulator.gguf",
+		})
+	default:
+		a.error(w, http.StatusNotFound, "File Not Found")
+	}
+}
+
+func (a llamaCppAPI) rateLimitHeaders(_ *Server, _ http.Header, _ time.Time) {
+	// llama.cpp server does not provide rate limit headers.
+}
+
+func (a llamaCppAPI) error(w http.ResponseWriter, statusCode int, message string) {
+	var e llamaCppError
+	e.Error.Code = statusCode
+	e.Error.Message = message
+	switch statusCode {
+	case http.StatusBadRequest:
+		e.Error.Type = "invalid_request_error"
+	case http.StatusUnauthorized:
+		e.Error.Type = "authentication_error"
+	case http.StatusNotFound:
+		e.Error.Type = "not_found_error"
+	case http.StatusNotImplemented:
+		e.Error.Type = "not_supported_error"
+	case http.StatusServiceUnavailable:
+		e.Error.Type = "unavailable_error"
+	default:
+		e.Error.Type = "server_error"
+	}
+	writeJSON(w, statusCode, e)
+}
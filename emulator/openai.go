@@ -0,0 +1,347 @@
+package emulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIMessage struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      openAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIResponse struct {
+	ID                string         `json:"id"`
+	Object            string         `json:"object"`
+	Created           int64          `json:"created"`
+	Model             string         `json:"model"`
+	SystemFingerprint string         `json:"system_fingerprint"`
+	Choices           []openAIChoice `json:"choices"`
+	Usage             openAIUsage    `json:"usage"`
+}
+
+type openAIStreamChoice struct {
+	Index        int           `json:"index"`
+	Delta        openAIMessage `json:"delta"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+type openAIStreamChunk struct {
+	ID                string               `json:"id"`
+	Object            string               `json:"object"`
+	Created           int64                `json:"created"`
+	Model             string               `json:"model"`
+	SystemFingerprint string               `json:"system_fingerprint"`
+	Choices           []openAIStreamChoice `json:"choices"`
+	Usage             *openAIUsage         `json:"usage,omitempty"`
+	XGroq             *groqXGroq           `json:"x_groq,omitempty"`
+}
+
+type groqXGroq struct {
+	ID    string       `json:"id"`
+	Usage *openAIUsage `json:"usage,omitempty"`
+}
+
+type groqModel struct {
+	ID                  string `json:"id"`
+	Object              string `json:"object"`
+	Created             int64  `json:"created"`
+	OwnedBy             string `json:"owned_by"`
+	Active              bool   `json:"active"`
+	ContextWindow       int    `json:"context_window"`
+	MaxCompletionTokens int    `json:"max_completion_tokens"`
+}
+
+type openAIError struct {
+	Error struct {
+		Code    string `json:"code,omitempty"`
+		Message string `json:"message"`
+		Type    string `json:"type,omitempty"`
+	} `json:"error"`
+}
+
+type openAIAPI struct {
+	// groq is true when emulating Groq API, which is OpenAI compatible
+	// but has its own paths, the models endpoint, and reports usage
+	// inside x_groq when streaming.
+	groq bool
+
+	// azure is true when emulating Azure OpenAI API, which uses deployment
+	// paths with api-version query parameter and reports only remaining
+	// rate limits.
+	azure bool
+}
+
+var _ api = openAIAPI{}
+
+// NewOpenAI returns a new emulator of OpenAI chat completions and responses API
+// which responds with provided scripted responses.
+//
+// Close it when you are done with it.
+func NewOpenAI(responses ...Response) *Server {
+	return newServer(openAIAPI{groq: false, azure: false}, RateLimits{ //nolint:exhaustruct
+		Requests: RateLimit{Limit: 10_000, Window: time.Minute},     //nolint:mnd
+		Tokens:   RateLimit{Limit: 10_000_000, Window: time.Minute}, //nolint:mnd
+	}, responses)
+}
+
+// NewGroq returns a new emulator of Groq chat completions and models API
+// which responds with provided scripted responses.
+//
+// Models are reported as active with context window of 131,072 tokens
+// and max completion tokens of 32,768.
+//
+// Close it when you are done with it.
+func NewGroq(responses ...Response) *Server {
+	return newServer(openAIAPI{groq: true, azure: false}, RateLimits{ //nolint:exhaustruct
+		Requests: RateLimit{Limit: 14_400, Window: 24 * time.Hour}, //nolint:mnd
+		Tokens:   RateLimit{Limit: 1_000_000, Window: time.Minute}, //nolint:mnd
+	}, responses)
+}
+
+// NewAzureOpenAI returns a new emulator of Azure OpenAI chat completions API
+// which responds with provided scripted responses.
+//
+// Any deployment name is accepted, but the api-version query parameter is required.
+// Only remaining requests and tokens are reported in rate limit headers.
+//
+// Close it when you are done with it.
+func NewAzureOpenAI(responses ...Response) *Server {
+	return newServer(openAIAPI{groq: false, azure: true}, RateLimits{ //nolint:exhaustruct
+		Requests: RateLimit{Limit: 1_000, Window: 10 * time.Second}, //nolint:mnd
+		Tokens:   RateLimit{Limit: 1_000_000, Window: time.Minute},  //nolint:mnd
+	}, responses)
+}
+
+func (a openAIAPI) requestIDHeader() string {
+	return "X-Request-Id"
+}
+
+func (a openAIAPI) handle(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	chatPath := "/v1/chat/completions"
+	if a.groq {
+		chatPath = "/openai/v1/chat/completions"
+	}
+
+	if a.azure {
+		switch {
+		case req.Method == http.MethodPost && strings.HasPrefix(req.Path, "/openai/deployments/") &&
+			strings.HasSuffix(req.Path, "/chat/completions") && req.Query.Get("api-version") != "":
+			a.chat(s, w, req, stream)
+		default:
+			a.error(w, http.StatusNotFound, "Resource not found")
+		}
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPost && req.Path == chatPath:
+		a.chat(s, w, req, stream)
+	case !a.groq && req.Method == http.MethodPost && req.Path == "/v1/responses":
+		a.responses(s, w, req, stream)
+	case a.groq && req.Method == http.MethodGet && strings.HasPrefix(req.Path, "/openai/v1/models/"):
+		writeJSON(w, http.StatusOK, groqModel{
+			ID:                  strings.TrimPrefix(req.Path, "/openai/v1/models/"),
+			Object:              "model",
+			Created:             time.Now().Unix(),
+			OwnedBy:             "emulator",
+			Active:              true,
+			ContextWindow:       131_072, //nolint:mnd
+			MaxCompletionTokens: 32_768,  //nolint:mnd
+		})
+	default:
+		a.error(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (a openAIAPI) chat(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	response, ok := s.next(w, req)
+	if !ok {
+		return
+	}
+
+	var model struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(req.Body, &model)
+
+	id := "chatcmpl-" + strconv.Itoa(req.number)
+	created := time.Now().Unix()
+	usage := openAIUsage{
+		PromptTokens:     response.PromptTokens,
+		CompletionTokens: response.ResponseTokens,
+		TotalTokens:      response.PromptTokens + response.ResponseTokens,
+	}
+
+	finishReason := "stop"
+	toolCalls := []openAIToolCall{}
+	for i, toolCall := range response.ToolCalls {
+		tc := openAIToolCall{ //nolint:exhaustruct
+			Index: &i,
+			ID:    toolCallID(req, toolCall, i),
+			Type:  "function",
+		}
+		tc.Function.Name = toolCall.Name
+		tc.Function.Arguments = string(toolCall.Input)
+		toolCalls = append(toolCalls, tc)
+	}
+	var content *string
+	if len(toolCalls) > 0 {
+		finishReason = "tool_calls"
+		if response.Content != "" {
+			content = &response.Content
+		}
+	} else {
+		content = &response.Content
+	}
+
+	if !stream {
+		for i := range toolCalls {
+			toolCalls[i].Index = nil
+		}
+		writeJSON(w, http.StatusOK, openAIResponse{
+			ID:                id,
+			Object:            "chat.completion",
+			Created:           created,
+			Model:             model.Model,
+			SystemFingerprint: "fp_emulator",
+			Choices: []openAIChoice{{
+				Index: 0,
+				Message: openAIMessage{
+					Role:      "assistant",
+					Content:   content,
+					ToolCalls: toolCalls,
+				},
+				FinishReason: finishReason,
+			}},
+			Usage: usage,
+		})
+		return
+	}
+
+	chunk := func(choices []openAIStreamChoice) openAIStreamChunk {
+		return openAIStreamChunk{
+			ID:                id,
+			Object:            "chat.completion.chunk",
+			Created:           created,
+			Model:             model.Model,
+			SystemFingerprint: "fp_emulator",
+			Choices:           choices,
+			Usage:             nil,
+			XGroq:             nil,
+		}
+	}
+
+	startEvents(w)
+
+	empty := ""
+	if content == nil {
+		content = &empty
+	}
+	writeEvent(w, "", chunk([]openAIStreamChoice{{
+		Index:        0,
+		Delta:        openAIMessage{Role: "assistant", Content: content, ToolCalls: nil},
+		FinishReason: nil,
+	}}))
+	for _, toolCall := range toolCalls {
+		writeEvent(w, "", chunk([]openAIStreamChoice{{
+			Index:        0,
+			Delta:        openAIMessage{Role: "", Content: nil, ToolCalls: []openAIToolCall{toolCall}},
+			FinishReason: nil,
+		}}))
+	}
+	last := chunk([]openAIStreamChoice{{
+		Index:        0,
+		Delta:        openAIMessage{Role: "", Content: nil, ToolCalls: nil},
+		FinishReason: &finishReason,
+	}})
+	if a.groq {
+		last.XGroq = &groqXGroq{
+			ID:    "req_" + strconv.Itoa(req.number),
+			Usage: &usage,
+		}
+	}
+	writeEvent(w, "", last)
+	if !a.groq {
+		// Usage is sent in a separate chunk when requested with stream_options.
+		u := chunk([]openAIStreamChoice{})
+		u.Usage = &usage
+		writeEvent(w, "", u)
+	}
+	_, _ = w.Write([]byte("data: [DONE]\n\n"))
+}
+
+func (a openAIAPI) rateLimitHeaders(s *Server, header http.Header, now time.Time) {
+	if s.rateLimits.Requests.Limit == 0 || s.rateLimits.Tokens.Limit == 0 {
+		return
+	}
+
+	if a.azure {
+		header.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(max(0, s.requestsUsed.remaining(s.rateLimits.Requests, now))))
+		header.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(max(0, s.tokensUsed.remaining(s.rateLimits.Tokens, now))))
+		return
+	}
+
+	header.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(s.rateLimits.Requests.Limit))
+	header.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(s.rateLimits.Tokens.Limit))
+	header.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(max(0, s.requestsUsed.remaining(s.rateLimits.Requests, now))))
+	header.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(max(0, s.tokensUsed.remaining(s.rateLimits.Tokens, now))))
+	header.Set("X-Ratelimit-Reset-Requests", s.requestsUsed.resets.Sub(now).Round(time.Millisecond).String())
+	header.Set("X-Ratelimit-Reset-Tokens", s.tokensUsed.resets.Sub(now).Round(time.Millisecond).String())
+}
+
+func (a openAIAPI) exceeds(s *Server, response Response, now time.Time) bool {
+	if s.rateLimits.Requests.Limit > 0 && s.requestsUsed.remaining(s.rateLimits.Requests, now) < 1 {
+		return true
+	}
+	if s.rateLimits.Tokens.Limit > 0 && s.tokensUsed.remaining(s.rateLimits.Tokens, now) < response.PromptTokens+response.ResponseTokens+response.ThinkingTokens {
+		return true
+	}
+	return false
+}
+
+func (a openAIAPI) consume(s *Server, response Response) {
+	s.requestsUsed.used++
+	s.tokensUsed.used += response.PromptTokens + response.ResponseTokens + response.ThinkingTokens
+}
+
+func (a openAIAPI) error(w http.ResponseWriter, statusCode int, message string) {
+	var e openAIError
+	e.Error.Message = message
+	if a.azure {
+		e.Error.Code = strconv.Itoa(statusCode)
+		writeJSON(w, statusCode, e)
+		return
+	}
+	e.Error.Type = "emulator_error"
+	if statusCode == http.StatusTooManyRequests {
+		e.Error.Type = "rate_limit_exceeded"
+	}
+	writeJSON(w, statusCode, e)
+}
@@ -0,0 +1,190 @@
+package emulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type openAIResponsesContent struct {
+	Type        string   `json:"type"`
+	Text        string   `json:"text"`
+	Annotations []string `json:"annotations"`
+}
+
+type openAIResponsesSummary struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type openAIResponsesItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status,omitempty"`
+
+	Role    string                   `json:"role,omitempty"`
+	Content []openAIResponsesContent `json:"content,omitempty"`
+
+	Summary          *[]openAIResponsesSummary `json:"summary,omitempty"`
+	EncryptedContent string                    `json:"encrypted_content,omitempty"`
+
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+type openAIResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+type openAIResponsesResponse struct {
+	ID        string                `json:"id"`
+	Object    string                `json:"object"`
+	CreatedAt int64                 `json:"created_at"`
+	Status    string                `json:"status"`
+	Model     string                `json:"model"`
+	Output    []openAIResponsesItem `json:"output"`
+	Usage     *openAIResponsesUsage `json:"usage"`
+}
+
+type openAIResponsesEvent struct {
+	Type           string                   `json:"type"`
+	SequenceNumber int                      `json:"sequence_number"`
+	Response       *openAIResponsesResponse `json:"response,omitempty"`
+	OutputIndex    *int                     `json:"output_index,omitempty"`
+	Item           *openAIResponsesItem     `json:"item,omitempty"`
+	ItemID         string                   `json:"item_id,omitempty"`
+	Delta          string                   `json:"delta,omitempty"`
+}
+
+// responses emulates OpenAI Responses API. Reasoning is returned (as a reasoning
+// item with the thought summary and encrypted content) when the response has
+// thinking or thinking tokens. Output tokens include thinking tokens.
+func (a openAIAPI) responses(s *Server, w http.ResponseWriter, req Request, stream bool) {
+	response, ok := s.next(w, req)
+	if !ok {
+		return
+	}
+
+	var model struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(req.Body, &model)
+
+	number := strconv.Itoa(req.number)
+	usage := openAIResponsesUsage{ //nolint:exhaustruct
+		InputTokens:  response.PromptTokens,
+		OutputTokens: response.ResponseTokens + response.ThinkingTokens,
+		TotalTokens:  response.PromptTokens + response.ResponseTokens + response.ThinkingTokens,
+	}
+	usage.InputTokensDetails.CachedTokens = response.CachedTokens
+	usage.OutputTokensDetails.ReasoningTokens = response.ThinkingTokens
+
+	output := []openAIResponsesItem{}
+	if response.Thinking != "" || response.ThinkingTokens > 0 {
+		summary := []openAIResponsesSummary{}
+		if response.Thinking != "" {
+			summary = append(summary, openAIResponsesSummary{Type: "summary_text", Text: response.Thinking})
+		}
+		output = append(output, openAIResponsesItem{ //nolint:exhaustruct
+			Type:             "reasoning",
+			ID:               "rs_" + number,
+			Summary:          &summary,
+			EncryptedContent: "encrypted_" + number,
+		})
+	}
+	if response.Content != "" || len(response.ToolCalls) == 0 {
+		output = append(output, openAIResponsesItem{ //nolint:exhaustruct
+			Type:   "message",
+			ID:     "msg_" + number,
+			Status: "completed",
+			Role:   "assistant",
+			Content: []openAIResponsesContent{{
+				Type:        "output_text",
+				Text:        response.Content,
+				Annotations: []string{},
+			}},
+		})
+	}
+	for i, toolCall := range response.ToolCalls {
+		output = append(output, openAIResponsesItem{ //nolint:exhaustruct
+			Type:      "function_call",
+			ID:        "fc_" + number + "_" + strconv.Itoa(i),
+			Status:    "completed",
+			CallID:    toolCallID(req, toolCall, i),
+			Name:      toolCall.Name,
+			Arguments: string(toolCall.Input),
+		})
+	}
+
+	resp := openAIResponsesResponse{
+		ID:        "resp_" + number,
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "completed",
+		Model:     model.Model,
+		Output:    output,
+		Usage:     &usage,
+	}
+
+	if !stream {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	startEvents(w)
+
+	sequenceNumber := 0
+	event := func(e openAIResponsesEvent) {
+		e.SequenceNumber = sequenceNumber
+		sequenceNumber++
+		writeEvent(w, e.Type, e)
+	}
+
+	created := resp
+	created.Status = "in_progress"
+	created.Output = []openAIResponsesItem{}
+	created.Usage = nil
+	event(openAIResponsesEvent{Type: "response.created", Response: &created}) //nolint:exhaustruct
+
+	for i, item := range output {
+		event(openAIResponsesEvent{Type: "response.output_item.added", OutputIndex: &i, Item: &item}) //nolint:exhaustruct
+		switch item.Type {
+		case "reasoning":
+			for _, summary := range *item.Summary {
+				event(openAIResponsesEvent{ //nolint:exhaustruct
+					Type:        "response.reasoning_summary_text.delta",
+					OutputIndex: &i,
+					ItemID:      item.ID,
+					Delta:       summary.Text,
+				})
+			}
+		case "message":
+			event(openAIResponsesEvent{ //nolint:exhaustruct
+				Type:        "response.output_text.delta",
+				OutputIndex: &i,
+				ItemID:      item.ID,
+				Delta:       item.Content[0].Text,
+			})
+		case "function_call":
+			event(openAIResponsesEvent{ //nolint:exhaustruct
+				Type:        "response.function_call_arguments.delta",
+				OutputIndex: &i,
+				ItemID:      item.ID,
+				Delta:       item.Arguments,
+			})
+		}
+		event(openAIResponsesEvent{Type: "response.output_item.done", OutputIndex: &i, Item: &item}) //nolint:exhaustruct
+	}
+
+	event(openAIResponsesEvent{Type: "response.completed", Response: &resp}) //nolint:exhaustruct
+}
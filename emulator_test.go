@@ -0,0 +1,379 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+//nolint:gochecknoglobals
+var emulatorTests = []struct {
+	Name     string
+	Server   func(responses ...emulator.Response) *emulator.Server
+	Path     string
+	Provider func(client *http.Client, baseURL string) fun.TextProvider
+	// RateLimitHeaders is true if the API provides rate limit headers with limits and resets.
+	RateLimitHeaders bool
+}{
+	{
+		"anthropic",
+		emulator.NewAnthropic,
+		"",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.AnthropicTextProvider{ //nolint:exhaustruct
+				Client:  client,
+				APIKey:  "test",
+				BaseURL: baseURL,
+				Headers: map[string]string{"X-Gateway": "emulator"},
+				Model:   "claude-3-haiku-20240307",
+			}
+		},
+		true,
+	},
+	{
+		"openai",
+		emulator.NewOpenAI,
+		"/v1",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.OpenAITextProvider{ //nolint:exhaustruct
+				Client:            client,
+				APIKey:            "test",
+				BaseURL:           baseURL,
+				Headers:           map[string]string{"X-Gateway": "emulator"},
+				Model:             "gpt-4o-mini-2024-07-18",
+				MaxContextLength:  128_000,
+				MaxResponseLength: 16_384,
+			}
+		},
+		true,
+	},
+	{
+		"openai-responses",
+		emulator.NewOpenAI,
+		"/v1",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.OpenAIResponsesTextProvider{ //nolint:exhaustruct
+				Client:  client,
+				APIKey:  "test",
+				BaseURL: baseURL,
+				Headers: map[string]string{"X-Gateway": "emulator"},
+				Model:   "gpt-4o-mini-2024-07-18",
+			}
+		},
+		true,
+	},
+	{
+		"azure-openai",
+		emulator.NewAzureOpenAI,
+		"",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			if baseURL == "" {
+				// BaseURL is required, but the client rewrites requests to the emulator.
+				baseURL = "https://emulator.openai.azure.com"
+			}
+			return &fun.AzureOpenAITextProvider{ //nolint:exhaustruct
+				Client:     client,
+				APIKey:     "test",
+				BaseURL:    baseURL,
+				Headers:    map[string]string{"X-Gateway": "emulator"},
+				Deployment: "gpt-4o-mini",
+				Model:      "gpt-4o-mini-2024-07-18",
+			}
+		},
+		false,
+	},
+	{
+		"groq",
+		emulator.NewGroq,
+		"/openai/v1",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.GroqTextProvider{ //nolint:exhaustruct
+				Client:  client,
+				APIKey:  "test",
+				BaseURL: baseURL,
+				Headers: map[string]string{"X-Gateway": "emulator"},
+				Model:   "llama-3.1-8b-instant",
+			}
+		},
+		true,
+	},
+	{
+		"gemini",
+		emulator.NewGemini,
+		"/v1beta",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.GeminiTextProvider{ //nolint:exhaustruct
+				Client:  client,
+				APIKey:  "test",
+				BaseURL: baseURL,
+				Headers: map[string]string{"X-Gateway": "emulator"},
+				Model:   "gemini-2.5-flash",
+			}
+		},
+		false,
+	},
+	{
+		"bedrock",
+		emulator.NewBedrock,
+		"",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.BedrockTextProvider{ //nolint:exhaustruct
+				Client:          client,
+				AccessKeyID:     "test",
+				SecretAccessKey: "test",
+				Region:          "us-east-1",
+				BaseURL:         baseURL,
+				Headers:         map[string]string{"X-Gateway": "emulator"},
+				Model:           "anthropic.claude-3-haiku-20240307-v1:0",
+			}
+		},
+		false,
+	},
+	{
+		"llamacpp",
+		emulator.NewLlamaCpp,
+		"",
+		func(client *http.Client, baseURL string) fun.TextProvider {
+			return &fun.LlamaCppTextProvider{ //nolint:exhaustruct
+				Client:  client,
+				BaseURL: baseURL,
+				Headers: map[string]string{"X-Gateway": "emulator"},
+			}
+		},
+		false,
+	},
+}
+
+func TestEmulator(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range emulatorTests {
+		for _, stream := range []bool{false, true} {
+			name := tt.Name
+			if stream {
+				name += "/stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+
+				server := tt.Server(
+					emulator.Response{ //nolint:exhaustruct
+						ToolCalls: []emulator.ToolCall{
+							{ID: "call_1", Name: "repeat_string", Input: json.RawMessage(`{"string":"foo"}`)},
+						},
+						PromptTokens:   100,
+						ResponseTokens: 10,
+					},
+					emulator.Response{ //nolint:exhaustruct
+						Check: func(req emulator.Request) error {
+							if !assert.Contains(t, string(req.Body), "foofoo") {
+								return errors.New("missing tool result")
+							}
+							return nil
+						},
+						Content:        "foofoo",
+						PromptTokens:   120,
+						ResponseTokens: 5,
+					},
+					emulator.Response{ //nolint:exhaustruct
+						StatusCode: http.StatusInternalServerError,
+					},
+				)
+				defer server.Close()
+
+				f := fun.Text[string, string]{
+					Provider:         tt.Provider(server.Client(), ""),
+					InputJSONSchema:  nil,
+					OutputJSONSchema: nil,
+					Prompt:           "Repeat the input twice.",
+					PromptTemplate:   "",
+					InputTemplate:    "",
+					Data:             nil,
+					Tools: map[string]fun.TextTooler{
+						"repeat_string": &fun.TextTool[toolStringInput, string]{
+							Description:      "Repeats the input twice, by concatenating the input string without any space.",
+							InputJSONSchema:  toolInputJSONSchema,
+							OutputJSONSchema: jsonSchemaString,
+							Fun: func(_ context.Context, input toolStringInput) (string, errors.E) {
+								return input.String + input.String, nil
+							},
+						},
+					},
+					MaxRepairAttempts: 0,
+					MaxData:           0,
+					DataScorer:        nil,
+				}
+
+				ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+				errE := f.Init(ctx)
+				require.NoError(t, errE, "% -+#.1v", errE)
+
+				ct := fun.WithTextRecorder(ctx)
+				var output string
+				if stream {
+					events := []string{}
+					output, errE = f.Stream(ct, func(event fun.TextStreamEvent) errors.E {
+						events = append(events, event.Type)
+						return nil
+					}, "foo")
+					assert.Contains(t, events, "text")
+					assert.Contains(t, events, "tool_use")
+				} else {
+					output, errE = f.Call(ct, "foo")
+				}
+				require.NoError(t, errE, "% -+#.1v", errE)
+				assert.Equal(t, "foofoo", output)
+
+				calls := fun.GetTextRecorder(ct).Calls()
+				require.Len(t, calls, 1)
+				total := 0
+				for _, usedTokens := range calls[0].UsedTokens {
+					total += usedTokens.Total
+				}
+				assert.Equal(t, 235, total)
+
+				_, errE = f.Call(ctx, "foo")
+				assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+
+				assert.Equal(t, 0, server.Remaining())
+			})
+		}
+	}
+}
+
+func TestEmulatorRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewOpenAI(
+		emulator.Response{Content: "foo", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+		emulator.Response{Content: "bar", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	server.SetRateLimits(emulator.RateLimits{ //nolint:exhaustruct
+		Requests: emulator.RateLimit{Limit: 1, Window: time.Hour},
+		Tokens:   emulator.RateLimit{Limit: 1000, Window: time.Hour},
+	})
+
+	send := func() *http.Response {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, server.URL+"/v1/chat/completions", strings.NewReader(`{"model":"test"}`))
+		require.NoError(t, err)
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "req_1", resp.Header.Get("X-Request-Id"))
+	assert.Equal(t, "1", resp.Header.Get("X-Ratelimit-Limit-Requests"))
+	assert.Equal(t, "0", resp.Header.Get("X-Ratelimit-Remaining-Requests"))
+	assert.Equal(t, "989", resp.Header.Get("X-Ratelimit-Remaining-Tokens"))
+	assert.NotEmpty(t, resp.Header.Get("X-Ratelimit-Reset-Requests"))
+
+	resp = send()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, server.Remaining())
+	assert.Len(t, server.Requests(), 2)
+}
+
+func TestEmulatorDefaultClient(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range emulatorTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			checkHeaders := func(req emulator.Request) error {
+				if req.Header.Get("X-Gateway") != "emulator" {
+					return errors.New("missing header")
+				}
+				return nil
+			}
+
+			server := tt.Server(
+				emulator.Response{StatusCode: http.StatusTooManyRequests},                                   //nolint:exhaustruct
+				emulator.Response{StatusCode: 524},                                                          //nolint:exhaustruct
+				emulator.Response{StatusCode: http.StatusServiceUnavailable},                                //nolint:exhaustruct
+				emulator.Response{Check: checkHeaders, Content: "foo", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+				emulator.Response{Check: checkHeaders, Content: "bar", PromptTokens: 10, ResponseTokens: 1}, //nolint:exhaustruct
+			)
+			defer server.Close()
+
+			// Only one successful request is allowed in the window,
+			// so the second call has to wait for the rate limit to reset.
+			// Without rate limit headers the rate limiter cannot know that,
+			// so we then allow both requests.
+			window := 2 * time.Second
+			limit := 1
+			if !tt.RateLimitHeaders {
+				limit = 2
+			}
+			server.SetRateLimits(emulator.RateLimits{
+				Requests:     emulator.RateLimit{Limit: limit, Window: window},
+				Tokens:       emulator.RateLimit{Limit: 1_000_000, Window: window},
+				InputTokens:  emulator.RateLimit{Limit: 1_000_000, Window: window},
+				OutputTokens: emulator.RateLimit{Limit: 1_000_000, Window: window},
+			})
+
+			f := fun.Text[string, string]{
+				Provider:          tt.Provider(nil, server.URL+tt.Path),
+				InputJSONSchema:   nil,
+				OutputJSONSchema:  nil,
+				Prompt:            "Repeat the input.",
+				PromptTemplate:    "",
+				InputTemplate:     "",
+				Data:              nil,
+				Tools:             nil,
+				MaxRepairAttempts: 0,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			start := time.Now()
+
+			// Errors are retried.
+			output, errE := f.Call(ctx, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "foo", output)
+
+			output, errE = f.Call(ctx, "bar")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "bar", output)
+
+			assert.Equal(t, 0, server.Remaining())
+			if tt.RateLimitHeaders {
+				assert.GreaterOrEqual(t, time.Since(start), window-100*time.Millisecond)
+			}
+
+			// The rate limiter waited instead of hitting the rate limit.
+			chatRequests := 0
+			for _, req := range server.Requests() {
+				if req.Method == http.MethodPost {
+					chatRequests++
+				}
+			}
+			assert.Equal(t, 5, chatRequests)
+		})
+	}
+}
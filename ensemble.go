@@ -0,0 +1,237 @@
+package fun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+)
+
+var _ Callee[any, any] = (*Ensemble[any, any])(nil)
+
+// EnsembleStrategy determines how many callees of [Ensemble]
+// have to agree on an output.
+type EnsembleStrategy string
+
+const (
+	// EnsembleMajority requires more than half of all callees to agree.
+	EnsembleMajority EnsembleStrategy = "majority"
+	// EnsembleUnanimous requires all callees to succeed and agree.
+	EnsembleUnanimous EnsembleStrategy = "unanimous"
+	// EnsembleQuorum requires at least [Ensemble.Quorum] callees to agree.
+	EnsembleQuorum EnsembleStrategy = "quorum"
+)
+
+// NoConsensusError is returned by [Ensemble] when callees do not agree
+// on an output. It carries outputs and errors of all callees.
+//
+// It wraps [ErrNoConsensus] and errors of all callees which failed.
+type NoConsensusError[Output any] struct {
+	errors.E
+
+	// Candidates are outputs of callees, in the order of callees.
+	// If a callee failed, its output is the zero value.
+	Candidates []Output
+
+	// Errors are errors of callees, in the order of callees.
+	// If a callee succeeded, its error is nil.
+	Errors []errors.E
+}
+
+// Unwrap returns the underlying error.
+func (e *NoConsensusError[Output]) Unwrap() error {
+	return e.E
+}
+
+// Ensemble implements [Callee] interface by calling multiple callees
+// (e.g., [Text] instances with different providers or prompts) concurrently
+// and returning the output on which enough of them agree.
+//
+// Outputs are by default compared by JSON-semantic equality: outputs are
+// equal if their JSON representations decode to equal values. Callees
+// which fail do not contribute to the agreement. If multiple groups of
+// equal outputs reach the required agreement, the largest one is used,
+// preferring the group with the output of the earlier callee on ties.
+//
+// Calls made by callees are recorded with [TextRecorderCall.Member]
+// set to "ensemble[i]", where i is the 0-based index of the callee
+// which made the call.
+type Ensemble[Input, Output any] struct {
+	// Callees to call concurrently.
+	Callees []Callee[Input, Output]
+
+	// Strategy determines how many callees have to agree on an output.
+	// If not provided, [EnsembleMajority] is used.
+	Strategy EnsembleStrategy
+
+	// Quorum is the minimum number of callees which have to agree on an output
+	// when Strategy is [EnsembleQuorum].
+	Quorum int
+
+	// Equal is a custom comparator of outputs. If not provided,
+	// outputs are compared by JSON-semantic equality.
+	Equal func(a, b Output) bool
+}
+
+func (e *Ensemble[Input, Output]) required() int {
+	switch e.Strategy { //nolint:exhaustive
+	case EnsembleUnanimous:
+		return len(e.Callees)
+	case EnsembleQuorum:
+		return e.Quorum
+	default:
+		return len(e.Callees)/2 + 1 //nolint:mnd
+	}
+}
+
+// Init implements [Callee] interface.
+func (e *Ensemble[Input, Output]) Init(ctx context.Context) errors.E {
+	if len(e.Callees) == 0 {
+		return errors.New("callees are missing")
+	}
+
+	switch e.Strategy {
+	case "", EnsembleMajority, EnsembleUnanimous:
+	case EnsembleQuorum:
+		if e.Quorum < 1 || e.Quorum > len(e.Callees) {
+			return errors.WithDetails(
+				errors.New("quorum out of range"),
+				"quorum", e.Quorum,
+				"callees", len(e.Callees),
+			)
+		}
+	default:
+		return errors.WithDetails(
+			errors.New("unknown strategy"),
+			"strategy", e.Strategy,
+		)
+	}
+
+	for i, callee := range e.Callees {
+		errE := callee.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["callee"] = i
+			return errE
+		}
+	}
+
+	return nil
+}
+
+// Call implements [Callee] interface.
+func (e *Ensemble[Input, Output]) Call(ctx context.Context, input ...Input) (Output, errors.E) { //nolint:ireturn
+	candidates := make([]Output, len(e.Callees))
+	errs := make([]errors.E, len(e.Callees))
+
+	var wg sync.WaitGroup
+	for i, callee := range e.Callees {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			candidates[i], errs[i] = callee.Call(withTextRecorderMember(ctx, fmt.Sprintf("ensemble[%d]", i)), input...)
+		}()
+	}
+	wg.Wait()
+
+	equal := e.Equal
+	if equal == nil {
+		equal = jsonEqual[Output]
+	}
+
+	// Indices of the first candidate in each group and sizes of groups.
+	groups := []int{}
+	counts := []int{}
+CANDIDATE:
+	for i, candidate := range candidates {
+		if errs[i] != nil {
+			continue
+		}
+		for j, g := range groups {
+			if equal(candidates[g], candidate) {
+				counts[j]++
+				continue CANDIDATE
+			}
+		}
+		groups = append(groups, i)
+		counts = append(counts, 1)
+	}
+
+	best := -1
+	for j := range groups {
+		if best == -1 || counts[j] > counts[best] {
+			best = j
+		}
+	}
+
+	required := e.required()
+	if best != -1 && counts[best] >= required {
+		return candidates[groups[best]], nil
+	}
+
+	// Callees probably failed because the context is done,
+	// so we return the context error directly.
+	if ctx.Err() != nil {
+		return *new(Output), errors.WithStack(ctx.Err())
+	}
+
+	agreed := 0
+	if best != -1 {
+		agreed = counts[best]
+	}
+
+	joinErrs := []error{ErrNoConsensus}
+	for _, err := range errs {
+		if err != nil {
+			joinErrs = append(joinErrs, err)
+		}
+	}
+	errE := errors.Join(joinErrs...)
+	errors.Details(errE)["agreed"] = agreed
+	errors.Details(errE)["required"] = required
+
+	return *new(Output), &NoConsensusError[Output]{
+		E:          errE,
+		Candidates: candidates,
+		Errors:     errs,
+	}
+}
+
+// Variadic implements [Callee] interface.
+func (e *Ensemble[Input, Output]) Variadic() func(ctx context.Context, input ...Input) (Output, errors.E) {
+	return func(ctx context.Context, input ...Input) (Output, errors.E) {
+		return e.Call(ctx, input...)
+	}
+}
+
+// Unary implements [Callee] interface.
+func (e *Ensemble[Input, Output]) Unary() func(ctx context.Context, input Input) (Output, errors.E) {
+	return func(ctx context.Context, input Input) (Output, errors.E) {
+		return e.Call(ctx, input)
+	}
+}
+
+func jsonEqual[T any](a, b T) bool {
+	aJSON, errE := x.MarshalWithoutEscapeHTML(a)
+	if errE != nil {
+		return false
+	}
+	bJSON, errE := x.MarshalWithoutEscapeHTML(b)
+	if errE != nil {
+		return false
+	}
+	var aValue, bValue any
+	err := json.Unmarshal(aJSON, &aValue)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(bJSON, &bValue)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
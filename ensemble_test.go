@@ -0,0 +1,190 @@
+package fun_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func ensembleCallees[Output any](outputs ...any) []fun.Callee[string, Output] {
+	callees := []fun.Callee[string, Output]{}
+	for _, output := range outputs {
+		callees = append(callees, &fun.Go[string, Output]{
+			Fun: func(_ context.Context, _ ...string) (Output, errors.E) {
+				if err, ok := output.(error); ok {
+					return *new(Output), errors.WithStack(err)
+				}
+				return output.(Output), nil //nolint:forcetypeassert
+			},
+		})
+	}
+	return callees
+}
+
+func TestEnsemble(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		Outputs  []any
+		Strategy fun.EnsembleStrategy
+		Quorum   int
+		Expected string
+	}{
+		{"majority", []any{"a", "b", "a"}, "", 0, "a"},
+		{"majority with error", []any{"a", fun.ErrGaveUpRetry, "a"}, fun.EnsembleMajority, 0, "a"},
+		{"no majority", []any{"a", "b", "c"}, fun.EnsembleMajority, 0, ""},
+		{"no majority with errors", []any{"a", fun.ErrGaveUpRetry, fun.ErrRefused}, fun.EnsembleMajority, 0, ""},
+		{"unanimous", []any{"a", "a", "a"}, fun.EnsembleUnanimous, 0, "a"},
+		{"not unanimous", []any{"a", "a", "b"}, fun.EnsembleUnanimous, 0, ""},
+		{"not unanimous with error", []any{"a", "a", fun.ErrGaveUpRetry}, fun.EnsembleUnanimous, 0, ""},
+		{"quorum", []any{"a", "b", "c", "b"}, fun.EnsembleQuorum, 2, "b"},
+		{"no quorum", []any{"a", "b", "c", "d"}, fun.EnsembleQuorum, 2, ""},
+		{"quorum tie", []any{"a", "b", "b", "a"}, fun.EnsembleQuorum, 2, "a"},
+		{"all errors", []any{fun.ErrGaveUpRetry, fun.ErrRefused, fun.ErrGaveUpRetry}, fun.EnsembleMajority, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			f := fun.Ensemble[string, string]{
+				Callees:  ensembleCallees[string](tt.Outputs...),
+				Strategy: tt.Strategy,
+				Quorum:   tt.Quorum,
+				Equal:    nil,
+			}
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			output, errE := f.Call(ctx, "foo")
+			if tt.Expected != "" {
+				require.NoError(t, errE, "% -+#.1v", errE)
+				assert.Equal(t, tt.Expected, output)
+			} else {
+				require.ErrorIs(t, errE, fun.ErrNoConsensus)
+				for _, o := range tt.Outputs {
+					if err, ok := o.(error); ok {
+						assert.ErrorIs(t, errE, err)
+					}
+				}
+				var noConsensus *fun.NoConsensusError[string]
+				require.ErrorAs(t, errE, &noConsensus)
+				assert.Len(t, noConsensus.Candidates, len(tt.Outputs))
+				assert.Len(t, noConsensus.Errors, len(tt.Outputs))
+				for i, o := range tt.Outputs {
+					if err, ok := o.(error); ok {
+						assert.ErrorIs(t, noConsensus.Errors[i], err)
+						assert.Empty(t, noConsensus.Candidates[i])
+					} else {
+						assert.NoError(t, noConsensus.Errors[i]) //nolint:testifylint
+						assert.Equal(t, o, noConsensus.Candidates[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEnsembleContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context()))
+
+	callee := &fun.Go[string, string]{
+		Fun: func(ctx context.Context, _ ...string) (string, errors.E) {
+			<-ctx.Done()
+			return "", errors.WithStack(ctx.Err())
+		},
+	}
+
+	f := fun.Ensemble[string, string]{
+		Callees:  []fun.Callee[string, string]{callee, callee, callee},
+		Strategy: fun.EnsembleMajority,
+		Quorum:   0,
+		Equal:    nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	cancel()
+
+	_, errE = f.Call(ctx, "foo")
+	require.ErrorIs(t, errE, context.Canceled)
+	assert.NotErrorIs(t, errE, fun.ErrNoConsensus)
+}
+
+func TestEnsembleJSONEqual(t *testing.T) {
+	t.Parallel()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	// Maps with same content are equal under JSON-semantic equality.
+	f := fun.Ensemble[string, map[string]any]{
+		Callees: ensembleCallees[map[string]any](
+			map[string]any{"a": 1, "b": []any{"x"}},
+			map[string]any{"b": []any{"x"}, "a": 1.0},
+			map[string]any{"a": 2},
+		),
+		Strategy: fun.EnsembleMajority,
+		Quorum:   0,
+		Equal:    nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Unary()(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, map[string]any{"a": 1, "b": []any{"x"}}, output)
+
+	// Custom comparator.
+	g := fun.Ensemble[string, string]{
+		Callees:  ensembleCallees[string]("foo", "FOO", "bar"),
+		Strategy: fun.EnsembleMajority,
+		Quorum:   0,
+		Equal:    strings.EqualFold,
+	}
+
+	errE = g.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output2, errE := g.Variadic()(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output2)
+}
+
+func TestEnsembleInit(t *testing.T) {
+	t.Parallel()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Ensemble[string, string]{
+		Callees:  ensembleCallees[string]("a", "b"),
+		Strategy: fun.EnsembleQuorum,
+		Quorum:   3,
+		Equal:    nil,
+	}
+	errE := f.Init(ctx)
+	assert.EqualError(t, errE, "quorum out of range")
+
+	f = fun.Ensemble[string, string]{
+		Callees:  ensembleCallees[string]("a", "b"),
+		Strategy: "foobar",
+		Quorum:   0,
+		Equal:    nil,
+	}
+	errE = f.Init(ctx)
+	assert.EqualError(t, errE, "unknown strategy")
+}
@@ -24,4 +24,12 @@ var (
 	ErrToolNotFound                 = errors.Base("tool not found")
 	ErrToolCallsWithoutCalls        = errors.Base("tool calls without calls")
 	ErrMaxExchangesReached          = errors.Base("reached max allowed exchanges")
+	ErrUnsupportedContentPart       = errors.Base("unsupported content part")
+	ErrNoMessages                   = errors.Base("no messages")
+	ErrNoConsensus                  = errors.Base("no consensus")
+	ErrBatchFailed                  = errors.Base("batch failed")
+	ErrMissingBatchResponses        = errors.Base("missing batch responses")
+	ErrBudgetExceeded               = errors.Base("budget exceeded")
+	ErrCassetteNoMatch              = errors.Base("no matching recorded exchange in cassette")
+	ErrNoFakeResponses              = errors.Base("no more scripted fake responses")
 )
@@ -0,0 +1,472 @@
+package fun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+)
+
+var (
+	_ TextProvider         = (*FakeTextProvider)(nil)
+	_ WithConversation     = (*FakeTextProvider)(nil)
+	_ WithOutputJSONSchema = (*FakeTextProvider)(nil)
+	_ WithTools            = (*FakeTextProvider)(nil)
+	_ typedProvider        = (*FakeTextProvider)(nil)
+)
+
+// FakeTextMessage is a message received by [FakeTextProvider].
+type FakeTextMessage struct {
+	// Role of the message. Possible values are "system",
+	// "assistant", "user", "tool_use", and "tool_result".
+	Role string
+
+	// Content is textual content of the message. For "tool_use"
+	// messages, it is the input to the tool, and for "tool_result"
+	// messages, it is the output of the tool.
+	Content string
+
+	// Parts is content of the message consisting of multiple parts,
+	// if the message was provided with them.
+	Parts []ChatContentPart
+
+	// ToolUseID is the ID of the tool use to correlate
+	// "tool_use" and "tool_result" messages.
+	ToolUseID string
+
+	// ToolUseName is the name of the tool to use.
+	ToolUseName string
+
+	// IsError is true if there was an error during tool execution.
+	// In this case, Content is the error message returned to the AI model.
+	IsError bool
+}
+
+// FakeTextToolCall is a tool call requested by [FakeTextResponse].
+type FakeTextToolCall struct {
+	// ID of the tool call. If not provided, it is generated.
+	ID string
+
+	// Name of the tool to call.
+	Name string
+
+	// Input to the tool.
+	Input json.RawMessage
+}
+
+// FakeTextResponse is a scripted response of [FakeTextProvider] to one
+// exchange with the fake AI model.
+type FakeTextResponse struct {
+	// Check, if set, is called with all messages the fake AI model received
+	// in this exchange (including messages provided to Init, and tool calls and
+	// their results from previous exchanges) before responding. If it returns
+	// an error, the chat fails with that error.
+	Check func(messages []FakeTextMessage) errors.E
+
+	// Content of the response.
+	Content string
+
+	// ToolCalls the fake AI model requests. When set, tools are called and
+	// the chat continues with the next scripted response, which receives
+	// results of tool calls.
+	ToolCalls []FakeTextToolCall
+
+	// Err, if set, is returned instead of the response, as if the
+	// request to the AI model failed.
+	Err errors.E
+
+	// PromptTokens is the number of tokens reported as used by the prompt.
+	PromptTokens int
+
+	// ResponseTokens is the number of tokens reported as used by the response.
+	ResponseTokens int
+}
+
+// FakeTextProvider is a [TextProvider] which responds with scripted responses,
+// without making any requests. It is meant for testing code which uses [Text].
+//
+// Responses are consumed in order, one per exchange with the fake AI model,
+// across all calls. Tool calls are made in the same way as with other providers.
+//
+// FakeTextProvider is safe for concurrent use, but responses are then
+// consumed in the order in which exchanges happen to be made.
+type FakeTextProvider struct {
+	// Model is the name of the model reported in records and metrics.
+	Model string `json:"model"`
+
+	// MaxExchanges is the maximum number of exchanges with the fake AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// ForceOutputJSONSchema when set to true validates scripted responses
+	// (without tool calls) against the output JSON Schema, as if the fake AI
+	// model was forced to output it.
+	ForceOutputJSONSchema bool `json:"forceOutputJsonSchema"`
+
+	// Responses are scripted responses.
+	Responses []FakeTextResponse `json:"-"`
+
+	mu               sync.Mutex
+	initialized      bool
+	messages         []FakeTextMessage
+	tools            map[string]TextTooler
+	outputJSONSchema json.RawMessage
+	outputValidator  *jsonschema.Schema
+}
+
+// MarshalJSON implements json.Marshaler interface for FakeTextProvider.
+func (f *FakeTextProvider) MarshalJSON() ([]byte, error) {
+	t := struct {
+		Model                 string `json:"model"`
+		MaxExchanges          int    `json:"maxExchanges"`
+		ForceOutputJSONSchema bool   `json:"forceOutputJsonSchema"`
+		Type                  string `json:"type"`
+	}{
+		Model:                 f.Model,
+		MaxExchanges:          f.MaxExchanges,
+		ForceOutputJSONSchema: f.ForceOutputJSONSchema,
+		Type:                  "fake",
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (f *FakeTextProvider) typeModel() (string, string) {
+	return "fake", f.Model
+}
+
+// Init implements [TextProvider] interface.
+func (f *FakeTextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.initialized {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	f.initialized = true
+
+	f.messages = []FakeTextMessage{}
+	for _, message := range messages {
+		f.messages = append(f.messages, newFakeTextMessage(message))
+	}
+
+	if f.MaxExchanges == 0 {
+		f.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// Remaining returns the number of scripted responses not yet consumed.
+func (f *FakeTextProvider) Remaining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.Responses)
+}
+
+// Chat implements [TextProvider] interface.
+func (f *FakeTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return f.chat(ctx, []ChatMessage{message})
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (f *FakeTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return f.chat(ctx, messages)
+}
+
+func (f *FakeTextProvider) next() (FakeTextResponse, errors.E) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.Responses) == 0 {
+		return FakeTextResponse{}, errors.WithStack(ErrNoFakeResponses) //nolint:exhaustruct
+	}
+
+	response := f.Responses[0]
+	f.Responses = f.Responses[1:]
+	return response, nil
+}
+
+func (f *FakeTextProvider) chat(ctx context.Context, conversation []ChatMessage) (string, errors.E) {
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newCall(ctx, callID, f)
+		defer recorder.recordCall(callRecorder)
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	messages := slices.Clone(f.messages)
+	for _, message := range conversation {
+		messages = append(messages, newFakeTextMessage(message))
+	}
+
+	if callRecorder != nil {
+		for _, message := range messages {
+			if len(message.Parts) > 0 {
+				for _, part := range message.Parts {
+					callRecorder.addPart(message.Role, part)
+				}
+			} else {
+				callRecorder.addMessage(message.Role, message.Content, "", "", false)
+			}
+		}
+
+		callRecorder.notify("", nil)
+	}
+
+	for apiRequestNumber := range f.MaxExchanges {
+		apiRequest := fmt.Sprintf("req_%d", apiRequestNumber+1)
+
+		response, errE := f.next()
+		if errE != nil {
+			return "", errE
+		}
+
+		if response.Check != nil {
+			errE := response.Check(slices.Clone(messages))
+			if errE != nil {
+				errors.Details(errE)["apiRequest"] = apiRequest
+				return "", errE
+			}
+		}
+
+		reservation, errE := reserveBudget(ctx, f, response.PromptTokens, response.ResponseTokens)
+		if errE != nil {
+			return "", errE
+		}
+
+		if response.Err != nil {
+			reservation.release()
+			return "", response.Err
+		}
+
+		reservation.settle(newUsedTokens(0, 0, response.PromptTokens, response.ResponseTokens, nil, nil, nil))
+
+		if callRecorder != nil {
+			callRecorder.addUsedTokens(apiRequest, 0, 0, response.PromptTokens, response.ResponseTokens, nil, nil, nil)
+			callRecorder.addUsedTime(apiRequest, 0, 0, 0)
+		}
+
+		if len(response.ToolCalls) > 0 {
+			toolCalls := make([]FakeTextToolCall, len(response.ToolCalls))
+			for i, toolCall := range response.ToolCalls {
+				if toolCall.ID == "" {
+					toolCall.ID = fmt.Sprintf("call_%d_%d", len(messages), i)
+				}
+				toolCalls[i] = toolCall
+			}
+
+			if response.Content != "" {
+				messages = append(messages, FakeTextMessage{ //nolint:exhaustruct
+					Role:    roleAssistant,
+					Content: response.Content,
+				})
+				if callRecorder != nil {
+					callRecorder.addMessage(roleAssistant, response.Content, "", "", false)
+				}
+			}
+			for _, toolCall := range toolCalls {
+				messages = append(messages, FakeTextMessage{ //nolint:exhaustruct
+					Role:        roleToolUse,
+					Content:     string(toolCall.Input),
+					ToolUseID:   toolCall.ID,
+					ToolUseName: toolCall.Name,
+				})
+				if callRecorder != nil {
+					callRecorder.addMessage(roleToolUse, string(toolCall.Input), toolCall.ID, toolCall.Name, false)
+				}
+			}
+
+			if callRecorder != nil {
+				callRecorder.notify("", nil)
+				// We grow the slice inside call recorder so that it does not grow
+				// when appending below and invalidate pointers goroutines keep.
+				callRecorder.prepareForToolMessages(len(toolCalls))
+			}
+
+			results := make([]FakeTextMessage, len(toolCalls))
+
+			var wg sync.WaitGroup
+			for i, toolCall := range toolCalls {
+				results[i] = FakeTextMessage{ //nolint:exhaustruct
+					Role:        roleToolResult,
+					ToolUseID:   toolCall.ID,
+					ToolUseName: toolCall.Name,
+				}
+
+				toolCtx := ctx
+				var toolMessage *TextRecorderMessage
+				if callRecorder != nil {
+					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolCall.ID)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f.callToolWrapper(toolCtx, apiRequest, toolCall, &results[i], callRecorder, toolMessage)
+				}()
+			}
+
+			wg.Wait()
+
+			messages = append(messages, results...)
+
+			continue
+		}
+
+		if callRecorder != nil {
+			callRecorder.addMessage(roleAssistant, response.Content, "", "", false)
+			callRecorder.notify("", nil)
+		}
+
+		if f.outputValidator != nil {
+			errE := validate(f.outputValidator, response.Content)
+			if errE != nil {
+				errors.Details(errE)["apiRequest"] = apiRequest
+				return "", errE
+			}
+		}
+
+		return response.Content, nil
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", f.MaxExchanges,
+	)
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (f *FakeTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if !f.ForceOutputJSONSchema {
+		return nil
+	}
+
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if f.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	validator, _, errE := compileValidator[any](schema)
+	if errE != nil {
+		return errors.Prefix(errE, ErrInvalidJSONSchema)
+	}
+
+	f.outputJSONSchema = schema
+	f.outputValidator = validator
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (f *FakeTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if f.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	f.tools = map[string]TextTooler{}
+
+	for name, tool := range tools {
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		f.tools[name] = tool
+	}
+
+	return nil
+}
+
+func (f *FakeTextProvider) callToolWrapper(
+	ctx context.Context, apiRequest string, toolCall FakeTextToolCall, result *FakeTextMessage,
+	callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+) {
+	if callRecorder != nil {
+		defer func() {
+			callRecorder.notify("", nil)
+		}()
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Name).Inc()
+
+			content := fmt.Sprintf("Error: %s", err)
+			result.Content = content
+			result.IsError = true
+
+			toolMessage.setContent(content, true)
+		}
+	}()
+
+	defer func() {
+		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
+	}()
+
+	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.ID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startToolSpan(ctx, toolCall.Name, toolCall.ID)
+	defer span.End()
+
+	output, duration, errE := f.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Name, duration, errE)
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Name).Str("apiRequest", apiRequest).
+			Str("tool", toolCall.ID).RawJSON("input", toolCall.Input).Msg("tool error")
+		content := "Error: " + errE.Error()
+		result.Content = content
+		result.IsError = true
+
+		toolMessage.setContent(content, true)
+	} else {
+		result.Content = output
+
+		toolMessage.setContent(output, false)
+	}
+
+	toolMessage.setToolDuration(duration)
+}
+
+func (f *FakeTextProvider) callTool(ctx context.Context, toolCall FakeTextToolCall) (string, Duration, errors.E) {
+	tool, ok := f.tools[toolCall.Name]
+	if !ok {
+		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolCall.Name)
+	}
+
+	start := time.Now()
+	output, errE := tool.Call(ctx, toolCall.Input)
+	duration := time.Since(start)
+	return output, Duration(duration), errE
+}
+
+func newFakeTextMessage(message ChatMessage) FakeTextMessage {
+	return FakeTextMessage{
+		Role:        message.Role,
+		Content:     message.Content,
+		Parts:       message.Parts,
+		ToolUseID:   "",
+		ToolUseName: "",
+		IsError:     false,
+	}
+}
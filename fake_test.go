@@ -0,0 +1,172 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func TestFakeTextProvider(t *testing.T) {
+	t.Parallel()
+
+	provider := &fun.FakeTextProvider{ //nolint:exhaustruct
+		Model: "fake-model",
+		Responses: []fun.FakeTextResponse{
+			{
+				Check: func(messages []fun.FakeTextMessage) errors.E {
+					assert.Equal(t, []fun.FakeTextMessage{
+						{Role: "system", Content: "Repeat the input twice."},
+						{Role: "user", Content: "foo"},
+					}, messages)
+					return nil
+				},
+				Content: "",
+				ToolCalls: []fun.FakeTextToolCall{
+					{ID: "call_1", Name: "repeat_string", Input: json.RawMessage(`{"string":"foo"}`)},
+					{ID: "call_2", Name: "missing_tool", Input: json.RawMessage(`{}`)},
+				},
+				Err:            nil,
+				PromptTokens:   100,
+				ResponseTokens: 10,
+			},
+			{
+				Check: func(messages []fun.FakeTextMessage) errors.E {
+					require.Len(t, messages, 6)
+					assert.Equal(t, fun.FakeTextMessage{ //nolint:exhaustruct
+						Role:        "tool_result",
+						Content:     "foofoo",
+						ToolUseID:   "call_1",
+						ToolUseName: "repeat_string",
+					}, messages[4])
+					assert.True(t, messages[5].IsError)
+					assert.Contains(t, messages[5].Content, "tool not found")
+					return nil
+				},
+				Content:        "foofoo",
+				ToolCalls:      nil,
+				Err:            nil,
+				PromptTokens:   150,
+				ResponseTokens: 5,
+			},
+		},
+	}
+
+	f := fun.Text[string, string]{
+		Provider:         provider,
+		InputJSONSchema:  nil,
+		OutputJSONSchema: nil,
+		Prompt:           "Repeat the input twice.",
+		PromptTemplate:   "",
+		InputTemplate:    "",
+		Data:             nil,
+		Tools: map[string]fun.TextTooler{
+			"repeat_string": &fun.TextTool[toolStringInput, string]{
+				Description:      "Repeats the input twice, by concatenating the input string without any space.",
+				InputJSONSchema:  toolInputJSONSchema,
+				OutputJSONSchema: jsonSchemaString,
+				Fun: func(_ context.Context, input toolStringInput) (string, errors.E) {
+					return input.String + input.String, nil
+				},
+			},
+		},
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	ct := fun.WithTextRecorder(ctx)
+	output, errE := f.Call(ct, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foofoo", output)
+	assert.Equal(t, 0, provider.Remaining())
+
+	calls := fun.GetTextRecorder(ct).Calls()
+	require.Len(t, calls, 1)
+	assert.Len(t, calls[0].UsedTokens, 2)
+	assert.Equal(t, 110, calls[0].UsedTokens["req_1"].Total)
+	roles := []string{}
+	for i := range calls[0].Messages {
+		roles = append(roles, calls[0].Messages[i].Role)
+	}
+	assert.Equal(t, []string{"system", "user", "tool_use", "tool_use", "tool_result", "tool_result", "assistant"}, roles)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrNoFakeResponses)
+}
+
+func TestFakeTextProviderErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errFailed := errors.Base("failed")
+
+	toolCall := fun.FakeTextResponse{ //nolint:exhaustruct
+		ToolCalls: []fun.FakeTextToolCall{
+			{ID: "", Name: "repeat_string", Input: json.RawMessage(`{"string":"foo"}`)},
+		},
+	}
+
+	provider := &fun.FakeTextProvider{ //nolint:exhaustruct
+		MaxExchanges:          2,
+		ForceOutputJSONSchema: true,
+		Responses: []fun.FakeTextResponse{
+			{Err: errors.WithStack(errFailed)}, //nolint:exhaustruct
+			toolCall,
+			toolCall,
+			{Content: `42`},  //nolint:exhaustruct
+			{Content: `foo`}, //nolint:exhaustruct
+		},
+	}
+
+	f := fun.Text[string, int]{
+		Provider:         provider,
+		InputJSONSchema:  nil,
+		OutputJSONSchema: nil,
+		Prompt:           "Count characters in the input.",
+		PromptTemplate:   "",
+		InputTemplate:    "",
+		Data:             nil,
+		Tools: map[string]fun.TextTooler{
+			"repeat_string": &fun.TextTool[toolStringInput, string]{
+				Description:      "Repeats the input twice, by concatenating the input string without any space.",
+				InputJSONSchema:  toolInputJSONSchema,
+				OutputJSONSchema: jsonSchemaString,
+				Fun: func(_ context.Context, input toolStringInput) (string, errors.E) {
+					return input.String + input.String, nil
+				},
+			},
+		},
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, errFailed)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrMaxExchangesReached)
+
+	output, errE := f.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, 42, output)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrJSONSchemaValidation)
+}
@@ -0,0 +1,103 @@
+package fun
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+)
+
+var _ Callee[any, any] = (*Fallback[any, any])(nil)
+
+// DefaultShouldFallback is the default predicate for [Fallback].
+// It returns true for errors which signal that the AI model is
+// unavailable or unable to respond: [ErrGaveUpRetry],
+// [ErrAPIResponseError], [ErrMaxExchangesReached], and [ErrRefused].
+func DefaultShouldFallback(errE errors.E) bool {
+	return errors.Is(errE, ErrGaveUpRetry) ||
+		errors.Is(errE, ErrAPIResponseError) ||
+		errors.Is(errE, ErrMaxExchangesReached) ||
+		errors.Is(errE, ErrRefused)
+}
+
+// Fallback implements [Callee] interface by calling an ordered list
+// of callees (e.g., [Text] instances with different providers) and
+// returning the output of the first one which succeeds.
+//
+// When a callee fails with an error for which ShouldFallback returns true,
+// the next callee is called. Otherwise the error is returned.
+// If all callees fail, errors of all of them are returned joined together.
+//
+// Calls made by callees are recorded with [TextRecorderCall.Member]
+// set to "fallback[i]", where i is the 0-based index of the callee
+// which made the call.
+type Fallback[Input, Output any] struct {
+	// Callees to call in order.
+	Callees []Callee[Input, Output]
+
+	// ShouldFallback returns true if the next callee should be called
+	// after the error. If not provided, [DefaultShouldFallback] is used.
+	ShouldFallback func(errE errors.E) bool
+}
+
+// Init implements [Callee] interface.
+func (f *Fallback[Input, Output]) Init(ctx context.Context) errors.E {
+	if len(f.Callees) == 0 {
+		return errors.New("callees are missing")
+	}
+
+	for i, callee := range f.Callees {
+		errE := callee.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["callee"] = i
+			return errE
+		}
+	}
+
+	return nil
+}
+
+// Call implements [Callee] interface.
+func (f *Fallback[Input, Output]) Call(ctx context.Context, input ...Input) (Output, errors.E) { //nolint:ireturn
+	shouldFallback := f.ShouldFallback
+	if shouldFallback == nil {
+		shouldFallback = DefaultShouldFallback
+	}
+
+	errs := []error{}
+	for i, callee := range f.Callees {
+		output, errE := callee.Call(withTextRecorderMember(ctx, fmt.Sprintf("fallback[%d]", i)), input...)
+		if errE == nil {
+			return output, nil
+		}
+
+		errors.Details(errE)["callee"] = i
+		errs = append(errs, errE)
+
+		if !shouldFallback(errE) || i == len(f.Callees)-1 {
+			break
+		}
+
+		zerolog.Ctx(ctx).Warn().Err(errE).Int("callee", i).Msg("falling back to next callee")
+	}
+
+	if len(errs) == 1 {
+		return *new(Output), errs[0].(errors.E) //nolint:errcheck,forcetypeassert
+	}
+	return *new(Output), errors.Join(errs...)
+}
+
+// Variadic implements [Callee] interface.
+func (f *Fallback[Input, Output]) Variadic() func(ctx context.Context, input ...Input) (Output, errors.E) {
+	return func(ctx context.Context, input ...Input) (Output, errors.E) {
+		return f.Call(ctx, input...)
+	}
+}
+
+// Unary implements [Callee] interface.
+func (f *Fallback[Input, Output]) Unary() func(ctx context.Context, input Input) (Output, errors.E) {
+	return func(ctx context.Context, input Input) (Output, errors.E) {
+		return f.Call(ctx, input)
+	}
+}
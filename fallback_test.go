@@ -0,0 +1,96 @@
+package fun_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+
+	called := []string{}
+	callee := func(name string, err error) fun.Callee[string, string] {
+		return &fun.Go[string, string]{
+			Fun: func(_ context.Context, input ...string) (string, errors.E) {
+				called = append(called, name)
+				if err != nil {
+					return "", errors.WithStack(err)
+				}
+				return name + input[0], nil
+			},
+		}
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Fallback[string, string]{
+		Callees: []fun.Callee[string, string]{
+			callee("a", fun.ErrGaveUpRetry),
+			callee("b", fun.ErrRefused),
+			callee("c", nil),
+			callee("d", nil),
+		},
+		ShouldFallback: nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "cfoo", output)
+	assert.Equal(t, []string{"a", "b", "c"}, called)
+
+	// Errors which are not matched by the predicate are returned immediately.
+	called = []string{}
+	f = fun.Fallback[string, string]{
+		Callees: []fun.Callee[string, string]{
+			callee("a", fun.ErrInvalidJSONSchema),
+			callee("b", nil),
+		},
+		ShouldFallback: nil,
+	}
+
+	errE = f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, errE = f.Unary()(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrInvalidJSONSchema)
+	assert.Equal(t, []string{"a"}, called)
+
+	// Custom predicate.
+	called = []string{}
+	f.ShouldFallback = func(errE errors.E) bool {
+		return errors.Is(errE, fun.ErrInvalidJSONSchema)
+	}
+
+	output, errE = f.Variadic()(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "bfoo", output)
+	assert.Equal(t, []string{"a", "b"}, called)
+
+	// When all callees fail, all errors are returned.
+	called = []string{}
+	f = fun.Fallback[string, string]{
+		Callees: []fun.Callee[string, string]{
+			callee("a", fun.ErrGaveUpRetry),
+			callee("b", fun.ErrAPIResponseError),
+		},
+		ShouldFallback: nil,
+	}
+
+	errE = f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrGaveUpRetry)
+	assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+	assert.Equal(t, []string{"a", "b"}, called)
+}
@@ -34,6 +34,38 @@ type ChatMessage struct {
 
 	// Content is textual content of the message.
 	Content string `json:"content"`
+
+	// Parts is content of the message consisting of multiple parts,
+	// e.g., text interleaved with images and documents.
+	// If Parts are provided, Content is ignored.
+	Parts []ChatContentPart `json:"parts,omitempty"`
+}
+
+// ChatContentPart is one part of [ChatMessage] content.
+type ChatContentPart struct {
+	// Type of the part. Possible values are "text", "image", and "document".
+	Type string `json:"type"`
+
+	// Text is textual content of the part for "text" parts.
+	Text string `json:"text,omitempty"`
+
+	// MIMEType of Data for "image" and "document" parts.
+	MIMEType string `json:"mimeType,omitempty"`
+
+	// Data is binary content of the part for "image" and "document" parts.
+	Data []byte `json:"data,omitempty"`
+}
+
+func (m ChatMessage) parts() []ChatContentPart {
+	if len(m.Parts) > 0 {
+		return m.Parts
+	}
+	return []ChatContentPart{{
+		Type:     typeText,
+		Text:     m.Content,
+		MIMEType: "",
+		Data:     nil,
+	}}
 }
 
 // TextProvider is a provider for text-based LLMs.
@@ -47,6 +79,76 @@ type TextProvider interface {
 	Chat(ctx context.Context, message ChatMessage) (string, errors.E)
 }
 
+// EmbeddingProvider is a provider for embedding-based AI models.
+type EmbeddingProvider interface {
+	// Init initializes embedding provider.
+	Init(ctx context.Context) errors.E
+
+	// Embed sends texts to the AI model and returns their embeddings,
+	// in the same order as texts.
+	Embed(ctx context.Context, texts []string) ([][]float32, errors.E)
+}
+
+// TextStreamEvent is an event emitted by a [WithStreaming] provider
+// while the AI model is responding.
+type TextStreamEvent struct {
+	// Type of the event. Possible values are "text" (a delta of the response),
+	// "thinking" (a delta of extended thinking or reasoning), "tool_use" (the AI model
+	// requested a tool call), "tool_result" (the tool call finished), and
+	// "usage" (tokens used by a request to the AI model).
+	Type string `json:"type"`
+
+	// Content is the delta for "text" and "thinking" events, the input to the tool
+	// for "tool_use" events, and the output of the tool for "tool_result" events.
+	Content string `json:"content,omitempty"`
+
+	// ToolUseID is the ID of the tool use to correlate
+	// "tool_use" and "tool_result" events.
+	ToolUseID string `json:"toolUseId,omitempty"`
+
+	// ToolUseName is the name of the tool to use.
+	ToolUseName string `json:"toolUseName,omitempty"`
+
+	// IsError is true if there was an error during tool execution.
+	// In this case, Content is the error message returned to the AI model.
+	IsError bool `json:"isError,omitempty"`
+
+	// APIRequest is the ID of the request to the AI model during which
+	// the event happened.
+	APIRequest string `json:"apiRequest,omitempty"`
+
+	// UsedTokens is set for "usage" events.
+	UsedTokens *TextRecorderUsedTokens `json:"usedTokens,omitempty"`
+}
+
+// WithStreaming is a [TextProvider] which supports streaming its response.
+type WithStreaming interface {
+	// ChatStream is like Chat, but it calls fn for every event while the AI model
+	// is responding. If fn returns an error, the chat is aborted with that error.
+	//
+	// Events from all exchanges with the AI model are passed to fn (e.g., when
+	// using tools), including any text the AI model responds with before
+	// requesting tool calls.
+	ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E)
+
+	// ChatConversationStream is like ChatStream, but it sends all messages to the AI model
+	// (after messages provided to Init) and streams the response to the last message.
+	// Messages should alternate between "user" and "assistant" roles, starting and
+	// ending with a "user" message.
+	ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E)
+}
+
+// WithConversation is a [TextProvider] which supports chatting with
+// a conversation history provided for each call.
+type WithConversation interface {
+	// ChatConversation is like Chat, but it sends all messages to the AI model
+	// (after messages provided to Init) and returns the response to the last message.
+	// Messages should alternate between "user" and "assistant" roles, starting and
+	// ending with a "user" message. If no messages were provided to Init,
+	// messages can start with a "system" message.
+	ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E)
+}
+
 // WithOutputJSONSchema is a [TextProvider] which supports forcing JSON Schema for its output.
 type WithOutputJSONSchema interface {
 	// InitOutputJSONSchema provides the JSON Schema the provider
@@ -59,3 +161,44 @@ type WithTools interface {
 	// InitTools initializes the tool with available tools.
 	InitTools(ctx context.Context, tools map[string]TextTooler) errors.E
 }
+
+// TextBatchRequest is a request submitted as part of a batch
+// using [WithBatch] interface.
+type TextBatchRequest struct {
+	// ID identifies the request inside the batch.
+	ID string `json:"id"`
+
+	// Messages sent to the AI model (after messages provided to Init).
+	// Messages should alternate between "user" and "assistant" roles,
+	// starting and ending with a "user" message. If no messages were
+	// provided to Init, messages can start with a "system" message.
+	Messages []ChatMessage `json:"messages"`
+}
+
+// TextBatchResponse is a response to a [TextBatchRequest].
+type TextBatchResponse struct {
+	// ID of the request this is the response to.
+	ID string
+
+	// Content of the response.
+	Content string
+
+	// Err is set if processing the request failed.
+	Err errors.E
+}
+
+// WithBatch is a [TextProvider] which supports asynchronous
+// processing of batches of requests.
+//
+// Tools are not supported with batches.
+type WithBatch interface {
+	// SubmitBatch submits requests for asynchronous processing and
+	// returns the ID of the batch. Request IDs have to be unique and
+	// can contain only ASCII letters, digits, "_", and "-".
+	SubmitBatch(ctx context.Context, requests []TextBatchRequest) (string, errors.E)
+
+	// BatchResponses returns responses to all requests in the batch,
+	// in no particular order. If the batch has not yet finished
+	// processing, it returns false and no responses.
+	BatchResponses(ctx context.Context, batchID string) ([]TextBatchResponse, bool, errors.E)
+}
@@ -0,0 +1,1176 @@
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"golang.org/x/time/rate"
+)
+
+const geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+const roleGeminiModel = "model"
+
+var geminiRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "gemini",
+	mu:       sync.RWMutex{},
+	limiters: map[string]map[string]any{},
+}
+
+type geminiInlineData struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"`
+
+	// raw is used for recording.
+	raw []byte
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+
+	// id is generated when the API does not provide ID.
+	id string
+}
+
+// callID returns the ID of the function call.
+func (c *geminiFunctionCall) callID() string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return c.id
+}
+
+// input returns arguments of the function call as JSON.
+func (c *geminiFunctionCall) input() json.RawMessage {
+	if len(c.Args) == 0 {
+		return json.RawMessage("{}")
+	}
+	return c.Args
+}
+
+type geminiFunctionResult struct {
+	Output *string `json:"output,omitempty"`
+	Error  *string `json:"error,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string               `json:"id,omitempty"`
+	Name     string               `json:"name"`
+	Response geminiFunctionResult `json:"response"`
+}
+
+type geminiPart struct {
+	Text             *string                 `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	ThoughtSignature string                  `json:"thoughtSignature,omitempty"`
+	InlineData       *geminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name                 string          `json:"name"`
+	Description          string          `json:"description,omitempty"`
+	ParametersJSONSchema json.RawMessage `json:"parametersJsonSchema"`
+	tool                 TextTooler
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiThinkingConfig struct {
+	ThinkingBudget  int  `json:"thinkingBudget"`
+	IncludeThoughts bool `json:"includeThoughts"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature        float64               `json:"temperature"`
+	MaxOutputTokens    int                   `json:"maxOutputTokens"`
+	Seed               int                   `json:"seed"`
+	ResponseMIMEType   string                `json:"responseMimeType,omitempty"`
+	ResponseJSONSchema json.RawMessage       `json:"responseJsonSchema,omitempty"`
+	ThinkingConfig     *geminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent        `json:"contents"`
+	Tools             []geminiTool           `json:"tools,omitempty"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	ToolUsePromptTokenCount int `json:"toolUsePromptTokenCount"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+	Index        int           `json:"index"`
+}
+
+type geminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+type geminiResponse struct {
+	Candidates     []geminiCandidate `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback,omitempty"`
+	UsageMetadata geminiUsage  `json:"usageMetadata"`
+	ModelVersion  string       `json:"modelVersion"`
+	ResponseID    string       `json:"responseId"`
+	Error         *geminiError `json:"error,omitempty"`
+}
+
+type geminiModel struct {
+	Name             string `json:"name"`
+	InputTokenLimit  int    `json:"inputTokenLimit"`
+	OutputTokenLimit int    `json:"outputTokenLimit"`
+}
+
+var (
+	_ TextProvider         = (*GeminiTextProvider)(nil)
+	_ WithStreaming        = (*GeminiTextProvider)(nil)
+	_ WithConversation     = (*GeminiTextProvider)(nil)
+	_ WithOutputJSONSchema = (*GeminiTextProvider)(nil)
+	_ WithTools            = (*GeminiTextProvider)(nil)
+	_ typedProvider        = (*GeminiTextProvider)(nil)
+)
+
+// GeminiTextProvider is a [TextProvider] which provides integration with
+// text-based [Gemini] AI models.
+//
+// [Gemini]: https://ai.google.dev/
+type GeminiTextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key to be used for API calls.
+	APIKey string `json:"-"`
+
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://generativelanguage.googleapis.com/v1beta".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the name of the model to be used.
+	Model string `json:"model"`
+
+	// RequestsPerMinuteLimit is the RPM limit for the used model and API key.
+	// Gemini API does not report rate limits, so they have to be provided.
+	// Default is 0 which means that requests are not rate limited.
+	RequestsPerMinuteLimit int `json:"requestsPerMinuteLimit"`
+
+	// TokensPerMinuteLimit is the input TPM limit for the used model and API key.
+	// Default is 0 which means that tokens are not rate limited.
+	TokensPerMinuteLimit int `json:"tokensPerMinuteLimit"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, it is obtained from the API.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, it is obtained
+	// from the API.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// ForceOutputJSONSchema when set to true requests the AI model to force
+	// the output JSON Schema for its output.
+	ForceOutputJSONSchema bool `json:"forceOutputJsonSchema"`
+
+	// ReasoningBudget is the budget of tokens to use for thinking. Thought
+	// summaries are then included in responses. Set to -1 for the AI model
+	// to determine the budget itself.
+	// Default is 0 which means that model's default is used and thought summaries
+	// are not included.
+	ReasoningBudget int `json:"reasoningBudget"`
+
+	// Seed is used to control the randomness of the AI model. Default is 0.
+	Seed int `json:"seed"`
+
+	// Temperature is how creative should the AI model be.
+	// Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	rateLimiterKey   string
+	system           *geminiContent
+	messages         []geminiContent
+	tools            []geminiFunctionDeclaration
+	outputJSONSchema json.RawMessage
+}
+
+// MarshalJSON implements json.Marshaler interface for GeminiTextProvider.
+func (g GeminiTextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P GeminiTextProvider
+	p := P(g)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "gemini",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (g GeminiTextProvider) typeModel() (string, string) {
+	return "gemini", g.Model
+}
+
+// Init implements [TextProvider] interface.
+func (g *GeminiTextProvider) Init(ctx context.Context, messages []ChatMessage) errors.E {
+	if g.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	g.messages = []geminiContent{}
+
+	for _, message := range messages {
+		if message.Role == roleSystem {
+			if g.system != nil {
+				return errors.WithStack(ErrMultipleSystemMessages)
+			}
+			g.system = &geminiContent{
+				Role:  "",
+				Parts: []geminiPart{{Text: &message.Content}}, //nolint:exhaustruct
+			}
+		} else {
+			content, errE := newGeminiContent(message)
+			if errE != nil {
+				return errE
+			}
+			g.messages = append(g.messages, content)
+		}
+	}
+
+	g.rateLimiterKey = fmt.Sprintf("%s-%s-%s", g.BaseURL, g.APIKey, g.Model)
+
+	if g.Client == nil {
+		// Gemini API does not provide rate limit headers, so rate limits are not updated from responses.
+		g.Client = newClient(
+			func(req *http.Request) error {
+				// The models endpoint is not rate limited.
+				if strings.HasSuffix(req.URL.Path, ":generateContent") || strings.HasSuffix(req.URL.Path, ":streamGenerateContent") {
+					reqCtx := req.Context()
+					estimatedInputTokens, _ := getEstimatedTokens(reqCtx)
+					// Rate limit retries.
+					return geminiRateLimiter.Take(reqCtx, g.rateLimiterKey, map[string]int{
+						"rpm": 1,
+						"tpm": estimatedInputTokens,
+					})
+				}
+				return nil
+			},
+			nil,
+			nil,
+		)
+	}
+
+	rateLimits := map[string]any{}
+	if g.RequestsPerMinuteLimit > 0 {
+		rateLimits["rpm"] = tokenBucketRateLimit{
+			Limit: rate.Limit(float64(g.RequestsPerMinuteLimit) / time.Minute.Seconds()), // Requests per minute.
+			Burst: g.RequestsPerMinuteLimit,
+		}
+	}
+	if g.TokensPerMinuteLimit > 0 {
+		rateLimits["tpm"] = tokenBucketRateLimit{
+			Limit: rate.Limit(float64(g.TokensPerMinuteLimit) / time.Minute.Seconds()), // Tokens per minute.
+			Burst: g.TokensPerMinuteLimit,
+		}
+	}
+	geminiRateLimiter.Set(g.rateLimiterKey, rateLimits)
+
+	if g.MaxContextLength == 0 || g.MaxResponseLength == 0 {
+		model, errE := g.getModel(ctx)
+		if errE != nil {
+			return errE
+		}
+
+		if g.MaxContextLength == 0 {
+			g.MaxContextLength = model.InputTokenLimit
+		}
+		if g.MaxResponseLength == 0 {
+			g.MaxResponseLength = model.OutputTokenLimit
+		}
+	}
+
+	if g.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	if g.MaxResponseLength == 0 {
+		return errors.New("MaxResponseLength not set")
+	}
+
+	if g.MaxExchanges == 0 {
+		g.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+func (g *GeminiTextProvider) modelURL() string {
+	return apiURL(g.BaseURL, geminiBaseURL, "/models/"+url.PathEscape(strings.TrimPrefix(g.Model, "models/")))
+}
+
+func (g *GeminiTextProvider) getModel(ctx context.Context) (*geminiModel, errors.E) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.modelURL(), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Add("X-Goog-Api-Key", g.APIKey)
+	setHeaders(req, g.Headers)
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return nil, errors.Prefix(err, ErrAPIRequestFailed)
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, geminiResponseError(resp)
+	}
+
+	var model geminiModel
+	errE := x.DecodeJSON(resp.Body, &model)
+	if errE != nil {
+		return nil, errE
+	}
+
+	return &model, nil
+}
+
+// geminiResponseError returns an error for a response with non-200 status code.
+// Its body is included as the error reported by the API if it can be parsed,
+// or as-is otherwise (e.g., when the error is from a proxy).
+func geminiResponseError(resp *http.Response) errors.E {
+	body, _ := io.ReadAll(resp.Body)
+	errE := errors.WithDetails(
+		ErrAPIResponseError,
+		"code", resp.StatusCode,
+	)
+	var response geminiResponse
+	if x.Unmarshal(body, &response) == nil && response.Error != nil {
+		errors.Details(errE)["body"] = response.Error
+	} else {
+		errors.Details(errE)["body"] = string(body)
+	}
+	return errE
+}
+
+// Chat implements [TextProvider] interface.
+func (g *GeminiTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return g.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (g *GeminiTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return g.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (g *GeminiTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return g.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (g *GeminiTextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return g.chat(ctx, messages, fn)
+}
+
+func (g *GeminiTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newCall(ctx, callID, g)
+		defer recorder.recordCall(callRecorder)
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	stream := newTextStream(callRecorder, fn)
+
+	system, messages, errE := g.conversationMessages(conversation)
+	if errE != nil {
+		return "", errE
+	}
+
+	if callRecorder != nil {
+		if system != nil {
+			for _, part := range system.Parts {
+				callRecorder.addMessage(roleSystem, *part.Text, "", "", false)
+			}
+		}
+
+		for _, message := range messages {
+			errE := g.recordMessage(callRecorder, message)
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		callRecorder.notify("", nil)
+	}
+
+	for range g.MaxExchanges {
+		response, apiRequest, apiCallDuration, errE := g.send(ctx, system, messages, stream)
+		if errE != nil {
+			return "", errE
+		}
+
+		if len(response.Candidates) == 0 && response.PromptFeedback != nil && response.PromptFeedback.BlockReason != "" {
+			return "", errors.WithDetails(
+				ErrRefused,
+				"refusal", response.PromptFeedback.BlockReason,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		if len(response.Candidates) != 1 {
+			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+			errors.Details(errE)["number"] = len(response.Candidates)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+
+		candidate := response.Candidates[0]
+		// Role is sometimes missing.
+		candidate.Content.Role = roleGeminiModel
+
+		if stream != nil {
+			errE = stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: g.usedTokens(response.UsageMetadata),
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		if callRecorder != nil {
+			callRecorder.setUsedTokens(apiRequest, g.usedTokens(response.UsageMetadata))
+			callRecorder.addUsedTime(
+				apiRequest,
+				0,
+				0,
+				apiCallDuration,
+			)
+
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
+			errE := g.recordMessage(callRecorder, candidate.Content)
+			if errE != nil {
+				return "", errE
+			}
+
+			callRecorder.notify("", nil)
+		}
+
+		usedTokens := g.usedTokens(response.UsageMetadata)
+		if usedTokens.Total >= g.MaxContextLength {
+			return "", errors.WithDetails(
+				ErrUnexpectedNumberOfTokens,
+				"prompt", usedTokens.Prompt,
+				"response", usedTokens.Response,
+				"total", usedTokens.Total,
+				"maxTotal", g.MaxContextLength,
+				"maxResponse", g.MaxResponseLength,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		toolCalls := []*geminiFunctionCall{}
+		for _, part := range candidate.Content.Parts {
+			if part.FunctionCall != nil {
+				toolCalls = append(toolCalls, part.FunctionCall)
+			}
+		}
+
+		if len(toolCalls) > 0 {
+			// We have already recorded this message above.
+			messages = append(messages, candidate.Content)
+
+			// We make space for tool results (one per tool call) so that the Parts slice
+			// does not grow when appending below and invalidate pointers goroutines keep.
+			messages = append(messages, geminiContent{
+				Role:  roleUser,
+				Parts: make([]geminiPart, 0, len(toolCalls)),
+			})
+
+			if callRecorder != nil {
+				// We grow the slice inside call recorder as well.
+				callRecorder.prepareForToolMessages(len(toolCalls))
+			}
+
+			var wg sync.WaitGroup
+			for _, toolCall := range toolCalls {
+				messages[len(messages)-1].Parts = append(messages[len(messages)-1].Parts, geminiPart{ //nolint:exhaustruct
+					FunctionResponse: &geminiFunctionResponse{
+						ID:       toolCall.ID,
+						Name:     toolCall.Name,
+						Response: geminiFunctionResult{Output: nil, Error: nil},
+					},
+				})
+				result := messages[len(messages)-1].Parts[len(messages[len(messages)-1].Parts)-1].FunctionResponse
+
+				toolCtx := ctx
+				var toolMessage *TextRecorderMessage
+				if callRecorder != nil {
+					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolCall.callID())
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					g.callToolWrapper(toolCtx, apiRequest, toolCall, result, callRecorder, toolMessage)
+				}()
+			}
+
+			wg.Wait()
+
+			if stream != nil {
+				for i, result := range messages[len(messages)-1].Parts {
+					content := result.FunctionResponse.Response.Output
+					if result.FunctionResponse.Response.Error != nil {
+						content = result.FunctionResponse.Response.Error
+					}
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    *content,
+						ToolUseID:  toolCalls[i].callID(),
+						IsError:    result.FunctionResponse.Response.Error != nil,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
+			continue
+		}
+
+		return geminiText(candidate, apiRequest)
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", g.MaxExchanges,
+	)
+}
+
+// conversationMessages returns the system instruction and messages provided to Init followed by the conversation.
+// The conversation can start with a system message if no system message was provided to Init.
+func (g *GeminiTextProvider) conversationMessages(conversation []ChatMessage) (*geminiContent, []geminiContent, errors.E) {
+	system := g.system
+	if len(conversation) > 0 && conversation[0].Role == roleSystem {
+		if g.system != nil {
+			return nil, nil, errors.WithStack(ErrMultipleSystemMessages)
+		}
+		system = &geminiContent{
+			Role:  "",
+			Parts: []geminiPart{{Text: &conversation[0].Content}}, //nolint:exhaustruct
+		}
+		conversation = conversation[1:]
+	}
+
+	messages := slices.Clone(g.messages)
+	for _, message := range conversation {
+		if message.Role == roleSystem {
+			return nil, nil, errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", message.Role,
+			)
+		}
+		content, errE := newGeminiContent(message)
+		if errE != nil {
+			return nil, nil, errE
+		}
+		messages = append(messages, content)
+	}
+	return system, messages, nil
+}
+
+// geminiText returns the text of the final response.
+func geminiText(candidate geminiCandidate, apiRequest string) (string, errors.E) {
+	if candidate.FinishReason != "STOP" {
+		return "", errors.WithDetails(
+			ErrUnexpectedStop,
+			"reason", candidate.FinishReason,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	// Gemini can split text into multiple parts.
+	var text strings.Builder
+	for _, part := range candidate.Content.Parts {
+		if part.Thought {
+			continue
+		}
+		if part.Text == nil {
+			errE := errors.Errorf("%w: part is not text", ErrUnexpectedMessageType)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+		text.WriteString(*part.Text)
+	}
+
+	return text.String(), nil
+}
+
+func (g *GeminiTextProvider) newRequest(system *geminiContent, messages []geminiContent) geminiRequest {
+	gReq := geminiRequest{
+		SystemInstruction: system,
+		Contents:          messages,
+		Tools:             nil,
+		GenerationConfig: geminiGenerationConfig{
+			Temperature:        g.Temperature,
+			MaxOutputTokens:    g.MaxResponseLength,
+			Seed:               g.Seed,
+			ResponseMIMEType:   "",
+			ResponseJSONSchema: nil,
+			ThinkingConfig:     nil,
+		},
+	}
+
+	if len(g.tools) > 0 {
+		gReq.Tools = []geminiTool{{FunctionDeclarations: g.tools}}
+	}
+
+	if g.outputJSONSchema != nil {
+		// We use responseJsonSchema instead of responseSchema because
+		// the latter supports only a subset of OpenAPI schema.
+		gReq.GenerationConfig.ResponseMIMEType = applicationJSONHeader
+		gReq.GenerationConfig.ResponseJSONSchema = g.outputJSONSchema
+	}
+
+	if g.ReasoningBudget != 0 {
+		gReq.GenerationConfig.ThinkingConfig = &geminiThinkingConfig{
+			ThinkingBudget:  g.ReasoningBudget,
+			IncludeThoughts: true,
+		}
+	}
+
+	return gReq
+}
+
+func (g *GeminiTextProvider) send(
+	ctx context.Context, system *geminiContent, messages []geminiContent, stream func(event TextStreamEvent) errors.E,
+) (_ *geminiResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, g,
+		semconv.GenAIRequestMaxTokens(g.MaxResponseLength),
+		semconv.GenAIRequestSeed(g.Seed),
+		semconv.GenAIRequestTemperature(g.Temperature),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(g)
+
+	request, errE := x.MarshalWithoutEscapeHTML(g.newRequest(system, messages))
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := g.estimatedTokens(system, messages)
+
+	reservation, errE := reserveBudget(ctx, g, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	u := g.modelURL() + ":generateContent"
+	if stream != nil {
+		u = g.modelURL() + ":streamGenerateContent?alt=sse"
+	}
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		u,
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("X-Goog-Api-Key", g.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, g.Headers)
+	// Rate limit the initial request.
+	errE = geminiRateLimiter.Take(ctx, g.rateLimiterKey, map[string]int{
+		"rpm": 1,
+		"tpm": estimatedInputTokens,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	start := time.Now()
+	resp, err := g.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	if err != nil {
+		return nil, "", 0, errors.Prefix(err, ErrAPIRequestFailed)
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", 0, geminiResponseError(resp)
+	}
+
+	var response geminiResponse
+	if stream != nil && isEventStream(resp) {
+		errE = decodeGeminiStream(resp.Body, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	// Gemini API does not provide a request ID header, so we use the response ID.
+	apiRequest := response.ResponseID
+	if apiRequest == "" {
+		apiRequest = identifier.New().String()
+	}
+	span.SetAttributes(apiRequestKey.String(apiRequest))
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, apiRequest, 0, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	// Function calls have IDs only sometimes, so we generate them otherwise.
+	for _, candidate := range response.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.FunctionCall != nil && part.FunctionCall.callID() == "" {
+				part.FunctionCall.id = identifier.New().String()
+			}
+		}
+	}
+
+	usedTokens := g.usedTokens(response.UsageMetadata)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	finishReasons := []string{}
+	for _, candidate := range response.Candidates {
+		finishReasons = append(finishReasons, candidate.FinishReason)
+	}
+	span.SetAttributes(
+		semconv.GenAIResponseID(response.ResponseID),
+		semconv.GenAIResponseModel(response.ModelVersion),
+		semconv.GenAIResponseFinishReasons(finishReasons...),
+		semconv.GenAIUsageInputTokens(usedTokens.Prompt),
+		semconv.GenAIUsageOutputTokens(usedTokens.Response),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+// decodeGeminiStream decodes server-sent events with partial responses into
+// the response, calling stream for every part.
+//
+// See: https://ai.google.dev/api/generate-content#method:-models.streamgeneratecontent
+func decodeGeminiStream(body io.Reader, response *geminiResponse, stream func(event TextStreamEvent) errors.E) errors.E {
+	return decodeServerSentEvents(body, func(_ string, data []byte) errors.E {
+		var chunk geminiResponse
+		errE := x.Unmarshal(data, &chunk)
+		if errE != nil {
+			return errE
+		}
+
+		if chunk.ResponseID != "" {
+			response.ResponseID = chunk.ResponseID
+		}
+		if chunk.ModelVersion != "" {
+			response.ModelVersion = chunk.ModelVersion
+		}
+		if chunk.PromptFeedback != nil {
+			response.PromptFeedback = chunk.PromptFeedback
+		}
+		if chunk.Error != nil {
+			response.Error = chunk.Error
+		}
+		// Usage metadata is cumulative.
+		response.UsageMetadata = chunk.UsageMetadata
+
+		for _, c := range chunk.Candidates {
+			for len(response.Candidates) <= c.Index {
+				response.Candidates = append(response.Candidates, geminiCandidate{ //nolint:exhaustruct
+					Content: geminiContent{Role: roleGeminiModel, Parts: []geminiPart{}},
+					Index:   len(response.Candidates),
+				})
+			}
+			candidate := &response.Candidates[c.Index]
+			if c.FinishReason != "" {
+				candidate.FinishReason = c.FinishReason
+			}
+			for _, part := range c.Content.Parts {
+				errE := mergeGeminiPart(&candidate.Content, part, response.ResponseID, stream)
+				if errE != nil {
+					return errE
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// mergeGeminiPart appends a streamed part to content, merging consecutive text parts.
+func mergeGeminiPart(content *geminiContent, part geminiPart, apiRequest string, stream func(event TextStreamEvent) errors.E) errors.E {
+	switch {
+	case part.Text != nil:
+		if len(content.Parts) > 0 {
+			last := &content.Parts[len(content.Parts)-1]
+			if last.Text != nil && last.Thought == part.Thought {
+				text := *last.Text + *part.Text
+				last.Text = &text
+				if part.ThoughtSignature != "" {
+					last.ThoughtSignature = part.ThoughtSignature
+				}
+			} else {
+				content.Parts = append(content.Parts, part)
+			}
+		} else {
+			content.Parts = append(content.Parts, part)
+		}
+		if *part.Text == "" {
+			return nil
+		}
+		eventType := typeText
+		if part.Thought {
+			eventType = roleThinking
+		}
+		return stream(TextStreamEvent{ //nolint:exhaustruct
+			Type:       eventType,
+			Content:    *part.Text,
+			APIRequest: apiRequest,
+		})
+	case part.FunctionCall != nil:
+		if part.FunctionCall.callID() == "" {
+			part.FunctionCall.id = identifier.New().String()
+		}
+		content.Parts = append(content.Parts, part)
+		return stream(TextStreamEvent{ //nolint:exhaustruct
+			Type:        roleToolUse,
+			Content:     string(part.FunctionCall.input()),
+			ToolUseID:   part.FunctionCall.callID(),
+			ToolUseName: part.FunctionCall.Name,
+			APIRequest:  apiRequest,
+		})
+	default:
+		content.Parts = append(content.Parts, part)
+		return nil
+	}
+}
+
+func (g *GeminiTextProvider) usedTokens(usage geminiUsage) *TextRecorderUsedTokens {
+	var cacheReadInputTokens *int
+	if usage.CachedContentTokenCount != 0 {
+		cacheReadInputTokens = &usage.CachedContentTokenCount
+	}
+	var thinkingTokens *int
+	if usage.ThoughtsTokenCount != 0 {
+		thinkingTokens = &usage.ThoughtsTokenCount
+	}
+	// Gemini does not include thinking tokens in response tokens, but we do.
+	return newUsedTokens(
+		g.MaxContextLength,
+		g.MaxResponseLength,
+		usage.PromptTokenCount+usage.ToolUsePromptTokenCount,
+		usage.CandidatesTokenCount+usage.ThoughtsTokenCount,
+		nil,
+		cacheReadInputTokens,
+		thinkingTokens,
+	)
+}
+
+func (g *GeminiTextProvider) estimatedTokens(system *geminiContent, messages []geminiContent) (int, int) {
+	// We estimate inputTokens from training messages (including system message) by
+	// dividing number of characters by 4.
+	inputTokens := 0
+	contents := messages
+	if system != nil {
+		contents = append([]geminiContent{*system}, messages...)
+	}
+	for _, message := range contents {
+		for _, part := range message.Parts {
+			if part.Text != nil {
+				inputTokens += len(*part.Text) / 4 //nolint:mnd
+			}
+			if part.InlineData != nil {
+				inputTokens += estimatedPartTokens
+			}
+			if part.FunctionCall != nil {
+				inputTokens += len(part.FunctionCall.Name) / 4 //nolint:mnd
+				inputTokens += len(part.FunctionCall.Args) / 4 //nolint:mnd
+			}
+			if part.FunctionResponse != nil {
+				if part.FunctionResponse.Response.Output != nil {
+					inputTokens += len(*part.FunctionResponse.Response.Output) / 4 //nolint:mnd
+				}
+				if part.FunctionResponse.Response.Error != nil {
+					inputTokens += len(*part.FunctionResponse.Response.Error) / 4 //nolint:mnd
+				}
+			}
+		}
+	}
+	for _, tool := range g.tools {
+		inputTokens += len(tool.Name) / 4                 //nolint:mnd
+		inputTokens += len(tool.Description) / 4          //nolint:mnd
+		inputTokens += len(tool.ParametersJSONSchema) / 4 //nolint:mnd
+	}
+	// TODO: Can we provide a better estimate for output tokens?
+	return inputTokens, g.MaxResponseLength
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (g *GeminiTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if !g.ForceOutputJSONSchema {
+		return nil
+	}
+
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if g.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	g.outputJSONSchema = schema
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (g *GeminiTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if g.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	g.tools = []geminiFunctionDeclaration{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		g.tools = append(g.tools, geminiFunctionDeclaration{
+			Name:                 name,
+			Description:          tool.GetDescription(),
+			ParametersJSONSchema: tool.GetInputJSONSchema(),
+			tool:                 tool,
+		})
+	}
+
+	return nil
+}
+
+func (g *GeminiTextProvider) callToolWrapper(
+	ctx context.Context, apiRequest string, toolCall *geminiFunctionCall, result *geminiFunctionResponse,
+	callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+) {
+	if callRecorder != nil {
+		defer func() {
+			callRecorder.notify("", nil)
+		}()
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Name).Inc()
+
+			content := fmt.Sprintf("Error: %s", err)
+			result.Response.Error = &content
+
+			toolMessage.setContent(content, true)
+		}
+	}()
+
+	defer func() {
+		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
+	}()
+
+	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.callID()).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startToolSpan(ctx, toolCall.Name, toolCall.callID())
+	defer span.End()
+
+	output, duration, errE := g.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Name, duration, errE)
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Name).Str("apiRequest", apiRequest).
+			Str("tool", toolCall.callID()).RawJSON("input", toolCall.input()).Msg("tool error")
+		content := "Error: " + errE.Error()
+		result.Response.Error = &content
+
+		toolMessage.setContent(content, true)
+	} else {
+		result.Response.Output = &output
+
+		toolMessage.setContent(output, false)
+	}
+
+	toolMessage.setToolDuration(duration)
+}
+
+func (g *GeminiTextProvider) callTool(ctx context.Context, toolCall *geminiFunctionCall) (string, Duration, errors.E) {
+	var tool TextTooler
+	for _, t := range g.tools {
+		if t.Name == toolCall.Name {
+			tool = t.tool
+			break
+		}
+	}
+	if tool == nil {
+		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolCall.Name)
+	}
+
+	start := time.Now()
+	output, errE := tool.Call(ctx, toolCall.input())
+	duration := time.Since(start)
+	return output, Duration(duration), errE
+}
+
+// newGeminiContent converts a message to Gemini content.
+//
+// See: https://ai.google.dev/gemini-api/docs/image-understanding
+// See: https://ai.google.dev/gemini-api/docs/document-processing
+func newGeminiContent(message ChatMessage) (geminiContent, errors.E) {
+	role := message.Role
+	if role == roleAssistant {
+		role = roleGeminiModel
+	}
+	parts := []geminiPart{}
+	for _, part := range message.parts() {
+		switch part.Type {
+		case typeText:
+			text := part.Text
+			parts = append(parts, geminiPart{ //nolint:exhaustruct
+				Text: &text,
+			})
+		case typeImage, typeDocument:
+			parts = append(parts, geminiPart{ //nolint:exhaustruct
+				InlineData: &geminiInlineData{
+					MIMEType: part.MIMEType,
+					Data:     base64.StdEncoding.EncodeToString(part.Data),
+					raw:      part.Data,
+				},
+			})
+		default:
+			return geminiContent{}, errors.WithDetails( //nolint:exhaustruct
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+	return geminiContent{
+		Role:  role,
+		Parts: parts,
+	}, nil
+}
+
+func (g *GeminiTextProvider) recordMessage(recorder *TextRecorderCall, message geminiContent) errors.E {
+	role := message.Role
+	if role == roleGeminiModel {
+		role = roleAssistant
+	}
+	for _, part := range message.Parts {
+		switch {
+		case part.FunctionResponse != nil:
+			return errors.New("recording tool result message should not happen")
+		case part.FunctionCall != nil:
+			recorder.addMessage(roleToolUse, string(part.FunctionCall.input()), part.FunctionCall.callID(), part.FunctionCall.Name, false)
+		case part.InlineData != nil:
+			recorder.addPart(role, ChatContentPart{
+				Type:     geminiPartType(part.InlineData.MIMEType),
+				Text:     "",
+				MIMEType: part.InlineData.MIMEType,
+				Data:     part.InlineData.raw,
+			})
+		case part.Text != nil && part.Thought:
+			recorder.addMessage(roleThinking, *part.Text, "", "", false)
+		case part.Text != nil:
+			recorder.addMessage(role, *part.Text, "", "", false)
+		}
+	}
+	return nil
+}
+
+// geminiPartType returns the type of the content part with inline data.
+func geminiPartType(mimeType string) string {
+	if strings.HasPrefix(mimeType, "image/") {
+		return typeImage
+	}
+	return typeDocument
+}
@@ -0,0 +1,180 @@
+package fun_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+func TestGeminiTextProvider(t *testing.T) {
+	t.Parallel()
+
+	for _, stream := range []bool{false, true} {
+		name := "call"
+		if stream {
+			name = "stream"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := emulator.NewGemini(
+				emulator.Response{ //nolint:exhaustruct
+					Check: func(req emulator.Request) error {
+						var request struct {
+							SystemInstruction struct {
+								Parts []struct {
+									Text string `json:"text"`
+								} `json:"parts"`
+							} `json:"systemInstruction"`
+							Contents []struct {
+								Role string `json:"role"`
+							} `json:"contents"`
+							GenerationConfig map[string]any `json:"generationConfig"`
+						}
+						errE := x.Unmarshal(req.Body, &request)
+						if errE != nil {
+							return errE
+						}
+						assert.Equal(t, "test", req.Header.Get("X-Goog-Api-Key"))
+						require.Len(t, request.SystemInstruction.Parts, 1)
+						assert.Equal(t, "Repeat the input.", request.SystemInstruction.Parts[0].Text)
+						// One example and the input.
+						roles := []string{}
+						for _, content := range request.Contents {
+							roles = append(roles, content.Role)
+						}
+						assert.Equal(t, []string{"user", "model", "user"}, roles)
+						assert.Equal(t, "application/json", request.GenerationConfig["responseMimeType"])
+						assert.Equal(t, map[string]any{"type": "string"}, request.GenerationConfig["responseJsonSchema"])
+						assert.Equal(t, map[string]any{"thinkingBudget": float64(1024), "includeThoughts": true}, request.GenerationConfig["thinkingConfig"])
+						return nil
+					},
+					Content:        "foo",
+					Thinking:       "The input is foo.",
+					PromptTokens:   100,
+					ResponseTokens: 10,
+					ThinkingTokens: 50,
+					CachedTokens:   80,
+				},
+				emulator.Response{StatusCode: http.StatusBadRequest}, //nolint:exhaustruct
+			)
+			defer server.Close()
+
+			f := fun.Text[string, string]{
+				Provider: &fun.GeminiTextProvider{ //nolint:exhaustruct
+					APIKey:                "test",
+					BaseURL:               server.URL + "/v1beta",
+					Model:                 "gemini-2.5-flash",
+					ForceOutputJSONSchema: true,
+					ReasoningBudget:       1024,
+				},
+				InputJSONSchema:  nil,
+				OutputJSONSchema: jsonSchemaString,
+				Prompt:           "Repeat the input.",
+				PromptTemplate:   "",
+				InputTemplate:    "",
+				Data: []fun.InputOutput[string, string]{
+					{Input: []string{"bar"}, Output: "bar"},
+				},
+				Tools:             nil,
+				MaxRepairAttempts: 0,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			var output string
+			if stream {
+				events := []string{}
+				output, errE = f.Stream(ct, func(event fun.TextStreamEvent) errors.E {
+					events = append(events, event.Type)
+					return nil
+				}, "foo")
+				assert.Equal(t, []string{"thinking", "text", "usage"}, events)
+			} else {
+				output, errE = f.Call(ct, "foo")
+			}
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "foo", output)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			require.Len(t, calls, 1)
+
+			assert.Equal(t, 1_048_576, calls[0].Provider.(*fun.GeminiTextProvider).MaxContextLength) //nolint:forcetypeassert,errcheck
+
+			roles := []string{}
+			for i := range calls[0].Messages {
+				roles = append(roles, calls[0].Messages[i].Role)
+			}
+			assert.Equal(t, []string{"system", "user", "assistant", "user", "thinking", "assistant"}, roles)
+
+			require.Len(t, calls[0].UsedTokens, 1)
+			for _, usedTokens := range calls[0].UsedTokens {
+				assert.Equal(t, 100, usedTokens.Prompt)
+				// Thinking tokens are included in response tokens.
+				assert.Equal(t, 60, usedTokens.Response)
+				assert.Equal(t, 160, usedTokens.Total)
+				assert.Equal(t, 80, *usedTokens.CacheReadInputTokens)
+				assert.Equal(t, 50, *usedTokens.ThinkingTokens)
+			}
+
+			_, errE = f.Call(ctx, "foo")
+			assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+			assert.Equal(t, http.StatusBadRequest, errors.Details(errE)["code"])
+
+			assert.Equal(t, 0, server.Remaining())
+		})
+	}
+}
+
+func TestGeminiTextProviderRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewGemini(
+		emulator.Response{StatusCode: http.StatusServiceUnavailable}, //nolint:exhaustruct
+		emulator.Response{Content: "foo"},                            //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	// The default client is used, which retries the failed request.
+	provider := &fun.GeminiTextProvider{ //nolint:exhaustruct
+		APIKey:                 "test",
+		BaseURL:                server.URL + "/v1beta",
+		Model:                  "gemini-2.5-flash",
+		RequestsPerMinuteLimit: 2,
+		TokensPerMinuteLimit:   1_000,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	// The initial request and its retry use the whole RPM limit.
+	output, errE := provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	_, errE = provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	assert.ErrorContains(t, errE, "would exceed context deadline")
+
+	assert.Equal(t, 0, server.Remaining())
+}
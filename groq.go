@@ -7,8 +7,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,10 +18,14 @@ import (
 	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"golang.org/x/time/rate"
 )
 
+const groqBaseURL = "https://api.groq.com/openai/v1"
+
 var groqRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "groq",
 	mu:       sync.RWMutex{},
 	limiters: map[string]map[string]any{},
 }
@@ -63,9 +69,11 @@ type groqRequest struct {
 	MaxCompletionTokens int           `json:"max_completion_tokens"`
 	Tools               []groqTool    `json:"tools,omitempty"`
 	ReasoningEffort     string        `json:"reasoning_effort,omitempty"`
+	Stream              bool          `json:"stream,omitempty"`
 }
 
 type groqToolCall struct {
+	Index    *int   `json:"index,omitempty"`
 	ID       string `json:"id"`
 	Type     string `json:"type"`
 	Function struct {
@@ -79,9 +87,93 @@ type groqMessage struct {
 	Content    *string        `json:"content,omitempty"`
 	ToolCalls  []groqToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string         `json:"tool_call_id,omitempty"`
+
+	isError bool
+	// parts are sent instead of Content, if set.
+	parts []ChatContentPart
+}
+
+// MarshalJSON implements json.Marshaler interface for groqMessage.
+func (m groqMessage) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type M groqMessage
+	if len(m.parts) == 0 {
+		return x.MarshalWithoutEscapeHTML(M(m))
+	}
+	t := struct {
+		M
+
+		Content []openAIContentPart `json:"content"`
+	}{
+		M:       M(m),
+		Content: openAIContentParts(m.parts),
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// newGroqMessage converts message to Groq message. Groq supports only images
+// as non-textual content parts.
+//
+// See: https://console.groq.com/docs/vision
+func newGroqMessage(message ChatMessage) (groqMessage, errors.E) {
+	if len(message.Parts) > 0 {
+		errE := checkOpenAIContentParts(message.Parts, typeText, typeImage)
+		if errE != nil {
+			return groqMessage{}, errE //nolint:exhaustruct
+		}
+	}
+
+	var content *string
+	if len(message.Parts) == 0 {
+		content = &message.Content
+	}
+	return groqMessage{
+		Role:       message.Role,
+		Content:    content,
+		ToolCalls:  nil,
+		ToolCallID: "",
+		isError:    false,
+		parts:      message.Parts,
+	}, nil
 }
 
 type groqResponse struct {
+	ID                string       `json:"id"`
+	Object            string       `json:"object"`
+	Created           int64        `json:"created"`
+	Model             string       `json:"model"`
+	SystemFingerprint string       `json:"system_fingerprint"`
+	Choices           []groqChoice `json:"choices"`
+	Usage             groqUsage    `json:"usage"`
+	XGroq             struct {
+		ID string `json:"id"`
+	} `json:"x_groq"`
+	Error *groqError `json:"error,omitempty"`
+}
+
+type groqChoice struct {
+	Index        int         `json:"index"`
+	Message      groqMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+type groqUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	PromptTime       float64 `json:"prompt_time"`
+	CompletionTime   float64 `json:"completion_time"`
+	TotalTime        float64 `json:"total_time"`
+}
+
+type groqError struct {
+	Message          string  `json:"message"`
+	Type             string  `json:"type"`
+	Code             *string `json:"code,omitempty"`
+	FailedGeneration *string `json:"failed_generation,omitempty"`
+}
+
+type groqStreamChunk struct {
 	ID                string `json:"id"`
 	Object            string `json:"object"`
 	Created           int64  `json:"created"`
@@ -89,29 +181,24 @@ type groqResponse struct {
 	SystemFingerprint string `json:"system_fingerprint"`
 	Choices           []struct {
 		Index        int         `json:"index"`
-		Message      groqMessage `json:"message"`
-		FinishReason string      `json:"finish_reason"`
+		Delta        groqMessage `json:"delta"`
+		FinishReason *string     `json:"finish_reason"`
 	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int     `json:"prompt_tokens"`
-		CompletionTokens int     `json:"completion_tokens"`
-		TotalTokens      int     `json:"total_tokens"`
-		PromptTime       float64 `json:"prompt_time"`
-		CompletionTime   float64 `json:"completion_time"`
-		TotalTime        float64 `json:"total_time"`
-	} `json:"usage"`
-	XGroq struct {
-		ID string `json:"id"`
-	} `json:"x_groq"`
-	Error *struct {
-		Message          string  `json:"message"`
-		Type             string  `json:"type"`
-		Code             *string `json:"code,omitempty"`
-		FailedGeneration *string `json:"failed_generation,omitempty"`
-	} `json:"error,omitempty"`
+	Usage *groqUsage `json:"usage,omitempty"`
+	XGroq *struct {
+		ID    string     `json:"id"`
+		Usage *groqUsage `json:"usage,omitempty"`
+		Error *groqError `json:"error,omitempty"`
+	} `json:"x_groq,omitempty"`
+	Error *groqError `json:"error,omitempty"`
 }
 
-var _ TextProvider = (*GroqTextProvider)(nil)
+var (
+	_ TextProvider     = (*GroqTextProvider)(nil)
+	_ WithStreaming    = (*GroqTextProvider)(nil)
+	_ WithConversation = (*GroqTextProvider)(nil)
+	_ typedProvider    = (*GroqTextProvider)(nil)
+)
 
 // GroqTextProvider is a [TextProvider] which provides integration with
 // text-based [Groq] AI models.
@@ -125,6 +212,15 @@ type GroqTextProvider struct {
 	// APIKey is the API key to be used for API calls.
 	APIKey string `json:"-"`
 
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://api.groq.com/openai/v1".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
 	// Model is the name of the model to be used.
 	Model string `json:"model"`
 
@@ -165,17 +261,24 @@ type GroqTextProvider struct {
 func (g GroqTextProvider) MarshalJSON() ([]byte, error) {
 	// We define a new type to not recurse into this same MarshalJSON.
 	type P GroqTextProvider
+	p := P(g)
+	p.Headers = nil
 	t := struct {
 		P
 
 		Type string `json:"type"`
 	}{
 		Type: "groq",
-		P:    P(g),
+		P:    p,
 	}
 	return x.MarshalWithoutEscapeHTML(t)
 }
 
+// typeModel implements typedProvider interface.
+func (g GroqTextProvider) typeModel() (string, string) {
+	return "groq", g.Model
+}
+
 // Init implements [TextProvider] interface.
 func (g *GroqTextProvider) Init(ctx context.Context, messages []ChatMessage) errors.E {
 	if g.messages != nil {
@@ -184,20 +287,19 @@ func (g *GroqTextProvider) Init(ctx context.Context, messages []ChatMessage) err
 	g.messages = []groqMessage{}
 
 	for _, message := range messages {
-		g.messages = append(g.messages, groqMessage{
-			Role:       message.Role,
-			Content:    &message.Content,
-			ToolCalls:  nil,
-			ToolCallID: "",
-		})
+		m, errE := newGroqMessage(message)
+		if errE != nil {
+			return errE
+		}
+		g.messages = append(g.messages, m)
 	}
 
-	g.rateLimiterKey = fmt.Sprintf("%s-%s", g.APIKey, g.Model)
+	g.rateLimiterKey = fmt.Sprintf("%s-%s-%s", g.BaseURL, g.APIKey, g.Model)
 
 	if g.Client == nil {
 		g.Client = newClient(
 			func(req *http.Request) error {
-				if req.URL.Path == "/openai/v1/chat/completions" {
+				if strings.HasSuffix(req.URL.Path, "/chat/completions") {
 					ctx := req.Context() //nolint:govet
 					estimatedInputTokens, _ := getEstimatedTokens(ctx)
 					// Rate limit retries.
@@ -235,12 +337,13 @@ func (g *GroqTextProvider) Init(ctx context.Context, messages []ChatMessage) err
 		)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.groq.com/openai/v1/models/"+g.Model, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL(g.BaseURL, groqBaseURL, "/models/"+g.Model), nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	req.Header.Add("Authorization", "Bearer "+g.APIKey)
 	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, g.Headers)
 	// This endpoint does not have rate limiting.
 	resp, err := g.Client.Do(req)
 	var apiRequest string
@@ -305,25 +408,53 @@ func (g *GroqTextProvider) Init(ctx context.Context, messages []ChatMessage) err
 }
 
 // Chat implements [TextProvider] interface.
-func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) { //nolint:maintidx
+func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return g.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (g *GroqTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return g.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (g *GroqTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return g.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (g *GroqTextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return g.chat(ctx, messages, fn)
+}
+
+func (g *GroqTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
 	callID := identifier.New().String()
 
 	var callRecorder *TextRecorderCall
 	if recorder := GetTextRecorder(ctx); recorder != nil {
-		callRecorder = recorder.newCall(callID, g)
+		callRecorder = recorder.newCall(ctx, callID, g)
 		defer recorder.recordCall(callRecorder)
 	}
 
 	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
 	ctx = logger.WithContext(ctx)
 
+	stream := newTextStream(callRecorder, fn)
+
 	messages := slices.Clone(g.messages)
-	messages = append(messages, groqMessage{
-		Role:       message.Role,
-		Content:    &message.Content,
-		ToolCalls:  nil,
-		ToolCallID: "",
-	})
+	for _, message := range conversation {
+		m, errE := newGroqMessage(message)
+		if errE != nil {
+			return "", errE
+		}
+		messages = append(messages, m)
+	}
 
 	if callRecorder != nil {
 		for _, message := range messages {
@@ -334,79 +465,11 @@ func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (strin
 	}
 
 	for range g.MaxExchanges {
-		request, errE := x.MarshalWithoutEscapeHTML(groqRequest{
-			Messages:            messages,
-			Model:               g.Model,
-			Seed:                g.Seed,
-			Temperature:         g.Temperature,
-			MaxCompletionTokens: g.MaxResponseLength,
-			Tools:               g.tools,
-			ReasoningEffort:     g.ReasoningEffort,
-		})
-		if errE != nil {
-			return "", errE
-		}
-
-		estimatedInputTokens, estimatedOutputTokens := g.estimatedTokens(messages)
-
-		req, err := http.NewRequestWithContext(
-			withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens),
-			http.MethodPost,
-			"https://api.groq.com/openai/v1/chat/completions",
-			bytes.NewReader(request),
-		)
-		if err != nil {
-			return "", errors.WithStack(err)
-		}
-		req.Header.Add("Authorization", "Bearer "+g.APIKey)
-		req.Header.Add("Content-Type", "application/json")
-		// Rate limit the initial request.
-		errE = groqRateLimiter.Take(ctx, g.rateLimiterKey, map[string]int{
-			"rpm": 1,
-			"rpd": 1,
-			"tpm": estimatedInputTokens,
-		})
-		if errE != nil {
-			return "", errE
-		}
-		start := time.Now()
-		resp, err := g.Client.Do(req)
-		var apiRequest string
-		if resp != nil {
-			apiRequest = resp.Header.Get("X-Request-Id")
-		}
-		if err != nil {
-			errE = errors.Prefix(err, ErrAPIRequestFailed)
-			if apiRequest != "" {
-				errors.Details(errE)["apiRequest"] = apiRequest
-			}
-			return "", errE
-		}
-		defer resp.Body.Close()              //nolint:errcheck
-		defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
-
-		if apiRequest == "" {
-			body, _ := io.ReadAll(resp.Body)
-			return "", errors.WithDetails(ErrMissingRequestID, body, string(body))
-		}
-
-		var response groqResponse
-		errE = x.DecodeJSON(resp.Body, &response)
+		response, apiRequest, apiCallDuration, errE := g.send(ctx, messages, stream)
 		if errE != nil {
-			errors.Details(errE)["apiRequest"] = apiRequest
 			return "", errE
 		}
 
-		apiCallDuration := time.Since(start)
-
-		if response.Error != nil {
-			return "", errors.WithDetails(
-				ErrAPIResponseError,
-				"body", response.Error,
-				"apiRequest", apiRequest,
-			)
-		}
-
 		if len(response.Choices) != 1 {
 			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
 			errors.Details(errE)["number"] = len(response.Choices)
@@ -432,11 +495,33 @@ func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (strin
 				apiCallDuration,
 			)
 
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
 			g.recordMessage(callRecorder, response.Choices[0].Message)
 
 			callRecorder.notify("", nil)
 		}
 
+		if stream != nil {
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: newUsedTokens(
+					g.MaxContextLength,
+					g.MaxResponseLength,
+					response.Usage.PromptTokens,
+					response.Usage.CompletionTokens,
+					nil,
+					nil,
+					nil,
+				),
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
 		if response.Usage.TotalTokens >= g.MaxContextLength {
 			return "", errors.WithDetails(
 				ErrUnexpectedNumberOfTokens,
@@ -485,6 +570,8 @@ func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (strin
 					Content:    nil,
 					ToolCalls:  nil,
 					ToolCallID: toolCall.ID,
+					isError:    false,
+					parts:      nil,
 				})
 				result := &messages[len(messages)-1]
 
@@ -502,6 +589,25 @@ func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (strin
 
 			wg.Wait()
 
+			if stream != nil {
+				for _, result := range messages[len(messages)-len(response.Choices[0].Message.ToolCalls):] {
+					var content string
+					if result.Content != nil {
+						content = *result.Content
+					}
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    content,
+						ToolUseID:  result.ToolCallID,
+						IsError:    result.isError,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
 			continue
 		}
 
@@ -527,11 +633,261 @@ func (g *GroqTextProvider) Chat(ctx context.Context, message ChatMessage) (strin
 	)
 }
 
+func (g *GroqTextProvider) send(
+	ctx context.Context, messages []groqMessage, stream func(event TextStreamEvent) errors.E,
+) (_ *groqResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, g,
+		semconv.GenAIRequestMaxTokens(g.MaxResponseLength),
+		semconv.GenAIRequestSeed(g.Seed),
+		semconv.GenAIRequestTemperature(g.Temperature),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(g)
+
+	request, errE := x.MarshalWithoutEscapeHTML(groqRequest{
+		Messages:            messages,
+		Model:               g.Model,
+		Seed:                g.Seed,
+		Temperature:         g.Temperature,
+		MaxCompletionTokens: g.MaxResponseLength,
+		Tools:               g.tools,
+		ReasoningEffort:     g.ReasoningEffort,
+		Stream:              stream != nil,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := g.estimatedTokens(messages)
+
+	reservation, errE := reserveBudget(ctx, g, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		apiURL(g.BaseURL, groqBaseURL, "/chat/completions"),
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+g.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, g.Headers)
+	// Rate limit the initial request.
+	errE = groqRateLimiter.Take(ctx, g.rateLimiterKey, map[string]int{
+		"rpm": 1,
+		"rpd": 1,
+		"tpm": estimatedInputTokens,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	start := time.Now()
+	resp, err := g.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("X-Request-Id")
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if apiRequest == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, "", 0, errors.WithDetails(ErrMissingRequestID, body, string(body))
+	}
+
+	var response groqResponse
+	if stream != nil && isEventStream(resp) {
+		errE = g.decodeStream(resp.Body, apiRequest, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, apiRequest, 0, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, apiRequest, 0, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	usedTokens := newUsedTokens(
+		g.MaxContextLength,
+		g.MaxResponseLength,
+		response.Usage.PromptTokens,
+		response.Usage.CompletionTokens,
+		nil,
+		nil,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	finishReasons := []string{}
+	for _, choice := range response.Choices {
+		finishReasons = append(finishReasons, choice.FinishReason)
+	}
+	span.SetAttributes(
+		semconv.GenAIResponseID(response.ID),
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIResponseFinishReasons(finishReasons...),
+		semconv.GenAIUsageInputTokens(response.Usage.PromptTokens),
+		semconv.GenAIUsageOutputTokens(response.Usage.CompletionTokens),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+// decodeStream decodes server-sent events with chat completion chunks into
+// the response, calling stream for every delta.
+//
+// See: https://console.groq.com/docs/text-chat#streaming-a-chat-completion
+func (g *GroqTextProvider) decodeStream( //nolint:dupl
+	body io.Reader, apiRequest string, response *groqResponse, stream func(event TextStreamEvent) errors.E,
+) errors.E {
+	var content *strings.Builder
+	errE := decodeServerSentEvents(body, func(_ string, data []byte) errors.E {
+		if string(data) == "[DONE]" {
+			return nil
+		}
+
+		var chunk groqStreamChunk
+		errE := x.Unmarshal(data, &chunk)
+		if errE != nil {
+			return errE
+		}
+
+		response.ID = chunk.ID
+		response.Object = chunk.Object
+		response.Created = chunk.Created
+		response.Model = chunk.Model
+		response.SystemFingerprint = chunk.SystemFingerprint
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
+		}
+		if chunk.Error != nil {
+			response.Error = chunk.Error
+		}
+		if chunk.XGroq != nil {
+			response.XGroq.ID = chunk.XGroq.ID
+			if chunk.XGroq.Usage != nil {
+				response.Usage = *chunk.XGroq.Usage
+			}
+			if chunk.XGroq.Error != nil {
+				response.Error = chunk.XGroq.Error
+			}
+		}
+
+		for _, choice := range chunk.Choices {
+			for len(response.Choices) <= choice.Index {
+				response.Choices = append(response.Choices, groqChoice{Index: len(response.Choices)}) //nolint:exhaustruct
+			}
+			c := &response.Choices[choice.Index]
+			if choice.FinishReason != nil {
+				c.FinishReason = *choice.FinishReason
+			}
+			if choice.Delta.Role != "" {
+				c.Message.Role = choice.Delta.Role
+			}
+			if choice.Delta.Content != nil {
+				if content == nil {
+					content = new(strings.Builder)
+				}
+				content.WriteString(*choice.Delta.Content)
+				c.Message.Content = ptr(content.String())
+				if *choice.Delta.Content != "" {
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       typeText,
+						Content:    *choice.Delta.Content,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return errE
+					}
+				}
+			}
+			for _, toolCall := range choice.Delta.ToolCalls {
+				i := len(c.Message.ToolCalls)
+				if toolCall.Index != nil {
+					i = *toolCall.Index
+				}
+				for len(c.Message.ToolCalls) <= i {
+					c.Message.ToolCalls = append(c.Message.ToolCalls, groqToolCall{}) //nolint:exhaustruct
+				}
+				tc := &c.Message.ToolCalls[i]
+				if toolCall.ID != "" {
+					tc.ID = toolCall.ID
+				}
+				if toolCall.Type != "" {
+					tc.Type = toolCall.Type
+				}
+				tc.Function.Name += toolCall.Function.Name
+				tc.Function.Arguments += toolCall.Function.Arguments
+			}
+		}
+
+		return nil
+	})
+	if errE != nil {
+		return errE
+	}
+
+	// Tool calls are complete only at the end of the stream.
+	for _, choice := range response.Choices {
+		for i := range choice.Message.ToolCalls {
+			// We do not send the index back to the API.
+			choice.Message.ToolCalls[i].Index = nil
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:        roleToolUse,
+				Content:     choice.Message.ToolCalls[i].Function.Arguments,
+				ToolUseID:   choice.Message.ToolCalls[i].ID,
+				ToolUseName: choice.Message.ToolCalls[i].Function.Name,
+				APIRequest:  apiRequest,
+			})
+			if errE != nil {
+				return errE
+			}
+		}
+	}
+
+	return nil
+}
+
 func (g *GroqTextProvider) estimatedTokens(messages []groqMessage) (int, int) {
 	// We estimate inputTokens from training messages (including system message) by
 	// dividing number of characters by 4.
 	inputTokens := 0
 	for _, message := range messages {
+		for _, part := range message.parts {
+			if part.Type == typeText {
+				inputTokens += len(part.Text) / 4 //nolint:mnd
+			} else {
+				inputTokens += estimatedPartTokens
+			}
+		}
 		if message.Content != nil {
 			inputTokens += len(*message.Content) / 4 //nolint:mnd
 			for _, tool := range message.ToolCalls {
@@ -563,7 +919,9 @@ func (g *GroqTextProvider) InitTools(ctx context.Context, tools map[string]TextT
 	}
 	g.tools = []groqTool{}
 
-	for name, tool := range tools {
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
 		errE := tool.Init(ctx)
 		if errE != nil {
 			errors.Details(errE)["name"] = name
@@ -595,8 +953,11 @@ func (g *GroqTextProvider) callToolWrapper( //nolint:dupl
 
 	defer func() {
 		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Function.Name).Inc()
+
 			content := fmt.Sprintf("Error: %s", err)
 			result.Content = &content
+			result.isError = true
 
 			toolMessage.setContent(content, true)
 		}
@@ -609,12 +970,18 @@ func (g *GroqTextProvider) callToolWrapper( //nolint:dupl
 	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.ID).Logger()
 	ctx = logger.WithContext(ctx)
 
+	ctx, span := startToolSpan(ctx, toolCall.Function.Name, toolCall.ID)
+	defer span.End()
+
 	output, duration, errE := g.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Function.Name, duration, errE)
 	if errE != nil {
 		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Function.Name).Str("apiRequest", apiRequest).
 			Str("tool", toolCall.ID).RawJSON("input", json.RawMessage(toolCall.Function.Arguments)).Msg("tool error")
 		content := "Error: " + errE.Error()
 		result.Content = &content
+		result.isError = true
 
 		toolMessage.setContent(content, true)
 	} else {
@@ -647,6 +1014,10 @@ func (g *GroqTextProvider) callTool(ctx context.Context, toolCall groqToolCall)
 func (g *GroqTextProvider) recordMessage(recorder *TextRecorderCall, message groqMessage) {
 	if message.Role == roleTool {
 		panic(errors.New("recording tool result message should not happen"))
+	} else if len(message.parts) > 0 {
+		for _, part := range message.parts {
+			recorder.addPart(message.Role, part)
+		}
 	} else if message.Content != nil {
 		recorder.addMessage(message.Role, *message.Content, "", "", false)
 	}
@@ -0,0 +1,388 @@
+//nolint:tagliatelle
+package fun
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+const llamaCppBaseURL = "http://localhost:8080"
+
+type llamaCppRequest struct {
+	Messages      []openAIMessage      `json:"messages"`
+	Model         string               `json:"model,omitempty"`
+	Seed          int                  `json:"seed"`
+	Temperature   float64              `json:"temperature"`
+	MaxTokens     int                  `json:"max_tokens"`
+	JSONSchema    json.RawMessage      `json:"json_schema,omitempty"`
+	Grammar       string               `json:"grammar,omitempty"`
+	Tools         []openAITool         `json:"tools,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// llamaCppProps are server properties as returned by the props endpoint.
+type llamaCppProps struct {
+	DefaultGenerationSettings struct {
+		// NCtx is the context size of one slot (i.e., the context size the server
+		// was started with divided by the number of parallel slots).
+		NCtx int `json:"n_ctx"`
+	} `json:"default_generation_settings"`
+}
+
+type llamaCppError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+var (
+	_ TextProvider         = (*LlamaCppTextProvider)(nil)
+	_ WithStreaming        = (*LlamaCppTextProvider)(nil)
+	_ WithConversation     = (*LlamaCppTextProvider)(nil)
+	_ WithOutputJSONSchema = (*LlamaCppTextProvider)(nil)
+	_ WithTools            = (*LlamaCppTextProvider)(nil)
+	_ typedProvider        = (*LlamaCppTextProvider)(nil)
+)
+
+// LlamaCppTextProvider is a [TextProvider] which provides integration with
+// text-based AI models served by llama.cpp server (llama-server).
+//
+// Unlike [OpenAICompatibleTextProvider], it uses llama.cpp specific features:
+// the context size is obtained from the server and output is constrained
+// with a GBNF grammar.
+type LlamaCppTextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key to be used for API calls, if the server
+	// has been started with one. If not provided, no API key is sent.
+	APIKey string `json:"-"`
+
+	// BaseURL is the base URL of the server. Default is "http://localhost:8080".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the name of the model to be used. The server serves the model
+	// it has been started with, so it is used only for recording and pricing.
+	Model string `json:"model,omitempty"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, the context size of the server's slot is used.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, MaxContextLength is used.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// Grammar is a GBNF grammar to which the AI model's output is constrained.
+	// It cannot be used together with the output JSON Schema, which is
+	// converted to a GBNF grammar by the server itself.
+	//
+	// See: https://github.com/ggml-org/llama.cpp/blob/master/grammars/README.md
+	Grammar string `json:"grammar,omitempty"`
+
+	// Seed is used to control the randomness of the AI model. Default is 0.
+	Seed int `json:"seed"`
+
+	// Temperature is how creative should the AI model be.
+	// Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	messages         []openAIMessage
+	tools            []openAITool
+	outputJSONSchema json.RawMessage
+}
+
+// MarshalJSON implements json.Marshaler interface for LlamaCppTextProvider.
+func (o LlamaCppTextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P LlamaCppTextProvider
+	p := P(o)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "llamacpp",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o LlamaCppTextProvider) typeModel() (string, string) {
+	return "llamacpp", o.Model
+}
+
+// Init implements [TextProvider] interface.
+func (o *LlamaCppTextProvider) Init(ctx context.Context, messages []ChatMessage) errors.E {
+	if o.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.messages = []openAIMessage{}
+
+	for _, message := range messages {
+		m, errE := newOpenAIMessage(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, m)
+	}
+
+	if o.Client == nil {
+		o.Client = newClient(
+			// The server queues requests itself.
+			nil,
+			// No headers to parse.
+			nil,
+			// Nothing to update after every request.
+			nil,
+		)
+	}
+
+	props, errE := o.getProps(ctx)
+	if errE != nil {
+		return errE
+	}
+	contextLength := props.DefaultGenerationSettings.NCtx
+	if contextLength == 0 {
+		return errors.WithStack(ErrModelMaxContextLength)
+	}
+
+	if o.MaxContextLength == 0 {
+		o.MaxContextLength = contextLength
+	}
+	if o.MaxContextLength > contextLength {
+		return errors.WithDetails(
+			ErrMaxContextLengthOverModel,
+			"maxTotal", o.MaxContextLength,
+			"model", contextLength,
+		)
+	}
+
+	if o.MaxResponseLength == 0 {
+		o.MaxResponseLength = o.MaxContextLength
+	}
+	if o.MaxResponseLength > o.MaxContextLength {
+		return errors.WithDetails(
+			ErrMaxResponseLengthOverContext,
+			"maxTotal", o.MaxContextLength,
+			"maxResponse", o.MaxResponseLength,
+		)
+	}
+
+	if o.MaxExchanges == 0 {
+		o.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// getProps returns server properties from the props endpoint.
+func (o *LlamaCppTextProvider) getProps(ctx context.Context) (*llamaCppProps, errors.E) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL(o.BaseURL, llamaCppBaseURL, "/props"), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	o.setHeaders(req)
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, errors.Prefix(err, ErrAPIRequestFailed)
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, llamaCppResponseError(resp)
+	}
+
+	var props llamaCppProps
+	errE := x.DecodeJSON(resp.Body, &props)
+	if errE != nil {
+		return nil, errE
+	}
+
+	return &props, nil
+}
+
+// llamaCppResponseError returns an error for a non-successful response.
+func llamaCppResponseError(resp *http.Response) errors.E {
+	body, _ := io.ReadAll(resp.Body)
+	errE := errors.WithDetails(
+		ErrAPIResponseError,
+		"code", resp.StatusCode,
+	)
+	var response struct {
+		Error *llamaCppError `json:"error"`
+	}
+	if x.Unmarshal(body, &response) == nil && response.Error != nil {
+		errors.Details(errE)["body"] = response.Error
+	} else {
+		errors.Details(errE)["body"] = string(body)
+	}
+	return errE
+}
+
+// setHeaders sets authentication and extra headers on the request.
+func (o *LlamaCppTextProvider) setHeaders(req *http.Request) {
+	if o.APIKey != "" {
+		req.Header.Add("Authorization", "Bearer "+o.APIKey)
+	}
+	setHeaders(req, o.Headers)
+}
+
+func (o *LlamaCppTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (o *LlamaCppTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (o *LlamaCppTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *LlamaCppTextProvider) ChatConversationStream(
+	ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E,
+) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
+
+func (o *LlamaCppTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.openAIChat().chat(ctx, conversation, fn)
+}
+
+// openAIChat returns chat completions API configuration for the provider.
+func (o *LlamaCppTextProvider) openAIChat() *openAIChat {
+	return &openAIChat{
+		provider:          o,
+		client:            o.Client,
+		maxContextLength:  o.MaxContextLength,
+		maxResponseLength: o.MaxResponseLength,
+		maxExchanges:      o.MaxExchanges,
+		messages:          o.messages,
+		tools:             o.tools,
+		attributes: []attribute.KeyValue{
+			semconv.GenAIRequestMaxTokens(o.MaxResponseLength),
+			semconv.GenAIRequestTemperature(o.Temperature),
+			semconv.GenAIRequestSeed(o.Seed),
+		},
+		url:            apiURL(o.BaseURL, llamaCppBaseURL, "/v1/chat/completions"),
+		setHeaders:     o.setHeaders,
+		rateLimiter:    nil,
+		rateLimiterKey: "",
+		newRequest: func(messages []openAIMessage, stream bool) any {
+			return o.newRequest(messages, stream)
+		},
+		// llama.cpp server does not provide request ID header, so the response ID is used.
+		requestID:        nil,
+		requireRequestID: false,
+		responseError:    llamaCppResponseError,
+	}
+}
+
+func (o *LlamaCppTextProvider) newRequest(messages []openAIMessage, stream bool) llamaCppRequest {
+	oReq := llamaCppRequest{
+		Messages:      messages,
+		Model:         o.Model,
+		Seed:          o.Seed,
+		Temperature:   o.Temperature,
+		MaxTokens:     o.MaxResponseLength,
+		JSONSchema:    o.outputJSONSchema,
+		Grammar:       o.Grammar,
+		Tools:         o.tools,
+		Stream:        false,
+		StreamOptions: nil,
+	}
+
+	if stream {
+		oReq.Stream = true
+		oReq.StreamOptions = &openAIStreamOptions{
+			IncludeUsage: true,
+		}
+	}
+
+	return oReq
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (o *LlamaCppTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if o.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	if o.Grammar != "" {
+		return errors.Errorf(`%w: output JSON Schema cannot be used together with Grammar`, ErrInvalidJSONSchema)
+	}
+
+	// The server converts the JSON Schema to a GBNF grammar which constrains the output.
+	o.outputJSONSchema = schema
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (o *LlamaCppTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if o.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.tools = []openAITool{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		o.tools = append(o.tools, openAITool{
+			Type: "function",
+			Function: openAIFunction{
+				Name:            name,
+				Description:     tool.GetDescription(),
+				InputJSONSchema: tool.GetInputJSONSchema(),
+				Strict:          false,
+			},
+			tool: tool,
+		})
+	}
+
+	return nil
+}
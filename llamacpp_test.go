@@ -0,0 +1,125 @@
+package fun_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+func TestLlamaCppTextProvider(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewLlamaCpp(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				var request map[string]any
+				errE := x.Unmarshal(req.Body, &request)
+				if errE != nil {
+					return errE
+				}
+				assert.Equal(t, "/v1/chat/completions", req.Path)
+				assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+				assert.NotContains(t, request, "model")
+				assert.NotContains(t, request, "response_format")
+				assert.NotContains(t, request, "grammar")
+				assert.InEpsilon(t, 8192, request["max_tokens"], 0)
+				assert.Equal(t, "object", request["json_schema"].(map[string]any)["type"]) //nolint:forcetypeassert,errcheck
+				return nil
+			},
+			Content:        `{"string":"foo"}`,
+			PromptTokens:   100,
+			ResponseTokens: 10,
+		},
+		emulator.Response{StatusCode: http.StatusServiceUnavailable}, //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	provider := &fun.LlamaCppTextProvider{ //nolint:exhaustruct
+		Client:  server.Client(),
+		APIKey:  "secret",
+		BaseURL: server.URL,
+	}
+
+	f := fun.Text[string, toolStringInput]{
+		Provider:          provider,
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  outputJSONSchemaWithTitle,
+		Prompt:            "Repeat the input.",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              nil,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	// Context length is obtained from the server.
+	assert.Equal(t, 8192, provider.MaxContextLength)
+	assert.Equal(t, 8192, provider.MaxResponseLength)
+
+	ct := fun.WithTextRecorder(ctx)
+	output, errE := f.Call(ct, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, toolStringInput{String: "foo"}, output)
+
+	calls := fun.GetTextRecorder(ct).Calls()
+	require.Len(t, calls, 1)
+	require.Len(t, calls[0].UsedTokens, 1)
+	for apiRequest, usedTokens := range calls[0].UsedTokens {
+		// Response ID is used as the request ID.
+		assert.Equal(t, "chatcmpl-2", apiRequest)
+		assert.Equal(t, 110, usedTokens.Total)
+	}
+
+	// The client is not retrying, so the error is returned.
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+	assert.Equal(t, http.StatusServiceUnavailable, errors.Details(errE)["code"])
+
+	assert.Equal(t, 0, server.Remaining())
+}
+
+func TestLlamaCppTextProviderInit(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewLlamaCpp()
+	defer server.Close()
+
+	provider := &fun.LlamaCppTextProvider{ //nolint:exhaustruct
+		BaseURL:          server.URL,
+		MaxContextLength: 16_384,
+	}
+	errE := provider.Init(t.Context(), nil)
+	assert.ErrorIs(t, errE, fun.ErrMaxContextLengthOverModel)
+
+	provider = &fun.LlamaCppTextProvider{ //nolint:exhaustruct
+		BaseURL:           server.URL,
+		MaxContextLength:  4096,
+		MaxResponseLength: 8192,
+	}
+	errE = provider.Init(t.Context(), nil)
+	assert.ErrorIs(t, errE, fun.ErrMaxResponseLengthOverContext)
+
+	provider = &fun.LlamaCppTextProvider{ //nolint:exhaustruct
+		BaseURL: server.URL,
+		Grammar: `root ::= "yes" | "no"`,
+	}
+	errE = provider.Init(t.Context(), nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	errE = provider.InitOutputJSONSchema(t.Context(), outputJSONSchemaWithTitle)
+	assert.ErrorIs(t, errE, fun.ErrInvalidJSONSchema)
+}
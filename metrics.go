@@ -0,0 +1,176 @@
+package fun
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/tozd/go/errors"
+)
+
+const metricsNamespace = "fun"
+
+var _ prometheus.Collector = (*metricsCollector)(nil)
+
+type metricsCollector struct {
+	apiRequests        *prometheus.CounterVec
+	apiRequestDuration *prometheus.HistogramVec
+	apiRequestRetries  *prometheus.CounterVec
+	tokens             *prometheus.CounterVec
+	rateLimiterWait    *prometheus.HistogramVec
+	toolCallDuration   *prometheus.HistogramVec
+	toolCallErrors     *prometheus.CounterVec
+	validationFailures prometheus.Counter
+}
+
+//nolint:gochecknoglobals
+var metrics = &metricsCollector{
+	apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of API requests made by providers, by HTTP status code of the response.",
+	}, []string{"provider", "model", "code"}),
+	apiRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of successful API requests made by providers.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12), //nolint:mnd
+	}, []string{"provider", "model"}),
+	apiRequestRetries: prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "api_request_retries_total",
+		Help:      "Number of retried API requests made by providers.",
+	}, []string{"provider", "model"}),
+	tokens: prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "tokens_total",
+		Help:      "Number of tokens used, by type (prompt, response, cache_creation, cache_read, thinking).",
+	}, []string{"provider", "model", "type"}),
+	rateLimiterWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "rate_limiter_wait_seconds",
+		Help:      "Time spent blocked by rate limiters, by the limit which blocked (e.g., rpm or tpm).",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10), //nolint:mnd
+	}, []string{"limiter", "limit"}),
+	toolCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "tool_call_duration_seconds",
+		Help:      "Duration of tool calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"tool"}),
+	toolCallErrors: prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "tool_call_errors_total",
+		Help:      "Number of tool calls which failed.",
+	}, []string{"tool"}),
+	validationFailures: prometheus.NewCounter(prometheus.CounterOpts{ //nolint:exhaustruct
+		Namespace: metricsNamespace,
+		Name:      "json_schema_validation_failures_total",
+		Help:      "Number of values which failed JSON Schema validation.",
+	}),
+}
+
+// Metrics returns a Prometheus collector with metrics about API requests made by
+// providers (counts by HTTP status code, durations, and retries), used tokens,
+// time spent blocked by rate limiters, tool calls, and JSON Schema validation failures.
+//
+// Metrics are collected for all calls made in the process.
+// Register the collector with your Prometheus registry to expose them.
+func Metrics() prometheus.Collector { //nolint:ireturn
+	return metrics
+}
+
+// Describe implements [prometheus.Collector] interface.
+func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	m.apiRequests.Describe(ch)
+	m.apiRequestDuration.Describe(ch)
+	m.apiRequestRetries.Describe(ch)
+	m.tokens.Describe(ch)
+	m.rateLimiterWait.Describe(ch)
+	m.toolCallDuration.Describe(ch)
+	m.toolCallErrors.Describe(ch)
+	m.validationFailures.Describe(ch)
+}
+
+// Collect implements [prometheus.Collector] interface.
+func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m.apiRequests.Collect(ch)
+	m.apiRequestDuration.Collect(ch)
+	m.apiRequestRetries.Collect(ch)
+	m.tokens.Collect(ch)
+	m.rateLimiterWait.Collect(ch)
+	m.toolCallDuration.Collect(ch)
+	m.toolCallErrors.Collect(ch)
+	m.validationFailures.Collect(ch)
+}
+
+// metricsLabels returns labels identifying the provider and the model it uses.
+func metricsLabels(provider any) prometheus.Labels {
+	providerType, model := providerTypeModel(provider)
+	return prometheus.Labels{
+		"provider": providerType,
+		"model":    model,
+	}
+}
+
+// apiRequest counts an API request by the HTTP status code of the response,
+// or as "error" if there is no response.
+func (m *metricsCollector) apiRequest(labels prometheus.Labels, resp *http.Response) {
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	m.apiRequestStatus(labels, statusCode)
+}
+
+// apiRequestStatus counts an API request by the HTTP status code,
+// or as "error" if the status code is zero.
+func (m *metricsCollector) apiRequestStatus(labels prometheus.Labels, statusCode int) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.apiRequests.MustCurryWith(labels).WithLabelValues(code).Inc()
+}
+
+func (m *metricsCollector) apiRequestDone(labels prometheus.Labels, duration time.Duration, usedTokens *TextRecorderUsedTokens) {
+	m.apiRequestDuration.With(labels).Observe(duration.Seconds())
+
+	tokens := m.tokens.MustCurryWith(labels)
+	tokens.WithLabelValues("prompt").Add(float64(usedTokens.Prompt))
+	tokens.WithLabelValues("response").Add(float64(usedTokens.Response))
+	if usedTokens.CacheCreationInputTokens != nil {
+		tokens.WithLabelValues("cache_creation").Add(float64(*usedTokens.CacheCreationInputTokens))
+	}
+	if usedTokens.CacheReadInputTokens != nil {
+		tokens.WithLabelValues("cache_read").Add(float64(*usedTokens.CacheReadInputTokens))
+	}
+	if usedTokens.ThinkingTokens != nil {
+		tokens.WithLabelValues("thinking").Add(float64(*usedTokens.ThinkingTokens))
+	}
+}
+
+func (m *metricsCollector) toolCall(name string, duration Duration, errE errors.E) {
+	m.toolCallDuration.WithLabelValues(name).Observe(time.Duration(duration).Seconds())
+	if errE != nil {
+		m.toolCallErrors.WithLabelValues(name).Inc()
+	}
+}
+
+type metricsLabelsContextKey struct{}
+
+// withMetricsLabels returns a copy of the context with labels identifying
+// the provider and the model, so that retries of API requests can be counted.
+func withMetricsLabels(ctx context.Context, labels prometheus.Labels) context.Context {
+	return context.WithValue(ctx, metricsLabelsContextKey{}, labels)
+}
+
+func (m *metricsCollector) apiRequestRetry(ctx context.Context) {
+	labels, ok := ctx.Value(metricsLabelsContextKey{}).(prometheus.Labels)
+	if !ok {
+		return
+	}
+	m.apiRequestRetries.With(labels).Inc()
+}
@@ -0,0 +1,132 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+// metricValues returns values of metrics with the name which have the label set to
+// the value, keyed by the value of the remaining label (other than "provider").
+// For histograms, the number of observations is returned.
+func metricValues(t *testing.T, families []*dto.MetricFamily, name, label, value string) map[string]float64 {
+	t.Helper()
+
+	values := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := ""
+			matches := false
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == label {
+					matches = l.GetValue() == value
+				} else if l.GetName() != "provider" {
+					key = l.GetValue()
+				}
+			}
+			if !matches {
+				continue
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				values[key] = metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				values[key] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []struct {
+				Role string `json:"role"`
+			} `json:"messages"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		w.Header().Set("X-Request-Id", "req_1")
+		if request.Messages[len(request.Messages)-1].Role == "user" {
+			_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant",` +
+				`"tool_calls":[{"id":"call_1","type":"function","function":{"name":"failing_tool","arguments":"{\"string\":\"foo\"}"}}]},` +
+				`"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":1000,"completion_tokens":100,"total_tokens":1100,` +
+				`"prompt_tokens_details":{"cached_tokens":200}}}`))
+		} else {
+			_, _ = w.Write([]byte(`{"id":"chatcmpl-2","choices":[{"index":0,"message":{"role":"assistant","content":"done"},` +
+				`"finish_reason":"stop"}],"usage":{"prompt_tokens":1100,"completion_tokens":10,"total_tokens":1110}}`))
+		}
+	})
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Text[string, string]{
+		Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+			Client:            newTestClient(t, mux),
+			APIKey:            "test",
+			Model:             "test-metrics",
+			MaxContextLength:  128_000,
+			MaxResponseLength: 16_384,
+		},
+		InputJSONSchema:  nil,
+		OutputJSONSchema: nil,
+		Prompt:           "Repeat the input.",
+		PromptTemplate:   "",
+		InputTemplate:    "",
+		Data:             nil,
+		Tools: map[string]fun.TextTooler{
+			"failing_tool": &fun.TextTool[toolStringInput, string]{
+				Description:      "Always fails.",
+				InputJSONSchema:  toolInputJSONSchema,
+				OutputJSONSchema: jsonSchemaString,
+				Fun: func(_ context.Context, _ toolStringInput) (string, errors.E) {
+					return "", errors.New("failed")
+				},
+			},
+		},
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := f.Call(ctx, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "done", output)
+
+	registry := prometheus.NewRegistry()
+	err := registry.Register(fun.Metrics())
+	require.NoError(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]float64{"200": 2}, metricValues(t, families, "fun_api_requests_total", "model", "test-metrics"))
+	assert.Equal(t, map[string]float64{"": 2}, metricValues(t, families, "fun_api_request_duration_seconds", "model", "test-metrics"))
+	assert.Equal(t, map[string]float64{
+		"prompt":     2100,
+		"response":   110,
+		"cache_read": 200,
+	}, metricValues(t, families, "fun_tokens_total", "model", "test-metrics"))
+	assert.Equal(t, map[string]float64{"": 1}, metricValues(t, families, "fun_tool_call_duration_seconds", "tool", "failing_tool"))
+	assert.Equal(t, map[string]float64{"": 1}, metricValues(t, families, "fun_tool_call_errors_total", "tool", "failing_tool"))
+}
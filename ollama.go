@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
 	"net/url"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 )
 
 var (
@@ -37,6 +40,19 @@ func getStatusError(err error) errors.E {
 	return errors.Prefix(err, ErrAPIRequestFailed)
 }
 
+// getStatusCode returns the HTTP status code of the API request
+// which failed with err, or zero if it is not known.
+func getStatusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var statusError api.StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode
+	}
+	return 0
+}
+
 func ollamaRateLimiterLock(key string) *sync.Mutex {
 	ollamaRateLimiterMu.Lock()
 	defer ollamaRateLimiterMu.Unlock()
@@ -48,7 +64,51 @@ func ollamaRateLimiterLock(key string) *sync.Mutex {
 	return ollamaRateLimiter[key]
 }
 
-var _ TextProvider = (*OllamaTextProvider)(nil)
+// ollamaModelContextLength pulls the model (if necessary) and
+// returns its context length.
+func ollamaModelContextLength(ctx context.Context, client *api.Client, model string, access OllamaModelAccess) (int, errors.E) {
+	stream := false
+	err := client.Pull(ctx, &api.PullRequest{ //nolint:exhaustruct
+		Model:    model,
+		Insecure: access.Insecure,
+		Username: access.Username,
+		Password: access.Password,
+		Stream:   &stream,
+	}, func(_ api.ProgressResponse) error { return nil })
+	if err != nil {
+		return 0, getStatusError(err)
+	}
+
+	resp, err := client.Show(ctx, &api.ShowRequest{ //nolint:exhaustruct
+		Model: model,
+	})
+	if err != nil {
+		return 0, getStatusError(err)
+	}
+
+	arch, ok := resp.ModelInfo["general.architecture"].(string)
+	if !ok {
+		return 0, errors.WithStack(ErrModelMaxContextLength)
+	}
+	contextLength, ok := resp.ModelInfo[arch+".context_length"].(float64)
+	if !ok {
+		return 0, errors.WithStack(ErrModelMaxContextLength)
+	}
+	contextLengthInt := int(contextLength)
+
+	if contextLengthInt == 0 {
+		return 0, errors.WithStack(ErrModelMaxContextLength)
+	}
+
+	return contextLengthInt, nil
+}
+
+var (
+	_ TextProvider     = (*OllamaTextProvider)(nil)
+	_ WithStreaming    = (*OllamaTextProvider)(nil)
+	_ WithConversation = (*OllamaTextProvider)(nil)
+	_ typedProvider    = (*OllamaTextProvider)(nil)
+)
 
 // OllamaModelAccess describes access to a model for [OllamaTextProvider].
 type OllamaModelAccess struct {
@@ -127,6 +187,11 @@ func (o OllamaTextProvider) MarshalJSON() ([]byte, error) {
 	return x.MarshalWithoutEscapeHTML(t)
 }
 
+// typeModel implements typedProvider interface.
+func (o OllamaTextProvider) typeModel() (string, string) {
+	return "ollama", o.Model
+}
+
 // Init implements [TextProvider] interface.
 func (o *OllamaTextProvider) Init(ctx context.Context, messages []ChatMessage) errors.E {
 	if o.client != nil {
@@ -152,47 +217,16 @@ func (o *OllamaTextProvider) Init(ctx context.Context, messages []ChatMessage) e
 
 	o.messages = []api.Message{}
 	for _, message := range messages {
-		o.messages = append(o.messages, api.Message{
-			Role:      message.Role,
-			Content:   message.Content,
-			Thinking:  "",
-			Images:    nil,
-			ToolCalls: nil,
-			ToolName:  "",
-		})
-	}
-
-	stream := false
-	err = o.client.Pull(ctx, &api.PullRequest{ //nolint:exhaustruct
-		Model:    o.Model,
-		Insecure: o.ModelAccess.Insecure,
-		Username: o.ModelAccess.Username,
-		Password: o.ModelAccess.Password,
-		Stream:   &stream,
-	}, func(_ api.ProgressResponse) error { return nil })
-	if err != nil {
-		return getStatusError(err)
-	}
-
-	resp, err := o.client.Show(ctx, &api.ShowRequest{ //nolint:exhaustruct
-		Model: o.Model,
-	})
-	if err != nil {
-		return getStatusError(err)
-	}
-
-	arch, ok := resp.ModelInfo["general.architecture"].(string)
-	if !ok {
-		return errors.WithStack(ErrModelMaxContextLength)
-	}
-	contextLength, ok := resp.ModelInfo[arch+".context_length"].(float64)
-	if !ok {
-		return errors.WithStack(ErrModelMaxContextLength)
+		m, errE := newOllamaMessage(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, m)
 	}
-	contextLengthInt := int(contextLength)
 
-	if contextLengthInt == 0 {
-		return errors.WithStack(ErrModelMaxContextLength)
+	contextLengthInt, errE := ollamaModelContextLength(ctx, o.client, o.Model, o.ModelAccess)
+	if errE != nil {
+		return errE
 	}
 
 	if o.MaxContextLength == 0 {
@@ -227,26 +261,52 @@ func (o *OllamaTextProvider) Init(ctx context.Context, messages []ChatMessage) e
 
 // Chat implements [TextProvider] interface.
 func (o *OllamaTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (o *OllamaTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (o *OllamaTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *OllamaTextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
+
+func (o *OllamaTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
 	callID := identifier.New().String()
 
 	var callRecorder *TextRecorderCall
 	if recorder := GetTextRecorder(ctx); recorder != nil {
-		callRecorder = recorder.newCall(callID, o)
+		callRecorder = recorder.newCall(ctx, callID, o)
 		defer recorder.recordCall(callRecorder)
 	}
 
 	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
 	ctx = logger.WithContext(ctx)
 
+	stream := newTextStream(callRecorder, fn)
+
 	messages := slices.Clone(o.messages)
-	messages = append(messages, api.Message{
-		Role:      message.Role,
-		Content:   message.Content,
-		Thinking:  "",
-		Images:    nil,
-		ToolCalls: nil,
-		ToolName:  "",
-	})
+	for _, message := range conversation {
+		m, errE := newOllamaMessage(message)
+		if errE != nil {
+			return "", errE
+		}
+		messages = append(messages, m)
+	}
 
 	if callRecorder != nil {
 		for _, message := range messages {
@@ -268,45 +328,8 @@ func (o *OllamaTextProvider) Chat(ctx context.Context, message ChatMessage) (str
 		apiRequestNumber++
 		apiRequest := fmt.Sprintf("req_%d", apiRequestNumber)
 
-		responses := []api.ChatResponse{}
-
-		start := time.Now()
-		stream := false
-		var think any = o.ReasoningEffort
-		if think == "" {
-			think = false
-		}
-		err := o.client.Chat(ctx, &api.ChatRequest{
-			Model:    o.Model,
-			Messages: messages,
-			Stream:   &stream,
-			Format:   o.outputJSONSchema,
-			Tools:    o.tools,
-			Options: map[string]interface{}{
-				"num_ctx":     o.MaxContextLength,
-				"num_predict": o.MaxResponseLength,
-				"seed":        o.Seed,
-				"temperature": o.Temperature,
-			},
-			KeepAlive:       nil,
-			Think:           &api.ThinkValue{Value: think},
-			DebugRenderOnly: false,
-		}, func(resp api.ChatResponse) error {
-			responses = append(responses, resp)
-			return nil
-		})
-		if err != nil {
-			errE := getStatusError(err)
-			errors.Details(errE)["apiRequest"] = apiRequest
-			return "", errE
-		}
-
-		apiCallDuration := time.Since(start)
-
-		if len(responses) != 1 {
-			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
-			errors.Details(errE)["number"] = len(responses)
-			errors.Details(errE)["apiRequest"] = apiRequest
+		response, apiCallDuration, errE := o.send(ctx, apiRequest, messages, stream)
+		if errE != nil {
 			return "", errE
 		}
 
@@ -317,68 +340,92 @@ func (o *OllamaTextProvider) Chat(ctx context.Context, message ChatMessage) (str
 				apiRequest,
 				o.MaxContextLength,
 				o.MaxResponseLength,
-				responses[0].PromptEvalCount,
-				responses[0].EvalCount,
+				response.PromptEvalCount,
+				response.EvalCount,
 				nil,
 				nil,
 				nil,
 			)
 			callRecorder.addUsedTime(
 				apiRequest,
-				responses[0].PromptEvalDuration,
-				responses[0].EvalDuration,
+				response.PromptEvalDuration,
+				response.EvalDuration,
 				apiCallDuration,
 			)
 
-			o.recordMessage(callRecorder, responses[0].Message, toolCallIDPrefix)
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
+			o.recordMessage(callRecorder, response.Message, toolCallIDPrefix)
 
 			callRecorder.notify("", nil)
 		}
 
-		if responses[0].PromptEvalCount+responses[0].EvalCount >= o.MaxContextLength {
+		if stream != nil {
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: newUsedTokens(
+					o.MaxContextLength,
+					o.MaxResponseLength,
+					response.PromptEvalCount,
+					response.EvalCount,
+					nil,
+					nil,
+					nil,
+				),
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		if response.PromptEvalCount+response.EvalCount >= o.MaxContextLength {
 			return "", errors.WithDetails(
 				ErrUnexpectedNumberOfTokens,
-				"content", responses[0].Message.Content,
-				"prompt", responses[0].PromptEvalCount,
-				"response", responses[0].EvalCount,
-				"total", responses[0].PromptEvalCount+responses[0].EvalCount,
+				"content", response.Message.Content,
+				"prompt", response.PromptEvalCount,
+				"response", response.EvalCount,
+				"total", response.PromptEvalCount+response.EvalCount,
 				"maxTotal", o.MaxContextLength,
 				"maxResponse", o.MaxResponseLength,
 				"apiRequest", apiRequest,
 			)
 		}
 
-		if responses[0].Message.Role != roleAssistant {
+		if response.Message.Role != roleAssistant {
 			return "", errors.WithDetails(
 				ErrUnexpectedRole,
-				"role", responses[0].Message.Role,
+				"role", response.Message.Role,
 				"apiRequest", apiRequest,
 			)
 		}
 
-		if responses[0].DoneReason != stopReason {
+		if response.DoneReason != stopReason {
 			return "", errors.WithDetails(
 				ErrUnexpectedStop,
-				"reason", responses[0].DoneReason,
+				"reason", response.DoneReason,
 				"apiRequest", apiRequest,
 			)
 		}
 
-		if len(responses[0].Message.ToolCalls) > 0 {
+		if len(response.Message.ToolCalls) > 0 {
 			// We have already recorded this message above.
-			messages = append(messages, responses[0].Message)
+			messages = append(messages, response.Message)
 
 			// We make space for tool results (one per tool call) so that the messages slice
 			// does not grow when appending below and invalidate pointers goroutines keep.
-			messages = slices.Grow(messages, len(responses[0].Message.ToolCalls))
+			messages = slices.Grow(messages, len(response.Message.ToolCalls))
 
 			if callRecorder != nil {
 				// We grow the slice inside call recorder as well.
-				callRecorder.prepareForToolMessages(len(responses[0].Message.ToolCalls))
+				callRecorder.prepareForToolMessages(len(response.Message.ToolCalls))
 			}
 
+			isError := make([]bool, len(response.Message.ToolCalls))
+
 			var wg sync.WaitGroup
-			for i, toolCall := range responses[0].Message.ToolCalls {
+			for i, toolCall := range response.Message.ToolCalls {
 				toolCallID := fmt.Sprintf("%s_%d", toolCallIDPrefix, i)
 				messages = append(messages, api.Message{
 					Role:      roleTool,
@@ -398,16 +445,32 @@ func (o *OllamaTextProvider) Chat(ctx context.Context, message ChatMessage) (str
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					o.callToolWrapper(toolCtx, apiRequest, toolCall, toolCallID, result, callRecorder, toolMessage)
+					o.callToolWrapper(toolCtx, apiRequest, toolCall, toolCallID, result, &isError[i], callRecorder, toolMessage)
 				}()
 			}
 
 			wg.Wait()
 
+			if stream != nil {
+				results := messages[len(messages)-len(response.Message.ToolCalls):]
+				for i, result := range results {
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    result.Content,
+						ToolUseID:  fmt.Sprintf("%s_%d", toolCallIDPrefix, i),
+						IsError:    isError[i],
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
 			continue
 		}
 
-		return responses[0].Message.Content, nil
+		return response.Message.Content, nil
 	}
 
 	return "", errors.WithDetails(
@@ -416,6 +479,161 @@ func (o *OllamaTextProvider) Chat(ctx context.Context, message ChatMessage) (str
 	)
 }
 
+func (o *OllamaTextProvider) send(
+	ctx context.Context, apiRequest string, messages []api.Message, stream func(event TextStreamEvent) errors.E,
+) (_ *api.ChatResponse, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, o,
+		semconv.GenAIRequestMaxTokens(o.MaxResponseLength),
+		semconv.GenAIRequestSeed(o.Seed),
+		semconv.GenAIRequestTemperature(o.Temperature),
+		apiRequestKey.String(apiRequest),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(o)
+
+	estimatedInputTokens, estimatedOutputTokens := o.estimatedTokens(messages)
+
+	reservation, errE := reserveBudget(ctx, o, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, 0, errE
+	}
+	defer reservation.release()
+
+	responses := []api.ChatResponse{}
+
+	start := time.Now()
+	streaming := stream != nil
+	var think any = o.ReasoningEffort
+	if think == "" {
+		think = false
+	}
+	err := o.client.Chat(ctx, &api.ChatRequest{
+		Model:    o.Model,
+		Messages: messages,
+		Stream:   &streaming,
+		Format:   o.outputJSONSchema,
+		Tools:    o.tools,
+		Options: map[string]interface{}{
+			"num_ctx":     o.MaxContextLength,
+			"num_predict": o.MaxResponseLength,
+			"seed":        o.Seed,
+			"temperature": o.Temperature,
+		},
+		KeepAlive:       nil,
+		Think:           &api.ThinkValue{Value: think},
+		DebugRenderOnly: false,
+	}, func(resp api.ChatResponse) error {
+		if stream != nil {
+			return o.streamResponse(resp, apiRequest, fmt.Sprintf("call_%d", len(messages)), &responses, stream)
+		}
+		responses = append(responses, resp)
+		return nil
+	})
+	metrics.apiRequestStatus(labels, getStatusCode(err))
+	if err != nil {
+		errE = getStatusError(err)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, 0, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if len(responses) != 1 {
+		errE = errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+		errors.Details(errE)["number"] = len(responses)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, 0, errE
+	}
+
+	response := &responses[0]
+
+	usedTokens := newUsedTokens(
+		o.MaxContextLength,
+		o.MaxResponseLength,
+		response.PromptEvalCount,
+		response.EvalCount,
+		nil,
+		nil,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	span.SetAttributes(
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIResponseFinishReasons(response.DoneReason),
+		semconv.GenAIUsageInputTokens(response.PromptEvalCount),
+		semconv.GenAIUsageOutputTokens(response.EvalCount),
+	)
+
+	return response, apiCallDuration, nil
+}
+
+// streamResponse merges streamed response chunks into one response,
+// calling stream for every delta.
+func (o *OllamaTextProvider) streamResponse(
+	resp api.ChatResponse, apiRequest, toolCallIDPrefix string, responses *[]api.ChatResponse, stream func(event TextStreamEvent) errors.E,
+) errors.E {
+	if resp.Message.Thinking != "" {
+		errE := stream(TextStreamEvent{ //nolint:exhaustruct
+			Type:       roleThinking,
+			Content:    resp.Message.Thinking,
+			APIRequest: apiRequest,
+		})
+		if errE != nil {
+			return errE
+		}
+	}
+	if resp.Message.Content != "" {
+		errE := stream(TextStreamEvent{ //nolint:exhaustruct
+			Type:       typeText,
+			Content:    resp.Message.Content,
+			APIRequest: apiRequest,
+		})
+		if errE != nil {
+			return errE
+		}
+	}
+
+	toolCallIndex := 0
+	if len(*responses) == 0 {
+		*responses = append(*responses, resp)
+	} else {
+		response := &(*responses)[0]
+		toolCallIndex = len(response.Message.ToolCalls)
+		response.Message.Content += resp.Message.Content
+		response.Message.Thinking += resp.Message.Thinking
+		response.Message.ToolCalls = append(response.Message.ToolCalls, resp.Message.ToolCalls...)
+		if resp.Message.Role != "" {
+			response.Message.Role = resp.Message.Role
+		}
+		if resp.Done {
+			response.Done = resp.Done
+			response.DoneReason = resp.DoneReason
+			response.Metrics = resp.Metrics
+		}
+	}
+
+	// Ollama sends tool calls complete, so we can pass them on as they come.
+	for i, toolCall := range resp.Message.ToolCalls {
+		errE := stream(TextStreamEvent{ //nolint:exhaustruct
+			Type:        roleToolUse,
+			Content:     toolCall.Function.Arguments.String(),
+			ToolUseID:   fmt.Sprintf("%s_%d", toolCallIDPrefix, toolCallIndex+i),
+			ToolUseName: toolCall.Function.Name,
+			APIRequest:  apiRequest,
+		})
+		if errE != nil {
+			return errE
+		}
+	}
+
+	return nil
+}
+
 // InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
 func (o *OllamaTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
 	if !o.ForceOutputJSONSchema {
@@ -442,7 +660,9 @@ func (o *OllamaTextProvider) InitTools(ctx context.Context, tools map[string]Tex
 	o.tools = []api.Tool{}
 	o.toolers = map[string]TextTooler{}
 
-	for name, tool := range tools {
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
 		errE := tool.Init(ctx)
 		if errE != nil {
 			errors.Details(errE)["name"] = name
@@ -496,7 +716,8 @@ func (o *OllamaTextProvider) InitTools(ctx context.Context, tools map[string]Tex
 }
 
 func (o *OllamaTextProvider) callToolWrapper(
-	ctx context.Context, apiRequest string, toolCall api.ToolCall, toolCallID string, result *api.Message, callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+	ctx context.Context, apiRequest string, toolCall api.ToolCall, toolCallID string, result *api.Message, isError *bool,
+	callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
 ) {
 	if callRecorder != nil {
 		defer func() {
@@ -506,8 +727,11 @@ func (o *OllamaTextProvider) callToolWrapper(
 
 	defer func() {
 		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Function.Name).Inc()
+
 			content := fmt.Sprintf("Error: %s", err)
 			result.Content = content
+			*isError = true
 
 			toolMessage.setContent(content, true)
 		}
@@ -520,12 +744,18 @@ func (o *OllamaTextProvider) callToolWrapper(
 	logger := zerolog.Ctx(ctx).With().Str("tool", toolCallID).Logger()
 	ctx = logger.WithContext(ctx)
 
+	ctx, span := startToolSpan(ctx, toolCall.Function.Name, toolCallID)
+	defer span.End()
+
 	output, duration, errE := o.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Function.Name, duration, errE)
 	if errE != nil {
 		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Function.Name).Str("apiRequest", apiRequest).
 			Str("tool", toolCallID).RawJSON("input", json.RawMessage(toolCall.Function.Arguments.String())).Msg("tool error")
 		content := "Error: " + errE.Error()
 		result.Content = content
+		*isError = true
 
 		toolMessage.setContent(content, true)
 	} else {
@@ -549,15 +779,79 @@ func (o *OllamaTextProvider) callTool(ctx context.Context, toolCall api.ToolCall
 	return output, Duration(duration), errE
 }
 
+// newOllamaMessage converts message to Ollama message. Ollama supports only images
+// as non-textual content parts, which are provided separately from textual content.
+func newOllamaMessage(message ChatMessage) (api.Message, errors.E) {
+	if len(message.Parts) == 0 {
+		return api.Message{
+			Role:      message.Role,
+			Content:   message.Content,
+			Thinking:  "",
+			Images:    nil,
+			ToolCalls: nil,
+			ToolName:  "",
+		}, nil
+	}
+
+	texts := []string{}
+	images := []api.ImageData{}
+	for _, part := range message.Parts {
+		switch part.Type {
+		case typeText:
+			texts = append(texts, part.Text)
+		case typeImage:
+			images = append(images, part.Data)
+		default:
+			return api.Message{}, errors.WithDetails( //nolint:exhaustruct
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+
+	return api.Message{
+		Role:      message.Role,
+		Content:   strings.Join(texts, "\n\n"),
+		Thinking:  "",
+		Images:    images,
+		ToolCalls: nil,
+		ToolName:  "",
+	}, nil
+}
+
 func (o *OllamaTextProvider) recordMessage(recorder *TextRecorderCall, message api.Message, toolCallIDPrefix string) {
 	if message.Role == roleTool {
 		panic(errors.New("recording tool result message should not happen"))
-	} else if message.Content != "" || len(message.ToolCalls) == 0 {
+	} else if message.Content != "" || (len(message.ToolCalls) == 0 && len(message.Images) == 0) {
 		// Often with ToolCalls present, the content is empty and we do not record the content in that case.
-		// But we do want to record empty content when there are no ToolCalls.
+		// But we do want to record empty content when there are no ToolCalls (or images).
 		recorder.addMessage(message.Role, message.Content, "", "", false)
 	}
+	for _, image := range message.Images {
+		recorder.addPart(message.Role, ChatContentPart{
+			Type:     typeImage,
+			Text:     "",
+			MIMEType: http.DetectContentType(image),
+			Data:     image,
+		})
+	}
 	for i, tool := range message.ToolCalls {
 		recorder.addMessage(roleToolUse, tool.Function.Arguments.String(), fmt.Sprintf("%s_%d", toolCallIDPrefix, i), tool.Function.Name, false)
 	}
 }
+
+func (o *OllamaTextProvider) estimatedTokens(messages []api.Message) (int, int) {
+	// We estimate inputTokens from messages (including system message) by
+	// dividing number of characters by 4.
+	inputTokens := 0
+	for _, message := range messages {
+		inputTokens += len(message.Content) / 4 //nolint:mnd
+		inputTokens += len(message.Images) * estimatedPartTokens
+		for _, tool := range message.ToolCalls {
+			inputTokens += len(tool.Function.Name) / 4               //nolint:mnd
+			inputTokens += len(tool.Function.Arguments.String()) / 4 //nolint:mnd
+		}
+	}
+	return inputTokens, 0
+}
@@ -0,0 +1,217 @@
+package fun
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+var (
+	_ EmbeddingProvider = (*OllamaEmbeddingProvider)(nil)
+	_ typedProvider     = (*OllamaEmbeddingProvider)(nil)
+)
+
+// OllamaEmbeddingProvider is an [EmbeddingProvider] which provides integration with
+// embedding-based [Ollama] AI models.
+//
+// [Ollama]: https://ollama.com/
+type OllamaEmbeddingProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// Base is a HTTP URL where Ollama instance is listening.
+	Base string `json:"-"`
+
+	// Model is the name of the model to be used.
+	Model string `json:"model"`
+
+	// ModelAccess allows Ollama to access private AI models.
+	ModelAccess OllamaModelAccess `json:"-"`
+
+	// MaxContextLength is the maximum number of tokens allowed to be used
+	// for each text with the underlying AI model. If not provided,
+	// it is obtained from Ollama for the model.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// Dimensions is the number of dimensions of returned embeddings.
+	// Not all models support it. If not provided, the model's default is used.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	client *api.Client
+}
+
+// MarshalJSON implements json.Marshaler interface for OllamaEmbeddingProvider.
+func (o OllamaEmbeddingProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P OllamaEmbeddingProvider
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "ollama",
+		P:    P(o),
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o OllamaEmbeddingProvider) typeModel() (string, string) {
+	return "ollama", o.Model
+}
+
+// Init implements [EmbeddingProvider] interface.
+func (o *OllamaEmbeddingProvider) Init(ctx context.Context) errors.E {
+	if o.client != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	base, err := url.Parse(o.Base)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client := o.Client
+	if client == nil {
+		client = newClient(
+			// We lock in OllamaEmbeddingProvider.Embed instead.
+			nil,
+			// No headers to parse.
+			nil,
+			// Nothing to update after every request.
+			nil,
+		)
+	}
+	o.client = api.NewClient(base, client)
+
+	contextLength, errE := ollamaModelContextLength(ctx, o.client, o.Model, o.ModelAccess)
+	if errE != nil {
+		return errE
+	}
+
+	if o.MaxContextLength == 0 {
+		o.MaxContextLength = contextLength
+	}
+	if o.MaxContextLength > contextLength {
+		return errors.WithDetails(
+			ErrMaxContextLengthOverModel,
+			"maxTotal", o.MaxContextLength,
+			"model", contextLength,
+		)
+	}
+
+	return nil
+}
+
+// Embed implements [EmbeddingProvider] interface.
+func (o *OllamaEmbeddingProvider) Embed(ctx context.Context, texts []string) (_ [][]float32, errE errors.E) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newEmbeddingCall(ctx, callID, o)
+		defer recorder.recordCall(callRecorder)
+
+		for _, text := range texts {
+			callRecorder.addMessage(roleUser, text, "", "", false)
+		}
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startAPIRequestSpan(ctx, operationEmbeddings, o)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(o)
+
+	// We estimate input tokens by dividing number of characters by 4.
+	estimatedInputTokens := 0
+	for _, text := range texts {
+		estimatedInputTokens += len(text) / 4 //nolint:mnd
+	}
+
+	reservation, errE := reserveBudget(ctx, o, estimatedInputTokens, 0)
+	if errE != nil {
+		return nil, errE
+	}
+	defer reservation.release()
+
+	mu := ollamaRateLimiterLock(o.Base)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Ollama does not provide request ID, so we make one ourselves.
+	apiRequest := "req_1"
+	span.SetAttributes(apiRequestKey.String(apiRequest))
+
+	start := time.Now()
+	resp, err := o.client.Embed(ctx, &api.EmbedRequest{
+		Model:      o.Model,
+		Input:      texts,
+		KeepAlive:  nil,
+		Truncate:   nil,
+		Dimensions: o.Dimensions,
+		Options: map[string]any{
+			"num_ctx": o.MaxContextLength,
+		},
+	})
+	apiCallDuration := time.Since(start)
+	metrics.apiRequestStatus(labels, getStatusCode(err))
+	if err != nil {
+		errE := getStatusError(err)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, errE
+	}
+
+	usedTokens := newUsedTokens(
+		o.MaxContextLength,
+		0,
+		resp.PromptEvalCount,
+		0,
+		nil,
+		nil,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	span.SetAttributes(
+		semconv.GenAIResponseModel(resp.Model),
+		semconv.GenAIUsageInputTokens(resp.PromptEvalCount),
+	)
+
+	if callRecorder != nil {
+		callRecorder.setUsedTokens(apiRequest, usedTokens)
+		callRecorder.addUsedTime(
+			apiRequest,
+			0,
+			0,
+			apiCallDuration,
+		)
+	}
+
+	if len(resp.Embeddings) != len(texts) {
+		errE := errors.Errorf("%w: unexpected number of embeddings", ErrUnexpectedMessage)
+		errors.Details(errE)["number"] = len(resp.Embeddings)
+		errors.Details(errE)["expected"] = len(texts)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, errE
+	}
+
+	return resp.Embeddings, nil
+}
@@ -1,10 +1,18 @@
 package fun_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 
 	"gitlab.com/tozd/go/fun"
@@ -34,3 +42,70 @@ func TestOllamaJSON(t *testing.T) {
 	require.NoError(t, errE, "% -+#.1v", errE)
 	assert.Equal(t, `{"model":"llama3:8b","maxContextLength":43,"maxResponseLength":56,"maxExchanges":57,"forceOutputJsonSchema":false,"seed":42,"temperature":0.7,"reasoningEffort":"","type":"ollama"}`, string(out)) //nolint:testifylint
 }
+
+func TestOllamaTextProviderContentParts(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	requests := []json.RawMessage{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/pull", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	})
+	mux.HandleFunc("POST /api/show", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"model_info":{"general.architecture":"llama","llama.context_length":8192}}`))
+	})
+	mux.HandleFunc("POST /api/chat", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err) //nolint:testifylint
+		mu.Lock()
+		requests = append(requests, body)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"model":"llava:7b","created_at":"2024-01-01T00:00:00Z","message":{"role":"assistant","content":"red"},` +
+			`"done":true,"done_reason":"stop","prompt_eval_count":100,"eval_count":1}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := &fun.OllamaTextProvider{ //nolint:exhaustruct
+		Client: server.Client(),
+		Base:   server.URL,
+		Model:  "llava:7b",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	message := contentPartsMessage(t, "image/png", "application/pdf")
+	// Ollama does not support documents.
+	message.Parts = message.Parts[:2]
+
+	output, errE := provider.Chat(ctx, message)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "red", output)
+
+	mu.Lock()
+	require.Len(t, requests, 1)
+	var request struct {
+		Messages json.RawMessage `json:"messages"`
+	}
+	errE = x.Unmarshal(requests[0], &request)
+	mu.Unlock()
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.JSONEq(t, `[
+		{"role": "user", "content": "Describe.", "images": ["`+base64.StdEncoding.EncodeToString(message.Parts[1].Data)+`"]}
+	]`, string(request.Messages))
+
+	// Documents are rejected before making a request.
+	_, errE = provider.Chat(ctx, contentPartsMessage(t, "image/png", "application/pdf"))
+	require.ErrorIs(t, errE, fun.ErrUnsupportedContentPart)
+	assert.Equal(t, "document", errors.Details(errE)["type"])
+	assert.Equal(t, "application/pdf", errors.Details(errE)["mimeType"])
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, requests, 1)
+}
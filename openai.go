@@ -7,18 +7,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/rs/zerolog"
 	"github.com/santhosh-tekuri/jsonschema/v6"
 	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 	"gitlab.com/tozd/identifier"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 )
 
+const openAIBaseURL = "https://api.openai.com/v1"
+
 //nolint:mnd
 var openAIModels = map[string]struct { //nolint:gochecknoglobals
 	MaxContextLength  int
@@ -63,6 +71,7 @@ var openAIModels = map[string]struct { //nolint:gochecknoglobals
 }
 
 var openAIRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "openai",
 	mu:       sync.RWMutex{},
 	limiters: map[string]map[string]any{},
 }
@@ -104,9 +113,16 @@ type openAIRequest struct {
 	ReasoningEffort     *string               `json:"reasoning_effort,omitempty"`
 	ResponseFormat      *openAIResponseFormat `json:"response_format,omitempty"`
 	Tools               []openAITool          `json:"tools,omitempty"`
+	Stream              bool                  `json:"stream,omitempty"`
+	StreamOptions       *openAIStreamOptions  `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
 	ID       string `json:"id"`
 	Type     string `json:"type"`
 	Function struct {
@@ -121,9 +137,208 @@ type openAIMessage struct {
 	Refusal    *string          `json:"refusal,omitempty"`
 	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string           `json:"tool_call_id,omitempty"`
+
+	isError bool
+	// parts are sent instead of Content, if set.
+	parts []ChatContentPart
+}
+
+// MarshalJSON implements json.Marshaler interface for openAIMessage.
+func (m openAIMessage) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type M openAIMessage
+	if len(m.parts) == 0 {
+		return x.MarshalWithoutEscapeHTML(M(m))
+	}
+	t := struct {
+		M
+
+		Content []openAIContentPart `json:"content"`
+	}{
+		M:       M(m),
+		Content: openAIContentParts(m.parts),
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     *string         `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+	File     *openAIFile     `json:"file,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIFile struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
+// openAIContentParts converts content parts to OpenAI content parts.
+// Parts should have already been validated by checkOpenAIContentParts.
+//
+// See: https://platform.openai.com/docs/guides/images-vision
+// See: https://platform.openai.com/docs/guides/pdf-files
+func openAIContentParts(parts []ChatContentPart) []openAIContentPart {
+	result := []openAIContentPart{}
+	for i, part := range parts {
+		switch part.Type {
+		case typeText:
+			text := part.Text
+			result = append(result, openAIContentPart{
+				Type:     typeText,
+				Text:     &text,
+				ImageURL: nil,
+				File:     nil,
+			})
+		case typeImage:
+			result = append(result, openAIContentPart{
+				Type: "image_url",
+				Text: nil,
+				ImageURL: &openAIImageURL{
+					URL: dataURL(part.MIMEType, part.Data),
+				},
+				File: nil,
+			})
+		case typeDocument:
+			result = append(result, openAIContentPart{
+				Type:     "file",
+				Text:     nil,
+				ImageURL: nil,
+				File: &openAIFile{
+					// A filename is required, but we do not have it.
+					Filename: fmt.Sprintf("document_%d", i),
+					FileData: dataURL(part.MIMEType, part.Data),
+				},
+			})
+		}
+	}
+	return result
+}
+
+// checkOpenAIContentParts checks that parts are of supported types and
+// that images and documents are of MIME types supported by OpenAI.
+func checkOpenAIContentParts(parts []ChatContentPart, supportedTypes ...string) errors.E {
+	for _, part := range parts {
+		mediaType, _, _ := mime.ParseMediaType(part.MIMEType)
+		if !slices.Contains(supportedTypes, part.Type) ||
+			(part.Type == typeImage && !slices.Contains(commonImageMIMETypes, mediaType)) ||
+			(part.Type == typeDocument && mediaType != "application/pdf") {
+			return errors.WithDetails(
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+	return nil
+}
+
+func newOpenAIMessage(message ChatMessage) (openAIMessage, errors.E) {
+	if len(message.Parts) > 0 {
+		errE := checkOpenAIContentParts(message.Parts, typeText, typeImage, typeDocument)
+		if errE != nil {
+			return openAIMessage{}, errE //nolint:exhaustruct
+		}
+	}
+
+	var content *string
+	if len(message.Parts) == 0 {
+		content = &message.Content
+	}
+	return openAIMessage{
+		Role:       message.Role,
+		Content:    content,
+		Refusal:    nil,
+		ToolCalls:  nil,
+		ToolCallID: "",
+		isError:    false,
+		parts:      message.Parts,
+	}, nil
 }
 
 type openAIResponse struct {
+	ID                string         `json:"id"`
+	Object            string         `json:"object"`
+	Created           int64          `json:"created"`
+	Model             string         `json:"model"`
+	SystemFingerprint string         `json:"system_fingerprint"`
+	ServiceTier       *string        `json:"service_tier,omitempty"`
+	Choices           []openAIChoice `json:"choices"`
+	Usage             openAIUsage    `json:"usage"`
+	Error             *openAIError   `json:"error,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      openAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type openAIUsage struct {
+	PromptTokens            int `json:"prompt_tokens"`
+	CompletionTokens        int `json:"completion_tokens"`
+	TotalTokens             int `json:"total_tokens"`
+	CompletionTokensDetails struct {
+		AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+		AudioTokens              int `json:"audio_tokens"`
+		ReasoningTokens          int `json:"reasoning_tokens"`
+		RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+	} `json:"completion_tokens_details"`
+	PromptTokensDetails struct {
+		AudioTokens  int `json:"audio_tokens"`
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+type openAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    *string `json:"code,omitempty"`
+	Param   *string `json:"param,omitempty"`
+}
+
+type openAIBatchLine struct {
+	CustomID string        `json:"custom_id"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Body     openAIRequest `json:"body"`
+}
+
+type openAIFileObject struct {
+	ID string `json:"id"`
+}
+
+type openAIBatchCreate struct {
+	InputFileID      string `json:"input_file_id"`
+	Endpoint         string `json:"endpoint"`
+	CompletionWindow string `json:"completion_window"`
+}
+
+type openAIBatch struct {
+	ID           string  `json:"id"`
+	Status       string  `json:"status"`
+	OutputFileID *string `json:"output_file_id,omitempty"`
+	ErrorFileID  *string `json:"error_file_id,omitempty"`
+	Errors       *struct {
+		Data []openAIError `json:"data"`
+	} `json:"errors,omitempty"`
+}
+
+type openAIBatchResult struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		RequestID  string          `json:"request_id"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response,omitempty"`
+	Error *openAIError `json:"error,omitempty"`
+}
+
+type openAIStreamChunk struct {
 	ID                string  `json:"id"`
 	Object            string  `json:"object"`
 	Created           int64   `json:"created"`
@@ -132,33 +347,20 @@ type openAIResponse struct {
 	ServiceTier       *string `json:"service_tier,omitempty"`
 	Choices           []struct {
 		Index        int           `json:"index"`
-		Message      openAIMessage `json:"message"`
-		FinishReason string        `json:"finish_reason"`
+		Delta        openAIMessage `json:"delta"`
+		FinishReason *string       `json:"finish_reason"`
 	} `json:"choices"`
-	Usage struct {
-		PromptTokens            int `json:"prompt_tokens"`
-		CompletionTokens        int `json:"completion_tokens"`
-		TotalTokens             int `json:"total_tokens"`
-		CompletionTokensDetails struct {
-			AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
-			AudioTokens              int `json:"audio_tokens"`
-			ReasoningTokens          int `json:"reasoning_tokens"`
-			RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
-		} `json:"completion_tokens_details"`
-		PromptTokensDetails struct {
-			AudioTokens  int `json:"audio_tokens"`
-			CachedTokens int `json:"cached_tokens"`
-		} `json:"prompt_tokens_details"`
-	} `json:"usage"`
-	Error *struct {
-		Message string  `json:"message"`
-		Type    string  `json:"type"`
-		Code    *string `json:"code,omitempty"`
-		Param   *string `json:"param,omitempty"`
-	} `json:"error,omitempty"`
-}
-
-var _ TextProvider = (*OpenAITextProvider)(nil)
+	Usage *openAIUsage `json:"usage,omitempty"`
+	Error *openAIError `json:"error,omitempty"`
+}
+
+var (
+	_ TextProvider     = (*OpenAITextProvider)(nil)
+	_ WithStreaming    = (*OpenAITextProvider)(nil)
+	_ WithConversation = (*OpenAITextProvider)(nil)
+	_ WithBatch        = (*OpenAITextProvider)(nil)
+	_ typedProvider    = (*OpenAITextProvider)(nil)
+)
 
 // OpenAITextProvider is a [TextProvider] which provides integration with
 // text-based [OpenAI] AI models.
@@ -172,6 +374,15 @@ type OpenAITextProvider struct {
 	// APIKey is the API key to be used for API calls.
 	APIKey string `json:"-"`
 
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://api.openai.com/v1".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
 	// Model is the name of the model to be used.
 	Model string `json:"model"`
 
@@ -229,17 +440,62 @@ type OpenAITextProvider struct {
 func (o OpenAITextProvider) MarshalJSON() ([]byte, error) {
 	// We define a new type to not recurse into this same MarshalJSON.
 	type P OpenAITextProvider
+	p := P(o)
+	p.Headers = nil
 	t := struct {
 		P
 
 		Type string `json:"type"`
 	}{
 		Type: "openai",
-		P:    P(o),
+		P:    p,
 	}
 	return x.MarshalWithoutEscapeHTML(t)
 }
 
+// typeModel implements typedProvider interface.
+func (o OpenAITextProvider) typeModel() (string, string) {
+	return "openai", o.Model
+}
+
+// newOpenAIClient returns a retryable HTTP client which is rate limited
+// using the rate limiter for the given key.
+func newOpenAIClient(rateLimiterKey string) *http.Client {
+	return newClient(
+		func(req *http.Request) error {
+			// Batch and file requests are not rate limited.
+			if strings.HasSuffix(req.URL.Path, "/chat/completions") || strings.HasSuffix(req.URL.Path, "/responses") ||
+				strings.HasSuffix(req.URL.Path, "/embeddings") {
+				ctx := req.Context()
+				estimatedInputTokens, _ := getEstimatedTokens(ctx)
+				// Rate limit retries.
+				return openAIRateLimiter.Take(ctx, rateLimiterKey, map[string]int{
+					"rpm": 1,
+					"tpm": estimatedInputTokens,
+				})
+			}
+			return nil
+		},
+		parseRateLimitHeaders,
+		func(limitRequests, limitTokens, remainingRequests, remainingTokens int, resetRequests, resetTokens time.Time) {
+			openAIRateLimiter.Set(rateLimiterKey, map[string]any{
+				"rpm": resettingRateLimit{
+					Limit:     limitRequests,
+					Remaining: remainingRequests,
+					Window:    time.Minute,
+					Resets:    resetRequests,
+				},
+				"tpm": resettingRateLimit{
+					Limit:     limitTokens,
+					Remaining: remainingTokens,
+					Window:    time.Minute,
+					Resets:    resetTokens,
+				},
+			})
+		},
+	)
+}
+
 // Init implements [TextProvider] interface.
 func (o *OpenAITextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
 	if o.messages != nil {
@@ -248,46 +504,17 @@ func (o *OpenAITextProvider) Init(_ context.Context, messages []ChatMessage) err
 	o.messages = []openAIMessage{}
 
 	for _, message := range messages {
-		o.messages = append(o.messages, openAIMessage{
-			Role:       message.Role,
-			Content:    &message.Content,
-			Refusal:    nil,
-			ToolCalls:  nil,
-			ToolCallID: "",
-		})
+		m, errE := newOpenAIMessage(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, m)
 	}
 
-	o.rateLimiterKey = fmt.Sprintf("%s-%s", o.APIKey, o.Model)
+	o.rateLimiterKey = fmt.Sprintf("%s-%s-%s", o.BaseURL, o.APIKey, o.Model)
 
 	if o.Client == nil {
-		o.Client = newClient(
-			func(req *http.Request) error {
-				ctx := req.Context()
-				estimatedInputTokens, _ := getEstimatedTokens(ctx)
-				// Rate limit retries.
-				return openAIRateLimiter.Take(req.Context(), o.rateLimiterKey, map[string]int{
-					"rpm": 1,
-					"tpm": estimatedInputTokens,
-				})
-			},
-			parseRateLimitHeaders,
-			func(limitRequests, limitTokens, remainingRequests, remainingTokens int, resetRequests, resetTokens time.Time) {
-				openAIRateLimiter.Set(o.rateLimiterKey, map[string]any{
-					"rpm": resettingRateLimit{
-						Limit:     limitRequests,
-						Remaining: remainingRequests,
-						Window:    time.Minute,
-						Resets:    resetRequests,
-					},
-					"tpm": resettingRateLimit{
-						Limit:     limitTokens,
-						Remaining: remainingTokens,
-						Window:    time.Minute,
-						Resets:    resetTokens,
-					},
-				})
-			},
-		)
+		o.Client = newOpenAIClient(o.rateLimiterKey)
 	}
 
 	if o.MaxContextLength == 0 {
@@ -312,263 +539,487 @@ func (o *OpenAITextProvider) Init(_ context.Context, messages []ChatMessage) err
 }
 
 // Chat implements [TextProvider] interface.
-func (o *OpenAITextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) { //nolint:maintidx
-	callID := identifier.New().String()
+func (o *OpenAITextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
 
-	var callRecorder *TextRecorderCall
-	if recorder := GetTextRecorder(ctx); recorder != nil {
-		callRecorder = recorder.newCall(callID, o)
-		defer recorder.recordCall(callRecorder)
+// ChatConversation implements [WithConversation] interface.
+func (o *OpenAITextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
 	}
+	return o.chat(ctx, messages, nil)
+}
 
-	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
-	ctx = logger.WithContext(ctx)
+// ChatStream implements [WithStreaming] interface.
+func (o *OpenAITextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
 
-	messages := slices.Clone(o.messages)
-	messages = append(messages, openAIMessage{
-		Role:       message.Role,
-		Content:    &message.Content,
-		Refusal:    nil,
-		ToolCalls:  nil,
-		ToolCallID: "",
-	})
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *OpenAITextProvider) ChatConversationStream(ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
 
-	if callRecorder != nil {
-		for _, message := range messages {
-			o.recordMessage(callRecorder, message)
-		}
+func (o *OpenAITextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.openAIChat().chat(ctx, conversation, fn)
+}
 
-		callRecorder.notify("", nil)
+// openAIChat returns chat completions API configuration for the provider.
+func (o *OpenAITextProvider) openAIChat() *openAIChat {
+	return &openAIChat{
+		provider:          o,
+		client:            o.Client,
+		maxContextLength:  o.MaxContextLength,
+		maxResponseLength: o.MaxResponseLength,
+		maxExchanges:      o.MaxExchanges,
+		messages:          o.messages,
+		tools:             o.tools,
+		attributes: []attribute.KeyValue{
+			semconv.GenAIRequestMaxTokens(o.MaxResponseLength),
+			semconv.GenAIRequestSeed(o.Seed),
+			semconv.GenAIRequestTemperature(o.Temperature),
+		},
+		url: apiURL(o.BaseURL, openAIBaseURL, "/chat/completions"),
+		setHeaders: func(req *http.Request) {
+			req.Header.Add("Authorization", "Bearer "+o.APIKey)
+			setHeaders(req, o.Headers)
+		},
+		rateLimiter:    &openAIRateLimiter,
+		rateLimiterKey: o.rateLimiterKey,
+		newRequest: func(messages []openAIMessage, stream bool) any {
+			return o.newRequest(messages, stream)
+		},
+		requestID: func(resp *http.Response) string {
+			return resp.Header.Get("X-Request-Id")
+		},
+		requireRequestID: true,
+		responseError:    nil,
 	}
+}
 
-	for range o.MaxExchanges {
-		var reasoningEffort *string
-		if o.ReasoningEffort != "" {
-			reasoningEffort = &o.ReasoningEffort
-		}
-		oReq := openAIRequest{
-			Messages:            messages,
-			Model:               o.Model,
-			Seed:                o.Seed,
-			Temperature:         o.Temperature,
-			MaxCompletionTokens: o.MaxResponseLength,
-			ReasoningEffort:     reasoningEffort,
-			ResponseFormat:      nil,
-			Tools:               o.tools,
-		}
+// openAIContent returns the content of the final response choice.
+func openAIContent(choice openAIChoice, apiRequest string) (string, errors.E) {
+	if choice.FinishReason != stopReason {
+		return "", errors.WithDetails(
+			ErrUnexpectedStop,
+			"reason", choice.FinishReason,
+			"apiRequest", apiRequest,
+		)
+	}
 
-		if o.outputJSONSchema != nil {
-			oReq.ResponseFormat = &openAIResponseFormat{
-				Type: "json_schema",
-				JSONSchema: openAIJSONSchema{
-					Description: o.outputJSONSchemaDescription,
-					Name:        o.outputJSONSchemaName,
-					Schema:      o.outputJSONSchema,
-					Strict:      true,
-				},
-			}
+	if choice.Message.Refusal != nil {
+		return "", errors.WithDetails(
+			ErrRefused,
+			"refusal", *choice.Message.Refusal,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	if choice.Message.Content == nil {
+		errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return "", errE
+	}
+
+	return *choice.Message.Content, nil
+}
+
+func (o *OpenAITextProvider) newRequest(messages []openAIMessage, stream bool) openAIRequest {
+	var reasoningEffort *string
+	if o.ReasoningEffort != "" {
+		reasoningEffort = &o.ReasoningEffort
+	}
+	oReq := openAIRequest{
+		Messages:            messages,
+		Model:               o.Model,
+		Seed:                o.Seed,
+		Temperature:         o.Temperature,
+		MaxCompletionTokens: o.MaxResponseLength,
+		ReasoningEffort:     reasoningEffort,
+		ResponseFormat:      nil,
+		Tools:               o.tools,
+		Stream:              false,
+		StreamOptions:       nil,
+	}
+
+	if stream {
+		oReq.Stream = true
+		oReq.StreamOptions = &openAIStreamOptions{
+			IncludeUsage: true,
 		}
+	}
 
-		request, errE := x.MarshalWithoutEscapeHTML(oReq)
-		if errE != nil {
-			return "", errE
+	if o.outputJSONSchema != nil {
+		oReq.ResponseFormat = &openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: openAIJSONSchema{
+				Description: o.outputJSONSchemaDescription,
+				Name:        o.outputJSONSchemaName,
+				Schema:      o.outputJSONSchema,
+				Strict:      true,
+			},
 		}
+	}
 
-		estimatedInputTokens, estimatedOutputTokens := o.estimatedTokens(messages)
+	return oReq
+}
 
-		req, err := http.NewRequestWithContext(
-			withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens),
-			http.MethodPost,
-			"https://api.openai.com/v1/chat/completions",
-			bytes.NewReader(request),
-		)
-		if err != nil {
-			return "", errors.WithStack(err)
+// decodeOpenAIStream decodes server-sent events with chat completion chunks into
+// the response, calling stream for every delta.
+//
+// See: https://platform.openai.com/docs/api-reference/chat-streaming
+func decodeOpenAIStream(body io.Reader, apiRequest string, response *openAIResponse, stream func(event TextStreamEvent) errors.E) errors.E {
+	var content, refusal *strings.Builder
+	errE := decodeServerSentEvents(body, func(_ string, data []byte) errors.E {
+		if string(data) == "[DONE]" {
+			return nil
 		}
-		req.Header.Add("Authorization", "Bearer "+o.APIKey)
-		req.Header.Add("Content-Type", "application/json")
-		// Rate limit the initial request.
-		errE = openAIRateLimiter.Take(ctx, o.rateLimiterKey, map[string]int{
-			"rpm": 1,
-			"tpm": estimatedInputTokens,
-		})
+
+		var chunk openAIStreamChunk
+		errE := x.Unmarshal(data, &chunk)
 		if errE != nil {
-			return "", errE
+			return errE
+		}
+
+		response.ID = chunk.ID
+		response.Object = chunk.Object
+		response.Created = chunk.Created
+		response.Model = chunk.Model
+		response.SystemFingerprint = chunk.SystemFingerprint
+		response.ServiceTier = chunk.ServiceTier
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
 		}
-		start := time.Now()
-		resp, err := o.Client.Do(req)
-		var apiRequest string
-		if resp != nil {
-			apiRequest = resp.Header.Get("X-Request-Id")
+		if chunk.Error != nil {
+			response.Error = chunk.Error
 		}
-		if err != nil {
-			errE = errors.Prefix(err, ErrAPIRequestFailed)
-			if apiRequest != "" {
-				errors.Details(errE)["apiRequest"] = apiRequest
+
+		for _, choice := range chunk.Choices {
+			for len(response.Choices) <= choice.Index {
+				response.Choices = append(response.Choices, openAIChoice{Index: len(response.Choices)}) //nolint:exhaustruct
+			}
+			c := &response.Choices[choice.Index]
+			if choice.FinishReason != nil {
+				c.FinishReason = *choice.FinishReason
+			}
+			if choice.Delta.Role != "" {
+				c.Message.Role = choice.Delta.Role
+			}
+			if choice.Delta.Content != nil {
+				if content == nil {
+					content = new(strings.Builder)
+				}
+				content.WriteString(*choice.Delta.Content)
+				c.Message.Content = ptr(content.String())
+				if *choice.Delta.Content != "" {
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       typeText,
+						Content:    *choice.Delta.Content,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return errE
+					}
+				}
+			}
+			if choice.Delta.Refusal != nil {
+				if refusal == nil {
+					refusal = new(strings.Builder)
+				}
+				refusal.WriteString(*choice.Delta.Refusal)
+				c.Message.Refusal = ptr(refusal.String())
+			}
+			for _, toolCall := range choice.Delta.ToolCalls {
+				i := len(c.Message.ToolCalls)
+				if toolCall.Index != nil {
+					i = *toolCall.Index
+				}
+				for len(c.Message.ToolCalls) <= i {
+					c.Message.ToolCalls = append(c.Message.ToolCalls, openAIToolCall{}) //nolint:exhaustruct
+				}
+				tc := &c.Message.ToolCalls[i]
+				if toolCall.ID != "" {
+					tc.ID = toolCall.ID
+				}
+				if toolCall.Type != "" {
+					tc.Type = toolCall.Type
+				}
+				tc.Function.Name += toolCall.Function.Name
+				tc.Function.Arguments += toolCall.Function.Arguments
 			}
-			return "", errE
 		}
-		defer resp.Body.Close()              //nolint:errcheck
-		defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
 
-		if apiRequest == "" {
-			body, _ := io.ReadAll(resp.Body)
-			return "", errors.WithDetails(ErrMissingRequestID, body, string(body))
+		return nil
+	})
+	if errE != nil {
+		return errE
+	}
+
+	// Tool calls are complete only at the end of the stream.
+	for _, choice := range response.Choices {
+		for i := range choice.Message.ToolCalls {
+			// We do not send the index back to the API.
+			choice.Message.ToolCalls[i].Index = nil
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:        roleToolUse,
+				Content:     choice.Message.ToolCalls[i].Function.Arguments,
+				ToolUseID:   choice.Message.ToolCalls[i].ID,
+				ToolUseName: choice.Message.ToolCalls[i].Function.Name,
+				APIRequest:  apiRequest,
+			})
+			if errE != nil {
+				return errE
+			}
 		}
+	}
+
+	return nil
+}
+
+// SubmitBatch implements [WithBatch] interface.
+//
+// See: https://platform.openai.com/docs/guides/batch
+func (o *OpenAITextProvider) SubmitBatch(ctx context.Context, requests []TextBatchRequest) (string, errors.E) {
+	if len(o.tools) > 0 {
+		return "", errors.New("batches do not support tools")
+	}
 
-		var response openAIResponse
-		errE = x.DecodeJSON(resp.Body, &response)
+	errE := checkBatchRequests(requests)
+	if errE != nil {
+		return "", errE
+	}
+
+	chat := o.openAIChat()
+	var lines bytes.Buffer
+	for _, request := range requests {
+		messages, errE := chat.conversationMessages(request.Messages)
+		if errE != nil {
+			errors.Details(errE)["id"] = request.ID
+			return "", errE
+		}
+		line, errE := x.MarshalWithoutEscapeHTML(openAIBatchLine{
+			CustomID: request.ID,
+			Method:   http.MethodPost,
+			URL:      "/v1/chat/completions",
+			Body:     o.newRequest(messages, false),
+		})
 		if errE != nil {
-			errors.Details(errE)["apiRequest"] = apiRequest
 			return "", errE
 		}
+		lines.Write(line)
+		lines.WriteString("\n")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err := writer.WriteField("purpose", "batch")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	part, err := writer.CreateFormFile("file", "batch.jsonl")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	_, err = part.Write(lines.Bytes())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
 
-		apiCallDuration := time.Since(start)
+	var file openAIFileObject
+	errE = o.batchRequest(ctx, http.MethodPost, apiURL(o.BaseURL, openAIBaseURL, "/files"), writer.FormDataContentType(), body.Bytes(), &file)
+	if errE != nil {
+		return "", errE
+	}
 
-		if response.Error != nil {
-			return "", errors.WithDetails(
-				ErrAPIResponseError,
-				"body", response.Error,
-				"apiRequest", apiRequest,
-			)
-		}
+	request, errE := x.MarshalWithoutEscapeHTML(openAIBatchCreate{
+		InputFileID:      file.ID,
+		Endpoint:         "/v1/chat/completions",
+		CompletionWindow: "24h",
+	})
+	if errE != nil {
+		return "", errE
+	}
 
-		if len(response.Choices) != 1 {
-			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
-			errors.Details(errE)["number"] = len(response.Choices)
-			errors.Details(errE)["apiRequest"] = apiRequest
-			return "", errE
-		}
+	var batch openAIBatch
+	errE = o.batchRequest(ctx, http.MethodPost, apiURL(o.BaseURL, openAIBaseURL, "/batches"), applicationJSONHeader, request, &batch)
+	if errE != nil {
+		return "", errE
+	}
 
-		if callRecorder != nil {
-			var cacheReadInputTokens *int
-			if response.Usage.PromptTokensDetails.CachedTokens != 0 {
-				cacheReadInputTokens = &response.Usage.PromptTokensDetails.CachedTokens
-			}
-			var reasoningTokens *int
-			if response.Usage.CompletionTokensDetails.ReasoningTokens != 0 {
-				reasoningTokens = &response.Usage.CompletionTokensDetails.ReasoningTokens
-			}
-			callRecorder.addUsedTokens(
-				apiRequest,
-				o.MaxContextLength,
-				o.MaxResponseLength,
-				response.Usage.PromptTokens,
-				response.Usage.CompletionTokens,
-				nil,
-				cacheReadInputTokens,
-				reasoningTokens,
-			)
-			callRecorder.addUsedTime(
-				apiRequest,
-				0,
-				0,
-				apiCallDuration,
-			)
+	return batch.ID, nil
+}
 
-			o.recordMessage(callRecorder, response.Choices[0].Message)
+// BatchResponses implements [WithBatch] interface.
+func (o *OpenAITextProvider) BatchResponses(ctx context.Context, batchID string) ([]TextBatchResponse, bool, errors.E) {
+	var batch openAIBatch
+	errE := o.batchRequest(ctx, http.MethodGet, apiURL(o.BaseURL, openAIBaseURL, "/batches/"+url.PathEscape(batchID)), "", nil, &batch)
+	if errE != nil {
+		errors.Details(errE)["batch"] = batchID
+		return nil, false, errE
+	}
 
-			callRecorder.notify("", nil)
+	switch batch.Status {
+	case "completed", "expired", "cancelled":
+		// Requests which have not been processed are reported in the error file.
+	case "failed":
+		errE := errors.WithDetails(
+			ErrBatchFailed,
+			"batch", batchID,
+		)
+		if batch.Errors != nil {
+			errors.Details(errE)["errors"] = batch.Errors.Data
 		}
+		return nil, true, errE
+	default:
+		return nil, false, nil
+	}
 
-		if response.Usage.TotalTokens >= o.MaxContextLength {
-			return "", errors.WithDetails(
-				ErrUnexpectedNumberOfTokens,
-				"content", *response.Choices[0].Message.Content,
-				"prompt", response.Usage.PromptTokens,
-				"response", response.Usage.CompletionTokens,
-				"total", response.Usage.TotalTokens,
-				"maxTotal", o.MaxContextLength,
-				"maxResponse", o.MaxResponseLength,
-				"apiRequest", apiRequest,
-			)
+	responses := []TextBatchResponse{}
+	for _, fileID := range []*string{batch.OutputFileID, batch.ErrorFileID} {
+		if fileID == nil || *fileID == "" {
+			continue
 		}
 
-		if response.Choices[0].Message.Role != roleAssistant {
-			return "", errors.WithDetails(
-				ErrUnexpectedRole,
-				"role", response.Choices[0].Message.Role,
-				"apiRequest", apiRequest,
-			)
+		var content []byte
+		errE := o.batchRequest(ctx, http.MethodGet, apiURL(o.BaseURL, openAIBaseURL, "/files/"+url.PathEscape(*fileID)+"/content"), "", nil, &content)
+		if errE != nil {
+			errors.Details(errE)["batch"] = batchID
+			return nil, true, errE
 		}
 
-		if response.Choices[0].FinishReason == "tool_calls" {
-			if len(response.Choices[0].Message.ToolCalls) == 0 {
-				errE := errors.Errorf("%w: expected tool calls", ErrUnexpectedMessage)
-				errors.Details(errE)["number"] = len(response.Choices[0].Message.ToolCalls)
-				errors.Details(errE)["apiRequest"] = apiRequest
-				return "", errE
+		for line := range bytes.Lines(content) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
 			}
 
-			// We have already recorded this message above.
-			messages = append(messages, response.Choices[0].Message)
+			var result openAIBatchResult
+			errE := x.Unmarshal(line, &result)
+			if errE != nil {
+				errors.Details(errE)["batch"] = batchID
+				return nil, true, errE
+			}
 
-			// We make space for tool results (one per tool call) so that the messages slice
-			// does not grow when appending below and invalidate pointers goroutines keep.
-			messages = slices.Grow(messages, len(response.Choices[0].Message.ToolCalls))
+			responses = append(responses, o.batchResponse(ctx, result))
+		}
+	}
 
-			if callRecorder != nil {
-				// We grow the slice inside call recorder as well.
-				callRecorder.prepareForToolMessages(len(response.Choices[0].Message.ToolCalls))
-			}
+	return responses, true, nil
+}
 
-			var wg sync.WaitGroup
-			for _, toolCall := range response.Choices[0].Message.ToolCalls {
-				messages = append(messages, openAIMessage{
-					Role:       roleTool,
-					Content:    nil,
-					Refusal:    nil,
-					ToolCalls:  nil,
-					ToolCallID: toolCall.ID,
-				})
-				result := &messages[len(messages)-1]
+func (o *OpenAITextProvider) batchResponse(ctx context.Context, result openAIBatchResult) TextBatchResponse {
+	r := TextBatchResponse{
+		ID:      result.CustomID,
+		Content: "",
+		Err:     nil,
+	}
 
-				toolCtx := ctx
-				var toolMessage *TextRecorderMessage
-				if callRecorder != nil {
-					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolCall.ID)
-				}
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					o.callToolWrapper(toolCtx, apiRequest, toolCall, result, callRecorder, toolMessage)
-				}()
-			}
+	if result.Error != nil {
+		r.Err = errors.WithDetails(
+			ErrAPIResponseError,
+			"body", result.Error,
+		)
+		return r
+	}
+	if result.Response == nil {
+		r.Err = errors.Errorf("%w: missing response", ErrUnexpectedMessage)
+		return r
+	}
 
-			wg.Wait()
+	apiRequest := result.Response.RequestID
 
-			continue
-		}
+	if result.Response.StatusCode != http.StatusOK {
+		r.Err = errors.WithDetails(
+			ErrAPIResponseError,
+			"code", result.Response.StatusCode,
+			"body", string(result.Response.Body),
+			"apiRequest", apiRequest,
+		)
+		return r
+	}
 
-		if response.Choices[0].FinishReason != stopReason {
-			return "", errors.WithDetails(
-				ErrUnexpectedStop,
-				"reason", response.Choices[0].FinishReason,
-				"apiRequest", apiRequest,
-			)
-		}
+	var response openAIResponse
+	errE := x.Unmarshal(result.Response.Body, &response)
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		r.Err = errE
+		return r
+	}
 
-		if response.Choices[0].Message.Refusal != nil {
-			return "", errors.WithDetails(
-				ErrRefused,
-				"refusal", *response.Choices[0].Message.Refusal,
-				"apiRequest", apiRequest,
-			)
-		}
+	if len(response.Choices) != 1 {
+		errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+		errors.Details(errE)["number"] = len(response.Choices)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		r.Err = errE
+		return r
+	}
 
-		if response.Choices[0].Message.Content == nil {
-			errE := errors.Errorf("%w: message content is nil", ErrUnexpectedMessageType)
-			errors.Details(errE)["apiRequest"] = apiRequest
-			return "", errE
-		}
+	chat := o.openAIChat()
+	usedTokens := chat.usedTokens(response.Usage)
+	chargeBudget(ctx, o, true, usedTokens)
+
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder := recorder.newBatchCall(ctx, identifier.New().String(), o)
+		callRecorder.setUsedTokens(apiRequest, usedTokens)
+		chat.recordMessage(callRecorder, response.Choices[0].Message)
+		recorder.recordCall(callRecorder)
+	}
 
-		return *response.Choices[0].Message.Content, nil
+	if response.Choices[0].Message.Role != roleAssistant {
+		r.Err = errors.WithDetails(
+			ErrUnexpectedRole,
+			"role", response.Choices[0].Message.Role,
+			"apiRequest", apiRequest,
+		)
+		return r
 	}
 
-	return "", errors.WithDetails(
-		ErrMaxExchangesReached,
-		"maxExchanges", o.MaxExchanges,
-	)
+	r.Content, r.Err = openAIContent(response.Choices[0], apiRequest)
+	return r
+}
+
+// batchRequest makes a request to the batch API. If output is *[]byte,
+// the response body is stored into it as-is, otherwise it is decoded as JSON.
+func (o *OpenAITextProvider) batchRequest(ctx context.Context, method, u, contentType string, body []byte, output any) errors.E {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+o.APIKey)
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	setHeaders(req, o.Headers)
+
+	data, apiRequest, errE := doBatchRequest(o.Client, req, "X-Request-Id")
+	if errE != nil {
+		return errE
+	}
+
+	if b, ok := output.(*[]byte); ok {
+		*b = data
+		return nil
+	}
+
+	errE = x.Unmarshal(data, output)
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return errE
+	}
+
+	return nil
 }
 
 // InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
@@ -608,7 +1059,9 @@ func (o *OpenAITextProvider) InitTools(ctx context.Context, tools map[string]Tex
 	}
 	o.tools = []openAITool{}
 
-	for name, tool := range tools {
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
 		errE := tool.Init(ctx)
 		if errE != nil {
 			errors.Details(errE)["name"] = name
@@ -629,97 +1082,3 @@ func (o *OpenAITextProvider) InitTools(ctx context.Context, tools map[string]Tex
 
 	return nil
 }
-
-func (o *OpenAITextProvider) estimatedTokens(messages []openAIMessage) (int, int) {
-	// We estimate inputTokens from training messages (including system message) by
-	// dividing number of characters by 4.
-	inputTokens := 0
-	for _, message := range messages {
-		if message.Content != nil {
-			inputTokens += len(*message.Content) / 4 //nolint:mnd
-			for _, tool := range message.ToolCalls {
-				inputTokens += len(tool.Function.Name) / 4      //nolint:mnd
-				inputTokens += len(tool.Function.Arguments) / 4 //nolint:mnd
-			}
-		}
-	}
-	for _, tool := range o.tools {
-		inputTokens += len(tool.Function.Name) / 4            //nolint:mnd
-		inputTokens += len(tool.Function.Description) / 4     //nolint:mnd
-		inputTokens += len(tool.Function.InputJSONSchema) / 4 //nolint:mnd
-	}
-	return inputTokens, 0
-}
-
-func (o *OpenAITextProvider) callToolWrapper( //nolint:dupl
-	ctx context.Context, apiRequest string, toolCall openAIToolCall, result *openAIMessage, callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
-) {
-	if callRecorder != nil {
-		defer func() {
-			callRecorder.notify("", nil)
-		}()
-	}
-
-	defer func() {
-		if err := recover(); err != nil {
-			content := fmt.Sprintf("Error: %s", err)
-			result.Content = &content
-
-			toolMessage.setContent(content, true)
-		}
-	}()
-
-	defer func() {
-		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
-	}()
-
-	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.ID).Logger()
-	ctx = logger.WithContext(ctx)
-
-	output, duration, errE := o.callTool(ctx, toolCall)
-	if errE != nil {
-		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Function.Name).Str("apiRequest", apiRequest).
-			Str("tool", toolCall.ID).RawJSON("input", json.RawMessage(toolCall.Function.Arguments)).Msg("tool error")
-		content := "Error: " + errE.Error()
-		result.Content = &content
-
-		toolMessage.setContent(content, true)
-	} else {
-		result.Content = &output
-
-		toolMessage.setContent(output, false)
-	}
-
-	toolMessage.setToolDuration(duration)
-}
-
-func (o *OpenAITextProvider) callTool(ctx context.Context, toolCall openAIToolCall) (string, Duration, errors.E) {
-	var tool TextTooler
-	for _, t := range o.tools {
-		if t.Function.Name == toolCall.Function.Name {
-			tool = t.tool
-			break
-		}
-	}
-	if tool == nil {
-		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolCall.Function.Name)
-	}
-
-	start := time.Now()
-	output, errE := tool.Call(ctx, json.RawMessage(toolCall.Function.Arguments))
-	duration := time.Since(start)
-	return output, Duration(duration), errE
-}
-
-func (o *OpenAITextProvider) recordMessage(recorder *TextRecorderCall, message openAIMessage) {
-	if message.Role == roleTool {
-		panic(errors.New("recording tool result message should not happen"))
-	} else if message.Content != nil {
-		recorder.addMessage(message.Role, *message.Content, "", "", false)
-	} else if message.Refusal != nil {
-		recorder.addMessage(message.Role, *message.Refusal, "", "", true)
-	}
-	for _, tool := range message.ToolCalls {
-		recorder.addMessage(roleToolUse, tool.Function.Arguments, tool.ID, tool.Function.Name, false)
-	}
-}
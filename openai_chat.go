@@ -0,0 +1,510 @@
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// openAIChat implements chat with tool calling for providers which use
+// OpenAI chat completions API or an API compatible with it.
+//
+// Providers differ in how they are reached and how they report errors,
+// which is configured through its fields.
+type openAIChat struct {
+	// provider is the provider used for recording, tracing, metrics, and budgets.
+	provider          TextProvider
+	client            *http.Client
+	maxContextLength  int
+	maxResponseLength int
+	maxExchanges      int
+	messages          []openAIMessage
+	tools             []openAITool
+
+	// attributes are span attributes describing the request.
+	attributes []attribute.KeyValue
+
+	// url is the URL of the chat completions endpoint.
+	url string
+
+	// setHeaders sets authentication and extra headers on the request.
+	setHeaders func(req *http.Request)
+
+	// rateLimiter rate limits the initial request under rateLimiterKey.
+	// It is nil if the API is not rate limited.
+	rateLimiter    *keyedRateLimiter
+	rateLimiterKey string
+
+	// newRequest returns the request body for messages. If stream is true,
+	// the response should be streamed.
+	newRequest func(messages []openAIMessage, stream bool) any
+
+	// requestID returns the request ID from response headers. It is nil
+	// if the API does not provide the request ID header.
+	requestID func(resp *http.Response) string
+
+	// requireRequestID set to true means that the response must have the request ID.
+	// Otherwise the response ID is used as the request ID.
+	requireRequestID bool
+
+	// responseError returns an error for a non-successful response. If it is nil,
+	// the response is decoded and the error in the response is returned.
+	responseError func(resp *http.Response) errors.E
+}
+
+func (c *openAIChat) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newCall(ctx, callID, c.provider)
+		defer recorder.recordCall(callRecorder)
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	stream := newTextStream(callRecorder, fn)
+
+	messages, errE := c.conversationMessages(conversation)
+	if errE != nil {
+		return "", errE
+	}
+
+	if callRecorder != nil {
+		for _, message := range messages {
+			c.recordMessage(callRecorder, message)
+		}
+
+		callRecorder.notify("", nil)
+	}
+
+	for range c.maxExchanges {
+		response, apiRequest, apiCallDuration, errE := c.send(ctx, messages, stream)
+		if errE != nil {
+			return "", errE
+		}
+
+		if len(response.Choices) != 1 {
+			errE := errors.Errorf("%w: not just one response", ErrUnexpectedMessage)
+			errors.Details(errE)["number"] = len(response.Choices)
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return "", errE
+		}
+
+		if callRecorder != nil {
+			callRecorder.setUsedTokens(apiRequest, c.usedTokens(response.Usage))
+			callRecorder.addUsedTime(
+				apiRequest,
+				0,
+				0,
+				apiCallDuration,
+			)
+
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
+			c.recordMessage(callRecorder, response.Choices[0].Message)
+
+			callRecorder.notify("", nil)
+		}
+
+		if stream != nil {
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: c.usedTokens(response.Usage),
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		if response.Usage.TotalTokens >= c.maxContextLength {
+			errE := errors.WithDetails(
+				ErrUnexpectedNumberOfTokens,
+				"prompt", response.Usage.PromptTokens,
+				"response", response.Usage.CompletionTokens,
+				"total", response.Usage.TotalTokens,
+				"maxTotal", c.maxContextLength,
+				"maxResponse", c.maxResponseLength,
+				"apiRequest", apiRequest,
+			)
+			if response.Choices[0].Message.Content != nil {
+				errors.Details(errE)["content"] = *response.Choices[0].Message.Content
+			}
+			return "", errE
+		}
+
+		if response.Choices[0].Message.Role != roleAssistant {
+			return "", errors.WithDetails(
+				ErrUnexpectedRole,
+				"role", response.Choices[0].Message.Role,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		if response.Choices[0].FinishReason == "tool_calls" || len(response.Choices[0].Message.ToolCalls) > 0 {
+			// Some APIs report "stop" finish reason even when there are tool calls.
+			if len(response.Choices[0].Message.ToolCalls) == 0 {
+				errE := errors.Errorf("%w: expected tool calls", ErrUnexpectedMessage)
+				errors.Details(errE)["number"] = len(response.Choices[0].Message.ToolCalls)
+				errors.Details(errE)["apiRequest"] = apiRequest
+				return "", errE
+			}
+
+			// We have already recorded this message above.
+			messages = append(messages, response.Choices[0].Message)
+
+			// We make space for tool results (one per tool call) so that the messages slice
+			// does not grow when appending below and invalidate pointers goroutines keep.
+			messages = slices.Grow(messages, len(response.Choices[0].Message.ToolCalls))
+
+			if callRecorder != nil {
+				// We grow the slice inside call recorder as well.
+				callRecorder.prepareForToolMessages(len(response.Choices[0].Message.ToolCalls))
+			}
+
+			var wg sync.WaitGroup
+			for _, toolCall := range response.Choices[0].Message.ToolCalls {
+				messages = append(messages, openAIMessage{
+					Role:       roleTool,
+					Content:    nil,
+					Refusal:    nil,
+					ToolCalls:  nil,
+					ToolCallID: toolCall.ID,
+					isError:    false,
+					parts:      nil,
+				})
+				result := &messages[len(messages)-1]
+
+				toolCtx := ctx
+				var toolMessage *TextRecorderMessage
+				if callRecorder != nil {
+					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolCall.ID)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.callToolWrapper(toolCtx, apiRequest, toolCall, result, callRecorder, toolMessage)
+				}()
+			}
+
+			wg.Wait()
+
+			if stream != nil {
+				for _, result := range messages[len(messages)-len(response.Choices[0].Message.ToolCalls):] {
+					var content string
+					if result.Content != nil {
+						content = *result.Content
+					}
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    content,
+						ToolUseID:  result.ToolCallID,
+						IsError:    result.isError,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
+			continue
+		}
+
+		return openAIContent(response.Choices[0], apiRequest)
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", c.maxExchanges,
+	)
+}
+
+// conversationMessages returns messages provided to Init followed by the conversation.
+func (c *openAIChat) conversationMessages(conversation []ChatMessage) ([]openAIMessage, errors.E) {
+	messages := slices.Clone(c.messages)
+	for _, message := range conversation {
+		m, errE := newOpenAIMessage(message)
+		if errE != nil {
+			return nil, errE
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+func (c *openAIChat) send(
+	ctx context.Context, messages []openAIMessage, stream func(event TextStreamEvent) errors.E,
+) (_ *openAIResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, c.provider, c.attributes...)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(c.provider)
+
+	request, errE := x.MarshalWithoutEscapeHTML(c.newRequest(messages, stream != nil))
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := c.estimatedTokens(messages)
+
+	reservation, errE := reserveBudget(ctx, c.provider, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		c.url,
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	c.setHeaders(req)
+	if c.rateLimiter != nil {
+		// Rate limit the initial request.
+		errE = c.rateLimiter.Take(ctx, c.rateLimiterKey, map[string]int{
+			"rpm": 1,
+			"tpm": estimatedInputTokens,
+		})
+		if errE != nil {
+			return nil, "", 0, errE
+		}
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil && c.requestID != nil {
+		apiRequest = c.requestID(resp)
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if c.requireRequestID && apiRequest == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, "", 0, errors.WithDetails(ErrMissingRequestID, "body", string(body))
+	}
+
+	if resp.StatusCode != http.StatusOK && c.responseError != nil {
+		errE := c.responseError(resp)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+
+	var response openAIResponse
+	if stream != nil && isEventStream(resp) {
+		errE = decodeOpenAIStream(resp.Body, apiRequest, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+
+	// Not all APIs provide a request ID header, so we fallback to the response ID.
+	if apiRequest == "" {
+		apiRequest = response.ID
+		if apiRequest == "" {
+			apiRequest = identifier.New().String()
+		}
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, apiRequest, 0, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	usedTokens := c.usedTokens(response.Usage)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	finishReasons := []string{}
+	for _, choice := range response.Choices {
+		finishReasons = append(finishReasons, choice.FinishReason)
+	}
+	span.SetAttributes(
+		semconv.GenAIResponseID(response.ID),
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIResponseFinishReasons(finishReasons...),
+		semconv.GenAIUsageInputTokens(response.Usage.PromptTokens),
+		semconv.GenAIUsageOutputTokens(response.Usage.CompletionTokens),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+func (c *openAIChat) usedTokens(usage openAIUsage) *TextRecorderUsedTokens {
+	var cacheReadInputTokens *int
+	if usage.PromptTokensDetails.CachedTokens != 0 {
+		cacheReadInputTokens = &usage.PromptTokensDetails.CachedTokens
+	}
+	var reasoningTokens *int
+	if usage.CompletionTokensDetails.ReasoningTokens != 0 {
+		reasoningTokens = &usage.CompletionTokensDetails.ReasoningTokens
+	}
+	return newUsedTokens(
+		c.maxContextLength,
+		c.maxResponseLength,
+		usage.PromptTokens,
+		usage.CompletionTokens,
+		nil,
+		cacheReadInputTokens,
+		reasoningTokens,
+	)
+}
+
+func (c *openAIChat) estimatedTokens(messages []openAIMessage) (int, int) {
+	// We estimate inputTokens from training messages (including system message) by
+	// dividing number of characters by 4.
+	inputTokens := 0
+	for _, message := range messages {
+		for _, part := range message.parts {
+			if part.Type == typeText {
+				inputTokens += len(part.Text) / 4 //nolint:mnd
+			} else {
+				inputTokens += estimatedPartTokens
+			}
+		}
+		if message.Content != nil {
+			inputTokens += len(*message.Content) / 4 //nolint:mnd
+			for _, tool := range message.ToolCalls {
+				inputTokens += len(tool.Function.Name) / 4      //nolint:mnd
+				inputTokens += len(tool.Function.Arguments) / 4 //nolint:mnd
+			}
+		}
+	}
+	for _, tool := range c.tools {
+		inputTokens += len(tool.Function.Name) / 4            //nolint:mnd
+		inputTokens += len(tool.Function.Description) / 4     //nolint:mnd
+		inputTokens += len(tool.Function.InputJSONSchema) / 4 //nolint:mnd
+	}
+	return inputTokens, 0
+}
+
+func (c *openAIChat) callToolWrapper( //nolint:dupl
+	ctx context.Context, apiRequest string, toolCall openAIToolCall, result *openAIMessage, callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+) {
+	if callRecorder != nil {
+		defer func() {
+			callRecorder.notify("", nil)
+		}()
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Function.Name).Inc()
+
+			content := fmt.Sprintf("Error: %s", err)
+			result.Content = &content
+			result.isError = true
+
+			toolMessage.setContent(content, true)
+		}
+	}()
+
+	defer func() {
+		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
+	}()
+
+	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.ID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startToolSpan(ctx, toolCall.Function.Name, toolCall.ID)
+	defer span.End()
+
+	output, duration, errE := c.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Function.Name, duration, errE)
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Function.Name).Str("apiRequest", apiRequest).
+			Str("tool", toolCall.ID).RawJSON("input", json.RawMessage(toolCall.Function.Arguments)).Msg("tool error")
+		content := "Error: " + errE.Error()
+		result.Content = &content
+		result.isError = true
+
+		toolMessage.setContent(content, true)
+	} else {
+		result.Content = &output
+
+		toolMessage.setContent(output, false)
+	}
+
+	toolMessage.setToolDuration(duration)
+}
+
+func (c *openAIChat) callTool(ctx context.Context, toolCall openAIToolCall) (string, Duration, errors.E) {
+	var tool TextTooler
+	for _, t := range c.tools {
+		if t.Function.Name == toolCall.Function.Name {
+			tool = t.tool
+			break
+		}
+	}
+	if tool == nil {
+		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolCall.Function.Name)
+	}
+
+	start := time.Now()
+	output, errE := tool.Call(ctx, json.RawMessage(toolCall.Function.Arguments))
+	duration := time.Since(start)
+	return output, Duration(duration), errE
+}
+
+func (c *openAIChat) recordMessage(recorder *TextRecorderCall, message openAIMessage) {
+	if message.Role == roleTool {
+		panic(errors.New("recording tool result message should not happen"))
+	} else if len(message.parts) > 0 {
+		for _, part := range message.parts {
+			recorder.addPart(message.Role, part)
+		}
+	} else if message.Content != nil {
+		recorder.addMessage(message.Role, *message.Content, "", "", false)
+	} else if message.Refusal != nil {
+		recorder.addMessage(message.Role, *message.Refusal, "", "", true)
+	}
+	for _, tool := range message.ToolCalls {
+		recorder.addMessage(roleToolUse, tool.Function.Arguments, tool.ID, tool.Function.Name, false)
+	}
+}
@@ -0,0 +1,535 @@
+//nolint:tagliatelle
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+var openAICompatibleRateLimiter = keyedRateLimiter{ //nolint:gochecknoglobals
+	name:     "openai-compatible",
+	mu:       sync.RWMutex{},
+	limiters: map[string]map[string]any{},
+}
+
+type openAICompatibleRequest struct {
+	Messages        []openAIMessage       `json:"messages"`
+	Model           string                `json:"model"`
+	Seed            *int                  `json:"seed,omitempty"`
+	Temperature     float64               `json:"temperature"`
+	MaxTokens       int                   `json:"max_tokens,omitempty"`
+	ReasoningEffort *string               `json:"reasoning_effort,omitempty"`
+	ResponseFormat  *openAIResponseFormat `json:"response_format,omitempty"`
+	Tools           []openAITool          `json:"tools,omitempty"`
+	Stream          bool                  `json:"stream,omitempty"`
+	StreamOptions   *openAIStreamOptions  `json:"stream_options,omitempty"`
+}
+
+// openAICompatibleModel is a model as listed by the models endpoint.
+// Different servers report context length using different fields.
+type openAICompatibleModel struct {
+	ID string `json:"id"`
+
+	// Used by OpenRouter and Together.
+	ContextLength int `json:"context_length"`
+	// Used by vLLM.
+	MaxModelLen int `json:"max_model_len"`
+	// Used by Mistral and LM Studio.
+	MaxContextLength int `json:"max_context_length"`
+	// Used by Groq.
+	ContextWindow       int `json:"context_window"`
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+	// Used by llama.cpp server.
+	Meta *struct {
+		NCtxTrain int `json:"n_ctx_train"`
+	} `json:"meta,omitempty"`
+	// Used by OpenRouter.
+	TopProvider *struct {
+		MaxCompletionTokens *int `json:"max_completion_tokens"`
+	} `json:"top_provider,omitempty"`
+}
+
+type openAICompatibleModels struct {
+	Data []openAICompatibleModel `json:"data"`
+}
+
+var (
+	_ TextProvider         = (*OpenAICompatibleTextProvider)(nil)
+	_ WithStreaming        = (*OpenAICompatibleTextProvider)(nil)
+	_ WithConversation     = (*OpenAICompatibleTextProvider)(nil)
+	_ WithOutputJSONSchema = (*OpenAICompatibleTextProvider)(nil)
+	_ WithTools            = (*OpenAICompatibleTextProvider)(nil)
+	_ typedProvider        = (*OpenAICompatibleTextProvider)(nil)
+)
+
+// OpenAICompatibleTextProvider is a [TextProvider] which provides integration with
+// text-based AI models served by any API compatible with OpenAI chat completions API,
+// e.g., vLLM, llama.cpp server, LM Studio, Together, DeepSeek, Mistral, or OpenRouter.
+//
+// Such APIs differ in which features they support, so they have to be enabled explicitly.
+type OpenAICompatibleTextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key to be used for API calls. If not provided,
+	// no API key is sent.
+	APIKey string `json:"-"`
+
+	// BaseURL is the base URL of the API, e.g., "http://localhost:8000/v1".
+	// Endpoints (e.g., "/chat/completions") are appended to it.
+	BaseURL string `json:"baseUrl"`
+
+	// AuthHeader is the name of the HTTP header used to send the API key.
+	// Default is "Authorization" in which case the API key is sent as a bearer token.
+	// Otherwise the API key is sent as-is.
+	AuthHeader string `json:"authHeader,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the name of the model to be used.
+	Model string `json:"model"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, it is obtained from the models endpoint, if the API reports it.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, it is obtained
+	// from the models endpoint, if the API reports it. Otherwise the maximum number
+	// of tokens is not sent and the API's default is used.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// SupportsJSONSchema set to true means that the API supports "json_schema"
+	// response format. The output JSON Schema is then passed to the API to force
+	// the AI model's output to conform to it.
+	SupportsJSONSchema bool `json:"supportsJsonSchema"`
+
+	// SupportsStrictTools set to true means that the API supports strict
+	// function calling, which forces tool inputs to conform to their JSON Schemas.
+	SupportsStrictTools bool `json:"supportsStrictTools"`
+
+	// SupportsSeed set to true means that the API supports the seed parameter.
+	// Seed is sent only then.
+	SupportsSeed bool `json:"supportsSeed"`
+
+	// SupportsReasoningEffort set to true means that the API supports the
+	// reasoning effort parameter. ReasoningEffort is sent only then.
+	SupportsReasoningEffort bool `json:"supportsReasoningEffort"`
+
+	// ReasoningEffort is the reasoning effort to use for reasoning models.
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+
+	// Seed is used to control the randomness of the AI model. Default is 0.
+	Seed int `json:"seed"`
+
+	// Temperature is how creative should the AI model be.
+	// Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	rateLimiterKey              string
+	messages                    []openAIMessage
+	tools                       []openAITool
+	outputJSONSchema            json.RawMessage
+	outputJSONSchemaName        string
+	outputJSONSchemaDescription string
+}
+
+// MarshalJSON implements json.Marshaler interface for OpenAICompatibleTextProvider.
+func (o OpenAICompatibleTextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P OpenAICompatibleTextProvider
+	p := P(o)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "openai-compatible",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o OpenAICompatibleTextProvider) typeModel() (string, string) {
+	return "openai-compatible", o.Model
+}
+
+// parseOpenAICompatibleRateLimitHeaders parses rate limit headers in the same
+// format as OpenAI API uses. If headers use a different format, they are ignored.
+func parseOpenAICompatibleRateLimitHeaders(resp *http.Response) (int, int, int, int, time.Time, time.Time, bool, errors.E) {
+	limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens, ok, errE := parseRateLimitHeaders(resp)
+	if errE != nil {
+		return 0, 0, 0, 0, time.Time{}, time.Time{}, false, nil
+	}
+	return limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens, ok, nil
+}
+
+// Init implements [TextProvider] interface.
+func (o *OpenAICompatibleTextProvider) Init(ctx context.Context, messages []ChatMessage) errors.E {
+	if o.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.messages = []openAIMessage{}
+
+	for _, message := range messages {
+		m, errE := newOpenAIMessage(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, m)
+	}
+
+	if o.BaseURL == "" {
+		return errors.New("BaseURL not set")
+	}
+
+	o.rateLimiterKey = fmt.Sprintf("%s-%s-%s", o.BaseURL, o.APIKey, o.Model)
+
+	if o.Client == nil {
+		o.Client = newClient(
+			func(req *http.Request) error {
+				// The models endpoint is not rate limited.
+				if strings.HasSuffix(req.URL.Path, "/chat/completions") {
+					reqCtx := req.Context()
+					estimatedInputTokens, _ := getEstimatedTokens(reqCtx)
+					// Rate limit retries.
+					return openAICompatibleRateLimiter.Take(reqCtx, o.rateLimiterKey, map[string]int{
+						"rpm": 1,
+						"tpm": estimatedInputTokens,
+					})
+				}
+				return nil
+			},
+			parseOpenAICompatibleRateLimitHeaders,
+			func(limitRequests, limitTokens, remainingRequests, remainingTokens int, resetRequests, resetTokens time.Time) {
+				openAICompatibleRateLimiter.Set(o.rateLimiterKey, map[string]any{
+					"rpm": resettingRateLimit{
+						Limit:     limitRequests,
+						Remaining: remainingRequests,
+						Window:    time.Minute,
+						Resets:    resetRequests,
+					},
+					"tpm": resettingRateLimit{
+						Limit:     limitTokens,
+						Remaining: remainingTokens,
+						Window:    time.Minute,
+						Resets:    resetTokens,
+					},
+				})
+			},
+		)
+	}
+
+	if o.MaxContextLength == 0 || o.MaxResponseLength == 0 {
+		model, errE := o.getModel(ctx)
+		if errE != nil {
+			return errE
+		}
+		if model != nil {
+			if o.MaxContextLength == 0 {
+				o.MaxContextLength = openAICompatibleMaxContextLength(model)
+			}
+			if o.MaxResponseLength == 0 {
+				o.MaxResponseLength = openAICompatibleMaxResponseLength(model)
+			}
+		}
+	}
+
+	if o.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	if o.MaxExchanges == 0 {
+		o.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// getModel returns the model from the models endpoint. It returns nil if the
+// API does not provide the models endpoint or the model is not listed.
+func (o *OpenAICompatibleTextProvider) getModel(ctx context.Context) (*openAICompatibleModel, errors.E) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL(o.BaseURL, "", "/models"), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	o.setHeaders(req)
+	// This endpoint does not have rate limiting.
+	resp, err := o.Client.Do(req)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("X-Request-Id")
+	}
+	if err != nil {
+		errE := errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		// The API does not provide the models endpoint.
+		return nil, nil //nolint:nilnil
+	}
+
+	var models openAICompatibleModels
+	errE := x.DecodeJSON(resp.Body, &models)
+	if errE != nil {
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, errE
+	}
+
+	for _, model := range models.Data {
+		if model.ID == o.Model {
+			return &model, nil
+		}
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+func openAICompatibleMaxContextLength(model *openAICompatibleModel) int {
+	for _, length := range []int{model.ContextLength, model.MaxModelLen, model.MaxContextLength, model.ContextWindow} {
+		if length > 0 {
+			return length
+		}
+	}
+	if model.Meta != nil {
+		return model.Meta.NCtxTrain
+	}
+	return 0
+}
+
+func openAICompatibleMaxResponseLength(model *openAICompatibleModel) int {
+	if model.MaxCompletionTokens > 0 {
+		return model.MaxCompletionTokens
+	}
+	if model.TopProvider != nil && model.TopProvider.MaxCompletionTokens != nil {
+		return *model.TopProvider.MaxCompletionTokens
+	}
+	return 0
+}
+
+// setHeaders sets authentication and extra headers on the request.
+func (o *OpenAICompatibleTextProvider) setHeaders(req *http.Request) {
+	if o.APIKey != "" {
+		if o.AuthHeader == "" || http.CanonicalHeaderKey(o.AuthHeader) == "Authorization" {
+			req.Header.Add("Authorization", "Bearer "+o.APIKey)
+		} else {
+			req.Header.Add(o.AuthHeader, o.APIKey)
+		}
+	}
+	setHeaders(req, o.Headers)
+}
+
+// Chat implements [TextProvider] interface.
+func (o *OpenAICompatibleTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (o *OpenAICompatibleTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (o *OpenAICompatibleTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *OpenAICompatibleTextProvider) ChatConversationStream(
+	ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E,
+) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
+
+func (o *OpenAICompatibleTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.openAIChat().chat(ctx, conversation, fn)
+}
+
+// openAIChat returns chat completions API configuration for the provider.
+func (o *OpenAICompatibleTextProvider) openAIChat() *openAIChat {
+	attrs := []attribute.KeyValue{
+		semconv.GenAIRequestTemperature(o.Temperature),
+	}
+	if o.MaxResponseLength != 0 {
+		attrs = append(attrs, semconv.GenAIRequestMaxTokens(o.MaxResponseLength))
+	}
+	if o.SupportsSeed {
+		attrs = append(attrs, semconv.GenAIRequestSeed(o.Seed))
+	}
+	return &openAIChat{
+		provider:          o,
+		client:            o.Client,
+		maxContextLength:  o.MaxContextLength,
+		maxResponseLength: o.MaxResponseLength,
+		maxExchanges:      o.MaxExchanges,
+		messages:          o.messages,
+		tools:             o.tools,
+		attributes:        attrs,
+		url:               apiURL(o.BaseURL, "", "/chat/completions"),
+		setHeaders:        o.setHeaders,
+		rateLimiter:       &openAICompatibleRateLimiter,
+		rateLimiterKey:    o.rateLimiterKey,
+		newRequest: func(messages []openAIMessage, stream bool) any {
+			return o.newRequest(messages, stream)
+		},
+		requestID: func(resp *http.Response) string {
+			return resp.Header.Get("X-Request-Id")
+		},
+		requireRequestID: false,
+		responseError: func(resp *http.Response) errors.E {
+			// Not all APIs respond with errors in the same format as OpenAI API, so we return the body as-is.
+			body, _ := io.ReadAll(resp.Body)
+			return errors.WithDetails(
+				ErrAPIResponseError,
+				"code", resp.StatusCode,
+				"body", string(body),
+			)
+		},
+	}
+}
+
+func (o *OpenAICompatibleTextProvider) newRequest(messages []openAIMessage, stream bool) openAICompatibleRequest {
+	oReq := openAICompatibleRequest{
+		Messages:        messages,
+		Model:           o.Model,
+		Seed:            nil,
+		Temperature:     o.Temperature,
+		MaxTokens:       o.MaxResponseLength,
+		ReasoningEffort: nil,
+		ResponseFormat:  nil,
+		Tools:           o.tools,
+		Stream:          false,
+		StreamOptions:   nil,
+	}
+
+	if stream {
+		oReq.Stream = true
+		oReq.StreamOptions = &openAIStreamOptions{
+			IncludeUsage: true,
+		}
+	}
+
+	if o.SupportsSeed {
+		oReq.Seed = &o.Seed
+	}
+
+	if o.SupportsReasoningEffort && o.ReasoningEffort != "" {
+		oReq.ReasoningEffort = &o.ReasoningEffort
+	}
+
+	if o.outputJSONSchema != nil {
+		oReq.ResponseFormat = &openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: openAIJSONSchema{
+				Description: o.outputJSONSchemaDescription,
+				Name:        o.outputJSONSchemaName,
+				Schema:      o.outputJSONSchema,
+				Strict:      true,
+			},
+		}
+	}
+
+	return oReq
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (o *OpenAICompatibleTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if !o.SupportsJSONSchema {
+		return nil
+	}
+
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if o.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.outputJSONSchema = schema
+
+	s, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	o.outputJSONSchemaName = getString(s, "title")
+	o.outputJSONSchemaDescription = getString(s, "description")
+
+	if o.outputJSONSchemaName == "" {
+		// The name is required, but unlike OpenAI API, APIs generally do not use it.
+		o.outputJSONSchemaName = "output"
+	}
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (o *OpenAICompatibleTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if o.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.tools = []openAITool{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		o.tools = append(o.tools, openAITool{
+			Type: "function",
+			Function: openAIFunction{
+				Name:            name,
+				Description:     tool.GetDescription(),
+				InputJSONSchema: tool.GetInputJSONSchema(),
+				Strict:          o.SupportsStrictTools,
+			},
+			tool: tool,
+		})
+	}
+
+	return nil
+}
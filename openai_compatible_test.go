@@ -0,0 +1,220 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+func TestOpenAICompatibleTextProvider(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewOpenAI(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				var request map[string]any
+				errE := x.Unmarshal(req.Body, &request)
+				if errE != nil {
+					return errE
+				}
+				assert.Empty(t, req.Header.Get("Authorization"))
+				assert.NotContains(t, request, "seed")
+				assert.NotContains(t, request, "reasoning_effort")
+				assert.InEpsilon(t, 1000, request["max_tokens"], 0)
+				assert.Equal(t, false, request["tools"].([]any)[0].(map[string]any)["function"].(map[string]any)["strict"]) //nolint:forcetypeassert
+				return nil
+			},
+			ToolCalls: []emulator.ToolCall{
+				{ID: "call_1", Name: "repeat_string", Input: json.RawMessage(`{"string":"foo"}`)},
+			},
+			PromptTokens:   100,
+			ResponseTokens: 10,
+		},
+		emulator.Response{Content: "foofoo", PromptTokens: 120, ResponseTokens: 5}, //nolint:exhaustruct
+		emulator.Response{StatusCode: http.StatusBadRequest},                       //nolint:exhaustruct
+	)
+	defer server.Close()
+
+	f := fun.Text[string, string]{
+		Provider: &fun.OpenAICompatibleTextProvider{ //nolint:exhaustruct
+			BaseURL:          server.URL + "/v1",
+			Model:            "local-model",
+			MaxContextLength: 8192,
+			// Ignored because SupportsReasoningEffort is false.
+			ReasoningEffort:   "low",
+			MaxResponseLength: 1000,
+		},
+		InputJSONSchema:  nil,
+		OutputJSONSchema: nil,
+		Prompt:           "Repeat the input twice.",
+		PromptTemplate:   "",
+		InputTemplate:    "",
+		Data:             nil,
+		Tools: map[string]fun.TextTooler{
+			"repeat_string": &fun.TextTool[toolStringInput, string]{
+				Description:      "Repeats the input twice, by concatenating the input string without any space.",
+				InputJSONSchema:  toolInputJSONSchema,
+				OutputJSONSchema: jsonSchemaString,
+				Fun: func(_ context.Context, input toolStringInput) (string, errors.E) {
+					return input.String + input.String, nil
+				},
+			},
+		},
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	ct := fun.WithTextRecorder(ctx)
+	output, errE := f.Call(ct, "foo")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foofoo", output)
+
+	calls := fun.GetTextRecorder(ct).Calls()
+	require.Len(t, calls, 1)
+	assert.Len(t, calls[0].UsedTokens, 2)
+
+	_, errE = f.Call(ctx, "foo")
+	assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+	assert.Equal(t, http.StatusBadRequest, errors.Details(errE)["code"])
+
+	assert.Equal(t, 0, server.Remaining())
+}
+
+func TestOpenAICompatibleTextProviderMaxTokens(t *testing.T) {
+	t.Parallel()
+
+	server := emulator.NewOpenAI(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				var request map[string]any
+				errE := x.Unmarshal(req.Body, &request)
+				if errE != nil {
+					return errE
+				}
+				// Without MaxResponseLength, the API's default is used.
+				assert.NotContains(t, request, "max_tokens")
+				return nil
+			},
+			Content:        "foo",
+			PromptTokens:   100,
+			ResponseTokens: 10,
+		},
+	)
+	defer server.Close()
+
+	provider := &fun.OpenAICompatibleTextProvider{ //nolint:exhaustruct
+		BaseURL:          server.URL + "/v1",
+		Model:            "local-model",
+		MaxContextLength: 8192,
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, 0, provider.MaxResponseLength)
+
+	output, errE := provider.Chat(ctx, fun.ChatMessage{Role: "user", Content: "foo"}) //nolint:exhaustruct
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "foo", output)
+
+	assert.Equal(t, 0, server.Remaining())
+}
+
+func TestOpenAICompatibleTextProviderModels(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name              string
+		Model             string
+		MaxContextLength  int
+		MaxResponseLength int
+	}{
+		{"vllm", `{"id":"test-model","object":"model","max_model_len":32768}`, 32768, 0},
+		{"openrouter", `{"id":"test-model","context_length":131072,"top_provider":{"max_completion_tokens":16384}}`, 131072, 16384},
+		{"llama.cpp", `{"id":"test-model","object":"model","meta":{"n_ctx_train":4096}}`, 4096, 0},
+		{"groq", `{"id":"test-model","context_window":131072,"max_completion_tokens":32768}`, 131072, 32768},
+		{"missing", `{"id":"other-model","context_length":1024}`, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/v1/models" || req.Header.Get("Api-Key") != "secret" {
+					http.NotFound(w, req)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"object":"list","data":[` + tt.Model + `]}`))
+			}))
+			defer server.Close()
+
+			provider := &fun.OpenAICompatibleTextProvider{ //nolint:exhaustruct
+				APIKey:     "secret",
+				BaseURL:    server.URL + "/v1",
+				AuthHeader: "api-key",
+				Model:      "test-model",
+			}
+
+			errE := provider.Init(t.Context(), nil)
+			if tt.MaxContextLength == 0 {
+				assert.EqualError(t, errE, "MaxContextLength not set")
+				return
+			}
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, tt.MaxContextLength, provider.MaxContextLength)
+			assert.Equal(t, tt.MaxResponseLength, provider.MaxResponseLength)
+		})
+	}
+}
+
+func TestOpenAICompatibleTextProviderModelsRetry(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/models" {
+			http.NotFound(w, req)
+			return
+		}
+		// The server is still starting for the first request.
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"test-model","object":"model","max_model_len":32768}]}`))
+	}))
+	defer server.Close()
+
+	// The default client is used, which retries the failed request.
+	provider := &fun.OpenAICompatibleTextProvider{ //nolint:exhaustruct
+		BaseURL: server.URL + "/v1",
+		Model:   "test-model",
+	}
+
+	errE := provider.Init(t.Context(), nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, 32768, provider.MaxContextLength)
+	assert.Equal(t, int32(2), requests.Load())
+}
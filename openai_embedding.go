@@ -0,0 +1,299 @@
+//nolint:tagliatelle
+package fun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+//nolint:mnd
+var openAIEmbeddingModels = map[string]struct { //nolint:gochecknoglobals
+	MaxContextLength int
+}{
+	"text-embedding-3-small": {
+		MaxContextLength: 8_191,
+	},
+	"text-embedding-3-large": {
+		MaxContextLength: 8_191,
+	},
+	"text-embedding-ada-002": {
+		MaxContextLength: 8_191,
+	},
+}
+
+type openAIEmbeddingRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format"`
+	Dimensions     int      `json:"dimensions,omitempty"`
+}
+
+type openAIEmbeddingResponse struct {
+	Object string `json:"object"`
+	Model  string `json:"model"`
+	Data   []struct {
+		Object    string    `json:"object"`
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *openAIError `json:"error,omitempty"`
+}
+
+var (
+	_ EmbeddingProvider = (*OpenAIEmbeddingProvider)(nil)
+	_ typedProvider     = (*OpenAIEmbeddingProvider)(nil)
+)
+
+// OpenAIEmbeddingProvider is an [EmbeddingProvider] which provides integration with
+// embedding-based [OpenAI] AI models.
+//
+// [OpenAI]: https://openai.com/
+type OpenAIEmbeddingProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key to be used for API calls.
+	APIKey string `json:"-"`
+
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://api.openai.com/v1".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the name of the model to be used.
+	Model string `json:"model"`
+
+	// MaxContextLength is the maximum number of tokens allowed to be used
+	// for each text with the underlying AI model. If not provided, heuristics
+	// are used to determine it automatically.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// Dimensions is the number of dimensions of returned embeddings.
+	// Not all models support it. If not provided, the model's default is used.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	rateLimiterKey string
+}
+
+// MarshalJSON implements json.Marshaler interface for OpenAIEmbeddingProvider.
+func (o OpenAIEmbeddingProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P OpenAIEmbeddingProvider
+	p := P(o)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "openai",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o OpenAIEmbeddingProvider) typeModel() (string, string) {
+	return "openai", o.Model
+}
+
+// Init implements [EmbeddingProvider] interface.
+func (o *OpenAIEmbeddingProvider) Init(_ context.Context) errors.E {
+	if o.rateLimiterKey != "" {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+
+	// Embedding models share rate limits with other models.
+	o.rateLimiterKey = fmt.Sprintf("%s-%s-%s", o.BaseURL, o.APIKey, o.Model)
+
+	if o.Client == nil {
+		o.Client = newOpenAIClient(o.rateLimiterKey)
+	}
+
+	if o.MaxContextLength == 0 {
+		o.MaxContextLength = openAIEmbeddingModels[o.Model].MaxContextLength
+	}
+	if o.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	return nil
+}
+
+// Embed implements [EmbeddingProvider] interface.
+func (o *OpenAIEmbeddingProvider) Embed(ctx context.Context, texts []string) (_ [][]float32, errE errors.E) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newEmbeddingCall(ctx, callID, o)
+		defer recorder.recordCall(callRecorder)
+
+		for _, text := range texts {
+			callRecorder.addMessage(roleUser, text, "", "", false)
+		}
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startAPIRequestSpan(ctx, operationEmbeddings, o)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(o)
+
+	request, errE := x.MarshalWithoutEscapeHTML(openAIEmbeddingRequest{
+		Model:          o.Model,
+		Input:          texts,
+		EncodingFormat: "float",
+		Dimensions:     o.Dimensions,
+	})
+	if errE != nil {
+		return nil, errE
+	}
+
+	// We estimate input tokens by dividing number of characters by 4.
+	estimatedInputTokens := 0
+	for _, text := range texts {
+		estimatedInputTokens += len(text) / 4 //nolint:mnd
+	}
+
+	reservation, errE := reserveBudget(ctx, o, estimatedInputTokens, 0)
+	if errE != nil {
+		return nil, errE
+	}
+	defer reservation.release()
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, 0), labels),
+		http.MethodPost,
+		apiURL(o.BaseURL, openAIBaseURL, "/embeddings"),
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+o.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, o.Headers)
+	// Rate limit the initial request.
+	errE = openAIRateLimiter.Take(ctx, o.rateLimiterKey, map[string]int{
+		"rpm": 1,
+		"tpm": estimatedInputTokens,
+	})
+	if errE != nil {
+		return nil, errE
+	}
+	start := time.Now()
+	resp, err := o.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("X-Request-Id")
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if apiRequest == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, errors.WithDetails(ErrMissingRequestID, "body", string(body))
+	}
+
+	var response openAIEmbeddingResponse
+	errE = x.DecodeJSON(resp.Body, &response)
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	usedTokens := newUsedTokens(
+		o.MaxContextLength,
+		0,
+		response.Usage.PromptTokens,
+		0,
+		nil,
+		nil,
+		nil,
+	)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	span.SetAttributes(
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIUsageInputTokens(response.Usage.PromptTokens),
+	)
+
+	if callRecorder != nil {
+		callRecorder.setUsedTokens(apiRequest, usedTokens)
+		callRecorder.addUsedTime(
+			apiRequest,
+			0,
+			0,
+			apiCallDuration,
+		)
+	}
+
+	if len(response.Data) != len(texts) {
+		errE := errors.Errorf("%w: unexpected number of embeddings", ErrUnexpectedMessage)
+		errors.Details(errE)["number"] = len(response.Data)
+		errors.Details(errE)["expected"] = len(texts)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, errE
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(embeddings) || embeddings[data.Index] != nil {
+			errE := errors.Errorf("%w: unexpected embedding index", ErrUnexpectedMessage)
+			errors.Details(errE)["index"] = data.Index
+			errors.Details(errE)["apiRequest"] = apiRequest
+			return nil, errE
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+
+	return embeddings, nil
+}
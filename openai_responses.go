@@ -0,0 +1,1028 @@
+//nolint:tagliatelle
+package fun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+	"gitlab.com/tozd/identifier"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+const (
+	typeOpenAIResponsesMessage            = "message"
+	typeOpenAIResponsesReasoning          = "reasoning"
+	typeOpenAIResponsesFunctionCall       = "function_call"
+	typeOpenAIResponsesFunctionCallOutput = "function_call_output"
+)
+
+type openAIResponsesContent struct {
+	Type        string          `json:"type"`
+	Text        *string         `json:"text,omitempty"`
+	Refusal     *string         `json:"refusal,omitempty"`
+	Annotations json.RawMessage `json:"annotations,omitempty"`
+	ImageURL    string          `json:"image_url,omitempty"`
+	Filename    string          `json:"filename,omitempty"`
+	FileData    string          `json:"file_data,omitempty"`
+}
+
+type openAIResponsesSummary struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// openAIResponsesItem is an input or output item of Responses API.
+// Only fields relevant to its type are set.
+type openAIResponsesItem struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// For "message" items.
+	Role    string                   `json:"role,omitempty"`
+	Content []openAIResponsesContent `json:"content,omitempty"`
+
+	// For "reasoning" items.
+	Summary          []openAIResponsesSummary `json:"summary,omitempty"`
+	EncryptedContent *string                  `json:"encrypted_content,omitempty"`
+
+	// For "function_call" and "function_call_output" items.
+	CallID    string  `json:"call_id,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Arguments string  `json:"arguments,omitempty"`
+	Output    *string `json:"output,omitempty"`
+
+	isError bool
+	// parts are used for recording, if set.
+	parts []ChatContentPart
+}
+
+// MarshalJSON implements json.Marshaler interface for openAIResponsesItem.
+func (i openAIResponsesItem) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type I openAIResponsesItem
+	if i.Type != typeOpenAIResponsesReasoning {
+		return x.MarshalWithoutEscapeHTML(I(i))
+	}
+	// Summary is required for reasoning items, even if empty.
+	summary := i.Summary
+	if summary == nil {
+		summary = []openAIResponsesSummary{}
+	}
+	t := struct {
+		I
+
+		Summary []openAIResponsesSummary `json:"summary"`
+	}{
+		I:       I(i),
+		Summary: summary,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+type openAIResponsesFunction struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+	Strict      bool            `json:"strict"`
+	tool        TextTooler
+}
+
+type openAIResponsesFormat struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      bool            `json:"strict"`
+}
+
+type openAIResponsesTextConfig struct {
+	Format openAIResponsesFormat `json:"format"`
+}
+
+type openAIResponsesReasoningConfig struct {
+	Effort  string `json:"effort"`
+	Summary string `json:"summary,omitempty"`
+}
+
+type openAIResponsesRequest struct {
+	Model           string                          `json:"model"`
+	Input           []openAIResponsesItem           `json:"input"`
+	MaxOutputTokens int                             `json:"max_output_tokens"`
+	Temperature     *float64                        `json:"temperature,omitempty"`
+	Reasoning       *openAIResponsesReasoningConfig `json:"reasoning,omitempty"`
+	Text            *openAIResponsesTextConfig      `json:"text,omitempty"`
+	Tools           []openAIResponsesFunction       `json:"tools,omitempty"`
+	Include         []string                        `json:"include,omitempty"`
+	Store           bool                            `json:"store"`
+	Stream          bool                            `json:"stream,omitempty"`
+}
+
+type openAIResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+type openAIResponsesResponse struct {
+	ID                string                `json:"id"`
+	Object            string                `json:"object"`
+	Status            string                `json:"status"`
+	Model             string                `json:"model"`
+	Output            []openAIResponsesItem `json:"output"`
+	Usage             openAIResponsesUsage  `json:"usage"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details,omitempty"`
+	Error *openAIError `json:"error,omitempty"`
+}
+
+type openAIResponsesStreamEvent struct {
+	Type     string                   `json:"type"`
+	Response *openAIResponsesResponse `json:"response,omitempty"`
+	Item     *openAIResponsesItem     `json:"item,omitempty"`
+	Delta    string                   `json:"delta,omitempty"`
+	Code     *string                  `json:"code,omitempty"`
+	Message  string                   `json:"message,omitempty"`
+}
+
+var (
+	_ TextProvider         = (*OpenAIResponsesTextProvider)(nil)
+	_ WithStreaming        = (*OpenAIResponsesTextProvider)(nil)
+	_ WithConversation     = (*OpenAIResponsesTextProvider)(nil)
+	_ WithOutputJSONSchema = (*OpenAIResponsesTextProvider)(nil)
+	_ WithTools            = (*OpenAIResponsesTextProvider)(nil)
+	_ typedProvider        = (*OpenAIResponsesTextProvider)(nil)
+)
+
+// OpenAIResponsesTextProvider is a [TextProvider] which provides integration with
+// text-based [OpenAI] AI models using Responses API.
+//
+// Unlike [OpenAITextProvider] which uses chat completions API, reasoning of reasoning
+// models is carried across exchanges with the AI model (e.g., when calling tools).
+// Responses are not stored by OpenAI, so reasoning is carried in encrypted form.
+//
+// [OpenAI]: https://openai.com/
+type OpenAIResponsesTextProvider struct {
+	// Client is a HTTP client to be used for API calls. If not provided
+	// a rate-limited retryable HTTP client is initialized instead.
+	Client *http.Client `json:"-"`
+
+	// APIKey is the API key to be used for API calls.
+	APIKey string `json:"-"`
+
+	// BaseURL is the base URL of the API, e.g., to use an API gateway or a proxy.
+	// Default is "https://api.openai.com/v1".
+	BaseURL string `json:"baseUrl,omitempty"`
+
+	// Headers are extra HTTP headers to be sent with API calls. They override
+	// default headers with the same name. They are not marshaled to JSON
+	// because they might contain secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Model is the name of the model to be used.
+	Model string `json:"model"`
+
+	// MaxContextLength is the maximum total number of tokens allowed to be used
+	// with the underlying AI model (i.e., the maximum context window).
+	// If not provided, heuristics are used to determine it automatically.
+	MaxContextLength int `json:"maxContextLength"`
+
+	// MaxResponseLength is the maximum number of tokens allowed to be used in
+	// a response with the underlying AI model. If not provided, heuristics
+	// are used to determine it automatically.
+	MaxResponseLength int `json:"maxResponseLength"`
+
+	// MaxExchanges is the maximum number of exchanges with the AI model per chat
+	// to obtain the final response. Default is 10.
+	MaxExchanges int `json:"maxExchanges"`
+
+	// ReasoningEffort is the reasoning effort to use for reasoning models.
+	// It has to be set when using reasoning models so that encrypted reasoning
+	// is included in responses and can be carried across exchanges.
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+
+	// ReasoningSummary is the level of detail of reasoning summaries which are
+	// recorded as thinking messages. Possible values are "auto", "concise",
+	// and "detailed". It is used only when ReasoningEffort is set. Default is "auto".
+	ReasoningSummary string `json:"reasoningSummary,omitempty"`
+
+	// ForceOutputJSONSchema when set to true requests the AI model to force
+	// the output JSON Schema for its output. When true, the JSON Schema must
+	// have "title" field to name the JSON Schema. The same limitations on
+	// the JSON Schema apply as with [OpenAITextProvider].
+	ForceOutputJSONSchema bool `json:"forceOutputJsonSchema"`
+
+	// Temperature is how creative should the AI model be.
+	// It is not sent when ReasoningEffort is set because reasoning models
+	// do not support it. Default is 0 which means not at all.
+	Temperature float64 `json:"temperature"`
+
+	rateLimiterKey              string
+	messages                    []openAIResponsesItem
+	tools                       []openAIResponsesFunction
+	outputJSONSchema            json.RawMessage
+	outputJSONSchemaName        string
+	outputJSONSchemaDescription string
+}
+
+// MarshalJSON implements json.Marshaler interface for OpenAIResponsesTextProvider.
+func (o OpenAIResponsesTextProvider) MarshalJSON() ([]byte, error) {
+	// We define a new type to not recurse into this same MarshalJSON.
+	type P OpenAIResponsesTextProvider
+	p := P(o)
+	p.Headers = nil
+	t := struct {
+		P
+
+		Type string `json:"type"`
+	}{
+		Type: "openai-responses",
+		P:    p,
+	}
+	return x.MarshalWithoutEscapeHTML(t)
+}
+
+// typeModel implements typedProvider interface.
+func (o OpenAIResponsesTextProvider) typeModel() (string, string) {
+	return "openai-responses", o.Model
+}
+
+// Init implements [TextProvider] interface.
+func (o *OpenAIResponsesTextProvider) Init(_ context.Context, messages []ChatMessage) errors.E {
+	if o.messages != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.messages = []openAIResponsesItem{}
+
+	for _, message := range messages {
+		item, errE := newOpenAIResponsesItem(message)
+		if errE != nil {
+			return errE
+		}
+		o.messages = append(o.messages, item)
+	}
+
+	// We share rate limits with OpenAITextProvider.
+	o.rateLimiterKey = fmt.Sprintf("%s-%s-%s", o.BaseURL, o.APIKey, o.Model)
+
+	if o.Client == nil {
+		o.Client = newOpenAIClient(o.rateLimiterKey)
+	}
+
+	if o.MaxContextLength == 0 {
+		o.MaxContextLength = openAIModels[o.Model].MaxContextLength
+	}
+	if o.MaxContextLength == 0 {
+		return errors.New("MaxContextLength not set")
+	}
+
+	if o.MaxResponseLength == 0 {
+		o.MaxResponseLength = openAIModels[o.Model].MaxResponseLength
+	}
+	if o.MaxResponseLength == 0 {
+		return errors.New("MaxResponseLength not set")
+	}
+
+	if o.MaxExchanges == 0 {
+		o.MaxExchanges = 10
+	}
+
+	return nil
+}
+
+// Chat implements [TextProvider] interface.
+func (o *OpenAIResponsesTextProvider) Chat(ctx context.Context, message ChatMessage) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, nil)
+}
+
+// ChatConversation implements [WithConversation] interface.
+func (o *OpenAIResponsesTextProvider) ChatConversation(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, nil)
+}
+
+// ChatStream implements [WithStreaming] interface.
+func (o *OpenAIResponsesTextProvider) ChatStream(ctx context.Context, message ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) {
+	return o.chat(ctx, []ChatMessage{message}, fn)
+}
+
+// ChatConversationStream implements [WithStreaming] interface.
+func (o *OpenAIResponsesTextProvider) ChatConversationStream(
+	ctx context.Context, messages []ChatMessage, fn func(event TextStreamEvent) errors.E,
+) (string, errors.E) {
+	if len(messages) == 0 {
+		return "", errors.WithStack(ErrNoMessages)
+	}
+	return o.chat(ctx, messages, fn)
+}
+
+func (o *OpenAIResponsesTextProvider) chat(ctx context.Context, conversation []ChatMessage, fn func(event TextStreamEvent) errors.E) (string, errors.E) { //nolint:maintidx
+	callID := identifier.New().String()
+
+	var callRecorder *TextRecorderCall
+	if recorder := GetTextRecorder(ctx); recorder != nil {
+		callRecorder = recorder.newCall(ctx, callID, o)
+		defer recorder.recordCall(callRecorder)
+	}
+
+	logger := zerolog.Ctx(ctx).With().Str("fun", callID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	stream := newTextStream(callRecorder, fn)
+
+	items := slices.Clone(o.messages)
+	for _, message := range conversation {
+		item, errE := newOpenAIResponsesItem(message)
+		if errE != nil {
+			return "", errE
+		}
+		items = append(items, item)
+	}
+
+	if callRecorder != nil {
+		for _, item := range items {
+			o.recordItem(callRecorder, item)
+		}
+
+		callRecorder.notify("", nil)
+	}
+
+	for range o.MaxExchanges {
+		response, apiRequest, apiCallDuration, errE := o.send(ctx, items, stream)
+		if errE != nil {
+			return "", errE
+		}
+
+		if callRecorder != nil {
+			callRecorder.setUsedTokens(apiRequest, o.usedTokens(response.Usage))
+			callRecorder.addUsedTime(
+				apiRequest,
+				0,
+				0,
+				apiCallDuration,
+			)
+
+			// We replace any streamed messages with the complete response.
+			callRecorder.discardStreamed()
+
+			for _, item := range response.Output {
+				o.recordItem(callRecorder, item)
+			}
+
+			callRecorder.notify("", nil)
+		}
+
+		if stream != nil {
+			errE := stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeUsage,
+				APIRequest: apiRequest,
+				UsedTokens: o.usedTokens(response.Usage),
+			})
+			if errE != nil {
+				return "", errE
+			}
+		}
+
+		if response.Usage.TotalTokens >= o.MaxContextLength {
+			return "", errors.WithDetails(
+				ErrUnexpectedNumberOfTokens,
+				"prompt", response.Usage.InputTokens,
+				"response", response.Usage.OutputTokens,
+				"total", response.Usage.TotalTokens,
+				"maxTotal", o.MaxContextLength,
+				"maxResponse", o.MaxResponseLength,
+				"apiRequest", apiRequest,
+			)
+		}
+
+		toolCalls := []openAIResponsesItem{}
+		for _, item := range response.Output {
+			if item.Type == typeOpenAIResponsesFunctionCall {
+				toolCalls = append(toolCalls, item)
+			}
+		}
+
+		if len(toolCalls) > 0 {
+			// We have already recorded these items above. Reasoning items
+			// are carried to the next exchange together with function calls.
+			items = append(items, response.Output...)
+
+			// We make space for tool results (one per tool call) so that the items slice
+			// does not grow when appending below and invalidate pointers goroutines keep.
+			items = slices.Grow(items, len(toolCalls))
+
+			if callRecorder != nil {
+				// We grow the slice inside call recorder as well.
+				callRecorder.prepareForToolMessages(len(toolCalls))
+			}
+
+			var wg sync.WaitGroup
+			for _, toolCall := range toolCalls {
+				items = append(items, openAIResponsesItem{ //nolint:exhaustruct
+					Type:   typeOpenAIResponsesFunctionCallOutput,
+					CallID: toolCall.CallID,
+				})
+				result := &items[len(items)-1]
+
+				toolCtx := ctx
+				var toolMessage *TextRecorderMessage
+				if callRecorder != nil {
+					toolCtx, toolMessage = callRecorder.startToolMessage(ctx, toolCall.CallID)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					o.callToolWrapper(toolCtx, apiRequest, toolCall, result, callRecorder, toolMessage)
+				}()
+			}
+
+			wg.Wait()
+
+			if stream != nil {
+				for _, result := range items[len(items)-len(toolCalls):] {
+					var content string
+					if result.Output != nil {
+						content = *result.Output
+					}
+					errE := stream(TextStreamEvent{ //nolint:exhaustruct
+						Type:       roleToolResult,
+						Content:    content,
+						ToolUseID:  result.CallID,
+						IsError:    result.isError,
+						APIRequest: apiRequest,
+					})
+					if errE != nil {
+						return "", errE
+					}
+				}
+			}
+
+			continue
+		}
+
+		return openAIResponsesText(response, apiRequest)
+	}
+
+	return "", errors.WithDetails(
+		ErrMaxExchangesReached,
+		"maxExchanges", o.MaxExchanges,
+	)
+}
+
+// openAIResponsesText returns the text of the final response.
+func openAIResponsesText(response *openAIResponsesResponse, apiRequest string) (string, errors.E) {
+	if response.Status != "completed" {
+		reason := response.Status
+		if response.IncompleteDetails != nil && response.IncompleteDetails.Reason != "" {
+			reason = response.IncompleteDetails.Reason
+		}
+		return "", errors.WithDetails(
+			ErrUnexpectedStop,
+			"reason", reason,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	var text strings.Builder
+	found := false
+	for _, item := range response.Output {
+		if item.Type != typeOpenAIResponsesMessage {
+			continue
+		}
+		found = true
+		for _, content := range item.Content {
+			switch {
+			case content.Refusal != nil:
+				return "", errors.WithDetails(
+					ErrRefused,
+					"refusal", *content.Refusal,
+					"apiRequest", apiRequest,
+				)
+			case content.Text != nil:
+				text.WriteString(*content.Text)
+			}
+		}
+	}
+
+	if !found {
+		errE := errors.Errorf("%w: message is missing", ErrUnexpectedMessageType)
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return "", errE
+	}
+
+	return text.String(), nil
+}
+
+func (o *OpenAIResponsesTextProvider) newRequest(items []openAIResponsesItem) openAIResponsesRequest {
+	oReq := openAIResponsesRequest{
+		Model:           o.Model,
+		Input:           items,
+		MaxOutputTokens: o.MaxResponseLength,
+		Temperature:     nil,
+		Reasoning:       nil,
+		Text:            nil,
+		Tools:           o.tools,
+		Include:         nil,
+		// We carry reasoning ourselves, so responses do not have to be stored.
+		Store:  false,
+		Stream: false,
+	}
+
+	if o.ReasoningEffort != "" {
+		summary := o.ReasoningSummary
+		if summary == "" {
+			summary = "auto"
+		}
+		oReq.Reasoning = &openAIResponsesReasoningConfig{
+			Effort:  o.ReasoningEffort,
+			Summary: summary,
+		}
+		oReq.Include = []string{"reasoning.encrypted_content"}
+	} else {
+		oReq.Temperature = &o.Temperature
+	}
+
+	if o.outputJSONSchema != nil {
+		oReq.Text = &openAIResponsesTextConfig{
+			Format: openAIResponsesFormat{
+				Type:        "json_schema",
+				Name:        o.outputJSONSchemaName,
+				Description: o.outputJSONSchemaDescription,
+				Schema:      o.outputJSONSchema,
+				Strict:      true,
+			},
+		}
+	}
+
+	return oReq
+}
+
+func (o *OpenAIResponsesTextProvider) send(
+	ctx context.Context, items []openAIResponsesItem, stream func(event TextStreamEvent) errors.E,
+) (_ *openAIResponsesResponse, _ string, _ time.Duration, errE errors.E) {
+	ctx, span := startAPIRequestSpan(ctx, operationChat, o,
+		semconv.GenAIRequestMaxTokens(o.MaxResponseLength),
+		semconv.GenAIRequestTemperature(o.Temperature),
+	)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	labels := metricsLabels(o)
+
+	oReq := o.newRequest(items)
+	oReq.Stream = stream != nil
+
+	request, errE := x.MarshalWithoutEscapeHTML(oReq)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+
+	estimatedInputTokens, estimatedOutputTokens := o.estimatedTokens(items)
+
+	reservation, errE := reserveBudget(ctx, o, estimatedInputTokens, estimatedOutputTokens)
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	defer reservation.release()
+
+	req, err := http.NewRequestWithContext(
+		withMetricsLabels(withEstimatedTokens(ctx, estimatedInputTokens, estimatedOutputTokens), labels),
+		http.MethodPost,
+		apiURL(o.BaseURL, openAIBaseURL, "/responses"),
+		bytes.NewReader(request),
+	)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+o.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+	setHeaders(req, o.Headers)
+	// Rate limit the initial request.
+	errE = openAIRateLimiter.Take(ctx, o.rateLimiterKey, map[string]int{
+		"rpm": 1,
+		"tpm": estimatedInputTokens,
+	})
+	if errE != nil {
+		return nil, "", 0, errE
+	}
+	start := time.Now()
+	resp, err := o.Client.Do(req)
+	metrics.apiRequest(labels, resp)
+	var apiRequest string
+	if resp != nil {
+		apiRequest = resp.Header.Get("X-Request-Id")
+		span.SetAttributes(apiRequestKey.String(apiRequest))
+	}
+	if err != nil {
+		errE = errors.Prefix(err, ErrAPIRequestFailed)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		return nil, apiRequest, 0, errE
+	}
+	defer resp.Body.Close()              //nolint:errcheck
+	defer io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		errE := errors.WithDetails(
+			ErrAPIResponseError,
+			"code", resp.StatusCode,
+		)
+		if apiRequest != "" {
+			errors.Details(errE)["apiRequest"] = apiRequest
+		}
+		var response openAIResponsesResponse
+		if x.Unmarshal(body, &response) == nil && response.Error != nil {
+			errors.Details(errE)["body"] = response.Error
+		} else {
+			errors.Details(errE)["body"] = string(body)
+		}
+		return nil, apiRequest, 0, errE
+	}
+
+	if apiRequest == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, "", 0, errors.WithDetails(ErrMissingRequestID, "body", string(body))
+	}
+
+	var response openAIResponsesResponse
+	if stream != nil && isEventStream(resp) {
+		errE = decodeOpenAIResponsesStream(resp.Body, apiRequest, &response, stream)
+	} else {
+		errE = x.DecodeJSON(resp.Body, &response)
+	}
+	if errE != nil {
+		errors.Details(errE)["apiRequest"] = apiRequest
+		return nil, apiRequest, 0, errE
+	}
+
+	apiCallDuration := time.Since(start)
+
+	if response.Error != nil {
+		return nil, apiRequest, 0, errors.WithDetails(
+			ErrAPIResponseError,
+			"body", response.Error,
+			"apiRequest", apiRequest,
+		)
+	}
+
+	usedTokens := o.usedTokens(response.Usage)
+	reservation.settle(usedTokens)
+	metrics.apiRequestDone(labels, apiCallDuration, usedTokens)
+
+	span.SetAttributes(
+		semconv.GenAIResponseID(response.ID),
+		semconv.GenAIResponseModel(response.Model),
+		semconv.GenAIResponseFinishReasons(response.Status),
+		semconv.GenAIUsageInputTokens(response.Usage.InputTokens),
+		semconv.GenAIUsageOutputTokens(response.Usage.OutputTokens),
+	)
+
+	return &response, apiRequest, apiCallDuration, nil
+}
+
+// decodeOpenAIResponsesStream decodes server-sent events of Responses API into
+// the response, calling stream for every text and reasoning summary delta and
+// for every complete function call.
+//
+// See: https://platform.openai.com/docs/api-reference/responses-streaming
+func decodeOpenAIResponsesStream(
+	body io.Reader, apiRequest string, response *openAIResponsesResponse, stream func(event TextStreamEvent) errors.E,
+) errors.E {
+	return decodeServerSentEvents(body, func(_ string, data []byte) errors.E {
+		var event openAIResponsesStreamEvent
+		errE := x.Unmarshal(data, &event)
+		if errE != nil {
+			return errE
+		}
+
+		switch event.Type {
+		case "response.output_text.delta":
+			if event.Delta == "" {
+				return nil
+			}
+			return stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       typeText,
+				Content:    event.Delta,
+				APIRequest: apiRequest,
+			})
+		case "response.reasoning_summary_text.delta":
+			if event.Delta == "" {
+				return nil
+			}
+			return stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:       roleThinking,
+				Content:    event.Delta,
+				APIRequest: apiRequest,
+			})
+		case "response.output_item.done":
+			// Function calls are complete only when their items are done.
+			if event.Item == nil || event.Item.Type != typeOpenAIResponsesFunctionCall {
+				return nil
+			}
+			return stream(TextStreamEvent{ //nolint:exhaustruct
+				Type:        roleToolUse,
+				Content:     event.Item.Arguments,
+				ToolUseID:   event.Item.CallID,
+				ToolUseName: event.Item.Name,
+				APIRequest:  apiRequest,
+			})
+		case "response.completed", "response.incomplete", "response.failed":
+			// The final event contains the complete response.
+			if event.Response != nil {
+				*response = *event.Response
+			}
+		case "error":
+			response.Error = &openAIError{
+				Message: event.Message,
+				Type:    "",
+				Code:    event.Code,
+				Param:   nil,
+			}
+		}
+
+		return nil
+	})
+}
+
+func (o *OpenAIResponsesTextProvider) usedTokens(usage openAIResponsesUsage) *TextRecorderUsedTokens {
+	var cacheReadInputTokens *int
+	if usage.InputTokensDetails.CachedTokens != 0 {
+		cacheReadInputTokens = &usage.InputTokensDetails.CachedTokens
+	}
+	var reasoningTokens *int
+	if usage.OutputTokensDetails.ReasoningTokens != 0 {
+		reasoningTokens = &usage.OutputTokensDetails.ReasoningTokens
+	}
+	return newUsedTokens(
+		o.MaxContextLength,
+		o.MaxResponseLength,
+		usage.InputTokens,
+		usage.OutputTokens,
+		nil,
+		cacheReadInputTokens,
+		reasoningTokens,
+	)
+}
+
+// InitOutputJSONSchema implements [WithOutputJSONSchema] interface.
+func (o *OpenAIResponsesTextProvider) InitOutputJSONSchema(_ context.Context, schema []byte) errors.E {
+	if !o.ForceOutputJSONSchema {
+		return nil
+	}
+
+	if schema == nil {
+		return errors.Errorf(`%w: output JSON Schema is missing`, ErrInvalidJSONSchema)
+	}
+
+	if o.outputJSONSchema != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.outputJSONSchema = schema
+
+	s, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	o.outputJSONSchemaName = getString(s, "title")
+	o.outputJSONSchemaDescription = getString(s, "description")
+
+	if o.outputJSONSchemaName == "" {
+		return errors.Errorf(`%w: JSON Schema is missing "title" field which is used for required JSON Schema "name" for OpenAI API`, ErrInvalidJSONSchema)
+	}
+
+	return nil
+}
+
+// InitTools implements [WithTools] interface.
+func (o *OpenAIResponsesTextProvider) InitTools(ctx context.Context, tools map[string]TextTooler) errors.E {
+	if o.tools != nil {
+		return errors.WithStack(ErrAlreadyInitialized)
+	}
+	o.tools = []openAIResponsesFunction{}
+
+	// We iterate in sorted order so that requests are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		tool := tools[name]
+		errE := tool.Init(ctx)
+		if errE != nil {
+			errors.Details(errE)["name"] = name
+			return errE
+		}
+
+		o.tools = append(o.tools, openAIResponsesFunction{
+			Type:        "function",
+			Name:        name,
+			Description: tool.GetDescription(),
+			Parameters:  tool.GetInputJSONSchema(),
+			Strict:      true,
+			tool:        tool,
+		})
+	}
+
+	return nil
+}
+
+func (o *OpenAIResponsesTextProvider) estimatedTokens(items []openAIResponsesItem) (int, int) {
+	// We estimate inputTokens from training messages (including system message) by
+	// dividing number of characters by 4.
+	inputTokens := 0
+	for _, item := range items {
+		for _, content := range item.Content {
+			switch {
+			case content.Text != nil:
+				inputTokens += len(*content.Text) / 4 //nolint:mnd
+			case content.Refusal != nil:
+				inputTokens += len(*content.Refusal) / 4 //nolint:mnd
+			default:
+				inputTokens += estimatedPartTokens
+			}
+		}
+		for _, summary := range item.Summary {
+			inputTokens += len(summary.Text) / 4 //nolint:mnd
+		}
+		inputTokens += len(item.Name) / 4      //nolint:mnd
+		inputTokens += len(item.Arguments) / 4 //nolint:mnd
+		if item.Output != nil {
+			inputTokens += len(*item.Output) / 4 //nolint:mnd
+		}
+	}
+	for _, tool := range o.tools {
+		inputTokens += len(tool.Name) / 4        //nolint:mnd
+		inputTokens += len(tool.Description) / 4 //nolint:mnd
+		inputTokens += len(tool.Parameters) / 4  //nolint:mnd
+	}
+	return inputTokens, 0
+}
+
+func (o *OpenAIResponsesTextProvider) callToolWrapper(
+	ctx context.Context, apiRequest string, toolCall openAIResponsesItem, result *openAIResponsesItem,
+	callRecorder *TextRecorderCall, toolMessage *TextRecorderMessage,
+) {
+	if callRecorder != nil {
+		defer func() {
+			callRecorder.notify("", nil)
+		}()
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			metrics.toolCallErrors.WithLabelValues(toolCall.Name).Inc()
+
+			content := fmt.Sprintf("Error: %s", err)
+			result.Output = &content
+			result.isError = true
+
+			toolMessage.setContent(content, true)
+		}
+	}()
+
+	defer func() {
+		toolMessage.setToolCalls(GetTextRecorder(ctx).Calls())
+	}()
+
+	logger := zerolog.Ctx(ctx).With().Str("tool", toolCall.CallID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	ctx, span := startToolSpan(ctx, toolCall.Name, toolCall.CallID)
+	defer span.End()
+
+	output, duration, errE := o.callTool(ctx, toolCall)
+	setSpanError(span, errE)
+	metrics.toolCall(toolCall.Name, duration, errE)
+	if errE != nil {
+		zerolog.Ctx(ctx).Warn().Err(errE).Str("name", toolCall.Name).Str("apiRequest", apiRequest).
+			Str("tool", toolCall.CallID).RawJSON("input", json.RawMessage(toolCall.Arguments)).Msg("tool error")
+		content := "Error: " + errE.Error()
+		result.Output = &content
+		result.isError = true
+
+		toolMessage.setContent(content, true)
+	} else {
+		result.Output = &output
+
+		toolMessage.setContent(output, false)
+	}
+
+	toolMessage.setToolDuration(duration)
+}
+
+func (o *OpenAIResponsesTextProvider) callTool(ctx context.Context, toolCall openAIResponsesItem) (string, Duration, errors.E) {
+	var tool TextTooler
+	for _, t := range o.tools {
+		if t.Name == toolCall.Name {
+			tool = t.tool
+			break
+		}
+	}
+	if tool == nil {
+		return "", 0, errors.Errorf("%w: %s", ErrToolNotFound, toolCall.Name)
+	}
+
+	start := time.Now()
+	output, errE := tool.Call(ctx, json.RawMessage(toolCall.Arguments))
+	duration := time.Since(start)
+	return output, Duration(duration), errE
+}
+
+// newOpenAIResponsesItem converts a message to a message item.
+//
+// See: https://platform.openai.com/docs/guides/images-vision
+// See: https://platform.openai.com/docs/guides/pdf-files
+func newOpenAIResponsesItem(message ChatMessage) (openAIResponsesItem, errors.E) {
+	content := []openAIResponsesContent{}
+	for i, part := range message.parts() {
+		switch {
+		case part.Type == typeText && message.Role == roleAssistant:
+			text := part.Text
+			content = append(content, openAIResponsesContent{ //nolint:exhaustruct
+				Type:        "output_text",
+				Text:        &text,
+				Annotations: json.RawMessage("[]"),
+			})
+		case part.Type == typeText:
+			text := part.Text
+			content = append(content, openAIResponsesContent{ //nolint:exhaustruct
+				Type: "input_text",
+				Text: &text,
+			})
+		case part.Type == typeImage && message.Role != roleAssistant:
+			content = append(content, openAIResponsesContent{ //nolint:exhaustruct
+				Type:     "input_image",
+				ImageURL: dataURL(part.MIMEType, part.Data),
+			})
+		case part.Type == typeDocument && message.Role != roleAssistant:
+			content = append(content, openAIResponsesContent{ //nolint:exhaustruct
+				Type: "input_file",
+				// A filename is required, but we do not have it.
+				Filename: fmt.Sprintf("document_%d", i),
+				FileData: dataURL(part.MIMEType, part.Data),
+			})
+		default:
+			return openAIResponsesItem{}, errors.WithDetails( //nolint:exhaustruct
+				ErrUnsupportedContentPart,
+				"type", part.Type,
+				"mimeType", part.MIMEType,
+			)
+		}
+	}
+	return openAIResponsesItem{ //nolint:exhaustruct
+		Type:    typeOpenAIResponsesMessage,
+		Role:    message.Role,
+		Content: content,
+		parts:   message.Parts,
+	}, nil
+}
+
+func (o *OpenAIResponsesTextProvider) recordItem(recorder *TextRecorderCall, item openAIResponsesItem) {
+	switch item.Type {
+	case typeOpenAIResponsesMessage:
+		if len(item.parts) > 0 {
+			for _, part := range item.parts {
+				recorder.addPart(item.Role, part)
+			}
+			return
+		}
+		for _, content := range item.Content {
+			switch {
+			case content.Refusal != nil:
+				recorder.addMessage(item.Role, *content.Refusal, "", "", true)
+			case content.Text != nil:
+				recorder.addMessage(item.Role, *content.Text, "", "", false)
+			}
+		}
+	case typeOpenAIResponsesReasoning:
+		for _, summary := range item.Summary {
+			recorder.addMessage(roleThinking, summary.Text, "", "", false)
+		}
+	case typeOpenAIResponsesFunctionCall:
+		recorder.addMessage(roleToolUse, item.Arguments, item.CallID, item.Name, false)
+	case typeOpenAIResponsesFunctionCallOutput:
+		panic(errors.New("recording tool result message should not happen"))
+	}
+}
@@ -0,0 +1,193 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+
+	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
+)
+
+type openAIResponsesTestRequest struct {
+	Input []struct {
+		Type             string  `json:"type"`
+		Role             string  `json:"role"`
+		EncryptedContent string  `json:"encrypted_content"`
+		CallID           string  `json:"call_id"`
+		Output           *string `json:"output"`
+	} `json:"input"`
+	Store     bool           `json:"store"`
+	Include   []string       `json:"include"`
+	Reasoning map[string]any `json:"reasoning"`
+	Text      struct {
+		Format map[string]any `json:"format"`
+	} `json:"text"`
+	Tools       []map[string]any `json:"tools"`
+	Temperature *float64         `json:"temperature"`
+}
+
+func TestOpenAIResponsesTextProvider(t *testing.T) {
+	t.Parallel()
+
+	for _, stream := range []bool{false, true} {
+		name := "call"
+		if stream {
+			name = "stream"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := emulator.NewOpenAI(
+				emulator.Response{ //nolint:exhaustruct
+					Check: func(req emulator.Request) error {
+						var request openAIResponsesTestRequest
+						errE := x.Unmarshal(req.Body, &request)
+						if errE != nil {
+							return errE
+						}
+						assert.Equal(t, "/v1/responses", req.Path)
+						assert.Equal(t, "Bearer test", req.Header.Get("Authorization"))
+						assert.False(t, request.Store)
+						assert.Equal(t, []string{"reasoning.encrypted_content"}, request.Include)
+						assert.Equal(t, map[string]any{"effort": "low", "summary": "auto"}, request.Reasoning)
+						assert.Nil(t, request.Temperature)
+						assert.Equal(t, "json_schema", request.Text.Format["type"])
+						assert.Equal(t, "output", request.Text.Format["name"])
+						assert.Equal(t, true, request.Text.Format["strict"])
+						require.Len(t, request.Tools, 1)
+						assert.Equal(t, "repeat_string", request.Tools[0]["name"])
+						types := []string{}
+						for _, item := range request.Input {
+							types = append(types, item.Type+":"+item.Role)
+						}
+						assert.Equal(t, []string{"message:system", "message:user"}, types)
+						return nil
+					},
+					ToolCalls: []emulator.ToolCall{
+						{ID: "call_1", Name: "repeat_string", Input: json.RawMessage(`{"string":"foo"}`)},
+					},
+					Thinking:       "I should use the tool.",
+					PromptTokens:   100,
+					ResponseTokens: 10,
+					ThinkingTokens: 20,
+				},
+				emulator.Response{ //nolint:exhaustruct
+					Check: func(req emulator.Request) error {
+						var request openAIResponsesTestRequest
+						errE := x.Unmarshal(req.Body, &request)
+						if errE != nil {
+							return errE
+						}
+						types := []string{}
+						for _, item := range request.Input {
+							types = append(types, item.Type)
+						}
+						// Reasoning is carried together with the function call.
+						assert.Equal(t, []string{"message", "message", "reasoning", "function_call", "function_call_output"}, types)
+						if len(request.Input) == 5 { //nolint:mnd
+							assert.Equal(t, "encrypted_1", request.Input[2].EncryptedContent)
+							assert.Equal(t, "call_1", request.Input[4].CallID)
+							if assert.NotNil(t, request.Input[4].Output) {
+								assert.Equal(t, "foofoo", *request.Input[4].Output)
+							}
+						}
+						return nil
+					},
+					Content:        `{"string":"foofoo"}`,
+					Thinking:       "The tool returned foofoo.",
+					PromptTokens:   150,
+					ResponseTokens: 10,
+					ThinkingTokens: 30,
+					CachedTokens:   100,
+				},
+				emulator.Response{StatusCode: http.StatusBadRequest}, //nolint:exhaustruct
+			)
+			defer server.Close()
+
+			f := fun.Text[string, toolStringInput]{
+				Provider: &fun.OpenAIResponsesTextProvider{ //nolint:exhaustruct
+					APIKey:                "test",
+					BaseURL:               server.URL + "/v1",
+					Model:                 "o3-mini-2025-01-31",
+					ReasoningEffort:       "low",
+					ForceOutputJSONSchema: true,
+				},
+				InputJSONSchema:  nil,
+				OutputJSONSchema: outputJSONSchemaWithTitle,
+				Prompt:           "Repeat the input twice.",
+				PromptTemplate:   "",
+				InputTemplate:    "",
+				Data:             nil,
+				Tools: map[string]fun.TextTooler{
+					"repeat_string": &fun.TextTool[toolStringInput, string]{
+						Description:      "Repeats the input twice, by concatenating the input string without any space.",
+						InputJSONSchema:  toolInputJSONSchema,
+						OutputJSONSchema: jsonSchemaString,
+						Fun: func(_ context.Context, input toolStringInput) (string, errors.E) {
+							return input.String + input.String, nil
+						},
+					},
+				},
+				MaxRepairAttempts: 0,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			var output toolStringInput
+			if stream {
+				events := []string{}
+				output, errE = f.Stream(ct, func(event fun.TextStreamEvent) errors.E {
+					events = append(events, event.Type)
+					return nil
+				}, "foo")
+				assert.Equal(t, []string{"thinking", "tool_use", "usage", "tool_result", "thinking", "text", "usage"}, events)
+			} else {
+				output, errE = f.Call(ct, "foo")
+			}
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, toolStringInput{String: "foofoo"}, output)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			require.Len(t, calls, 1)
+
+			assert.Equal(t, 200_000, calls[0].Provider.(*fun.OpenAIResponsesTextProvider).MaxContextLength) //nolint:forcetypeassert,errcheck
+
+			roles := []string{}
+			for i := range calls[0].Messages {
+				roles = append(roles, calls[0].Messages[i].Role)
+			}
+			assert.Equal(t, []string{"system", "user", "thinking", "tool_use", "tool_result", "thinking", "assistant"}, roles)
+			assert.Equal(t, "I should use the tool.", *calls[0].Messages[2].Content)
+
+			require.Len(t, calls[0].UsedTokens, 2)
+			usedTokens := calls[0].UsedTokens["req_2"]
+			require.NotNil(t, usedTokens)
+			assert.Equal(t, 150, usedTokens.Prompt)
+			// Reasoning tokens are included in response tokens.
+			assert.Equal(t, 40, usedTokens.Response)
+			assert.Equal(t, 190, usedTokens.Total)
+			assert.Equal(t, 100, *usedTokens.CacheReadInputTokens)
+			assert.Equal(t, 30, *usedTokens.ThinkingTokens)
+
+			_, errE = f.Call(ctx, "foo")
+			assert.ErrorIs(t, errE, fun.ErrAPIResponseError)
+			assert.Equal(t, http.StatusBadRequest, errors.Details(errE)["code"])
+
+			assert.Equal(t, 0, server.Remaining())
+		})
+	}
+}
@@ -1,13 +1,18 @@
 package fun_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
 
 	"gitlab.com/tozd/go/fun"
+	"gitlab.com/tozd/go/fun/emulator"
 )
 
 func TestOpenAIJSON(t *testing.T) {
@@ -30,3 +35,65 @@ func TestOpenAIJSON(t *testing.T) {
 	require.NoError(t, errE, "% -+#.1v", errE)
 	assert.Equal(t, `{"model":"gpt-4o-mini-2024-07-18","maxContextLength":43,"maxResponseLength":56,"maxExchanges":57,"forceOutputJsonSchema":false,"seed":42,"temperature":0.7,"type":"openai"}`, string(out)) //nolint:testifylint
 }
+
+func TestOpenAITextProviderContentParts(t *testing.T) {
+	t.Parallel()
+
+	message := contentPartsMessage(t, "image/png", "application/pdf")
+
+	server := emulator.NewOpenAI(
+		emulator.Response{ //nolint:exhaustruct
+			Check: func(req emulator.Request) error {
+				var request struct {
+					Messages []struct {
+						Role    string          `json:"role"`
+						Content json.RawMessage `json:"content"`
+					} `json:"messages"`
+				}
+				errE := x.Unmarshal(req.Body, &request)
+				if errE != nil {
+					return errE
+				}
+				require.Len(t, request.Messages, 1)
+				assert.Equal(t, "user", request.Messages[0].Role)
+				assert.JSONEq(t, `[
+					{"type": "text", "text": "Describe."},
+					{"type": "image_url", "image_url": {"url": "data:image/png;base64,`+base64.StdEncoding.EncodeToString(message.Parts[1].Data)+`"}},
+					{"type": "file", "file": {"filename": "document_2", "file_data": "data:application/pdf;base64,`+base64.StdEncoding.EncodeToString(testPDF)+`"}}
+				]`, string(request.Messages[0].Content))
+				return nil
+			},
+			Content:        "red",
+			PromptTokens:   100,
+			ResponseTokens: 1,
+		},
+	)
+	defer server.Close()
+
+	provider := &fun.OpenAITextProvider{ //nolint:exhaustruct
+		Client: server.Client(),
+		APIKey: "test",
+		Model:  "gpt-4o-mini-2024-07-18",
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	errE := provider.Init(ctx, nil)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	output, errE := provider.Chat(ctx, message)
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "red", output)
+
+	// Unsupported MIME types are rejected before making a request.
+	for _, m := range []fun.ChatMessage{
+		contentPartsMessage(t, "image/bmp", "application/pdf"),
+		contentPartsMessage(t, "image/png", "text/plain"),
+	} {
+		_, errE = provider.Chat(ctx, m)
+		require.ErrorIs(t, errE, fun.ErrUnsupportedContentPart)
+		assert.Contains(t, []string{"image/bmp", "text/plain"}, errors.Details(errE)["mimeType"])
+	}
+
+	assert.Equal(t, 0, server.Remaining())
+}
@@ -0,0 +1,257 @@
+package fun
+
+import (
+	"encoding/json"
+	"maps"
+	"sync"
+)
+
+// ModelPrice describes prices of tokens used with an AI model,
+// in USD per million tokens.
+type ModelPrice struct {
+	// Input is the price of prompt tokens.
+	Input float64 `json:"input"`
+
+	// Output is the price of response tokens.
+	Output float64 `json:"output"`
+
+	// CacheRead is the price of prompt tokens retrieved from the cache.
+	// If zero, Input price is used.
+	CacheRead float64 `json:"cacheRead,omitempty"`
+
+	// CacheWrite is the price of prompt tokens written to the cache.
+	// If zero, Input price is used.
+	CacheWrite float64 `json:"cacheWrite,omitempty"`
+
+	// Reasoning is the price of tokens used for extended thinking or reasoning.
+	// If zero, Output price is used.
+	Reasoning float64 `json:"reasoning,omitempty"`
+}
+
+type modelPriceKey struct {
+	Provider string
+	Model    string
+}
+
+// defaultModelPrices are built-in prices of known models.
+//
+//nolint:exhaustruct,gochecknoglobals,mnd
+var defaultModelPrices = map[modelPriceKey]ModelPrice{
+	{"openai", "gpt-4o-2024-11-20"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"openai", "gpt-4o-2024-08-06"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"openai", "gpt-4o-2024-05-13"}:      {Input: 5, Output: 15},
+	{"openai", "gpt-4o-mini-2024-07-18"}: {Input: 0.15, Output: 0.6, CacheRead: 0.075},
+	{"openai", "o1-preview-2024-09-12"}:  {Input: 15, Output: 60, CacheRead: 7.5},
+	{"openai", "o1-mini-2024-09-12"}:     {Input: 1.1, Output: 4.4, CacheRead: 0.55},
+	{"openai", "gpt-4-turbo-2024-04-09"}: {Input: 10, Output: 30},
+	{"openai", "o3-mini-2025-01-31"}:     {Input: 1.1, Output: 4.4, CacheRead: 0.55},
+	{"openai", "o1-2024-12-17"}:          {Input: 15, Output: 60, CacheRead: 7.5},
+	{"openai", "text-embedding-3-small"}: {Input: 0.02},
+	{"openai", "text-embedding-3-large"}: {Input: 0.13},
+	{"openai", "text-embedding-ada-002"}: {Input: 0.1},
+
+	{"azure-openai", "gpt-4o-2024-11-20"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"azure-openai", "gpt-4o-2024-08-06"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"azure-openai", "gpt-4o-mini-2024-07-18"}: {Input: 0.15, Output: 0.6, CacheRead: 0.075},
+	{"azure-openai", "o3-mini-2025-01-31"}:     {Input: 1.1, Output: 4.4, CacheRead: 0.55},
+	{"azure-openai", "o1-2024-12-17"}:          {Input: 15, Output: 60, CacheRead: 7.5},
+
+	{"openai-responses", "gpt-4o-2024-11-20"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"openai-responses", "gpt-4o-2024-08-06"}:      {Input: 2.5, Output: 10, CacheRead: 1.25},
+	{"openai-responses", "gpt-4o-2024-05-13"}:      {Input: 5, Output: 15},
+	{"openai-responses", "gpt-4o-mini-2024-07-18"}: {Input: 0.15, Output: 0.6, CacheRead: 0.075},
+	{"openai-responses", "o1-preview-2024-09-12"}:  {Input: 15, Output: 60, CacheRead: 7.5},
+	{"openai-responses", "o1-mini-2024-09-12"}:     {Input: 1.1, Output: 4.4, CacheRead: 0.55},
+	{"openai-responses", "gpt-4-turbo-2024-04-09"}: {Input: 10, Output: 30},
+	{"openai-responses", "o3-mini-2025-01-31"}:     {Input: 1.1, Output: 4.4, CacheRead: 0.55},
+	{"openai-responses", "o1-2024-12-17"}:          {Input: 15, Output: 60, CacheRead: 7.5},
+
+	{"anthropic", "claude-3-haiku-20240307"}:    {Input: 0.25, Output: 1.25, CacheRead: 0.03, CacheWrite: 0.3},
+	{"anthropic", "claude-3-5-haiku-20241022"}:  {Input: 0.8, Output: 4, CacheRead: 0.08, CacheWrite: 1},
+	{"anthropic", "claude-3-5-sonnet-20240620"}: {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"anthropic", "claude-3-5-sonnet-20241022"}: {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"anthropic", "claude-3-7-sonnet-20250219"}: {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"anthropic", "claude-3-opus-20240229"}:     {Input: 15, Output: 75, CacheRead: 1.5, CacheWrite: 18.75},
+	{"anthropic", "claude-sonnet-4-20250514"}:   {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"anthropic", "claude-opus-4-20250514"}:     {Input: 15, Output: 75, CacheRead: 1.5, CacheWrite: 18.75},
+	{"anthropic", "claude-opus-4-1-20250805"}:   {Input: 15, Output: 75, CacheRead: 1.5, CacheWrite: 18.75},
+
+	{"groq", "openai/gpt-oss-20b"}:               {Input: 0.1, Output: 0.5},
+	{"groq", "openai/gpt-oss-120b"}:              {Input: 0.15, Output: 0.75},
+	{"groq", "moonshotai/kimi-k2-instruct-0905"}: {Input: 1, Output: 3},
+	{"groq", "llama-3.1-8b-instant"}:             {Input: 0.05, Output: 0.08},
+	{"groq", "llama-3.3-70b-versatile"}:          {Input: 0.59, Output: 0.79},
+
+	{"gemini", "gemini-2.5-pro"}:        {Input: 1.25, Output: 10, CacheRead: 0.31},
+	{"gemini", "gemini-2.5-flash"}:      {Input: 0.3, Output: 2.5, CacheRead: 0.075},
+	{"gemini", "gemini-2.5-flash-lite"}: {Input: 0.1, Output: 0.4, CacheRead: 0.025},
+	{"gemini", "gemini-2.0-flash"}:      {Input: 0.1, Output: 0.4, CacheRead: 0.025},
+
+	{"bedrock", "anthropic.claude-3-haiku-20240307-v1:0"}:       {Input: 0.25, Output: 1.25},
+	{"bedrock", "anthropic.claude-3-5-haiku-20241022-v1:0"}:     {Input: 0.8, Output: 4, CacheRead: 0.08, CacheWrite: 1},
+	{"bedrock", "us.anthropic.claude-3-7-sonnet-20250219-v1:0"}: {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"bedrock", "us.anthropic.claude-sonnet-4-20250514-v1:0"}:   {Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75},
+	{"bedrock", "meta.llama3-1-8b-instruct-v1:0"}:               {Input: 0.22, Output: 0.22},
+	{"bedrock", "meta.llama3-1-70b-instruct-v1:0"}:              {Input: 0.72, Output: 0.72},
+	{"bedrock", "us.meta.llama3-3-70b-instruct-v1:0"}:           {Input: 0.72, Output: 0.72},
+}
+
+// cacheTokensExcludedFromPrompt lists providers which do not include
+// cache tokens in the number of prompt tokens.
+//
+//nolint:gochecknoglobals
+var cacheTokensExcludedFromPrompt = map[string]bool{
+	"anthropic": true,
+	"bedrock":   true,
+}
+
+// batchPriceFactors lists providers which discount prices of tokens
+// used through their batch APIs, with the factor applied to prices.
+//
+//nolint:gochecknoglobals,mnd
+var batchPriceFactors = map[string]float64{
+	"openai":    0.5,
+	"anthropic": 0.5,
+}
+
+//nolint:gochecknoglobals
+var (
+	modelPricesMu sync.RWMutex
+	modelPrices   = maps.Clone(defaultModelPrices)
+)
+
+// SetModelPrice sets the price of the model for the provider, overriding
+// any built-in price. The provider is identified by its type as used
+// in its JSON representation (e.g., "openai" or "anthropic").
+//
+// Prices are used to compute costs recorded by [TextRecorder]
+// for calls made after the price is set. For requests made through
+// batch APIs (see [WithBatch]), the provider's batch discount is
+// applied to the price (50% for "openai" and "anthropic").
+func SetModelPrice(provider, model string, price ModelPrice) {
+	modelPricesMu.Lock()
+	defer modelPricesMu.Unlock()
+
+	modelPrices[modelPriceKey{provider, model}] = price
+}
+
+// GetModelPrice returns the price of the model for the provider,
+// if the price is known.
+func GetModelPrice(provider, model string) (ModelPrice, bool) {
+	modelPricesMu.RLock()
+	defer modelPricesMu.RUnlock()
+
+	price, ok := modelPrices[modelPriceKey{provider, model}]
+	return price, ok
+}
+
+// typedProvider is implemented by providers which report their type
+// and the model they use directly, without marshaling them to JSON.
+type typedProvider interface {
+	// typeModel returns the type of the provider, as used in its
+	// JSON representation, and the model it uses.
+	typeModel() (string, string)
+}
+
+// providerTypeModel returns the type of the provider and the model it uses.
+// For providers which do not implement typedProvider interface, they
+// are determined from the JSON representation of the provider.
+func providerTypeModel(provider any) (string, string) {
+	if provider == nil {
+		return "", ""
+	}
+
+	if p, ok := provider.(typedProvider); ok {
+		return p.typeModel()
+	}
+
+	data, err := json.Marshal(provider)
+	if err != nil {
+		return "", ""
+	}
+	var p struct {
+		Type  string `json:"type"`
+		Model string `json:"model"`
+	}
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return "", ""
+	}
+	return p.Type, p.Model
+}
+
+// providerPrice returns the price of the model used by the provider and if
+// the provider includes cache tokens in the number of prompt tokens.
+// If batch is true, the price for requests made through the provider's
+// batch API is returned.
+func providerPrice(provider any, batch bool) (*ModelPrice, bool) {
+	providerType, model := providerTypeModel(provider)
+	if providerType == "" {
+		return nil, false
+	}
+
+	promptIncludesCache := !cacheTokensExcludedFromPrompt[providerType]
+	price, ok := GetModelPrice(providerType, model)
+	if !ok {
+		return nil, promptIncludesCache
+	}
+	if factor, ok := batchPriceFactors[providerType]; batch && ok {
+		price = price.scaled(factor)
+	}
+	return &price, promptIncludesCache
+}
+
+// scaled returns the price with all prices multiplied by factor.
+func (p ModelPrice) scaled(factor float64) ModelPrice {
+	return ModelPrice{
+		Input:      p.Input * factor,
+		Output:     p.Output * factor,
+		CacheRead:  p.CacheRead * factor,
+		CacheWrite: p.CacheWrite * factor,
+		Reasoning:  p.Reasoning * factor,
+	}
+}
+
+// cost returns the cost of used tokens in USD.
+//
+// Reasoning tokens are assumed to be included in the number of response tokens.
+func (p ModelPrice) cost(usedTokens TextRecorderUsedTokens, promptIncludesCache bool) float64 {
+	cacheRead := 0
+	if usedTokens.CacheReadInputTokens != nil {
+		cacheRead = *usedTokens.CacheReadInputTokens
+	}
+	cacheWrite := 0
+	if usedTokens.CacheCreationInputTokens != nil {
+		cacheWrite = *usedTokens.CacheCreationInputTokens
+	}
+	thinking := 0
+	if usedTokens.ThinkingTokens != nil {
+		thinking = *usedTokens.ThinkingTokens
+	}
+
+	input := usedTokens.Prompt
+	if promptIncludesCache {
+		input -= cacheRead + cacheWrite
+	}
+	output := usedTokens.Response - thinking
+
+	cacheReadPrice := p.CacheRead
+	if cacheReadPrice == 0 {
+		cacheReadPrice = p.Input
+	}
+	cacheWritePrice := p.CacheWrite
+	if cacheWritePrice == 0 {
+		cacheWritePrice = p.Input
+	}
+	reasoningPrice := p.Reasoning
+	if reasoningPrice == 0 {
+		reasoningPrice = p.Output
+	}
+
+	total := float64(input)*p.Input +
+		float64(output)*p.Output +
+		float64(cacheRead)*cacheReadPrice +
+		float64(cacheWrite)*cacheWritePrice +
+		float64(thinking)*reasoningPrice
+	return total / 1_000_000 //nolint:mnd
+}
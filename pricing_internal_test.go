@@ -0,0 +1,47 @@
+package fun
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedProviders(t *testing.T) {
+	t.Parallel()
+
+	//nolint:exhaustruct
+	providers := []typedProvider{
+		&OpenAITextProvider{Model: "model"},
+		&AzureOpenAITextProvider{Model: "model"},
+		&OpenAIResponsesTextProvider{Model: "model"},
+		&AnthropicTextProvider{Model: "model"},
+		&GroqTextProvider{Model: "model"},
+		&GeminiTextProvider{Model: "model"},
+		&BedrockTextProvider{Model: "model"},
+		&OllamaTextProvider{Model: "model"},
+		&LlamaCppTextProvider{Model: "model"},
+		&OpenAICompatibleTextProvider{Model: "model"},
+		&OpenAIEmbeddingProvider{Model: "model"},
+		&OllamaEmbeddingProvider{Model: "model"},
+		&FakeTextProvider{Model: "model"},
+	}
+
+	for _, provider := range providers {
+		data, err := json.Marshal(provider)
+		require.NoError(t, err)
+		var p struct {
+			Type  string `json:"type"`
+			Model string `json:"model"`
+		}
+		err = json.Unmarshal(data, &p)
+		require.NoError(t, err)
+
+		// Type and model must match the JSON representation.
+		providerType, model := provider.typeModel()
+		assert.Equal(t, p.Type, providerType)
+		assert.Equal(t, p.Model, model)
+		assert.Equal(t, "model", model)
+	}
+}
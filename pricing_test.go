@@ -0,0 +1,100 @@
+package fun_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func testCost(t *testing.T, provider fun.TextProvider, expected float64) {
+	t.Helper()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Text[string, string]{
+		Provider:          provider,
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  nil,
+		Prompt:            "Repeat the input.",
+		PromptTemplate:    "",
+		InputTemplate:     "",
+		Data:              nil,
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	ctx = fun.WithTextRecorder(ctx)
+	for range 2 {
+		_, errE = f.Call(ctx, "foo")
+		require.NoError(t, errE, "% -+#.1v", errE)
+	}
+
+	recorder := fun.GetTextRecorder(ctx)
+	calls := recorder.Calls()
+	require.Len(t, calls, 2)
+	require.Contains(t, calls[0].UsedTokens, "req_1")
+	require.NotNil(t, calls[0].UsedTokens["req_1"].Cost)
+	assert.InDelta(t, expected, *calls[0].UsedTokens["req_1"].Cost, 1e-12)
+	assert.InDelta(t, expected, calls[0].TotalCost(), 1e-12)
+	assert.InDelta(t, 2*expected, recorder.TotalCost(), 1e-12)
+}
+
+func TestOpenAICost(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"foo"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":1000,"completion_tokens":100,"total_tokens":1100,"prompt_tokens_details":{"cached_tokens":200}}}`))
+	})
+
+	// (800 * 0.15 + 100 * 0.6 + 200 * 0.075) / 1,000,000
+	testCost(t, &fun.OpenAITextProvider{ //nolint:exhaustruct
+		Client: newTestClient(t, mux),
+		APIKey: "test",
+		Model:  "gpt-4o-mini-2024-07-18",
+	}, 0.000195)
+}
+
+func TestAnthropicCost(t *testing.T) {
+	t.Parallel()
+
+	fun.SetModelPrice("anthropic", "test-cost", fun.ModelPrice{
+		Input:      1,
+		Output:     10,
+		CacheRead:  0.1,
+		CacheWrite: 2,
+		Reasoning:  0,
+	})
+
+	price, ok := fun.GetModelPrice("anthropic", "test-cost")
+	assert.True(t, ok)
+	assert.InDelta(t, 10.0, price.Output, 0)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"foo"}],"stop_reason":"end_turn",` +
+			`"usage":{"input_tokens":1000,"output_tokens":100,"cache_creation_input_tokens":500,"cache_read_input_tokens":200}}`))
+	})
+
+	// (1000 * 1 + 100 * 10 + 500 * 2 + 200 * 0.1) / 1,000,000
+	testCost(t, &fun.AnthropicTextProvider{ //nolint:exhaustruct
+		Client:            newTestClient(t, mux),
+		APIKey:            "test",
+		Model:             "test-cost",
+		MaxContextLength:  200_000,
+		MaxResponseLength: 4096,
+	}, 0.00302)
+}
@@ -13,6 +13,8 @@ import (
 var errTooLargeRequest = errors.Base("max limit smaller than requested n")
 
 type keyedRateLimiter struct {
+	// name of the rate limiter used in metrics.
+	name     string
 	mu       sync.RWMutex
 	limiters map[string]map[string]any
 }
@@ -24,6 +26,10 @@ type resettingRateLimiter struct {
 	window    time.Duration
 	resets    time.Time
 	setC      chan struct{}
+
+	// limitUnknown is true when only the remaining number is known,
+	// but not the limit nor when the window resets.
+	limitUnknown bool
 }
 
 func (r *resettingRateLimiter) Take(ctx context.Context, n int) (time.Duration, errors.E) {
@@ -44,7 +50,7 @@ func (r *resettingRateLimiter) reserve(n int, now time.Time) (bool, time.Time, <
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if r.limit < n {
+	if !r.limitUnknown && r.limit < n {
 		return false, time.Time{}, nil, errors.WithDetails(
 			errTooLargeRequest,
 			"limit", r.limit,
@@ -53,6 +59,11 @@ func (r *resettingRateLimiter) reserve(n int, now time.Time) (bool, time.Time, <
 	}
 
 	if r.resets.Compare(now) <= 0 {
+		if r.limitUnknown {
+			// We do not know to what the window resets, so we do not limit
+			// until the remaining number is set again.
+			return true, time.Time{}, nil, nil
+		}
 		r.remaining = r.limit
 		r.resets = now.Add(r.window)
 	}
@@ -110,6 +121,26 @@ func (r *resettingRateLimiter) Set(limit, remaining int, window time.Duration, r
 	r.remaining = remaining
 	r.window = window
 	r.resets = resets
+	r.limitUnknown = false
+
+	// We signal that rate limit was set and create a new channel for the next time.
+	close(r.setC)
+	r.setC = make(chan struct{})
+}
+
+// SetRemaining sets only the remaining number when the limit and when the window
+// resets are not known. The current window is assumed to reset after the given
+// window duration since it started. Until then, requests are limited to the remaining number.
+func (r *resettingRateLimiter) SetRemaining(remaining int, window time.Duration, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remaining = remaining
+	r.window = window
+	if r.resets.Compare(now) <= 0 {
+		r.resets = now.Add(window)
+	}
+	r.limitUnknown = true
 
 	// We signal that rate limit was set and create a new channel for the next time.
 	close(r.setC)
@@ -118,12 +149,13 @@ func (r *resettingRateLimiter) Set(limit, remaining int, window time.Duration, r
 
 func newResettingRateLimiter(limit, remaining int, window time.Duration, resets time.Time) *resettingRateLimiter {
 	return &resettingRateLimiter{
-		mu:        sync.Mutex{},
-		limit:     limit,
-		remaining: remaining,
-		window:    window,
-		resets:    resets,
-		setC:      make(chan struct{}),
+		mu:           sync.Mutex{},
+		limit:        limit,
+		remaining:    remaining,
+		window:       window,
+		resets:       resets,
+		setC:         make(chan struct{}),
+		limitUnknown: false,
 	}
 }
 
@@ -134,6 +166,13 @@ type resettingRateLimit struct {
 	Resets    time.Time
 }
 
+// remainingRateLimit is a rate limit for which only the remaining number in
+// the current window is known, e.g., when the API does not report limits and resets.
+type remainingRateLimit struct {
+	Remaining int
+	Window    time.Duration
+}
+
 type tokenBucketRateLimit struct {
 	Limit rate.Limit
 	Burst int
@@ -216,10 +255,16 @@ func (r *keyedRateLimiter) getOrCreate(key, k string, create func() any) any {
 	return r.limiters[key][k]
 }
 
-func (r *keyedRateLimiter) Take(ctx context.Context, key string, ns map[string]int) errors.E {
+func (r *keyedRateLimiter) Take(ctx context.Context, key string, ns map[string]int) (errE errors.E) {
+	ctx, span := startRateLimiterSpan(ctx)
+
 	delay := time.Duration(0)
 	limits := []string{}
 
+	defer func() {
+		endRateLimiterSpan(span, delay, limits, errE)
+	}()
+
 	for k, n := range ns {
 		limiter := r.get(key, k)
 		if limiter != nil {
@@ -232,6 +277,7 @@ func (r *keyedRateLimiter) Take(ctx context.Context, key string, ns map[string]i
 				delay += d
 				if d > 0 {
 					limits = append(limits, k)
+					metrics.rateLimiterWait.WithLabelValues(r.name, k).Observe(d.Seconds())
 				}
 			case *resettingRateLimiter:
 				d, errE := limiter.Take(ctx, n)
@@ -241,6 +287,7 @@ func (r *keyedRateLimiter) Take(ctx context.Context, key string, ns map[string]i
 				delay += d
 				if d > 0 {
 					limits = append(limits, k)
+					metrics.rateLimiterWait.WithLabelValues(r.name, k).Observe(d.Seconds())
 				}
 			default:
 				panic(errors.Errorf("invalid limiter type: %T", limiter))
@@ -265,6 +312,9 @@ func (r *keyedRateLimiter) Set(key string, rateLimits map[string]any) {
 				return rate.NewLimiter(rateLimit.Limit, rateLimit.Burst)
 			case resettingRateLimit:
 				return newResettingRateLimiter(rateLimit.Limit, rateLimit.Remaining, rateLimit.Window, rateLimit.Resets)
+			case remainingRateLimit:
+				// Remaining number is set below.
+				return newResettingRateLimiter(0, 0, rateLimit.Window, time.Time{})
 			default:
 				panic(errors.Errorf("invalid rate limit type: %T", rl))
 			}
@@ -282,11 +332,14 @@ func (r *keyedRateLimiter) Set(key string, rateLimits map[string]any) {
 				l.SetBurstAt(now, rateLimit.Burst)
 			}
 		case *resettingRateLimiter:
-			rateLimit, ok := rl.(resettingRateLimit)
-			if !ok {
+			switch rateLimit := rl.(type) {
+			case resettingRateLimit:
+				l.Set(rateLimit.Limit, rateLimit.Remaining, rateLimit.Window, rateLimit.Resets)
+			case remainingRateLimit:
+				l.SetRemaining(rateLimit.Remaining, rateLimit.Window, now)
+			default:
 				panic(errors.Errorf("mismatch between limiter type (%T) and rate limit type (%T)", l, rl))
 			}
-			l.Set(rateLimit.Limit, rateLimit.Remaining, rateLimit.Window, rateLimit.Resets)
 		default:
 			panic(errors.Errorf("invalid limiter type: %T", limiter))
 		}
@@ -0,0 +1,101 @@
+package fun
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeyedRateLimiter() *keyedRateLimiter {
+	return &keyedRateLimiter{
+		name:     "test",
+		mu:       sync.RWMutex{},
+		limiters: map[string]map[string]any{},
+	}
+}
+
+func TestRemainingRateLimitBlocks(t *testing.T) {
+	t.Parallel()
+
+	limiter := newTestKeyedRateLimiter()
+	limiter.Set("key", map[string]any{
+		"rpm": remainingRateLimit{
+			Remaining: 1,
+			Window:    200 * time.Millisecond,
+		},
+	})
+
+	start := time.Now()
+	errE := limiter.Take(t.Context(), "key", map[string]int{"rpm": 1})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// Remaining reached 0, so we have to wait until the window passes.
+	errE = limiter.Take(t.Context(), "key", map[string]int{"rpm": 1})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestRemainingRateLimitUnlimitedAfterWindow(t *testing.T) {
+	t.Parallel()
+
+	limiter := newTestKeyedRateLimiter()
+	limiter.Set("key", map[string]any{
+		"rpm": remainingRateLimit{
+			Remaining: 0,
+			Window:    100 * time.Millisecond,
+		},
+	})
+
+	time.Sleep(150 * time.Millisecond)
+
+	// The limit is not known, so after the window passes requests
+	// are not limited until the remaining number is set again.
+	start := time.Now()
+	for range 100 {
+		errE := limiter.Take(t.Context(), "key", map[string]int{"rpm": 1})
+		require.NoError(t, errE, "% -+#.1v", errE)
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRemainingRateLimitOverridesSet(t *testing.T) {
+	t.Parallel()
+
+	limiter := newTestKeyedRateLimiter()
+	limiter.Set("key", map[string]any{
+		"rpm": resettingRateLimit{
+			Limit:     10,
+			Remaining: 10,
+			Window:    time.Minute,
+			Resets:    time.Now().Add(time.Minute),
+		},
+	})
+	limiter.Set("key", map[string]any{
+		"rpm": remainingRateLimit{
+			Remaining: 0,
+			Window:    time.Minute,
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	// Remaining is 0 even though the limit set before had requests remaining.
+	errE := limiter.Take(ctx, "key", map[string]int{"rpm": 1})
+	assert.ErrorIs(t, errE, context.DeadlineExceeded)
+
+	// The limit is not known anymore, so requests larger than the previous limit are allowed.
+	limiter.Set("key", map[string]any{
+		"rpm": remainingRateLimit{
+			Remaining: 20,
+			Window:    time.Minute,
+		},
+	})
+	errE = limiter.Take(t.Context(), "key", map[string]int{"rpm": 20})
+	require.NoError(t, errE, "% -+#.1v", errE)
+}
@@ -2,6 +2,8 @@ package fun
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"maps"
 	"slices"
 	"strconv"
@@ -9,7 +11,10 @@ import (
 	"time"
 )
 
-var textRecorderContextKey = &contextKey{"text-provider-recorder"} //nolint:gochecknoglobals
+var (
+	textRecorderContextKey       = &contextKey{"text-provider-recorder"}        //nolint:gochecknoglobals
+	textRecorderMemberContextKey = &contextKey{"text-provider-recorder-member"} //nolint:gochecknoglobals
+)
 
 // Duration is [time.Duration] but which formats duration as
 // seconds with millisecond precision in JSON.
@@ -51,6 +56,10 @@ type TextRecorderUsedTokens struct {
 
 	// ThinkingTokens is the number of tokens used for extended thinking or reasoning.
 	ThinkingTokens *int `json:"thinkingTokens,omitempty"`
+
+	// Cost is the cost of used tokens in USD, if the price of
+	// the model is known (see [SetModelPrice]).
+	Cost *float64 `json:"cost,omitempty"`
 }
 
 // TextRecorderUsedTime describes time taken by a request to an AI model.
@@ -80,7 +89,24 @@ type TextRecorderCall struct {
 	ID string `json:"id"`
 
 	// Provider for this call.
-	Provider TextProvider `json:"provider"`
+	Provider TextProvider `json:"provider,omitempty"`
+
+	// EmbeddingProvider for this call, if the call was made to an embedding-based
+	// AI model instead (in which case Provider is nil).
+	EmbeddingProvider EmbeddingProvider `json:"embeddingProvider,omitempty"`
+
+	// Member identifies the member of a composite callee (e.g., [Fallback])
+	// which made this call, if any. Members of nested composite callees
+	// are separated by a dot.
+	Member string `json:"member,omitempty"`
+
+	// Cached is true if the response was retrieved from a cache
+	// (e.g., by [Cached]) instead of being made to the AI model.
+	Cached bool `json:"cached,omitempty"`
+
+	// Batch is true if the request was made through the provider's
+	// batch API (see [WithBatch]), in which case the batch price is used.
+	Batch bool `json:"batch,omitempty"`
 
 	// Messages sent to and received from the AI model. Note that
 	// these messages might have been sent and received multiple times
@@ -96,8 +122,10 @@ type TextRecorderCall struct {
 	// Duration is end-to-end duration of this call.
 	Duration Duration `json:"duration,omitempty"`
 
-	recorder *TextRecorder
-	start    time.Time
+	recorder            *TextRecorder
+	start               time.Time
+	price               *ModelPrice
+	promptIncludesCache bool
 }
 
 // TextRecorderMessage describes one message sent to or received
@@ -133,7 +161,15 @@ type TextRecorderMessage struct {
 	// In this case, Content is the explanation of the refusal.
 	IsRefusal bool `json:"isRefusal,omitempty"`
 
-	start time.Time
+	// MIMEType of non-textual content of the message (e.g., an image or a document).
+	// Non-textual content itself is not recorded, only its MIME type and hash.
+	MIMEType string `json:"mimeType,omitempty"`
+
+	// Hash is SHA-256 hash of non-textual content of the message, in hex.
+	Hash string `json:"hash,omitempty"`
+
+	start    time.Time
+	streamed bool
 }
 
 func (m *TextRecorderMessage) snapshot(final bool) TextRecorderMessage {
@@ -170,10 +206,24 @@ func (m *TextRecorderMessage) snapshot(final bool) TextRecorderMessage {
 		ToolCalls:    toolCalls,
 		IsError:      m.IsError,
 		IsRefusal:    m.IsRefusal,
+		MIMEType:     m.MIMEType,
+		Hash:         m.Hash,
 		start:        start,
+		streamed:     false,
 	}
 }
 
+func (m *TextRecorderMessage) totalCost() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0.0
+	for i := range m.ToolCalls {
+		total += m.ToolCalls[i].TotalCost()
+	}
+	return total
+}
+
 func (m *TextRecorderMessage) setContent(content string, isError bool) {
 	if m == nil {
 		return
@@ -234,15 +284,21 @@ func (c *TextRecorderCall) snapshot(final bool) TextRecorderCall {
 	}
 
 	return TextRecorderCall{
-		mu:         sync.Mutex{},
-		ID:         c.ID,
-		Provider:   c.Provider,
-		Messages:   messages,
-		UsedTokens: maps.Clone(c.UsedTokens),
-		UsedTime:   maps.Clone(c.UsedTime),
-		Duration:   duration,
-		recorder:   nil,
-		start:      start,
+		mu:                  sync.Mutex{},
+		ID:                  c.ID,
+		Provider:            c.Provider,
+		EmbeddingProvider:   c.EmbeddingProvider,
+		Member:              c.Member,
+		Cached:              c.Cached,
+		Batch:               c.Batch,
+		Messages:            messages,
+		UsedTokens:          maps.Clone(c.UsedTokens),
+		UsedTime:            maps.Clone(c.UsedTime),
+		Duration:            duration,
+		recorder:            nil,
+		start:               start,
+		price:               nil,
+		promptIncludesCache: false,
 	}
 }
 
@@ -272,10 +328,87 @@ func (c *TextRecorderCall) addMessage(role, content, toolID, toolName string, is
 		ToolCalls:    nil,
 		IsError:      false,
 		IsRefusal:    isRefusal,
+		MIMEType:     "",
+		Hash:         "",
 		start:        time.Time{},
+		streamed:     false,
 	})
 }
 
+// addPart records a content part. Non-textual parts are recorded
+// only with their MIME type and hash.
+func (c *TextRecorderCall) addPart(role string, part ChatContentPart) {
+	if part.Type == typeText {
+		c.addMessage(role, part.Text, "", "", false)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash := sha256.Sum256(part.Data)
+	c.Messages = append(c.Messages, TextRecorderMessage{
+		mu:           sync.Mutex{},
+		Role:         role,
+		Content:      nil,
+		ToolUseID:    "",
+		ToolUseName:  "",
+		ToolDuration: 0,
+		ToolCalls:    nil,
+		IsError:      false,
+		IsRefusal:    false,
+		MIMEType:     part.MIMEType,
+		Hash:         hex.EncodeToString(hash[:]),
+		start:        time.Time{},
+		streamed:     false,
+	})
+}
+
+// streamContent appends delta to the content of the last message if it is a message
+// with the same role which is being streamed, or starts streaming a new message.
+func (c *TextRecorderCall) streamContent(role, delta string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.Messages) > 0 {
+		m := &c.Messages[len(c.Messages)-1]
+		if m.streamed && m.Role == role {
+			content := *m.Content + delta
+			m.setContent(content, false)
+			return
+		}
+	}
+
+	c.Messages = append(c.Messages, TextRecorderMessage{
+		mu:           sync.Mutex{},
+		Role:         role,
+		Content:      &delta,
+		ToolUseID:    "",
+		ToolUseName:  "",
+		ToolDuration: 0,
+		ToolCalls:    nil,
+		IsError:      false,
+		IsRefusal:    false,
+		MIMEType:     "",
+		Hash:         "",
+		start:        time.Time{},
+		streamed:     true,
+	})
+}
+
+// discardStreamed removes messages at the end which were being streamed,
+// so that complete messages can be recorded instead.
+func (c *TextRecorderCall) discardStreamed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := len(c.Messages)
+	for i > 0 && c.Messages[i-1].streamed {
+		i--
+	}
+	c.Messages = c.Messages[:i]
+}
+
 func (c *TextRecorderCall) addUsedTokens(
 	requestID string, maxTotal, maxResponse, prompt, response int,
 	cacheCreationInputTokens, cacheReadInputTokens, thinkingTokens *int,
@@ -287,16 +420,48 @@ func (c *TextRecorderCall) addUsedTokens(
 		c.UsedTokens = map[string]TextRecorderUsedTokens{}
 	}
 
-	c.UsedTokens[requestID] = TextRecorderUsedTokens{
-		MaxTotal:                 maxTotal,
-		MaxResponse:              maxResponse,
-		Prompt:                   prompt,
-		Response:                 response,
-		Total:                    prompt + response,
-		CacheCreationInputTokens: cacheCreationInputTokens,
-		CacheReadInputTokens:     cacheReadInputTokens,
-		ThinkingTokens:           thinkingTokens,
+	c.UsedTokens[requestID] = c.withCost(*newUsedTokens(
+		maxTotal, maxResponse, prompt, response,
+		cacheCreationInputTokens, cacheReadInputTokens, thinkingTokens,
+	))
+}
+
+func (c *TextRecorderCall) setUsedTokens(requestID string, usedTokens *TextRecorderUsedTokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.UsedTokens == nil {
+		c.UsedTokens = map[string]TextRecorderUsedTokens{}
+	}
+
+	c.UsedTokens[requestID] = c.withCost(*usedTokens)
+}
+
+// withCost returns used tokens with cost set, if the price of the model is known.
+func (c *TextRecorderCall) withCost(usedTokens TextRecorderUsedTokens) TextRecorderUsedTokens {
+	if c.price != nil {
+		usedTokens.Cost = ptr(c.price.cost(usedTokens, c.promptIncludesCache))
+	}
+	return usedTokens
+}
+
+// TotalCost returns the sum of costs of all requests made to the AI model
+// during this call, including calls recorded while running tools.
+// Requests for which the price of the model is not known are not included.
+func (c *TextRecorderCall) TotalCost() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0.0
+	for _, usedTokens := range c.UsedTokens {
+		if usedTokens.Cost != nil {
+			total += *usedTokens.Cost
+		}
+	}
+	for i := range c.Messages {
+		total += c.Messages[i].totalCost()
 	}
+	return total
 }
 
 func (c *TextRecorderCall) addUsedTime(requestID string, prompt, response, apiCall time.Duration) {
@@ -358,9 +523,15 @@ func (c *TextRecorderCall) startToolMessage(ctx context.Context, toolCallID stri
 		ToolCalls:    nil,
 		IsError:      false,
 		IsRefusal:    false,
+		MIMEType:     "",
+		Hash:         "",
 		start:        time.Now(),
+		streamed:     false,
 	})
 
+	// Calls made by the tool are not made by the member which made this call.
+	ctx = context.WithValue(ctx, textRecorderMemberContextKey, "")
+
 	return context.WithValue(ctx, textRecorderContextKey, &TextRecorder{
 		mu:               sync.Mutex{},
 		calls:            nil,
@@ -370,6 +541,15 @@ func (c *TextRecorderCall) startToolMessage(ctx context.Context, toolCallID stri
 	}), &c.Messages[len(c.Messages)-1]
 }
 
+// withTextRecorderMember returns a context in which calls are recorded
+// as made by the member, nested inside any existing member.
+func withTextRecorderMember(ctx context.Context, member string) context.Context {
+	if parent, _ := ctx.Value(textRecorderMemberContextKey).(string); parent != "" {
+		member = parent + "." + member
+	}
+	return context.WithValue(ctx, textRecorderMemberContextKey, member)
+}
+
 // TextRecorder is a recorder which records all communication
 // with the AI model and track usage.
 //
@@ -385,20 +565,43 @@ type TextRecorder struct {
 	c                chan<- []TextRecorderCall
 }
 
-func (t *TextRecorder) newCall(callID string, provider TextProvider) *TextRecorderCall {
+func (t *TextRecorder) newCall(ctx context.Context, callID string, provider TextProvider) *TextRecorderCall {
+	member, _ := ctx.Value(textRecorderMemberContextKey).(string)
+	price, promptIncludesCache := providerPrice(provider, false)
+
 	return &TextRecorderCall{
-		mu:         sync.Mutex{},
-		ID:         callID,
-		Provider:   provider,
-		Messages:   nil,
-		UsedTokens: nil,
-		UsedTime:   nil,
-		Duration:   0,
-		recorder:   t,
-		start:      time.Now(),
+		mu:                  sync.Mutex{},
+		ID:                  callID,
+		Provider:            provider,
+		EmbeddingProvider:   nil,
+		Member:              member,
+		Cached:              false,
+		Batch:               false,
+		Messages:            nil,
+		UsedTokens:          nil,
+		UsedTime:            nil,
+		Duration:            0,
+		recorder:            t,
+		start:               time.Now(),
+		price:               price,
+		promptIncludesCache: promptIncludesCache,
 	}
 }
 
+func (t *TextRecorder) newEmbeddingCall(ctx context.Context, callID string, provider EmbeddingProvider) *TextRecorderCall {
+	call := t.newCall(ctx, callID, nil)
+	call.EmbeddingProvider = provider
+	call.price, call.promptIncludesCache = providerPrice(provider, false)
+	return call
+}
+
+func (t *TextRecorder) newBatchCall(ctx context.Context, callID string, provider TextProvider) *TextRecorderCall {
+	call := t.newCall(ctx, callID, provider)
+	call.Batch = true
+	call.price, call.promptIncludesCache = providerPrice(provider, true)
+	return call
+}
+
 func (t *TextRecorder) recordCall(call *TextRecorderCall) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -440,6 +643,23 @@ func (t *TextRecorder) Calls() []TextRecorderCall {
 	return t.calls
 }
 
+// TotalCost returns the sum of costs of all recorded calls,
+// including calls recorded while running tools.
+func (t *TextRecorder) TotalCost() float64 {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := 0.0
+	for i := range t.calls {
+		total += t.calls[i].TotalCost()
+	}
+	return total
+}
+
 // WithTextRecorder returns a copy of the context in which an instance
 // of [TextRecorder] is stored.
 //
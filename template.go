@@ -0,0 +1,96 @@
+package fun
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"text/template"
+
+	"gitlab.com/tozd/go/errors"
+	"gitlab.com/tozd/go/x"
+)
+
+type templateVarsContextKey struct{}
+
+// WithTemplateVars returns a copy of the context with template variables
+// which can be accessed by [Text] templates using "var" function.
+//
+// Variables are merged with any variables already in the context.
+func WithTemplateVars(ctx context.Context, vars map[string]any) context.Context {
+	v := maps.Clone(getTemplateVars(ctx))
+	if v == nil {
+		v = map[string]any{}
+	}
+	maps.Copy(v, vars)
+	return context.WithValue(ctx, templateVarsContextKey{}, v)
+}
+
+func getTemplateVars(ctx context.Context) map[string]any {
+	v, _ := ctx.Value(templateVarsContextKey{}).(map[string]any)
+	return v
+}
+
+// templateFuncs returns functions available to templates.
+// Function "var" returns template variables from the context.
+func templateFuncs(ctx context.Context) template.FuncMap {
+	vars := getTemplateVars(ctx)
+	return template.FuncMap{
+		"json": func(value any) (string, error) {
+			data, errE := x.MarshalWithoutEscapeHTML(value)
+			if errE != nil {
+				return "", errE
+			}
+			return string(data), nil
+		},
+		"indent": func(spaces int, s string) string {
+			prefix := strings.Repeat(" ", spaces)
+			return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+		},
+		"var": func(name string) (any, error) {
+			value, ok := vars[name]
+			if !ok {
+				return nil, errors.WithDetails(
+					errors.New("template variable not found"),
+					"name", name,
+				)
+			}
+			return value, nil
+		},
+	}
+}
+
+// parseTemplate parses a template. Template variables are
+// obtained from the context only when rendering.
+func parseTemplate(name, text string) (*template.Template, errors.E) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs(context.Background())).Parse(text)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return t, nil
+}
+
+// renderTemplate renders the template with inputs. If there is
+// only one input, the input itself is passed to the template,
+// otherwise the slice of all inputs is passed.
+func renderTemplate[T any](ctx context.Context, t *template.Template, data []T) (string, errors.E) {
+	t, err := t.Clone()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	t = t.Funcs(templateFuncs(ctx))
+
+	var value any = data
+	if len(data) == 1 {
+		value = data[0]
+	}
+
+	var output strings.Builder
+	err = t.Execute(&output, value)
+	if err != nil {
+		return "", errors.WithDetails(
+			errors.WithStack(err),
+			"template", t.Name(),
+		)
+	}
+	return output.String(), nil
+}
@@ -0,0 +1,132 @@
+package fun_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+type translateInput struct {
+	Text string `json:"text"`
+	Lang string `json:"lang"`
+}
+
+func testTemplate(t *testing.T, provider fun.TextProvider) {
+	t.Helper()
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	f := fun.Text[translateInput, string]{
+		Provider:          provider,
+		InputJSONSchema:   nil,
+		OutputJSONSchema:  nil,
+		Prompt:            "",
+		PromptTemplate:    `Translate into {{.Lang}} using {{var "style"}} style.`,
+		InputTemplate:     `Translate {{json .Text}} into {{.Lang}}.`,
+		Data:              []fun.InputOutput[translateInput, string]{{Input: []translateInput{{Text: "hello", Lang: "German"}}, Output: "hallo"}},
+		Tools:             nil,
+		MaxRepairAttempts: 0,
+		MaxData:           0,
+		DataScorer:        nil,
+	}
+
+	errE := f.Init(fun.WithTemplateVars(ctx, map[string]any{"style": "formal"}))
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	_, errE = f.Call(ctx, translateInput{Text: "thank you", Lang: "French"})
+	assert.ErrorContains(t, errE, "template variable not found")
+
+	output, errE := f.Call(fun.WithTemplateVars(ctx, map[string]any{"style": "casual"}), translateInput{Text: "thank you", Lang: "French"})
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "merci", output)
+}
+
+func TestOpenAITemplate(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var received []json.RawMessage
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []json.RawMessage `json:"messages"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		mu.Lock()
+		received = request.Messages
+		mu.Unlock()
+		w.Header().Set("X-Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"merci"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`))
+	})
+
+	testTemplate(t, &fun.OpenAITextProvider{ //nolint:exhaustruct
+		Client: newTestClient(t, mux),
+		APIKey: "test",
+		Model:  "gpt-4o-mini-2024-07-18",
+	})
+
+	messages := []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}{}
+	for _, message := range received {
+		var m struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}
+		err := json.Unmarshal(message, &m)
+		require.NoError(t, err)
+		messages = append(messages, m)
+	}
+
+	require.Len(t, messages, 4)
+	assert.Equal(t, "system", messages[0].Role)
+	assert.Equal(t, "Translate into French using casual style.", messages[0].Content)
+	assert.Equal(t, `Translate "hello" into German.`, messages[1].Content)
+	assert.Equal(t, "hallo", messages[2].Content)
+	assert.Equal(t, `Translate "thank you" into French.`, messages[3].Content)
+}
+
+func TestAnthropicTemplate(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var received struct {
+		System []struct {
+			Text string `json:"text"`
+		} `json:"system"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		err := json.NewDecoder(r.Body).Decode(&received)
+		require.NoError(t, err)
+		w.Header().Set("Request-Id", "req_1")
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant",` +
+			`"content":[{"type":"text","text":"merci"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":1}}`))
+	})
+
+	testTemplate(t, &fun.AnthropicTextProvider{ //nolint:exhaustruct
+		Client: newTestClient(t, mux),
+		APIKey: "test",
+		Model:  "claude-3-haiku-20240307",
+	})
+
+	require.Len(t, received.System, 1)
+	assert.Equal(t, "Translate into French using casual style.", received.System[0].Text)
+	require.Len(t, received.Messages, 3)
+	assert.Equal(t, `Translate "thank you" into French.`, lastUserContent(t, received.Messages))
+}
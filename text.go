@@ -2,11 +2,17 @@ package fun
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"slices"
+	"strings"
+	"text/template"
 
 	jsonschemaGen "github.com/invopop/jsonschema"
+	"github.com/rs/zerolog"
 	"github.com/santhosh-tekuri/jsonschema/v6"
 	"gitlab.com/tozd/go/errors"
 	"gitlab.com/tozd/go/x"
@@ -22,6 +28,10 @@ const (
 	// TextToJSONPrompt is a prompt to request only JSON output,
 	// which is then converted into the target struct.
 	TextToJSONPrompt = `Output only JSON.`
+
+	// TextRepairPrompt is a prompt to request a corrected response
+	// after the AI model responded with an invalid response.
+	TextRepairPrompt = `Respond again with a corrected response. Output only the corrected response, without any explanation.`
 )
 
 const (
@@ -34,8 +44,11 @@ const (
 	roleThinking         = "thinking"
 	roleRedactedThinking = "redacted_thinking"
 
-	typeText   = "text"
-	stopReason = "stop"
+	typeText     = "text"
+	typeImage    = "image"
+	typeDocument = "document"
+	typeUsage    = "usage"
+	stopReason   = "stop"
 )
 
 func compileValidator[T any](jsonSchema []byte) (*jsonschema.Schema, []byte, errors.E) {
@@ -75,6 +88,7 @@ func validateJSON(validator *jsonschema.Schema, data json.RawMessage) errors.E {
 	}
 	err = validator.Validate(v)
 	if err != nil {
+		metrics.validationFailures.Inc()
 		errE := errors.Prefix(err, ErrJSONSchemaValidation)
 		errors.Details(errE)["data"] = data
 		return errE
@@ -106,6 +120,130 @@ func validate(validator *jsonschema.Schema, value any) errors.E {
 	return validateJSON(validator, data)
 }
 
+// Image is an image which can be used as Input to [Text].
+// It is provided to the AI model as an image and not marshaled to JSON.
+type Image struct {
+	// MIMEType of Data. If not provided, it is detected from Data.
+	MIMEType string
+
+	// Data is the binary content of the image.
+	Data []byte
+}
+
+// Document is a document (e.g., PDF) which can be used as Input to [Text].
+// It is provided to the AI model as a document and not marshaled to JSON.
+type Document struct {
+	// MIMEType of Data. If not provided, it is detected from Data.
+	MIMEType string
+
+	// Data is the binary content of the document.
+	Data []byte
+}
+
+func detectMIMEType(mimeType string, data []byte) string {
+	if mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(data)
+}
+
+// toContentPart converts binary input (Image, Document, or []byte)
+// to a content part. It returns false for any other input.
+func toContentPart(value any) (ChatContentPart, bool) {
+	switch v := value.(type) {
+	case Image:
+		return ChatContentPart{
+			Type:     typeImage,
+			Text:     "",
+			MIMEType: detectMIMEType(v.MIMEType, v.Data),
+			Data:     v.Data,
+		}, true
+	case Document:
+		return ChatContentPart{
+			Type:     typeDocument,
+			Text:     "",
+			MIMEType: detectMIMEType(v.MIMEType, v.Data),
+			Data:     v.Data,
+		}, true
+	case []byte:
+		mimeType := http.DetectContentType(v)
+		switch {
+		case strings.HasPrefix(mimeType, "image/"):
+			return ChatContentPart{
+				Type:     typeImage,
+				Text:     "",
+				MIMEType: mimeType,
+				Data:     v,
+			}, true
+		case strings.HasPrefix(mimeType, "text/plain"):
+			return ChatContentPart{
+				Type:     typeText,
+				Text:     string(v),
+				MIMEType: "",
+				Data:     nil,
+			}, true
+		default:
+			return ChatContentPart{
+				Type:     typeDocument,
+				Text:     "",
+				MIMEType: mimeType,
+				Data:     v,
+			}, true
+		}
+	default:
+		return ChatContentPart{}, false //nolint:exhaustruct
+	}
+}
+
+// toInputMessage converts inputs to a message. Binary inputs are provided
+// as content parts, all other inputs are provided as textual content.
+func toInputMessage[T any](data []T) (ChatMessage, errors.E) {
+	binary := false
+	for _, d := range data {
+		if _, ok := toContentPart(d); ok {
+			binary = true
+			break
+		}
+	}
+
+	if !binary {
+		i, errE := toInputString(data)
+		if errE != nil {
+			return ChatMessage{}, errE //nolint:exhaustruct
+		}
+
+		return ChatMessage{
+			Role:    roleUser,
+			Content: i,
+			Parts:   nil,
+		}, nil
+	}
+
+	parts := []ChatContentPart{}
+	for _, d := range data {
+		part, ok := toContentPart(d)
+		if !ok {
+			i, errE := toInputString([]T{d})
+			if errE != nil {
+				return ChatMessage{}, errE //nolint:exhaustruct
+			}
+			part = ChatContentPart{
+				Type:     typeText,
+				Text:     i,
+				MIMEType: "",
+				Data:     nil,
+			}
+		}
+		parts = append(parts, part)
+	}
+
+	return ChatMessage{
+		Role:    roleUser,
+		Content: "",
+		Parts:   parts,
+	}, nil
+}
+
 func toInputString[T any](data []T) (string, errors.E) {
 	if len(data) == 1 {
 		// TODO: Use type assertion on type parameter.
@@ -158,7 +296,9 @@ type InputOutput[Input, Output any] struct {
 // It uses a text-based AI model provided by a [TextProvider].
 //
 // For non-string Input types, it marshals them to JSON before
-// providing them to the AI model, and for non-string Output types,
+// providing them to the AI model, except for [Image], [Document],
+// and []byte Input types which are provided as images and documents
+// (based on their MIME type). For non-string Output types,
 // it unmarshals model outputs from JSON to Output type.
 // For this to work, Input and Output types should have a
 // JSON representation.
@@ -177,14 +317,54 @@ type Text[Input, Output any] struct {
 	// Prompt is a natural language description of the logic.
 	Prompt string
 
+	// PromptTemplate is a Go [text/template] for the prompt, rendered for each call.
+	// It can be used instead of Prompt when the prompt depends on inputs. Inputs
+	// are passed to the template (a single input directly, multiple inputs as a slice).
+	// Besides standard functions, "json" (converts a value to JSON), "indent" (indents
+	// all lines by the number of spaces), and "var" (returns a variable set with
+	// [WithTemplateVars]) functions are available. The rendered prompt and examples
+	// from Data are sent with each call, so providers cannot cache them in advance.
+	// The provider must implement [WithConversation] interface to use this.
+	PromptTemplate string
+
+	// InputTemplate is a Go [text/template] used to convert inputs into the message
+	// to the AI model, instead of providing inputs as they are or as JSON. Inputs and
+	// functions available are the same as for PromptTemplate. Image and document
+	// inputs are provided after the rendered template. It is used for inputs
+	// in Data as well.
+	InputTemplate string
+
 	// Data are example inputs with corresponding outputs for the function.
 	Data []InputOutput[Input, Output]
 
 	// Tools that can be called by the AI model.
 	Tools map[string]TextTooler
 
+	// MaxRepairAttempts is the maximum number of times the AI model is asked
+	// to correct its response when the response cannot be parsed or fails to
+	// validate against OutputJSONSchema. Parsing and validation errors are
+	// sent to the AI model in a follow-up message. Default is 0, which
+	// disables repairing. The provider must implement [WithConversation]
+	// interface to use repairing.
+	MaxRepairAttempts int
+
+	// MaxData is the maximum number of examples from Data provided to the
+	// AI model with each call. If set and there are more examples in Data,
+	// for each call only the most relevant examples as scored by DataScorer are
+	// provided, after the prompt and before the input. Default is 0, which
+	// provides all examples with every call. The provider must implement
+	// [WithConversation] interface to use this.
+	MaxData int
+
+	// DataScorer scores relevance of examples from Data to inputs.
+	// It is required when MaxData is set.
+	DataScorer DataScorer[Input, Output]
+
 	inputValidator  *jsonschema.Schema
 	outputValidator *jsonschema.Schema
+	data            [][]ChatMessage
+	promptTemplate  *template.Template
+	inputTemplate   *template.Template
 }
 
 // Init implements [Callee] interface.
@@ -211,49 +391,105 @@ func (t *Text[Input, Output]) Init(ctx context.Context) errors.E {
 		t.OutputJSONSchema = outputSchema
 	}
 
+	if t.Prompt != "" && t.PromptTemplate != "" {
+		return errors.New("Prompt and PromptTemplate cannot be both set")
+	}
+
+	if t.PromptTemplate != "" {
+		if _, ok := t.Provider.(WithConversation); !ok {
+			return errors.New("provider does not support conversations, but PromptTemplate is set")
+		}
+
+		t.promptTemplate, errE = parseTemplate("prompt", t.PromptTemplate)
+		if errE != nil {
+			return errE
+		}
+	}
+
+	if t.InputTemplate != "" {
+		t.inputTemplate, errE = parseTemplate("input", t.InputTemplate)
+		if errE != nil {
+			return errE
+		}
+	}
+
 	messages := []ChatMessage{}
 	if t.Prompt != "" {
 		messages = append(messages, ChatMessage{
 			Role:    roleSystem,
 			Content: t.Prompt,
+			Parts:   nil,
 		})
 	}
 
-	for _, data := range t.Data {
-		for _, i := range data.Input {
+	data := [][]ChatMessage{}
+	for _, d := range t.Data {
+		for _, i := range d.Input {
 			errE = validate(t.inputValidator, i)
 			if errE != nil {
 				return errE
 			}
 		}
-		input, errE := toInputString(data.Input)
+		input, errE := t.inputMessage(ctx, d.Input)
 		if errE != nil {
 			return errE
 		}
 
-		errE = validate(t.outputValidator, data.Output)
+		errE = validate(t.outputValidator, d.Output)
 		if errE != nil {
 			return errE
 		}
-		output, errE := toOutputString(data.Output)
+		output, errE := toOutputString(d.Output)
 		if errE != nil {
 			return errE
 		}
 
-		messages = append(messages, ChatMessage{
-			Role:    roleUser,
-			Content: input,
-		})
-		messages = append(messages, ChatMessage{
+		data = append(data, []ChatMessage{input, {
 			Role:    roleAssistant,
 			Content: output,
-		})
+			Parts:   nil,
+		}})
 	}
 
-	if len(messages) == 0 {
+	if len(messages) == 0 && len(data) == 0 && t.promptTemplate == nil {
 		return errors.New("prompt and training data are missing, at least one of them has to be provided")
 	}
 
+	if t.MaxRepairAttempts > 0 {
+		if _, ok := t.Provider.(WithConversation); !ok {
+			return errors.New("provider does not support conversations, but MaxRepairAttempts is set")
+		}
+	}
+
+	if t.MaxData < 0 {
+		return errors.New("MaxData cannot be negative")
+	}
+	if t.MaxData > 0 && t.DataScorer == nil {
+		return errors.New("DataScorer is missing, but MaxData is set")
+	}
+
+	if t.MaxData > 0 && len(data) > t.MaxData {
+		if _, ok := t.Provider.(WithConversation); !ok {
+			return errors.New("provider does not support conversations, but MaxData is set")
+		}
+
+		errE = t.DataScorer.Init(ctx, t.Data)
+		if errE != nil {
+			return errE
+		}
+
+		// Examples are selected for each call, so we do not provide them to the provider.
+		t.data = data
+	} else if t.promptTemplate != nil {
+		// Examples have to follow the prompt which is rendered for each call,
+		// so we do not provide them to the provider.
+		t.data = data
+	} else {
+		for _, d := range data {
+			messages = append(messages, d...)
+		}
+	}
+
 	errE = t.Provider.Init(ctx, messages)
 	if errE != nil {
 		return errE
@@ -281,7 +517,59 @@ func (t *Text[Input, Output]) Init(ctx context.Context) errors.E {
 }
 
 // Call implements [Callee] interface.
-func (t *Text[Input, Output]) Call(ctx context.Context, input ...Input) (Output, errors.E) { //nolint:ireturn
+func (t *Text[Input, Output]) Call(ctx context.Context, input ...Input) (_ Output, errE errors.E) { //nolint:ireturn
+	ctx, span := startSpan(ctx, "Text.Call", t.Provider)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	return t.call(ctx, input, func(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+		if len(messages) == 1 {
+			return t.Provider.Chat(ctx, messages[0])
+		}
+		return t.Provider.(WithConversation).ChatConversation(ctx, messages) //nolint:errcheck,forcetypeassert
+	})
+}
+
+// Stream is like Call, but it streams the response from the provider as it
+// is being generated, calling fn for every received event.
+//
+// The provider must implement [WithStreaming] interface. Output is still
+// returned only once the whole response has been received, parsed, and validated.
+// Repair attempts (see MaxRepairAttempts) are not streamed.
+func (t *Text[Input, Output]) Stream( //nolint:ireturn
+	ctx context.Context, fn func(event TextStreamEvent) errors.E, input ...Input,
+) (_ Output, errE errors.E) {
+	provider, ok := t.Provider.(WithStreaming)
+	if !ok {
+		return *new(Output), errors.New("provider does not support streaming")
+	}
+
+	ctx, span := startSpan(ctx, "Text.Stream", t.Provider)
+	defer func() {
+		endSpan(span, errE)
+	}()
+
+	streamed := false
+	return t.call(ctx, input, func(ctx context.Context, messages []ChatMessage) (string, errors.E) {
+		if streamed {
+			return t.Provider.(WithConversation).ChatConversation(ctx, messages) //nolint:errcheck,forcetypeassert
+		}
+		streamed = true
+		if len(messages) == 1 {
+			return provider.ChatStream(ctx, messages[0], fn)
+		}
+		return provider.ChatConversationStream(ctx, messages, fn)
+	})
+}
+
+// call validates inputs, calls chat with messages for inputs (see messages method),
+// and parses and validates the output.
+// If parsing or validation fails, it repeatedly calls chat again with the whole exchange and
+// a message asking the AI model to repair its response, up to MaxRepairAttempts times.
+func (t *Text[Input, Output]) call( //nolint:ireturn
+	ctx context.Context, input []Input, chat func(ctx context.Context, messages []ChatMessage) (string, errors.E),
+) (Output, errors.E) {
 	for _, i := range input {
 		errE := validate(t.inputValidator, i)
 		if errE != nil {
@@ -289,19 +577,155 @@ func (t *Text[Input, Output]) Call(ctx context.Context, input ...Input) (Output,
 		}
 	}
 
-	i, errE := toInputString(input)
+	messages, errE := t.messages(ctx, input)
 	if errE != nil {
 		return *new(Output), errE
 	}
 
-	content, errE := t.Provider.Chat(ctx, ChatMessage{
+	for attempt := 0; ; attempt++ {
+		content, errE := chat(ctx, messages)
+		if errE != nil {
+			return *new(Output), errE
+		}
+
+		output, errE := t.parseOutput(content)
+		if errE == nil || attempt >= t.MaxRepairAttempts {
+			return output, errE
+		}
+
+		zerolog.Ctx(ctx).Debug().Err(errE).Int("attempt", attempt+1).Msg("repairing output")
+
+		messages = append(messages, ChatMessage{
+			Role:    roleAssistant,
+			Content: content,
+			Parts:   nil,
+		}, ChatMessage{
+			Role:    roleUser,
+			Content: repairPrompt(errE),
+			Parts:   nil,
+		})
+	}
+}
+
+// messages returns messages for inputs: the rendered PromptTemplate (if set),
+// selected examples (if MaxData is used), and the input message.
+func (t *Text[Input, Output]) messages(ctx context.Context, input []Input) ([]ChatMessage, errors.E) {
+	messages := []ChatMessage{}
+	if t.promptTemplate != nil {
+		prompt, errE := renderTemplate(ctx, t.promptTemplate, input)
+		if errE != nil {
+			return nil, errE
+		}
+		messages = append(messages, ChatMessage{
+			Role:    roleSystem,
+			Content: prompt,
+			Parts:   nil,
+		})
+	}
+
+	data, errE := t.dataMessages(ctx, input)
+	if errE != nil {
+		return nil, errE
+	}
+	messages = append(messages, data...)
+
+	message, errE := t.inputMessage(ctx, input)
+	if errE != nil {
+		return nil, errE
+	}
+	return append(messages, message), nil
+}
+
+// inputMessage converts inputs to a message. If InputTemplate is set, the rendered
+// template is provided as textual content, followed by any binary inputs.
+func (t *Text[Input, Output]) inputMessage(ctx context.Context, input []Input) (ChatMessage, errors.E) {
+	if t.inputTemplate == nil {
+		return toInputMessage(input)
+	}
+
+	text, errE := renderTemplate(ctx, t.inputTemplate, input)
+	if errE != nil {
+		return ChatMessage{}, errE //nolint:exhaustruct
+	}
+
+	parts := []ChatContentPart{}
+	for _, i := range input {
+		if part, ok := toContentPart(i); ok {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return ChatMessage{
+			Role:    roleUser,
+			Content: text,
+			Parts:   nil,
+		}, nil
+	}
+
+	return ChatMessage{
 		Role:    roleUser,
-		Content: i,
-	})
+		Content: "",
+		Parts: append([]ChatContentPart{{
+			Type:     typeText,
+			Text:     text,
+			MIMEType: "",
+			Data:     nil,
+		}}, parts...),
+	}, nil
+}
+
+// dataMessages returns messages for at most MaxData examples from Data which are
+// the most relevant to the input (or all examples if MaxData is not used). Examples are returned in the same order as they
+// are in Data so that the same selection results in the same messages, which
+// allows providers to use prompt caching. It returns no messages if examples
+// are not selected for each call.
+func (t *Text[Input, Output]) dataMessages(ctx context.Context, input []Input) ([]ChatMessage, errors.E) {
+	if t.data == nil {
+		return []ChatMessage{}, nil
+	}
+
+	if t.MaxData == 0 || len(t.data) <= t.MaxData {
+		messages := []ChatMessage{}
+		for _, d := range t.data {
+			messages = append(messages, d...)
+		}
+		return messages, nil
+	}
+
+	scores, errE := t.DataScorer.Score(ctx, input)
 	if errE != nil {
-		return *new(Output), errE
+		return nil, errE
 	}
+	if len(scores) != len(t.data) {
+		return nil, errors.WithDetails(
+			errors.New("unexpected number of scores"),
+			"number", len(scores),
+			"expected", len(t.data),
+		)
+	}
+
+	indices := make([]int, len(t.data))
+	for i := range indices {
+		indices[i] = i
+	}
+	// Sorting is stable so that for equal scores earlier examples are preferred.
+	slices.SortStableFunc(indices, func(a, b int) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+	indices = indices[:t.MaxData]
+	slices.Sort(indices)
+
+	zerolog.Ctx(ctx).Debug().Ints("data", indices).Msg("selected data")
 
+	messages := []ChatMessage{}
+	for _, i := range indices {
+		messages = append(messages, t.data[i]...)
+	}
+	return messages, nil
+}
+
+func (t *Text[Input, Output]) parseOutput(content string) (Output, errors.E) { //nolint:ireturn
 	var output Output
 
 	// TODO: Use type assertion on type parameter.
@@ -311,13 +735,13 @@ func (t *Text[Input, Output]) Call(ctx context.Context, input ...Input) (Output,
 	case string:
 		output = any(content).(Output) //nolint:errcheck,forcetypeassert
 	default:
-		errE = x.UnmarshalWithoutUnknownFields([]byte(content), &output)
+		errE := x.UnmarshalWithoutUnknownFields([]byte(content), &output)
 		if errE != nil {
 			return output, errE
 		}
 	}
 
-	errE = validate(t.outputValidator, output)
+	errE := validate(t.outputValidator, output)
 	if errE != nil {
 		return output, errE
 	}
@@ -325,6 +749,34 @@ func (t *Text[Input, Output]) Call(ctx context.Context, input ...Input) (Output,
 	return output, nil
 }
 
+// repairPrompt returns a message to the AI model explaining why its response is invalid.
+// For JSON Schema validation errors it lists the location of each error in the response
+// (as JSON Pointer) together with the error message.
+func repairPrompt(errE errors.E) string {
+	var prompt strings.Builder
+	prompt.WriteString("Your response is invalid:\n")
+
+	var validationError *jsonschema.ValidationError
+	if errors.As(errE, &validationError) {
+		for _, unit := range validationError.BasicOutput().Errors {
+			if unit.Error == nil {
+				continue
+			}
+			location := unit.InstanceLocation
+			if location == "" {
+				location = "(root)"
+			}
+			fmt.Fprintf(&prompt, "- at %s: %s\n", location, unit.Error.String())
+		}
+	} else {
+		fmt.Fprintf(&prompt, "- %s\n", errE.Error())
+	}
+
+	prompt.WriteString("\n")
+	prompt.WriteString(TextRepairPrompt)
+	return prompt.String()
+}
+
 // Variadic implements [Callee] interface.
 func (t *Text[Input, Output]) Variadic() func(ctx context.Context, input ...Input) (Output, errors.E) {
 	return func(ctx context.Context, input ...Input) (Output, errors.E) {
@@ -338,3 +790,44 @@ func (t *Text[Input, Output]) Unary() func(ctx context.Context, input Input) (Ou
 		return t.Call(ctx, input)
 	}
 }
+
+// cacheConfig returns the provider and configuration included in cache keys.
+// DataScorer is not included because scorers (e.g., [EmbeddingDataScorer])
+// often cannot be marshaled to JSON.
+func (t *Text[Input, Output]) cacheConfig() (TextProvider, any) {
+	type tool struct {
+		Description     string          `json:"description"`
+		InputJSONSchema json.RawMessage `json:"inputJsonSchema"`
+	}
+	tools := map[string]tool{}
+	for name, tt := range t.Tools {
+		tools[name] = tool{
+			Description:     tt.GetDescription(),
+			InputJSONSchema: tt.GetInputJSONSchema(),
+		}
+	}
+
+	return t.Provider, struct {
+		Provider          TextProvider                 `json:"provider"`
+		InputJSONSchema   json.RawMessage              `json:"inputJsonSchema"`
+		OutputJSONSchema  json.RawMessage              `json:"outputJsonSchema"`
+		Prompt            string                       `json:"prompt"`
+		PromptTemplate    string                       `json:"promptTemplate,omitempty"`
+		InputTemplate     string                       `json:"inputTemplate,omitempty"`
+		Data              []InputOutput[Input, Output] `json:"data"`
+		Tools             map[string]tool              `json:"tools"`
+		MaxRepairAttempts int                          `json:"maxRepairAttempts"`
+		MaxData           int                          `json:"maxData"`
+	}{
+		Provider:          t.Provider,
+		InputJSONSchema:   t.InputJSONSchema,
+		OutputJSONSchema:  t.OutputJSONSchema,
+		Prompt:            t.Prompt,
+		PromptTemplate:    t.PromptTemplate,
+		InputTemplate:     t.InputTemplate,
+		Data:              t.Data,
+		Tools:             tools,
+		MaxRepairAttempts: t.MaxRepairAttempts,
+		MaxData:           t.MaxData,
+	}
+}
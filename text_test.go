@@ -1,10 +1,16 @@
 package fun_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"slices"
 	"testing"
 	"time"
@@ -109,12 +115,10 @@ var providers = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("OLLAMA_HOST") == "" {
-				t.Skip("OLLAMA_HOST is not available")
-			}
+			client, base := cassetteClient(t, "OLLAMA_HOST", "http://localhost:11434")
 			return &fun.OllamaTextProvider{
-				Client:            nil,
-				Base:              os.Getenv("OLLAMA_HOST"),
+				Client:            client,
+				Base:              base,
 				Model:             "llama3.1:70b",
 				MaxContextLength:  0,
 				MaxResponseLength: 0,
@@ -128,12 +132,10 @@ var providers = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("GROQ_API_KEY") == "" {
-				t.Skip("GROQ_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "GROQ_API_KEY", "test")
 			return &fun.GroqTextProvider{
-				Client:                 nil,
-				APIKey:                 os.Getenv("GROQ_API_KEY"),
+				Client:                 client,
+				APIKey:                 apiKey,
 				Model:                  "moonshotai/kimi-k2-instruct-0905",
 				RequestsPerMinuteLimit: 100,
 				MaxContextLength:       0,
@@ -148,12 +150,10 @@ var providers = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("ANTHROPIC_API_KEY") == "" {
-				t.Skip("ANTHROPIC_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "ANTHROPIC_API_KEY", "test")
 			return &fun.AnthropicTextProvider{
-				Client:          nil,
-				APIKey:          os.Getenv("ANTHROPIC_API_KEY"),
+				Client:          client,
+				APIKey:          apiKey,
 				Model:           "claude-3-7-sonnet-20250219",
 				PromptCaching:   true,
 				ReasoningBudget: 32000,
@@ -166,12 +166,10 @@ var providers = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("OPENAI_API_KEY") == "" {
-				t.Skip("OPENAI_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "OPENAI_API_KEY", "test")
 			return &fun.OpenAITextProvider{
-				Client:                nil,
-				APIKey:                os.Getenv("OPENAI_API_KEY"),
+				Client:                client,
+				APIKey:                apiKey,
 				Model:                 "gpt-4o-mini-2024-07-18",
 				MaxContextLength:      128_000,
 				MaxResponseLength:     16_384,
@@ -221,12 +219,10 @@ var providersForTools = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("OLLAMA_HOST") == "" {
-				t.Skip("OLLAMA_HOST is not available")
-			}
+			client, base := cassetteClient(t, "OLLAMA_HOST", "http://localhost:11434")
 			return &fun.OllamaTextProvider{
-				Client:            nil,
-				Base:              os.Getenv("OLLAMA_HOST"),
+				Client:            client,
+				Base:              base,
 				Model:             "llama3.1:70b",
 				MaxContextLength:  0,
 				MaxResponseLength: 0,
@@ -240,12 +236,10 @@ var providersForTools = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("GROQ_API_KEY") == "" {
-				t.Skip("GROQ_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "GROQ_API_KEY", "test")
 			return &fun.GroqTextProvider{
-				Client:                 nil,
-				APIKey:                 os.Getenv("GROQ_API_KEY"),
+				Client:                 client,
+				APIKey:                 apiKey,
 				Model:                  "moonshotai/kimi-k2-instruct-0905",
 				RequestsPerMinuteLimit: 100,
 				MaxContextLength:       0,
@@ -260,12 +254,10 @@ var providersForTools = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("ANTHROPIC_API_KEY") == "" {
-				t.Skip("ANTHROPIC_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "ANTHROPIC_API_KEY", "test")
 			return &fun.AnthropicTextProvider{
-				Client:          nil,
-				APIKey:          os.Getenv("ANTHROPIC_API_KEY"),
+				Client:          client,
+				APIKey:          apiKey,
 				Model:           "claude-3-7-sonnet-20250219",
 				PromptCaching:   true,
 				ReasoningBudget: 32000,
@@ -278,12 +270,10 @@ var providersForTools = []testProvider{
 		func(t *testing.T) fun.TextProvider {
 			t.Helper()
 
-			if os.Getenv("OPENAI_API_KEY") == "" {
-				t.Skip("OPENAI_API_KEY is not available")
-			}
+			client, apiKey := cassetteClient(t, "OPENAI_API_KEY", "test")
 			return &fun.OpenAITextProvider{
-				Client:                nil,
-				APIKey:                os.Getenv("OPENAI_API_KEY"),
+				Client:                client,
+				APIKey:                apiKey,
 				Model:                 "gpt-4o-mini-2024-07-18",
 				MaxContextLength:      128_000,
 				MaxResponseLength:     16_384,
@@ -698,6 +688,181 @@ func TestTextTools(t *testing.T) { //nolint:paralleltest,tparallel
 	})
 }
 
+func TestTextStream(t *testing.T) { //nolint:paralleltest,tparallel
+	// We do not run test cases in parallel, so that we can run Ollama tests in sequence.
+
+	for _, provider := range providersForTools {
+		t.Run(provider.Name, func(t *testing.T) {
+			if provider.Name != "ollama" {
+				t.Parallel()
+			}
+
+			f := fun.Text[string, string]{
+				Provider:         provider.Provider(t),
+				InputJSONSchema:  jsonSchemaString,
+				OutputJSONSchema: jsonSchemaString,
+				Prompt:           "Repeat the input twice, by concatenating the input string without any space. Return only the resulting string. Do not explain anything. You must use the tool.",
+				Data:             nil,
+				Tools:            tools(),
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			events := []fun.TextStreamEvent{}
+			output, errE := f.Stream(ct, func(event fun.TextStreamEvent) errors.E {
+				events = append(events, event)
+				return nil
+			}, "foo")
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "foofoo", output)
+
+			counts := map[string]int{}
+			for _, event := range events {
+				counts[event.Type]++
+				assert.NotEmpty(t, event.APIRequest)
+			}
+			eventsJSON, err := json.MarshalIndent(events, "", "  ")
+			require.NoError(t, err)
+			assert.Equal(t, 1, counts["tool_use"], string(eventsJSON))
+			assert.Equal(t, 1, counts["tool_result"], string(eventsJSON))
+			assert.Positive(t, counts["text"], string(eventsJSON))
+			assert.Equal(t, len(fun.GetTextRecorder(ct).Calls()[0].UsedTokens), counts["usage"], string(eventsJSON))
+
+			// Streamed messages should be replaced with complete messages.
+			messages := fun.GetTextRecorder(ct).Calls()[0].Messages
+			assert.Equal(t, "foofoo", *messages[len(messages)-1].Content)
+		})
+	}
+}
+
+func redImage(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.RGBA{R: 255, G: 0, B: 0, A: 255}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// testPDF is a minimal PDF document.
+var testPDF = []byte("%PDF-1.4\n%%EOF\n")
+
+// contentPartsMessage returns a user message with a text, an image (redImage),
+// and a document (testPDF) content part, using provided MIME types.
+func contentPartsMessage(t *testing.T, imageMIMEType, documentMIMEType string) fun.ChatMessage {
+	t.Helper()
+
+	return fun.ChatMessage{
+		Role:    "user",
+		Content: "",
+		Parts: []fun.ChatContentPart{
+			{Type: "text", Text: "Describe.", MIMEType: "", Data: nil},
+			{Type: "image", Text: "", MIMEType: imageMIMEType, Data: redImage(t)},
+			{Type: "document", Text: "", MIMEType: documentMIMEType, Data: testPDF},
+		},
+	}
+}
+
+func TestTextImage(t *testing.T) {
+	t.Parallel()
+
+	data := redImage(t)
+	hash := sha256.Sum256(data)
+
+	for _, provider := range providers {
+		if provider.Name != "anthropic" && provider.Name != "openai" {
+			continue
+		}
+
+		t.Run(provider.Name, func(t *testing.T) {
+			t.Parallel()
+
+			f := fun.Text[[]byte, string]{
+				Provider:         provider.Provider(t),
+				InputJSONSchema:  nil,
+				OutputJSONSchema: jsonSchemaString,
+				Prompt:           "Return just the color of the image as one lowercase English word.",
+				Data:             nil,
+				Tools:            nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			output, errE := f.Call(ct, data)
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.Equal(t, "red", output)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			callsJSON, err := json.MarshalIndent(calls, "", "  ")
+			require.NoError(t, err)
+			if assert.Len(t, calls, 1, string(callsJSON)) {
+				found := false
+				for _, m := range calls[0].Messages { //nolint:govet
+					if m.Role == "user" {
+						assert.Nil(t, m.Content, string(callsJSON))
+						assert.Equal(t, "image/png", m.MIMEType, string(callsJSON))
+						assert.Equal(t, hex.EncodeToString(hash[:]), m.Hash, string(callsJSON))
+						found = true
+					}
+				}
+				assert.True(t, found, string(callsJSON))
+			}
+		})
+	}
+}
+
+func TestTextRepair(t *testing.T) { //nolint:paralleltest,tparallel
+	// We do not run test cases in parallel, so that we can run Ollama tests in sequence.
+
+	for _, provider := range providers {
+		t.Run(provider.Name, func(t *testing.T) {
+			if provider.Name != "ollama" {
+				t.Parallel()
+			}
+
+			f := fun.Text[int, int]{
+				Provider:          provider.Provider(t),
+				InputJSONSchema:   nil,
+				OutputJSONSchema:  []byte(`{"type": "integer", "minimum": 10}`),
+				Prompt:            "Return the input number. Output only the number.",
+				PromptTemplate:    "",
+				InputTemplate:     "",
+				Data:              nil,
+				Tools:             nil,
+				MaxRepairAttempts: 2,
+				MaxData:           0,
+				DataScorer:        nil,
+			}
+
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+			errE := f.Init(ctx)
+			require.NoError(t, errE, "% -+#.1v", errE)
+
+			ct := fun.WithTextRecorder(ctx)
+			output, errE := f.Call(ct, 5)
+			require.NoError(t, errE, "% -+#.1v", errE)
+			assert.GreaterOrEqual(t, output, 10)
+
+			calls := fun.GetTextRecorder(ct).Calls()
+			callsJSON, err := json.MarshalIndent(calls, "", "  ")
+			require.NoError(t, err)
+			// Every repair attempt is recorded as a separate call.
+			assert.GreaterOrEqual(t, len(calls), 2, string(callsJSON))
+		})
+	}
+}
+
 func TestTextStruct(t *testing.T) { //nolint:paralleltest,tparallel
 	// We do not run test cases in parallel, so that we can run Ollama tests in sequence.
 
@@ -768,14 +933,12 @@ func TestTextStruct(t *testing.T) { //nolint:paralleltest,tparallel
 func TestOpenAIJSONSchema(t *testing.T) {
 	t.Parallel()
 
-	if os.Getenv("OPENAI_API_KEY") == "" {
-		t.Skip("OPENAI_API_KEY is not available")
-	}
-
 	for _, tt := range tests {
 		t.Run(tt.Name, func(t *testing.T) {
 			t.Parallel()
 
+			client, apiKey := cassetteClient(t, "OPENAI_API_KEY", "test")
+
 			data := []fun.InputOutput[string, OutputStructWithoutOmitEmpty]{}
 			for _, d := range tt.Data {
 				data = append(data, fun.InputOutput[string, OutputStructWithoutOmitEmpty]{
@@ -786,8 +949,8 @@ func TestOpenAIJSONSchema(t *testing.T) {
 
 			f := fun.Text[string, OutputStructWithoutOmitEmpty]{
 				Provider: &fun.OpenAITextProvider{
-					Client:                nil,
-					APIKey:                os.Getenv("OPENAI_API_KEY"),
+					Client:                client,
+					APIKey:                apiKey,
 					Model:                 "gpt-4o-mini-2024-07-18",
 					MaxContextLength:      128_000,
 					MaxResponseLength:     16_384,
@@ -0,0 +1,122 @@
+package fun
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "gitlab.com/tozd/go/fun"
+
+const (
+	operationChat        = "chat"
+	operationEmbeddings  = "embeddings"
+	operationExecuteTool = "execute_tool"
+)
+
+// apiRequestKey is the attribute with the API request ID.
+const apiRequestKey = attribute.Key("fun.api_request")
+
+type tracerProviderContextKey struct{}
+
+// WithTracerProvider returns a copy of the context with the OpenTelemetry
+// tracer provider used to create spans for calls made with the context.
+//
+// If no tracer provider is set, the global tracer provider is used.
+func WithTracerProvider(ctx context.Context, provider trace.TracerProvider) context.Context {
+	return context.WithValue(ctx, tracerProviderContextKey{}, provider)
+}
+
+func tracer(ctx context.Context) trace.Tracer { //nolint:ireturn
+	provider, ok := ctx.Value(tracerProviderContextKey{}).(trace.TracerProvider)
+	if !ok {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// providerAttributes returns GenAI semantic conventions' attributes for
+// the provider and the model it uses. Provider types match provider
+// names of GenAI semantic conventions.
+func providerAttributes(provider any) (string, []attribute.KeyValue) {
+	providerType, model := providerTypeModel(provider)
+	attrs := []attribute.KeyValue{}
+	if providerType != "" {
+		attrs = append(attrs, semconv.GenAIProviderNameKey.String(providerType))
+	}
+	if model != "" {
+		attrs = append(attrs, semconv.GenAIRequestModel(model))
+	}
+	return model, attrs
+}
+
+// startSpan starts a span for a call to a callee using the provider.
+func startSpan(ctx context.Context, name string, provider any) (context.Context, trace.Span) { //nolint:ireturn
+	_, attrs := providerAttributes(provider)
+	return tracer(ctx).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startAPIRequestSpan starts a span for an API request to the provider.
+// The span is named following GenAI semantic conventions.
+func startAPIRequestSpan(ctx context.Context, operation string, provider any, attrs ...attribute.KeyValue) (context.Context, trace.Span) { //nolint:ireturn
+	model, providerAttrs := providerAttributes(provider)
+	name := operation
+	if model != "" {
+		name += " " + model
+	}
+	return tracer(ctx).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.GenAIOperationNameKey.String(operation)),
+		trace.WithAttributes(providerAttrs...),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// startToolSpan starts a span for a tool call.
+func startToolSpan(ctx context.Context, name, toolCallID string) (context.Context, trace.Span) { //nolint:ireturn
+	return tracer(ctx).Start(ctx, operationExecuteTool+" "+name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			semconv.GenAIOperationNameKey.String(operationExecuteTool),
+			semconv.GenAIToolName(name),
+			semconv.GenAIToolCallID(toolCallID),
+			semconv.GenAIToolType("function"),
+		),
+	)
+}
+
+// startRateLimiterSpan starts a span for waiting on a rate limiter.
+//
+// The rate limiter key is not recorded because it contains the API key.
+func startRateLimiterSpan(ctx context.Context) (context.Context, trace.Span) { //nolint:ireturn
+	return tracer(ctx).Start(ctx, "rate limit")
+}
+
+// endRateLimiterSpan sets attributes with the delay and limits which caused it and ends the span.
+func endRateLimiterSpan(span trace.Span, delay time.Duration, limits []string, errE errors.E) {
+	span.SetAttributes(
+		attribute.Int64("fun.rate_limiter.delay_ms", delay.Milliseconds()),
+		attribute.StringSlice("fun.rate_limiter.limits", limits),
+	)
+	endSpan(span, errE)
+}
+
+// setSpanError records the error (if any) on the span.
+func setSpanError(span trace.Span, errE errors.E) {
+	if errE != nil {
+		span.RecordError(errE)
+		span.SetStatus(codes.Error, errE.Error())
+	}
+}
+
+// endSpan records the error (if any) on the span and ends the span.
+func endSpan(span trace.Span, errE errors.E) {
+	setSpanError(span, errE)
+	span.End()
+}
@@ -0,0 +1,161 @@
+package fun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"gitlab.com/tozd/go/fun"
+)
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		require.NoError(t, err)
+		last := request.Messages[len(request.Messages)-1]
+		w.Header().Set("X-Request-Id", "req_"+last.Role)
+		switch {
+		case last.Role == "user" && last.Content == "outer":
+			_, _ = w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini-2024-07-18","choices":[{"index":0,"message":{"role":"assistant",` +
+				`"tool_calls":[{"id":"call_1","type":"function","function":{"name":"repeat_string","arguments":"{\"string\":\"inner\"}"}}]},` +
+				`"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+		case last.Role == "user":
+			_, _ = w.Write([]byte(`{"id":"chatcmpl-2","model":"gpt-4o-mini-2024-07-18","choices":[{"index":0,"message":{"role":"assistant",` +
+				`"content":"innerinner"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`))
+		default:
+			_, _ = w.Write([]byte(`{"id":"chatcmpl-3","model":"gpt-4o-mini-2024-07-18","choices":[{"index":0,"message":{"role":"assistant",` +
+				`"content":"done"},"finish_reason":"stop"}],"usage":{"prompt_tokens":20,"completion_tokens":1,"total_tokens":21}}`))
+		}
+	})
+
+	client := newTestClient(t, mux)
+
+	newText := func(tools map[string]fun.TextTooler) *fun.Text[string, string] {
+		return &fun.Text[string, string]{
+			Provider: &fun.OpenAITextProvider{ //nolint:exhaustruct
+				Client: client,
+				APIKey: "test",
+				Model:  "gpt-4o-mini-2024-07-18",
+			},
+			InputJSONSchema:   nil,
+			OutputJSONSchema:  nil,
+			Prompt:            "Repeat the input.",
+			PromptTemplate:    "",
+			InputTemplate:     "",
+			Data:              nil,
+			Tools:             tools,
+			MaxRepairAttempts: 0,
+			MaxData:           0,
+			DataScorer:        nil,
+		}
+	}
+
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(t.Context())
+
+	inner := newText(nil)
+	errE := inner.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	outer := newText(map[string]fun.TextTooler{
+		"repeat_string": &fun.TextTool[toolStringInput, string]{
+			Description:      "Repeats the input twice, by concatenating the input string without any space.",
+			InputJSONSchema:  toolInputJSONSchema,
+			OutputJSONSchema: jsonSchemaString,
+			Fun: func(ctx context.Context, input toolStringInput) (string, errors.E) {
+				return inner.Call(ctx, input.String)
+			},
+		},
+	})
+	errE = outer.Init(ctx)
+	require.NoError(t, errE, "% -+#.1v", errE)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx = fun.WithTracerProvider(ctx, tracerProvider)
+
+	output, errE := outer.Call(ctx, "outer")
+	require.NoError(t, errE, "% -+#.1v", errE)
+	assert.Equal(t, "done", output)
+
+	spans := exporter.GetSpans()
+	byName := map[string][]tracetest.SpanStub{}
+	for _, span := range spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+
+	require.Len(t, byName["Text.Call"], 2)
+	require.Len(t, byName["chat gpt-4o-mini-2024-07-18"], 3)
+	require.Len(t, byName["execute_tool repeat_string"], 1)
+	assert.Len(t, byName["rate limit"], 3)
+
+	var outerCall, innerCall tracetest.SpanStub
+	for _, span := range byName["Text.Call"] {
+		if span.Parent.IsValid() {
+			innerCall = span
+		} else {
+			outerCall = span
+		}
+	}
+	toolCall := byName["execute_tool repeat_string"][0]
+
+	assert.Equal(t, outerCall.SpanContext.SpanID(), toolCall.Parent.SpanID())
+	assert.Equal(t, toolCall.SpanContext.SpanID(), innerCall.Parent.SpanID())
+
+	parents := map[string]int{}
+	for _, span := range byName["chat gpt-4o-mini-2024-07-18"] {
+		parents[span.Parent.SpanID().String()]++
+	}
+	assert.Equal(t, map[string]int{
+		outerCall.SpanContext.SpanID().String(): 2,
+		innerCall.SpanContext.SpanID().String(): 1,
+	}, parents)
+
+	for _, span := range byName["rate limit"] {
+		assert.Equal(t, "chat gpt-4o-mini-2024-07-18", spanName(spans, span.Parent.SpanID().String()))
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, span := range byName["chat gpt-4o-mini-2024-07-18"] {
+		if span.Parent.SpanID() == innerCall.SpanContext.SpanID() {
+			for _, attr := range span.Attributes {
+				attrs[attr.Key] = attr.Value
+			}
+		}
+	}
+	assert.Equal(t, "chat", attrs["gen_ai.operation.name"].AsString())
+	assert.Equal(t, "openai", attrs["gen_ai.provider.name"].AsString())
+	assert.Equal(t, "gpt-4o-mini-2024-07-18", attrs["gen_ai.request.model"].AsString())
+	assert.Equal(t, "gpt-4o-mini-2024-07-18", attrs["gen_ai.response.model"].AsString())
+	assert.Equal(t, "chatcmpl-2", attrs["gen_ai.response.id"].AsString())
+	assert.Equal(t, []string{"stop"}, attrs["gen_ai.response.finish_reasons"].AsStringSlice())
+	assert.Equal(t, int64(10), attrs["gen_ai.usage.input_tokens"].AsInt64())
+	assert.Equal(t, int64(1), attrs["gen_ai.usage.output_tokens"].AsInt64())
+	assert.Equal(t, "req_user", attrs["fun.api_request"].AsString())
+}
+
+func spanName(spans tracetest.SpanStubs, spanID string) string {
+	for _, span := range spans {
+		if span.SpanContext.SpanID().String() == spanID {
+			return span.Name
+		}
+	}
+	return ""
+}
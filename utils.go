@@ -1,12 +1,15 @@
 package fun
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -20,7 +23,17 @@ const (
 	httpTimeout  = 5 * time.Minute
 )
 
-const applicationJSONHeader = "application/json"
+const (
+	applicationJSONHeader = "application/json"
+	eventStreamHeader     = "text/event-stream"
+)
+
+// estimatedPartTokens is a rough estimate of the number of tokens used
+// by one non-textual content part (e.g., an image).
+const estimatedPartTokens = 1600
+
+// maxServerSentEventSize is the maximum size of one line in a server-sent events stream.
+const maxServerSentEventSize = 10 * 1024 * 1024
 
 func retryErrorHandler(resp *http.Response, err error, numTries int) (*http.Response, error) {
 	var body []byte
@@ -50,6 +63,25 @@ func newClient(
 	parseRateLimitHeaders func(resp *http.Response) (int, int, int, int, time.Time, time.Time, bool, errors.E),
 	setRateLimit func(int, int, int, int, time.Time, time.Time),
 ) *http.Client {
+	var updateRateLimit func(resp *http.Response) errors.E
+	if parseRateLimitHeaders != nil {
+		updateRateLimit = func(resp *http.Response) errors.E {
+			limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens, ok, errE := parseRateLimitHeaders(resp)
+			if errE != nil {
+				return errE
+			}
+			if ok && setRateLimit != nil {
+				setRateLimit(limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens)
+			}
+			return nil
+		}
+	}
+	return newRetryableClient(prepareRetry, updateRateLimit)
+}
+
+// newRetryableClient returns a retryable HTTP client which calls updateRateLimit
+// with every response, so that rate limits can be updated from response headers.
+func newRetryableClient(prepareRetry retryablehttp.PrepareRetry, updateRateLimit func(resp *http.Response) errors.E) *http.Client {
 	client := retryablehttp.NewClient()
 	// TODO: Configure logger which should log to a logger in ctx.
 	//       See: https://github.com/hashicorp/go-retryablehttp/issues/182
@@ -58,15 +90,19 @@ func newClient(
 	client.RetryWaitMin = retryWaitMin
 	client.RetryWaitMax = retryWaitMax
 	client.HTTPClient.Timeout = httpTimeout
-	if prepareRetry != nil {
-		client.PrepareRetry = prepareRetry
+	client.PrepareRetry = func(req *http.Request) error {
+		metrics.apiRequestRetry(req.Context())
+		if prepareRetry != nil {
+			return prepareRetry(req)
+		}
+		return nil
 	}
 	client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
 		if err != nil {
 			check, err := retryablehttp.ErrorPropagatedRetryPolicy(ctx, resp, err)
 			return check, errors.WithStack(err)
 		}
-		if resp.StatusCode == http.StatusTooManyRequests {
+		if isThrottled(resp) {
 			// We read the body and provide it back.
 			body, _ := io.ReadAll(resp.Body)
 			resp.Body.Close() //nolint:errcheck,gosec
@@ -77,23 +113,20 @@ func newClient(
 				zerolog.Ctx(ctx).Warn().Str("body", string(body)).Msg("hit rate limit")
 			}
 		}
-		var limitRequests, limitTokens, remainingRequests, remainingTokens int
-		var resetRequests, resetTokens time.Time
-		var ok bool
-		if parseRateLimitHeaders != nil {
-			var errE errors.E
-			limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens, ok, errE = parseRateLimitHeaders(resp)
+		if updateRateLimit != nil {
+			errE := updateRateLimit(resp)
 			if errE != nil {
 				return false, errE
 			}
 		}
-		if ok && setRateLimit != nil {
-			setRateLimit(limitRequests, limitTokens, remainingRequests, remainingTokens, resetRequests, resetTokens)
-		}
 		if resp.StatusCode == 524 { //nolint:mnd
 			// ClaudFlare returns 524 when it fails to connect, so we retry.
 			return true, nil
 		}
+		if isThrottled(resp) {
+			// AWS APIs might report throttling with other status codes, so we retry.
+			return true, nil
+		}
 		check, err := retryablehttp.ErrorPropagatedRetryPolicy(ctx, resp, err)
 		return check, errors.WithStack(err)
 	}
@@ -101,6 +134,16 @@ func newClient(
 	return client.StandardClient()
 }
 
+// isThrottled returns true if the response reports that the request was rate limited.
+// Besides 429 status code, AWS APIs report throttling with the error type header.
+func isThrottled(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	errorType, _, _ := strings.Cut(resp.Header.Get("X-Amzn-Errortype"), ":")
+	return errorType == "ThrottlingException"
+}
+
 func parseRateLimitHeaders(resp *http.Response) ( //nolint:nonamedreturns
 	limitRequests, limitTokens,
 	remainingRequests, remainingTokens int,
@@ -197,3 +240,129 @@ func getEstimatedTokens(ctx context.Context) (int, int) {
 	et := ctx.Value(estimatedTokensContextKey).(estimatedTokens) //nolint:forcetypeassert,errcheck
 	return et.Input, et.Output
 }
+
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), eventStreamHeader)
+}
+
+// decodeServerSentEvents reads server-sent events from r and calls fn for every event.
+//
+// See: https://html.spec.whatwg.org/multipage/server-sent-events.html
+func decodeServerSentEvents(r io.Reader, fn func(event string, data []byte) errors.E) errors.E {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxServerSentEventSize)
+
+	event := ""
+	var data []byte
+	hasData := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// Empty line dispatches the event.
+			if hasData {
+				errE := fn(event, data)
+				if errE != nil {
+					return errE
+				}
+			}
+			event = ""
+			data = nil
+			hasData = false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// A comment.
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			if hasData {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+			hasData = true
+		default:
+			// We ignore other fields.
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Stream might end without the final empty line.
+	if hasData {
+		return fn(event, data)
+	}
+
+	return nil
+}
+
+// newTextStream returns a function which passes events to fn and records
+// streamed content into the callRecorder, if any. It returns nil if fn is nil.
+func newTextStream(callRecorder *TextRecorderCall, fn func(event TextStreamEvent) errors.E) func(event TextStreamEvent) errors.E {
+	if fn == nil {
+		return nil
+	}
+
+	return func(event TextStreamEvent) errors.E {
+		if callRecorder != nil {
+			switch event.Type {
+			case typeText:
+				callRecorder.streamContent(roleAssistant, event.Content)
+				callRecorder.notify("", nil)
+			case roleThinking:
+				callRecorder.streamContent(roleThinking, event.Content)
+				callRecorder.notify("", nil)
+			}
+		}
+
+		return fn(event)
+	}
+}
+
+func newUsedTokens(maxTotal, maxResponse, prompt, response int, cacheCreationInputTokens, cacheReadInputTokens, thinkingTokens *int) *TextRecorderUsedTokens {
+	return &TextRecorderUsedTokens{
+		MaxTotal:                 maxTotal,
+		MaxResponse:              maxResponse,
+		Prompt:                   prompt,
+		Response:                 response,
+		Total:                    prompt + response,
+		CacheCreationInputTokens: cacheCreationInputTokens,
+		CacheReadInputTokens:     cacheReadInputTokens,
+		ThinkingTokens:           thinkingTokens,
+	}
+}
+
+// apiURL returns the URL of the API endpoint at path, relative to baseURL
+// or to defaultBaseURL if baseURL is empty.
+func apiURL(baseURL, defaultBaseURL, path string) string {
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + path
+}
+
+// setHeaders sets extra headers on the request, overriding existing ones.
+func setHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// commonImageMIMETypes are MIME types of images supported by most providers.
+//
+//nolint:gochecknoglobals
+var commonImageMIMETypes = []string{"image/gif", "image/jpeg", "image/png", "image/webp"}
+
+func dataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}